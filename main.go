@@ -2,11 +2,24 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	lokiv1 "github.com/grafana/loki/operator/apis/loki/v1"
@@ -16,13 +29,24 @@ import (
 	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/push"
+	"github.com/prometheus/common/model"
+	"golang.org/x/exp/slices"
+	"golang.org/x/net/http/httpguts"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/kubernetes/scheme"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
 	k8sconfig "sigs.k8s.io/controller-runtime/pkg/client/config"
 
+	"github.com/rhobs/obsctl-reloader/pkg/k8sretry"
 	"github.com/rhobs/obsctl-reloader/pkg/loader"
 	"github.com/rhobs/obsctl-reloader/pkg/loop"
+	"github.com/rhobs/obsctl-reloader/pkg/metricsprefix"
 	"github.com/rhobs/obsctl-reloader/pkg/syncer"
 )
 
@@ -30,18 +54,101 @@ const (
 	obsctlContextAPIName               = "api"
 	defaultSleepDurationSeconds        = 15
 	defaultConfigReloadIntervalSeconds = 60
+
+	// serviceAccountNamespaceFile holds the namespace of the pod's service account, mounted with its token.
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	ruleSourceKubernetes = "kubernetes"
+	ruleSourceGit        = "git"
+	ruleSourceStatusCRD  = "status-crd"
 )
 
 type cfg struct {
-	observatoriumURL     string
-	sleepDurationSeconds uint
-	managedTenants       string
-	audience             string
-	issuerURL            string
-	logRulesEnabled      bool
-	logLevel             string
-	listenInternal       string
-	configReloadInterval uint
+	observatoriumURL       string
+	sleepDurationSeconds   uint
+	minSleepInterval       time.Duration
+	managedTenants         string
+	tenantNameRegex        string
+	audience               string
+	issuerURL              string
+	logRulesEnabled        bool
+	lokiAlertingEnabled    bool
+	lokiRecordingEnabled   bool
+	logLevel               string
+	listenInternal         string
+	listenNetwork          string
+	configReloadInterval   uint
+	runOnce                bool
+	initialSyncDelay       time.Duration
+	startupJitter          time.Duration
+	maxCycleDuration       time.Duration
+	requeueFailedOnce      bool
+	requeueFailedDelay     time.Duration
+	estimateSeriesImpact   bool
+	apiMaxIdleConns        int
+	configCheckConcurrency int
+	obsctlConfigInMemory   bool
+	pprofEnabled           bool
+	pushgatewayURL         string
+	apiCAConfigMap         string
+	apiForceHTTP2          bool
+	apiDisableHTTP2        bool
+	apiTenantPathTemplate  string
+	apiMaxRetryAfter       time.Duration
+	k8sThrottleRetries     int
+	k8sThrottleBackoff     time.Duration
+	maxRulesPerType        int
+	minAlertFor            time.Duration
+	maxRangeSelector       time.Duration
+	maxRangeDuration       time.Duration
+	maxRangeAction         string
+	syncSuccessWindow      int
+	rejectNumericExprs     bool
+	lokiBatchGroups        bool
+	debugHTTP              bool
+	lokiRulesContentType   string
+	tenantHeaderName       string
+
+	promoteAnnotationsToLabels string
+	auditLogFile               string
+	managedGroupPrefix         string
+	logRuleDiffs               bool
+
+	strictTenantMatch     bool
+	sanitizeTenantLabels  bool
+	metricsPrefix         string
+	mergeSameNameGroups   bool
+	dedupRules            bool
+	checkRuleReferences   bool
+	writeSyncStatus       bool
+	allowedMetricPrefixes string
+	bannedFunctions       string
+
+	lokiVersionConflict string
+	lokiRuleSelector    string
+
+	requiredAlertAnnotations      string
+	requiredAlertAnnotationAction string
+
+	ruleSource      string
+	gitRepo         string
+	gitBranch       string
+	gitPath         string
+	gitPullInterval time.Duration
+	gitCheckoutDir  string
+
+	statusCRDResource string
+	statusCRDPath     string
+
+	configCheck bool
+
+	pauseConfigMap string
+
+	activeTenants          string
+	shardIndex             int
+	shardTotal             int
+	metricsDisabledTenants string
+	logsDisabledTenants    string
 }
 
 func setupLogger(logLevel string) log.Logger {
@@ -66,33 +173,628 @@ func setupLogger(logLevel string) log.Logger {
 	return logger
 }
 
+func newInternalHandler(reg *prometheus.Registry, pprofEnabled bool) *internalserver.Handler {
+	opts := []internalserver.Option{
+		internalserver.WithName("Internal - obsctl-reloader"),
+		internalserver.WithPrometheusRegistry(reg),
+	}
+	if pprofEnabled {
+		opts = append(opts, internalserver.WithPProf())
+	}
+
+	return internalserver.NewHandler(opts...)
+}
+
+// tenantStatuser returns the status of each managed tenant.
+type tenantStatuser interface {
+	TenantStatuses() []syncer.TenantStatus
+}
+
+// tenantsHandler serves the status of each managed tenant as JSON.
+func tenantsHandler(s tenantStatuser) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		b, err := json.Marshal(s.TenantStatuses())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(b)
+	}
+}
+
+// sighupHandler returns a run group actor which triggers a reload on each SIGHUP, without terminating the process.
+func sighupHandler(ctx context.Context, logger log.Logger, reload chan<- struct{}) (func() error, func(error)) {
+	ctx, cancel := context.WithCancel(ctx)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	return func() error {
+			for {
+				select {
+				case <-hup:
+					level.Info(logger).Log("msg", "received SIGHUP, triggering reload")
+					// Don't block if a reload is already pending.
+					select {
+					case reload <- struct{}{}:
+					default:
+					}
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		}, func(_ error) {
+			signal.Stop(hup)
+			cancel()
+		}
+}
+
+// randomJitter returns a random duration in [0, max), or 0 if max isn't positive.
+func randomJitter(r *rand.Rand, max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(r.Int63n(int64(max)))
+}
+
+// waitStartupJitter waits for a random duration of up to max, returning early with the context error if ctx is done.
+func waitStartupJitter(ctx context.Context, logger log.Logger, max time.Duration) error {
+	d := randomJitter(rand.New(rand.NewSource(time.Now().UnixNano())), max) //nolint:gosec
+	if d == 0 {
+		return nil
+	}
+
+	level.Info(logger).Log("msg", "delaying startup", "delay", d)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// registrationChecker is a prometheus.Registerer which records the first registration error, rather than panicking on
+// it like a registry does when used with promauto.
+type registrationChecker struct {
+	*prometheus.Registry
+	err error
+}
+
+func (r *registrationChecker) MustRegister(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := r.Register(c); err != nil && r.err == nil {
+			r.err = err
+		}
+	}
+}
+
+// checkMetricsRegistration calls register with a throwaway registry, and returns the first error registering metrics
+// with it, e.g. for a duplicate metric.
+func checkMetricsRegistration(register func(reg prometheus.Registerer)) error {
+	r := &registrationChecker{Registry: prometheus.NewRegistry()}
+	register(r)
+	if r.err != nil {
+		return errors.Wrap(r.err, "registering metrics")
+	}
+	return nil
+}
+
+// registerComponentMetrics registers the metrics of each component configured with the given options with reg.
+func registerComponentMetrics(reg prometheus.Registerer, k8sRetryOpts []k8sretry.Option, loaderOpts []loader.Option, syncerOpts []syncer.Option, loopOpts []loop.Option) {
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		//nolint:exhaustivestruct
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	k8sretry.RegisterMetrics(reg, k8sRetryOpts...)
+	loader.RegisterMetrics(reg, loaderOpts...)
+	syncer.RegisterMetrics(reg, syncerOpts...)
+	loop.RegisterMetrics(reg, loopOpts...)
+}
+
+// pushMetrics pushes the current values of all metrics in g to the Pushgateway at url.
+func pushMetrics(url string, g prometheus.Gatherer) error {
+	return push.New(url, "obsctl-reloader").Gatherer(g).Push()
+}
+
+// resolveNamespace returns the namespace to watch: env, i.e. the NAMESPACE_NAME env var, if set, or the namespace
+// read from nsFile otherwise.
+func resolveNamespace(env, nsFile string) (string, error) {
+	if env != "" {
+		return env, nil
+	}
+
+	b, err := os.ReadFile(nsFile)
+	if err != nil {
+		return "", errors.Wrap(err, "missing env var NAMESPACE_NAME, and reading service account namespace")
+	}
+	ns := strings.TrimSpace(string(b))
+	if ns == "" {
+		return "", errors.Newf("missing env var NAMESPACE_NAME, and service account namespace file %s is empty", nsFile)
+	}
+
+	return ns, nil
+}
+
+// configMapExists returns a function reporting whether the given ConfigMap exists.
+func configMapExists(ctx context.Context, kc client.Client, namespace, name string) func() (bool, error) {
+	return func() (bool, error) {
+		err := kc.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, &corev1.ConfigMap{})
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "getting ConfigMap %s/%s", namespace, name)
+		}
+
+		return true, nil
+	}
+}
+
+// parseConfigMapKeyRef parses a ConfigMap key reference in the form namespace/name:key.
+func parseConfigMapKeyRef(ref string) (syncer.ConfigMapKeyRef, error) {
+	nsName, key, ok := strings.Cut(ref, ":")
+	if !ok || key == "" {
+		return syncer.ConfigMapKeyRef{}, errors.Newf("invalid configmap reference %q, expected namespace/name:key", ref)
+	}
+
+	namespace, name, ok := strings.Cut(nsName, "/")
+	if !ok || namespace == "" || name == "" {
+		return syncer.ConfigMapKeyRef{}, errors.Newf("invalid configmap reference %q, expected namespace/name:key", ref)
+	}
+
+	return syncer.ConfigMapKeyRef{Namespace: namespace, Name: name, Key: key}, nil
+}
+
+// envVarName returns the environment variable name that can be used instead of the given flag,
+// e.g. SLEEP_DURATION_SECONDS for --sleep-duration-seconds.
+func envVarName(flagName string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(flagName))
+}
+
+// applyEnvFallback sets every flag in fs, which wasn't explicitly passed on the command line, from its
+// corresponding environment variable, if present. Flags always take precedence over the environment.
+func applyEnvFallback(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	set := map[string]struct{}{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = struct{}{}
+	})
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if _, ok := set[f.Name]; ok || err != nil {
+			return
+		}
+
+		// KUBECONFIG is already honored by the kubeconfig loader, and may hold a list of paths.
+		if f.Name == "kubeconfig" {
+			return
+		}
+
+		v, ok := lookupEnv(envVarName(f.Name))
+		if !ok {
+			return
+		}
+
+		if setErr := fs.Set(f.Name, v); setErr != nil {
+			err = errors.Wrapf(setErr, "invalid value %q for env var %s", v, envVarName(f.Name))
+		}
+	})
+
+	return err
+}
+
+// validateURL returns an error if u isn't an absolute http(s) URL.
+func validateURL(flagName, u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return errors.Wrapf(err, "invalid --%s", flagName)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return errors.Newf("invalid --%s %q, expected an absolute http(s) URL", flagName, u)
+	}
+
+	return nil
+}
+
+// defaultTenantNameRegex matches the tenant names Observatorium API accepts in its paths.
+const defaultTenantNameRegex = `[a-zA-Z0-9][a-zA-Z0-9._-]*`
+
+// validateTenantNames returns an error listing the tenants whose name doesn't fully match pattern.
+func validateTenantNames(pattern string, tenants []string) error {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return errors.Wrapf(err, "invalid --tenant-name-regex %q", pattern)
+	}
+
+	var invalid []string
+	for _, t := range tenants {
+		if !re.MatchString(t) {
+			invalid = append(invalid, strconv.Quote(t))
+		}
+	}
+	if len(invalid) > 0 {
+		return errors.Newf("managed tenant names %s don't match --tenant-name-regex %q", strings.Join(invalid, ", "), pattern)
+	}
+
+	return nil
+}
+
+// validateListenAddress returns an error if addr isn't a host:port address network can listen on, e.g. ":8081",
+// "0.0.0.0:8081" or "[::]:8081". IP literals must match the address family of tcp4 and tcp6.
+func validateListenAddress(network, addr string) error {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return errors.Newf("invalid --web.internal.network %q, expected one of: tcp, tcp4, tcp6", network)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return errors.Wrapf(err, "invalid --web.internal.listen %q", addr)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return errors.Newf("invalid --web.internal.listen %q, expected a numeric port", addr)
+	}
+
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+	case network == "tcp4" && ip.To4() == nil:
+		return errors.Newf("invalid --web.internal.listen %q, expected an IPv4 address with --web.internal.network=tcp4", addr)
+	case network == "tcp6" && ip.To4() != nil:
+		return errors.Newf("invalid --web.internal.listen %q, expected an IPv6 address with --web.internal.network=tcp6", addr)
+	}
+
+	return nil
+}
+
+// effectiveSleepDurationSeconds returns the sleep duration between syncs, raised to the minimum sleep interval if
+// shorter, with a warning.
+func effectiveSleepDurationSeconds(logger log.Logger, cfg *cfg) uint {
+	floor := uint(math.Ceil(cfg.minSleepInterval.Seconds()))
+	if cfg.runOnce || cfg.sleepDurationSeconds >= floor {
+		return cfg.sleepDurationSeconds
+	}
+
+	level.Warn(logger).Log("msg", "sleep duration below the minimum sleep interval, using the minimum", "sleep_duration_seconds", cfg.sleepDurationSeconds, "min_sleep_interval", cfg.minSleepInterval)
+	return floor
+}
+
+// validateConfig checks the resolved configuration for mistakes which would only show up at runtime, e.g. malformed
+// URLs or a set of flags that leaves nothing to sync.
+func validateConfig(cfg *cfg) error {
+	if cfg.observatoriumURL == "" {
+		return errors.New("--observatorium-api-url is required")
+	}
+	if err := validateURL("observatorium-api-url", cfg.observatoriumURL); err != nil {
+		return err
+	}
+	if cfg.issuerURL != "" {
+		if err := validateURL("issuer-url", cfg.issuerURL); err != nil {
+			return err
+		}
+	}
+	if err := validateListenAddress(cfg.listenNetwork, cfg.listenInternal); err != nil {
+		return err
+	}
+	if err := metricsprefix.Validate(cfg.metricsPrefix); err != nil {
+		return errors.Wrap(err, "--metrics-prefix")
+	}
+	if cfg.minAlertFor < 0 {
+		return errors.New("--min-alert-for must not be negative")
+	}
+	if cfg.syncSuccessWindow < 1 {
+		return errors.New("--sync-success-window must be at least 1")
+	}
+	if cfg.maxRangeSelector < 0 {
+		return errors.New("--max-range-selector must not be negative")
+	}
+	if cfg.maxRangeDuration < 0 {
+		return errors.New("--max-range-duration must not be negative")
+	}
+	if cfg.maxRangeSelector > 0 && cfg.maxRangeDuration > 0 {
+		return errors.New("--max-range-selector and --max-range-duration are mutually exclusive")
+	}
+	if _, err := syncer.ParseRangeLimitAction(cfg.maxRangeAction); err != nil {
+		return err
+	}
+	if cfg.maxRulesPerType < 0 {
+		return errors.New("--max-rules-per-type must not be negative")
+	}
+	if cfg.k8sThrottleRetries < 0 {
+		return errors.New("--k8s-throttle-retries must not be negative")
+	}
+	if cfg.k8sThrottleBackoff <= 0 {
+		return errors.New("--k8s-throttle-backoff must be positive")
+	}
+	if cfg.apiMaxRetryAfter < 0 {
+		return errors.New("--api-max-retry-after must not be negative")
+	}
+	if cfg.configCheckConcurrency < 1 {
+		return errors.New("--config-check-concurrency must be at least 1")
+	}
+	if cfg.pushgatewayURL != "" {
+		if err := validateURL("pushgateway-url", cfg.pushgatewayURL); err != nil {
+			return err
+		}
+	}
+
+	if cfg.sleepDurationSeconds == 0 && cfg.minSleepInterval == 0 && !cfg.runOnce {
+		return errors.New("--sleep-duration-seconds must be positive, unless --run-once or --min-sleep-interval is set")
+	}
+	if cfg.minSleepInterval < 0 {
+		return errors.New("--min-sleep-interval must not be negative")
+	}
+	if cfg.initialSyncDelay < 0 {
+		return errors.New("--initial-sync-delay must not be negative")
+	}
+	if cfg.startupJitter < 0 {
+		return errors.New("--startup-jitter must not be negative")
+	}
+	if cfg.maxCycleDuration < 0 {
+		return errors.New("--max-cycle-duration must not be negative")
+	}
+	if cfg.requeueFailedDelay < 0 {
+		return errors.New("--requeue-failed-delay must not be negative")
+	}
+	if cfg.apiMaxIdleConns < 0 {
+		return errors.New("--api-max-idle-conns must not be negative")
+	}
+
+	switch cfg.logLevel {
+	case "error", "warn", "info", "debug":
+	default:
+		return errors.Newf("invalid --log.level %q, expected one of: debug, info, warn, error", cfg.logLevel)
+	}
+
+	tenants := syncer.SplitList(cfg.managedTenants)
+	if len(tenants) == 0 {
+		return errors.New("--managed-tenants must list at least one tenant")
+	}
+	if err := validateTenantNames(cfg.tenantNameRegex, tenants); err != nil {
+		return err
+	}
+
+	if cfg.shardTotal < 1 {
+		return errors.New("--shard-total must be at least 1")
+	}
+	if cfg.shardIndex < 0 || cfg.shardIndex >= cfg.shardTotal {
+		return errors.Newf("--shard-index must be between 0 and %d", cfg.shardTotal-1)
+	}
+
+	active := syncer.SplitList(cfg.activeTenants)
+	for _, t := range active {
+		if !slices.Contains(tenants, t) {
+			return errors.Newf("active tenant %q is not a managed tenant", t)
+		}
+	}
+	if len(active) > 0 {
+		tenants = active
+	}
+
+	metricsDisabled, logsDisabled := syncer.SplitList(cfg.metricsDisabledTenants), syncer.SplitList(cfg.logsDisabledTenants)
+	enabledSignals := 0
+	for _, t := range tenants {
+		if !slices.Contains(metricsDisabled, t) {
+			enabledSignals++
+		}
+		if cfg.logRulesEnabled && (cfg.lokiAlertingEnabled || cfg.lokiRecordingEnabled) && !slices.Contains(logsDisabled, t) {
+			enabledSignals++
+		}
+	}
+	if enabledSignals == 0 {
+		return errors.New("no signal is enabled for any active managed tenant, check --active-tenants, --metrics-disabled-tenants, --logs-disabled-tenants, --log-rules-enabled, --loki-alerting-enabled and --loki-recording-enabled")
+	}
+
+	if cfg.apiForceHTTP2 && cfg.apiDisableHTTP2 {
+		return errors.New("--api-force-http2 and --api-disable-http2 are mutually exclusive")
+	}
+	if t := cfg.apiTenantPathTemplate; t != "" && (!strings.HasPrefix(t, "/") || !strings.Contains(t, "{tenant}")) {
+		return errors.Newf("invalid --api-tenant-path-template %q, expected an absolute path containing {tenant}", t)
+	}
+	if _, _, err := mime.ParseMediaType(cfg.lokiRulesContentType); err != nil {
+		return errors.Wrapf(err, "invalid --loki-rules-content-type %q", cfg.lokiRulesContentType)
+	}
+	if cfg.tenantHeaderName != "" && !httpguts.ValidHeaderFieldName(cfg.tenantHeaderName) {
+		return errors.Newf("invalid --tenant-header-name %q", cfg.tenantHeaderName)
+	}
+	for _, name := range syncer.SplitList(cfg.bannedFunctions) {
+		if !loader.IsPromQLFunction(name) {
+			return errors.Newf("invalid --banned-promql-functions function %q, not a PromQL function", name)
+		}
+	}
+	for _, key := range syncer.SplitList(cfg.promoteAnnotationsToLabels) {
+		if !model.LabelName(key).IsValid() {
+			return errors.Newf("invalid --promote-annotations-to-labels key %q, not a valid label name", key)
+		}
+	}
+	if cfg.apiCAConfigMap != "" {
+		if _, err := parseConfigMapKeyRef(cfg.apiCAConfigMap); err != nil {
+			return err
+		}
+	}
+	if _, err := loader.ParseLokiVersionConflictPolicy(cfg.lokiVersionConflict); err != nil {
+		return err
+	}
+	if _, err := loader.ParseRequiredAnnotationsAction(cfg.requiredAlertAnnotationAction); err != nil {
+		return err
+	}
+	if _, err := labels.Parse(cfg.lokiRuleSelector); err != nil {
+		return errors.Wrapf(err, "invalid --loki-rule-selector %q", cfg.lokiRuleSelector)
+	}
+
+	switch cfg.ruleSource {
+	case ruleSourceKubernetes:
+	case ruleSourceGit:
+		if cfg.gitRepo == "" {
+			return errors.New("--git-repo is required with --rule-source=git")
+		}
+		if cfg.logRulesEnabled {
+			return errors.New("--log-rules-enabled is not supported with --rule-source=git")
+		}
+		if cfg.writeSyncStatus {
+			return errors.New("--write-sync-status is not supported with --rule-source=git")
+		}
+	case ruleSourceStatusCRD:
+		if _, err := parseStatusCRDResource(cfg.statusCRDResource); err != nil {
+			return err
+		}
+		if cfg.logRulesEnabled {
+			return errors.New("--log-rules-enabled is not supported with --rule-source=status-crd")
+		}
+		if cfg.writeSyncStatus {
+			return errors.New("--write-sync-status is not supported with --rule-source=status-crd")
+		}
+	default:
+		return errors.Newf("invalid --rule-source %q, expected one of: kubernetes, git, status-crd", cfg.ruleSource)
+	}
+
+	return nil
+}
+
+// parseStatusCRDResource parses the --status-crd-resource flag value, in the form resource.version.group.
+func parseStatusCRDResource(s string) (schema.GroupVersionResource, error) {
+	gvr, _ := schema.ParseResourceArg(s)
+	if gvr == nil {
+		return schema.GroupVersionResource{}, errors.Newf("invalid --status-crd-resource %q, expected resource.version.group", s)
+	}
+
+	return *gvr, nil
+}
+
+// resolvedConfigYAML returns the values of all flags in fs, after environment variable fallback, as YAML.
+func resolvedConfigYAML(fs *flag.FlagSet) ([]byte, error) {
+	resolved := map[string]interface{}{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config-check" {
+			return
+		}
+
+		if g, ok := f.Value.(flag.Getter); ok {
+			resolved[f.Name] = g.Get()
+			return
+		}
+		resolved[f.Name] = f.Value.String()
+	})
+
+	return yaml.Marshal(resolved)
+}
+
 func parseFlags() *cfg {
 	cfg := &cfg{}
 
 	// Common flags.
 	flag.UintVar(&cfg.sleepDurationSeconds, "sleep-duration-seconds", defaultSleepDurationSeconds, "The interval in seconds after which all PrometheusRules are synced to Observatorium API.")
-	flag.UintVar(&cfg.configReloadInterval, "config-reload-interval-seconds", defaultConfigReloadIntervalSeconds, "The interval in seconds for reloading configuration.")
+	flag.DurationVar(&cfg.minSleepInterval, "min-sleep-interval", 5*time.Second, "The minimum interval between syncs. A shorter --sleep-duration-seconds is raised to it, rounded up to whole seconds, to avoid hammering the Kubernetes and Observatorium APIs. Disabled if 0.")
+	flag.UintVar(&cfg.configReloadInterval, "config-reload-interval-seconds", defaultConfigReloadIntervalSeconds, "The interval in seconds for reloading configuration. 0 disables periodic reloads.")
+	flag.BoolVar(&cfg.runOnce, "run-once", false, "Sync rules once and exit, instead of every --sleep-duration-seconds, which may then be 0.")
+	flag.DurationVar(&cfg.initialSyncDelay, "initial-sync-delay", 0, "How long to wait after startup before the first sync, e.g. to let dependent services come up after a coordinated restart.")
+	flag.DurationVar(&cfg.startupJitter, "startup-jitter", 0, "The maximum random delay before first loading the tenant configs at startup, so that replicas restarted together don't all authenticate at once. Disabled if 0.")
+	flag.DurationVar(&cfg.maxCycleDuration, "max-cycle-duration", 0, "The maximum duration of a sync cycle. Tenants not synced yet when it's exceeded are skipped until the next cycle. No limit if 0.")
+	flag.BoolVar(&cfg.requeueFailedOnce, "requeue-failed-once", false, "Retry the tenants whose rules failed to sync once more at the end of the same cycle, rather than only in the next one.")
+	flag.DurationVar(&cfg.requeueFailedDelay, "requeue-failed-delay", 5*time.Second, "How long to wait before retrying failed tenants at the end of a cycle, with --requeue-failed-once.")
+	flag.BoolVar(&cfg.estimateSeriesImpact, "estimate-series-impact", false, "Estimate the number of series produced by each tenant's recording rules from their aggregation labels, and export changes of the estimate as obsctl_reloader_estimated_series_delta. Best-effort.")
 	flag.StringVar(&cfg.observatoriumURL, "observatorium-api-url", "", "The URL of the Observatorium API to which rules will be synced.")
 	flag.StringVar(&cfg.managedTenants, "managed-tenants", "", "The name of the tenants whose rules should be synced. If there are multiple tenants, ensure they are comma-separated.")
+	flag.StringVar(&cfg.tenantNameRegex, "tenant-name-regex", defaultTenantNameRegex, "Regular expression each managed tenant name must fully match to be accepted by Observatorium API. The reloader fails to start if any doesn't.")
 	flag.StringVar(&cfg.issuerURL, "issuer-url", "", "The OIDC issuer URL, see https://openid.net/specs/openid-connect-discovery-1_0.html#IssuerDiscovery.")
 	flag.StringVar(&cfg.audience, "audience", "", "The audience for whom the access token is intended, see https://openid.net/specs/openid-connect-core-1_0.html#IDToken.")
 	flag.BoolVar(&cfg.logRulesEnabled, "log-rules-enabled", false, "Enable syncing Loki logging rules.")
+	flag.BoolVar(&cfg.lokiAlertingEnabled, "loki-alerting-enabled", true, "Enable syncing Loki alerting rules, if --log-rules-enabled is set.")
+	flag.BoolVar(&cfg.lokiRecordingEnabled, "loki-recording-enabled", true, "Enable syncing Loki recording rules, if --log-rules-enabled is set.")
+	flag.BoolVar(&cfg.sanitizeTenantLabels, "sanitize-metric-tenant-labels", false, "Replace characters other than letters, digits, '_' and '-' with '_' in the tenant label values of exported metrics. Requests to Observatorium API use the actual tenant.")
+	flag.StringVar(&cfg.metricsPrefix, "metrics-prefix", metricsprefix.Default, "Prefix of the names of exported metrics, other than the Go runtime and process ones, e.g. for running under a different product name.")
+	flag.BoolVar(&cfg.strictTenantMatch, "strict-tenant-match", false, "Report PrometheusRules whose tenant label doesn't match any managed tenant as errors, instead of skipping them silently.")
+	flag.BoolVar(&cfg.mergeSameNameGroups, "merge-same-name-groups", false, "Merge the rules of identically named PrometheusRule groups of a tenant into one group, dropping duplicate rules.")
+	flag.BoolVar(&cfg.dedupRules, "dedup-rules", false, "Remove PrometheusRule rules identical to another rule of the same group, logging and counting each removal.")
+	flag.BoolVar(&cfg.checkRuleReferences, "check-recording-rule-references", false, "Warn about PrometheusRule alerts referencing recording rules (metric names containing a colon) which none of the tenant's rules record.")
+	flag.BoolVar(&cfg.writeSyncStatus, "write-sync-status", false, "Annotate each PrometheusRule with the outcome of the last sync of each tenant it has rules for, as JSON in the sync-status.obsctl-reloader.rhobs/<tenant> annotation. Requires patch permissions on PrometheusRules, and --rule-source=kubernetes.")
+	flag.StringVar(&cfg.allowedMetricPrefixes, "allowed-metric-prefixes", "", "Comma-separated metric name prefixes tenants may reference in PrometheusRules; rules selecting other metrics are skipped. Tenants can override it with the allowed_metric_prefixes key of their secret. Disabled if empty.")
+	flag.StringVar(&cfg.bannedFunctions, "banned-promql-functions", "", "Comma-separated PromQL functions PrometheusRule rules may not call, e.g. absent_over_time,topk; aggregation operators can be banned too. Rules calling them are skipped. Disabled if empty.")
+	flag.StringVar(&cfg.ruleSource, "rule-source", ruleSourceKubernetes, "Where to load rules from. One of: kubernetes (PrometheusRule and Loki rule objects), git (Prometheus rule files in a Git repository, see --git-* flags), status-crd (Prometheus rules rendered into custom resources, see --status-crd-* flags).")
+	flag.StringVar(&cfg.gitRepo, "git-repo", "", "The URL of the Git repository to load rules from, with --rule-source=git.")
+	flag.StringVar(&cfg.gitBranch, "git-branch", "main", "The branch of --git-repo to load rules from.")
+	flag.StringVar(&cfg.gitPath, "git-path", ".", "The directory of --git-repo holding one subdirectory of Prometheus rule files per tenant, e.g. <path>/<tenant>/rules.yaml.")
+	flag.DurationVar(&cfg.gitPullInterval, "git-pull-interval", time.Minute, "The minimum interval between pulls of --git-repo.")
+	flag.StringVar(&cfg.gitCheckoutDir, "git-checkout-dir", "", "The local directory to clone --git-repo into. A temporary directory if empty.")
+	flag.StringVar(&cfg.statusCRDResource, "status-crd-resource", "", "The custom resources to load rules from with --rule-source=status-crd, as resource.version.group, e.g. rulesets.v1.example.com. Resources are assigned to tenants by their tenant label.")
+	flag.StringVar(&cfg.statusCRDPath, "status-crd-path", "{.status.rules}", "The JSONPath of the rules within each --status-crd-resource, selecting either an object with rule groups or a string holding a Prometheus rule file.")
+	flag.StringVar(&cfg.managedGroupPrefix, "managed-group-prefix", "", "Prefix added to the name of each synced rule group, e.g. obsctl-reloader:, to identify rule groups managed by the reloader in Observatorium. Disabled if empty.")
+	flag.BoolVar(&cfg.logRuleDiffs, "log-rule-diffs", false, "Log the rule groups added, removed and modified for a tenant whenever its synced rules change.")
+	flag.StringVar(&cfg.auditLogFile, "audit-log-file", "", "Path of a file to append an audit entry to for each rules set operation, as a JSON line. The file is opened in append mode, so it can be rotated by copying and truncating it.")
+	flag.StringVar(&cfg.promoteAnnotationsToLabels, "promote-annotations-to-labels", "", "Comma-separated annotation keys whose values are copied onto the labels of each synced metrics rule. Existing labels are kept.")
+	flag.StringVar(&cfg.requiredAlertAnnotations, "required-alert-annotations", "", "Comma-separated annotations every PrometheusRule alert must have, e.g. summary,runbook_url. Disabled if empty.")
+	flag.StringVar(&cfg.requiredAlertAnnotationAction, "required-alert-annotations-action", string(loader.RequiredAnnotationsWarn), "How to handle alerts missing required annotations. One of: warn (keep the alert), skip (drop the alert), error (reject the whole PrometheusRule).")
+	flag.StringVar(&cfg.lokiVersionConflict, "loki-version-conflict", string(loader.LokiVersionConflictPreferV1), "How to handle Loki rules with the same namespace and name in both v1 and v1beta1. One of: prefer-v1, prefer-v1beta1, error.")
+	flag.StringVar(&cfg.lokiRuleSelector, "loki-rule-selector", "", "A label selector, e.g. loki.grafana.com/operator-managed=true, which Loki AlertingRules and RecordingRules must match to be synced. All are synced if empty.")
+	flag.StringVar(&cfg.activeTenants, "active-tenants", "", "Comma-separated subset of the managed tenants whose rules are actually synced, e.g. for canary rollouts. Config is still loaded for all managed tenants. All managed tenants are synced if empty.")
+	flag.IntVar(&cfg.shardIndex, "shard-index", 0, "Index of the shard of managed tenants this replica syncs, from 0 to --shard-total minus 1.")
+	flag.IntVar(&cfg.shardTotal, "shard-total", 1, "Number of shards managed tenants are split into by a consistent hash of their name, e.g. one per replica. Config is still loaded for all managed tenants.")
+	flag.StringVar(&cfg.metricsDisabledTenants, "metrics-disabled-tenants", "", "Comma-separated managed tenants for which metrics rules should not be synced.")
+	flag.StringVar(&cfg.logsDisabledTenants, "logs-disabled-tenants", "", "Comma-separated managed tenants for which Loki rules should not be synced, even if --log-rules-enabled is set.")
+	flag.StringVar(&cfg.apiCAConfigMap, "api-ca-configmap", "", "A ConfigMap key holding the CA bundle to trust for Observatorium API, in the form namespace/name:key. Re-read on every config reload.")
+	flag.BoolVar(&cfg.apiForceHTTP2, "api-force-http2", false, "Only use HTTP/2 for requests to Observatorium API, failing if the server doesn't support it over TLS.")
+	flag.BoolVar(&cfg.apiDisableHTTP2, "api-disable-http2", false, "Only use HTTP/1.1 for requests to Observatorium API.")
+	flag.StringVar(&cfg.apiTenantPathTemplate, "api-tenant-path-template", "", "A path template, e.g. /api/v1/{tenant}, replacing the default /api/{signal}/v1/{tenant} prefix of Observatorium API requests, for deployments with per-tenant API prefixes. {signal} is either metrics or logs.")
+	flag.StringVar(&cfg.tenantHeaderName, "tenant-header-name", "", "Name of a header to set to the tenant in each request to Observatorium API, e.g. X-Scope-OrgID, in addition to the tenant in the request path. Disabled if empty.")
+	flag.DurationVar(&cfg.apiMaxRetryAfter, "api-max-retry-after", 0, "The maximum Retry-After delay honored when Observatorium API rate limits Loki rules set requests with 429 Too Many Requests. Such requests are retried up to 3 times. Zero disables retries.")
+	flag.IntVar(&cfg.k8sThrottleRetries, "k8s-throttle-retries", 3, "How many times Kubernetes API requests throttled with 429 Too Many Requests are retried. Zero disables retries.")
+	flag.DurationVar(&cfg.k8sThrottleBackoff, "k8s-throttle-backoff", time.Second, "The initial delay before retrying a throttled Kubernetes API request, doubled on each retry, unless the API server suggests one with Retry-After.")
+	flag.IntVar(&cfg.maxRulesPerType, "max-rules-per-type", 0, "The maximum number of rules of each type, i.e. metrics, Loki alerting or Loki recording rules, a tenant may have. The limit applies to each type separately, not to all of a tenant's rules. Rules of a type exceeding it are rejected as a whole. No limit if 0.")
+	flag.DurationVar(&cfg.minAlertFor, "min-alert-for", 0, "The minimum for duration of synced metrics alerts. Alerts with a shorter or no for duration are synced with this one instead. Disabled if 0.")
+	flag.DurationVar(&cfg.maxRangeSelector, "max-range-selector", 0, "The maximum range of range vector selectors in synced metrics rules, e.g. 1d. Longer ranges are capped to it. Disabled if 0. Prefer --max-range-duration, which also records metrics and can reject rules instead.")
+	flag.DurationVar(&cfg.maxRangeDuration, "max-range-duration", 0, "The maximum range of range vector selectors in synced metrics rules, e.g. 1d, to prevent expensive queries like rate(x[30d]). Disabled if 0.")
+	flag.StringVar(&cfg.maxRangeAction, "max-range-duration-action", string(syncer.RangeLimitCap), "How to handle metrics rules with ranges exceeding --max-range-duration. One of: cap (cap the range to the maximum), reject (reject the tenant's metrics rules).")
+	flag.IntVar(&cfg.syncSuccessWindow, "sync-success-window", syncer.DefaultSyncSuccessWindow, "The number of last rules set operations of each tenant the sync_success_ratio metric is computed over.")
+	flag.BoolVar(&cfg.rejectNumericExprs, "reject-numeric-exprs", false, "Reject the metrics rules of a tenant if any PrometheusRule expr is an integer rather than a string, instead of syncing it as a PromQL number.")
+	flag.BoolVar(&cfg.lokiBatchGroups, "loki-batch-groups", false, "Set all of a tenant's Loki alerting or recording rule groups in a single request, falling back to one request per group if it is rejected.")
+	flag.BoolVar(&cfg.debugHTTP, "debug-http", false, "Log each Loki rules request and response in full at debug level, with credential headers redacted. Requires --log.level=debug.")
+	flag.StringVar(&cfg.lokiRulesContentType, "loki-rules-content-type", syncer.DefaultLokiRulesContentType, "Content-Type Loki rule groups are sent with, e.g. application/x-yaml. Groups are encoded as JSON for JSON media types, e.g. application/json, and as YAML otherwise.")
+	flag.IntVar(&cfg.apiMaxIdleConns, "api-max-idle-conns", syncer.DefaultAPIMaxIdleConnsPerHost, "The maximum number of idle (keep-alive) connections to keep per Observatorium API host.")
 
 	flag.StringVar(&cfg.logLevel, "log.level", "info", "Log filtering level. One of: debug, info, warn, error.")
-	flag.StringVar(&cfg.listenInternal, "web.internal.listen", ":8081", "The address on which the internal server listens.")
+	flag.StringVar(&cfg.listenInternal, "web.internal.listen", ":8081", "The address on which the internal server listens, e.g. [::]:8081 to listen on IPv6.")
+	flag.StringVar(&cfg.listenNetwork, "web.internal.network", "tcp", "The network the internal server listens on. One of: tcp, tcp4 (IPv4 only), tcp6 (IPv6 only).")
+	flag.StringVar(&cfg.pushgatewayURL, "pushgateway-url", "", "The URL of a Prometheus Pushgateway to push final metric values to on exit. Disabled if empty.")
+	flag.BoolVar(&cfg.pprofEnabled, "web.internal.pprof-enabled", true, "Expose pprof endpoints on the internal server.")
+	flag.IntVar(&cfg.configCheckConcurrency, "config-check-concurrency", 1, "The maximum number of tenant configs checked concurrently, by acquiring a token, when initializing the obsctl config.")
+	flag.BoolVar(&cfg.obsctlConfigInMemory, "obsctl-config-in-memory", false, "Keep the obsctl config in memory only, never reading or writing it on disk. It is then kept in memory across config reloads.")
+	flag.StringVar(&cfg.pauseConfigMap, "pause-configmap", "", "Name of a sentinel ConfigMap in the reloader's namespace, e.g. obsctl-reloader-pause. While it exists, syncing is paused. Disabled if empty.")
+	flag.BoolVar(&cfg.configCheck, "config-check", false, "Print the resolved configuration as YAML and exit, once the flags are validated like at startup.")
 
 	flag.Parse()
+	if err := applyEnvFallback(flag.CommandLine, os.LookupEnv); err != nil {
+		panic(err)
+	}
+
 	return cfg
 }
 
 func main() {
 	cfg := parseFlags()
 
+	// Fail fast on invalid flags, rather than e.g. failing every sync with cryptic API errors.
+	if err := validateConfig(cfg); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(1)
+	}
+
+	if cfg.configCheck {
+		out, err := resolvedConfigYAML(flag.CommandLine)
+		if err != nil {
+			panic(err)
+		}
+		_, _ = os.Stdout.Write(out)
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
-	namespace := os.Getenv("NAMESPACE_NAME")
-	if namespace == "" {
-		panic("Missing env var NAMESPACE_NAME")
+	namespace, err := resolveNamespace(os.Getenv("NAMESPACE_NAME"), serviceAccountNamespaceFile)
+	if err != nil {
+		panic(err)
 	}
 
 	logger := setupLogger(cfg.logLevel)
@@ -132,6 +834,127 @@ func main() {
 		panic("Failed to create new k8s client")
 	}
 
+	lokiVersionConflict, err := loader.ParseLokiVersionConflictPolicy(cfg.lokiVersionConflict)
+	if err != nil {
+		panic(err)
+	}
+
+	loaderOpts := []loader.Option{
+		loader.WithStrictTenantMatch(cfg.strictTenantMatch),
+		loader.WithSanitizedTenantLabels(cfg.sanitizeTenantLabels),
+		loader.WithMetricsPrefix(cfg.metricsPrefix),
+		loader.WithMergeSameNameGroups(cfg.mergeSameNameGroups),
+		loader.WithDedupRules(cfg.dedupRules),
+		loader.WithRecordingRuleReferenceCheck(cfg.checkRuleReferences),
+		loader.WithSyncStatus(cfg.writeSyncStatus),
+		loader.WithLokiVersionConflictPolicy(lokiVersionConflict),
+	}
+	if cfg.lokiRuleSelector != "" {
+		selector, err := labels.Parse(cfg.lokiRuleSelector)
+		if err != nil {
+			panic(err)
+		}
+		loaderOpts = append(loaderOpts, loader.WithLokiRuleSelector(selector))
+	}
+	if prefixes := syncer.SplitList(cfg.allowedMetricPrefixes); len(prefixes) > 0 {
+		loaderOpts = append(loaderOpts, loader.WithAllowedMetricPrefixes(prefixes...))
+	}
+	if functions := syncer.SplitList(cfg.bannedFunctions); len(functions) > 0 {
+		loaderOpts = append(loaderOpts, loader.WithBannedPromQLFunctions(functions...))
+	}
+	if annotations := syncer.SplitList(cfg.requiredAlertAnnotations); len(annotations) > 0 {
+		action, err := loader.ParseRequiredAnnotationsAction(cfg.requiredAlertAnnotationAction)
+		if err != nil {
+			panic(err)
+		}
+		loaderOpts = append(loaderOpts, loader.WithRequiredAlertAnnotations(action, annotations...))
+	}
+	if cfg.ruleSource == ruleSourceKubernetes {
+		loaderOpts = append(loaderOpts, loader.WithCRDDiscovery(mapper))
+	}
+
+	syncerOpts := []syncer.Option{
+		syncer.WithAPIMaxIdleConnsPerHost(cfg.apiMaxIdleConns),
+		syncer.WithSanitizedTenantLabels(cfg.sanitizeTenantLabels),
+		syncer.WithMetricsPrefix(cfg.metricsPrefix),
+		syncer.WithPromotedAnnotations(syncer.SplitList(cfg.promoteAnnotationsToLabels)...),
+		syncer.WithConfigCheckConcurrency(cfg.configCheckConcurrency),
+		syncer.WithInMemoryConfig(cfg.obsctlConfigInMemory),
+		syncer.WithMaxRetryAfter(cfg.apiMaxRetryAfter),
+		syncer.WithMaxRulesPerType(cfg.maxRulesPerType),
+		syncer.WithMinAlertFor(cfg.minAlertFor),
+		syncer.WithSyncSuccessWindow(cfg.syncSuccessWindow),
+		syncer.WithRejectNumericExprs(cfg.rejectNumericExprs),
+		syncer.WithLokiBatchGroups(cfg.lokiBatchGroups),
+		syncer.WithDebugHTTP(cfg.debugHTTP),
+		syncer.WithLokiRulesContentType(cfg.lokiRulesContentType),
+		syncer.WithManagedGroupPrefix(cfg.managedGroupPrefix),
+		syncer.WithRuleDiffLogging(cfg.logRuleDiffs),
+		syncer.WithTenantHeaderName(cfg.tenantHeaderName),
+	}
+	if cfg.maxRangeSelector > 0 {
+		syncerOpts = append(syncerOpts, syncer.WithExprTransforms(syncer.MaxRangeSelector(cfg.maxRangeSelector)))
+	}
+	if cfg.maxRangeDuration > 0 {
+		action, err := syncer.ParseRangeLimitAction(cfg.maxRangeAction)
+		if err != nil {
+			panic(err)
+		}
+		syncerOpts = append(syncerOpts, syncer.WithMaxRangeDuration(cfg.maxRangeDuration, action))
+	}
+	switch {
+	case cfg.apiForceHTTP2:
+		syncerOpts = append(syncerOpts, syncer.WithAPIHTTP2Mode(syncer.HTTP2Force))
+	case cfg.apiDisableHTTP2:
+		syncerOpts = append(syncerOpts, syncer.WithAPIHTTP2Mode(syncer.HTTP2Disable))
+	}
+	if cfg.apiTenantPathTemplate != "" {
+		syncerOpts = append(syncerOpts, syncer.WithAPITenantPathTemplate(cfg.apiTenantPathTemplate))
+	}
+	if cfg.auditLogFile != "" {
+		f, err := os.OpenFile(cfg.auditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+		if err != nil {
+			level.Error(logger).Log("msg", "opening audit log file", "error", err)
+			panic(err)
+		}
+		defer f.Close()
+		syncerOpts = append(syncerOpts, syncer.WithAuditLog(f))
+	}
+	if cfg.apiCAConfigMap != "" {
+		ref, err := parseConfigMapKeyRef(cfg.apiCAConfigMap)
+		if err != nil {
+			panic(err)
+		}
+		syncerOpts = append(syncerOpts, syncer.WithAPICAConfigMap(ref))
+	}
+
+	loopOpts := []loop.Option{
+		loop.WithInitialSyncDelay(cfg.initialSyncDelay),
+		loop.WithMaxCycleDuration(cfg.maxCycleDuration),
+		loop.WithSanitizedTenantLabels(cfg.sanitizeTenantLabels),
+		loop.WithMetricsPrefix(cfg.metricsPrefix),
+		loop.WithActiveTenants(syncer.SplitList(cfg.activeTenants)...),
+		loop.WithShard(cfg.shardIndex, cfg.shardTotal),
+		loop.WithMetricsDisabledTenants(syncer.SplitList(cfg.metricsDisabledTenants)...),
+		loop.WithLogsDisabledTenants(syncer.SplitList(cfg.logsDisabledTenants)...),
+		loop.WithRunOnce(cfg.runOnce),
+		loop.WithLokiRuleTypes(cfg.lokiAlertingEnabled, cfg.lokiRecordingEnabled),
+		loop.WithSeriesImpactEstimate(cfg.estimateSeriesImpact),
+	}
+	if cfg.requeueFailedOnce {
+		loopOpts = append(loopOpts, loop.WithRequeueFailedOnce(cfg.requeueFailedDelay))
+	}
+
+	k8sRetryOpts := []k8sretry.Option{k8sretry.WithMetricsPrefix(cfg.metricsPrefix)}
+
+	// Registering a duplicate metric panics, so check for one with a throwaway registry first.
+	if err := checkMetricsRegistration(func(reg prometheus.Registerer) {
+		registerComponentMetrics(reg, k8sRetryOpts, loaderOpts, syncerOpts, loopOpts)
+	}); err != nil {
+		level.Error(logger).Log("msg", "metrics self-test failed", "error", err)
+		os.Exit(1)
+	}
+
 	// Create prometheus registry.
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(
@@ -139,6 +962,59 @@ func main() {
 		//nolint:exhaustivestruct
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
+	k8sClient = k8sretry.NewClient(k8sClient, logger, reg, cfg.k8sThrottleRetries, cfg.k8sThrottleBackoff, k8sRetryOpts...)
+
+	var rulesLoader loader.RulesLoader
+	switch cfg.ruleSource {
+	case ruleSourceKubernetes:
+		rulesLoader = loader.NewKubeRulesLoader(ctx, k8sClient, logger, namespace, cfg.managedTenants, reg, loaderOpts...)
+	case ruleSourceGit:
+		checkoutDir := cfg.gitCheckoutDir
+		if checkoutDir == "" {
+			checkoutDir, err = os.MkdirTemp("", "obsctl-reloader-rules-")
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		rulesLoader = loader.NewGitRulesLoader(ctx, k8sClient, logger, namespace, cfg.managedTenants, loader.GitSource{
+			Repo:         cfg.gitRepo,
+			Branch:       cfg.gitBranch,
+			Path:         cfg.gitPath,
+			PullInterval: cfg.gitPullInterval,
+			CheckoutDir:  checkoutDir,
+		}, reg, loaderOpts...)
+	case ruleSourceStatusCRD:
+		gvr, err := parseStatusCRDResource(cfg.statusCRDResource)
+		if err != nil {
+			panic(err)
+		}
+		kind, err := mapper.KindFor(gvr)
+		if err != nil {
+			panic(err)
+		}
+
+		rulesLoader, err = loader.NewStatusCRDRulesLoader(ctx, k8sClient, logger, namespace, cfg.managedTenants, loader.StatusCRDSource{
+			Kind: kind,
+			Path: cfg.statusCRDPath,
+		}, reg, loaderOpts...)
+		if err != nil {
+			panic(err)
+		}
+	default:
+		panic("unknown rule source " + cfg.ruleSource)
+	}
+
+	if r, ok := rulesLoader.(syncer.LokiNamespaceResolver); ok {
+		syncerOpts = append(syncerOpts, syncer.WithLokiNamespaceResolver(r))
+	}
+	if cfg.writeSyncStatus {
+		// Only supported by KubeRulesLoader, as checked by validateConfig.
+		loopOpts = append(loopOpts, loop.WithSyncStatusWriter(rulesLoader.(loop.SyncStatusWriter)))
+	}
+	if cfg.pauseConfigMap != "" {
+		loopOpts = append(loopOpts, loop.WithPauseCheck(configMapExists(ctx, k8sClient, namespace, cfg.pauseConfigMap)))
+	}
 
 	// Initialize config.
 	o := syncer.NewObsctlRulesSyncer(
@@ -151,36 +1027,57 @@ func main() {
 		cfg.issuerURL,
 		cfg.managedTenants,
 		reg,
+		syncerOpts...,
 	)
+	// Listen right away, so that an unusable internal address fails startup rather than the running reloader.
+	l, err := net.Listen(cfg.listenNetwork, cfg.listenInternal)
+	if err != nil {
+		level.Error(logger).Log("msg", "listening for internal HTTP server", "error", err)
+		panic(err)
+	}
+
+	// The signal handler isn't running yet, so stop waiting on termination signals here.
+	jitterCtx, stopJitter := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	err = waitStartupJitter(jitterCtx, logger, cfg.startupJitter)
+	stopJitter()
+	if err != nil {
+		level.Info(logger).Log("msg", "stopped during startup jitter", "error", err)
+		return
+	}
 	if err := o.InitOrReloadObsctlConfig(); err != nil {
 		level.Error(logger).Log("msg", "error initializing obsctl config", "error", err)
 		panic(err)
 	}
 
+	reload := make(chan struct{}, 1)
+
 	var g run.Group
 	{
 		g.Add(run.SignalHandler(ctx, os.Interrupt, syscall.SIGINT, syscall.SIGTERM))
 	}
+	{
+		g.Add(sighupHandler(ctx, logger, reload))
+	}
 	{
 		g.Add(func() error {
 			level.Info(logger).Log("msg", "starting obsctl-reloader sync")
 			return loop.SyncLoop(ctx, logger,
-				loader.NewKubeRulesLoader(ctx, k8sClient, logger, namespace, cfg.managedTenants, reg),
+				rulesLoader,
 				o,
 				cfg.logRulesEnabled,
-				cfg.sleepDurationSeconds,
+				effectiveSleepDurationSeconds(logger, cfg),
 				cfg.configReloadInterval,
+				reload,
+				reg,
+				loopOpts...,
 			)
 		}, func(_ error) {
 			cancel()
 		})
 	}
 	{
-		h := internalserver.NewHandler(
-			internalserver.WithName("Internal - obsctl-reloader"),
-			internalserver.WithPrometheusRegistry(reg),
-			internalserver.WithPProf(),
-		)
+		h := newInternalHandler(reg, cfg.pprofEnabled)
+		h.AddEndpoint("/tenants", "Managed tenants with their auth status and last sync", tenantsHandler(o))
 
 		//nolint:exhaustivestruct
 		s := http.Server{
@@ -189,16 +1086,23 @@ func main() {
 		}
 
 		g.Add(func() error {
-			level.Info(logger).Log("msg", "starting internal HTTP server", "address", s.Addr)
-
-			return s.ListenAndServe() //nolint:wrapcheck
+			level.Info(logger).Log("msg", "starting internal HTTP server", "address", l.Addr(), "network", cfg.listenNetwork)
+			return s.Serve(l) //nolint:wrapcheck
 		}, func(_ error) {
 			_ = s.Shutdown(ctx)
 			cancel()
 		})
 	}
 
-	if err := g.Run(); err != nil {
+	err = g.Run()
+
+	if cfg.pushgatewayURL != "" {
+		if err := pushMetrics(cfg.pushgatewayURL, reg); err != nil {
+			level.Error(logger).Log("msg", "pushing metrics to pushgateway", "error", err)
+		}
+	}
+
+	if err != nil {
 		level.Error(logger).Log("msg", "starting run group", "error", err)
 		os.Exit(1)
 	}
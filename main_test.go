@@ -1,17 +1,39 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/efficientgo/core/testutil"
 	"github.com/go-kit/log"
 	lokiv1 "github.com/grafana/loki/operator/apis/loki/v1"
 	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"gopkg.in/yaml.v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 
+	"github.com/rhobs/obsctl-reloader/pkg/k8sretry"
+	"github.com/rhobs/obsctl-reloader/pkg/loader"
 	"github.com/rhobs/obsctl-reloader/pkg/loop"
+	"github.com/rhobs/obsctl-reloader/pkg/syncer"
 )
 
 type testRulesLoader struct{}
@@ -47,12 +69,14 @@ func (r *testRulesLoader) GetTenantMetricsRuleGroups(_ []*monitoringv1.Prometheu
 }
 
 type testRulesSyncer struct {
+	initOrReloadCnt     int
 	setCurrentTenantCnt int
 	logsRulesCnt        int
 	metricsRulesCnt     int
 }
 
 func (r *testRulesSyncer) InitOrReloadObsctlConfig() error {
+	r.initOrReloadCnt++
 	return nil
 }
 
@@ -81,11 +105,1084 @@ func TestSyncLoop(t *testing.T) {
 	rs := &testRulesSyncer{}
 
 	ctx, cancel := context.WithCancel(context.Background())
-	time.AfterFunc(25*time.Second, func() { cancel() })
+	// Cancel between syncs, so that the result doesn't depend on which of two simultaneous timers fires first.
+	time.AfterFunc(22*time.Second, func() { cancel() })
 
-	testutil.Ok(t, loop.SyncLoop(ctx, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), rl, rs, true, 5, 60))
+	testutil.Ok(t, loop.SyncLoop(ctx, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), rl, rs, true, 5, 60, nil, prometheus.NewRegistry()))
 
 	testutil.Equals(t, 12, rs.setCurrentTenantCnt)
 	testutil.Equals(t, 4, rs.metricsRulesCnt)
 	testutil.Equals(t, 8, rs.logsRulesCnt)
 }
+
+type partialRulesLoader struct {
+	testRulesLoader
+}
+
+func (r *partialRulesLoader) GetTenantMetricsRuleGroups(_ []*monitoringv1.PrometheusRule) map[string]monitoringv1.PrometheusRuleSpec {
+	return map[string]monitoringv1.PrometheusRuleSpec{
+		"test": {},
+		"yolo": {Groups: []monitoringv1.RuleGroup{{Name: "YoloGroup"}}},
+	}
+}
+
+func TestSyncLoopTenantsWithZeroRules(t *testing.T) {
+	rl := &partialRulesLoader{}
+	rs := &testRulesSyncer{}
+	reg := prometheus.NewRegistry()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(1500*time.Millisecond, func() { cancel() })
+
+	testutil.Ok(t, loop.SyncLoop(ctx, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), rl, rs, true, 1, 60, nil, reg))
+
+	testutil.Equals(t, 2, rs.metricsRulesCnt)
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP obsctl_reloader_tenants_with_zero_rules Number of managed tenants without any metrics or logs rule groups in the last sync cycle.
+# TYPE obsctl_reloader_tenants_with_zero_rules gauge
+obsctl_reloader_tenants_with_zero_rules 1
+`), "obsctl_reloader_tenants_with_zero_rules"))
+}
+
+// lokiUnavailableRulesLoader fails to list Loki rules, as when the Loki rule CRDs can't be served.
+type lokiUnavailableRulesLoader struct {
+	testRulesLoader
+}
+
+func (r *lokiUnavailableRulesLoader) GetLokiAlertingRules() ([]lokiv1.AlertingRule, error) {
+	return nil, errors.New("loki alerting rules unavailable")
+}
+
+func (r *lokiUnavailableRulesLoader) GetLokiRecordingRules() ([]lokiv1.RecordingRule, error) {
+	return nil, errors.New("loki recording rules unavailable")
+}
+
+func TestSyncLoopLokiUnavailable(t *testing.T) {
+	rl := &lokiUnavailableRulesLoader{}
+	rs := &testRulesSyncer{}
+	reg := prometheus.NewRegistry()
+
+	testutil.Ok(t, loop.SyncLoop(context.Background(), log.NewNopLogger(), rl, rs, true, 0, 0, nil, reg, loop.WithRunOnce(true)))
+
+	// Metrics rules are still synced, Loki rules aren't touched.
+	testutil.Equals(t, 1, rs.metricsRulesCnt)
+	testutil.Equals(t, 0, rs.logsRulesCnt)
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP obsctl_reloader_loki_unavailable_total Total number of sync cycles which skipped Loki rules of a type, because listing them failed.
+# TYPE obsctl_reloader_loki_unavailable_total counter
+obsctl_reloader_loki_unavailable_total{type="alerting"} 1
+obsctl_reloader_loki_unavailable_total{type="recording"} 1
+`), "obsctl_reloader_loki_unavailable_total"))
+}
+
+func TestInternalHandlerPProf(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		pprofEnabled bool
+	}{
+		{name: "pprof enabled", pprofEnabled: true},
+		{name: "pprof disabled", pprofEnabled: false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newInternalHandler(prometheus.NewRegistry(), tc.pprofEnabled)
+
+			// Unknown paths fall back to the index page, so check which endpoints it lists.
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+			testutil.Equals(t, http.StatusOK, rr.Code)
+			testutil.Equals(t, tc.pprofEnabled, strings.Contains(rr.Body.String(), "/debug/"))
+			testutil.Assert(t, strings.Contains(rr.Body.String(), "/metrics"))
+
+			rr = httptest.NewRecorder()
+			h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/debug/pprof/cmdline", nil))
+			testutil.Equals(t, tc.pprofEnabled, rr.Header().Get("Content-Type") == "text/plain; charset=utf-8")
+		})
+	}
+}
+
+type staticTenantStatuses []syncer.TenantStatus
+
+func (s staticTenantStatuses) TenantStatuses() []syncer.TenantStatus {
+	return s
+}
+
+func TestTenantsHandler(t *testing.T) {
+	lastSync := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := newInternalHandler(prometheus.NewRegistry(), false)
+	h.AddEndpoint("/tenants", "Managed tenants", tenantsHandler(staticTenantStatuses{
+		{Tenant: "test", Configured: true, AuthStatus: syncer.AuthStatusFailed, LastSync: &syncer.SyncSummary{Time: lastSync, Error: "auth"}},
+		{Tenant: "missing", AuthStatus: syncer.AuthStatusUnconfigured},
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/tenants", nil))
+	testutil.Equals(t, http.StatusOK, rr.Code)
+	testutil.Equals(t, "application/json", rr.Header().Get("Content-Type"))
+	testutil.Equals(t, `[{"tenant":"test","configured":true,"authStatus":"failed","lastSync":{"time":"2024-01-02T03:04:05Z","error":"auth"}},{"tenant":"missing","configured":false,"authStatus":"unconfigured"}]`, rr.Body.String())
+}
+
+func TestSyncLoopReload(t *testing.T) {
+	rl := &testRulesLoader{}
+	rs := &testRulesSyncer{}
+	reload := make(chan struct{}, 1)
+	reload <- struct{}{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, func() { cancel() })
+
+	testutil.Ok(t, loop.SyncLoop(ctx, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), rl, rs, true, 60, 60, reload, prometheus.NewRegistry()))
+
+	// A single reload both reloads the config and syncs rules, without waiting for the sleep duration.
+	testutil.Equals(t, 1, rs.initOrReloadCnt)
+	testutil.Equals(t, 1, rs.metricsRulesCnt)
+	testutil.Equals(t, 2, rs.logsRulesCnt)
+}
+
+func TestSIGHUPHandler(t *testing.T) {
+	reload := make(chan struct{}, 1)
+	execute, interrupt := sighupHandler(context.Background(), log.NewNopLogger(), reload)
+
+	done := make(chan error, 1)
+	go func() { done <- execute() }()
+
+	testutil.Ok(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	select {
+	case <-reload:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected reload to be triggered by SIGHUP")
+	}
+
+	interrupt(nil)
+	testutil.Ok(t, <-done)
+}
+
+func TestPushMetrics(t *testing.T) {
+	var gotMethod, gotPath, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotMethod, gotPath, gotBody = r.Method, r.URL.Path, string(b)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	reg := prometheus.NewRegistry()
+	c := promauto.With(reg).NewCounter(prometheus.CounterOpts{Name: "obsctl_reloader_test_total", Help: "Test counter."})
+	c.Add(3)
+
+	testutil.Ok(t, pushMetrics(srv.URL, reg))
+	testutil.Equals(t, http.MethodPut, gotMethod)
+	testutil.Equals(t, "/metrics/job/obsctl-reloader", gotPath)
+	testutil.Assert(t, strings.Contains(gotBody, "obsctl_reloader_test_total"), "expected pushed metric in body")
+}
+
+func TestApplyEnvFallback(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		args      []string
+		env       map[string]string
+		wantSleep uint
+		wantURL   string
+		wantErr   bool
+	}{
+		{
+			name:      "defaults",
+			wantSleep: 15,
+		},
+		{
+			name:      "env only",
+			env:       map[string]string{"SLEEP_DURATION_SECONDS": "30", "OBSERVATORIUM_API_URL": "http://env"},
+			wantSleep: 30,
+			wantURL:   "http://env",
+		},
+		{
+			name:      "flag takes precedence over env",
+			args:      []string{"--sleep-duration-seconds=45"},
+			env:       map[string]string{"SLEEP_DURATION_SECONDS": "30", "OBSERVATORIUM_API_URL": "http://env"},
+			wantSleep: 45,
+			wantURL:   "http://env",
+		},
+		{
+			name:    "invalid env value",
+			env:     map[string]string{"SLEEP_DURATION_SECONDS": "soon"},
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				sleep uint
+				url   string
+			)
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.UintVar(&sleep, "sleep-duration-seconds", 15, "")
+			fs.StringVar(&url, "observatorium-api-url", "", "")
+			testutil.Ok(t, fs.Parse(tc.args))
+
+			err := applyEnvFallback(fs, func(k string) (string, bool) {
+				v, ok := tc.env[k]
+				return v, ok
+			})
+			if tc.wantErr {
+				testutil.NotOk(t, err)
+				return
+			}
+
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.wantSleep, sleep)
+			testutil.Equals(t, tc.wantURL, url)
+		})
+	}
+}
+
+func TestSyncLoopTenantSignals(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		opts        []loop.Option
+		wantMetrics int
+		wantLogs    int
+	}{
+		{
+			name:        "all signals enabled",
+			wantMetrics: 1,
+			wantLogs:    2,
+		},
+		{
+			name:        "logs disabled",
+			opts:        []loop.Option{loop.WithLogsDisabledTenants("test")},
+			wantMetrics: 1,
+			wantLogs:    0,
+		},
+		{
+			name:        "metrics disabled",
+			opts:        []loop.Option{loop.WithMetricsDisabledTenants("test")},
+			wantMetrics: 0,
+			wantLogs:    2,
+		},
+		{
+			name:        "other tenant disabled",
+			opts:        []loop.Option{loop.WithMetricsDisabledTenants("yolo"), loop.WithLogsDisabledTenants("yolo")},
+			wantMetrics: 1,
+			wantLogs:    2,
+		},
+		{
+			name:        "tenant active",
+			opts:        []loop.Option{loop.WithActiveTenants("test", "yolo")},
+			wantMetrics: 1,
+			wantLogs:    2,
+		},
+		{
+			name:        "tenant not active",
+			opts:        []loop.Option{loop.WithActiveTenants("yolo")},
+			wantMetrics: 0,
+			wantLogs:    0,
+		},
+		{
+			name:        "no active tenants set",
+			opts:        []loop.Option{loop.WithActiveTenants()},
+			wantMetrics: 1,
+			wantLogs:    2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rl := &testRulesLoader{}
+			rs := &testRulesSyncer{}
+			reload := make(chan struct{}, 1)
+			reload <- struct{}{}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(200*time.Millisecond, func() { cancel() })
+
+			testutil.Ok(t, loop.SyncLoop(ctx, log.NewNopLogger(), rl, rs, true, 60, 60, reload, prometheus.NewRegistry(), tc.opts...))
+			testutil.Equals(t, tc.wantMetrics, rs.metricsRulesCnt)
+			testutil.Equals(t, tc.wantLogs, rs.logsRulesCnt)
+		})
+	}
+}
+
+func TestParseConfigMapKeyRef(t *testing.T) {
+	ref, err := parseConfigMapKeyRef("observatorium/api-ca:service-ca.crt")
+	testutil.Ok(t, err)
+	testutil.Equals(t, syncer.ConfigMapKeyRef{Namespace: "observatorium", Name: "api-ca", Key: "service-ca.crt"}, ref)
+
+	for _, invalid := range []string{"", "api-ca:ca.crt", "observatorium/api-ca", "observatorium/api-ca:", "/api-ca:ca.crt", "observatorium/:ca.crt"} {
+		_, err := parseConfigMapKeyRef(invalid)
+		testutil.NotOk(t, err, invalid)
+	}
+}
+
+func TestValidateTenantNames(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		pattern string
+		tenants []string
+		wantErr string
+	}{
+		{name: "valid", pattern: defaultTenantNameRegex, tenants: []string{"rhobs", "telemeter", "team-a_prod", "team.a", "Team1"}},
+		{name: "none", pattern: defaultTenantNameRegex},
+		{name: "space", pattern: defaultTenantNameRegex, tenants: []string{"rhobs", "team a"}, wantErr: `managed tenant names "team a" don't match`},
+		{name: "slash and leading dash", pattern: defaultTenantNameRegex, tenants: []string{"org/team", "-rhobs"}, wantErr: `managed tenant names "org/team", "-rhobs" don't match`},
+		{name: "non-ascii", pattern: defaultTenantNameRegex, tenants: []string{"équipe"}, wantErr: `"équipe"`},
+		// Patterns must match the whole name.
+		{name: "custom", pattern: "[a-z]+", tenants: []string{"rhobs", "rhobs2"}, wantErr: `"rhobs2"`},
+		{name: "custom alternation", pattern: "a|b", tenants: []string{"a", "b", "ab"}, wantErr: `"ab"`},
+		{name: "invalid regex", pattern: "[", tenants: []string{"rhobs"}, wantErr: "invalid --tenant-name-regex"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateTenantNames(tc.pattern, tc.tenants)
+			if tc.wantErr == "" {
+				testutil.Ok(t, err)
+				return
+			}
+			testutil.NotOk(t, err)
+			testutil.Assert(t, strings.Contains(err.Error(), tc.wantErr), "expected error containing %q, got %v", tc.wantErr, err)
+		})
+	}
+}
+
+func TestValidateListenAddress(t *testing.T) {
+	for _, tc := range []struct {
+		network string
+		addr    string
+		wantErr bool
+	}{
+		{network: "tcp", addr: ":8081"},
+		{network: "tcp", addr: "0.0.0.0:8081"},
+		{network: "tcp", addr: "[::]:8081"},
+		{network: "tcp", addr: "localhost:8081"},
+		{network: "tcp4", addr: "127.0.0.1:8081"},
+		{network: "tcp6", addr: "[::1]:8081"},
+		{network: "tcp6", addr: ":8081"},
+		{network: "tcp", addr: "8081", wantErr: true},
+		{network: "tcp", addr: "::8081", wantErr: true},
+		{network: "tcp", addr: ":http", wantErr: true},
+		{network: "tcp", addr: ":65536", wantErr: true},
+		{network: "tcp4", addr: "[::]:8081", wantErr: true},
+		{network: "tcp6", addr: "0.0.0.0:8081", wantErr: true},
+		{network: "udp", addr: ":8081", wantErr: true},
+	} {
+		t.Run(tc.network+" "+tc.addr, func(t *testing.T) {
+			err := validateListenAddress(tc.network, tc.addr)
+			if tc.wantErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+		})
+	}
+}
+
+func TestEffectiveSleepDurationSeconds(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		sleep    uint
+		floor    time.Duration
+		runOnce  bool
+		want     uint
+		wantWarn bool
+	}{
+		{name: "above floor", sleep: 15, floor: 5 * time.Second, want: 15},
+		{name: "at floor", sleep: 5, floor: 5 * time.Second, want: 5},
+		{name: "below floor", sleep: 1, floor: 5 * time.Second, want: 5, wantWarn: true},
+		{name: "zero", sleep: 0, floor: 5 * time.Second, want: 5, wantWarn: true},
+		{name: "fractional floor rounds up", sleep: 2, floor: 2500 * time.Millisecond, want: 3, wantWarn: true},
+		{name: "no floor", sleep: 0, want: 0},
+		{name: "run once", sleep: 0, floor: 5 * time.Second, runOnce: true, want: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			c := &cfg{sleepDurationSeconds: tc.sleep, minSleepInterval: tc.floor, runOnce: tc.runOnce}
+
+			testutil.Equals(t, tc.want, effectiveSleepDurationSeconds(log.NewLogfmtLogger(&buf), c))
+			testutil.Equals(t, tc.wantWarn, strings.Contains(buf.String(), "level=warn"))
+		})
+	}
+}
+
+func TestCheckMetricsRegistration(t *testing.T) {
+	register := func(reg prometheus.Registerer) {
+		registerComponentMetrics(reg,
+			[]k8sretry.Option{k8sretry.WithMetricsPrefix("obsctl_reloader")},
+			[]loader.Option{loader.WithMetricsPrefix("obsctl_reloader"), loader.WithCRDDiscovery(meta.NewDefaultRESTMapper(nil))},
+			[]syncer.Option{syncer.WithMetricsPrefix("obsctl_reloader")},
+			[]loop.Option{loop.WithMetricsPrefix("obsctl_reloader")},
+		)
+	}
+	testutil.Ok(t, checkMetricsRegistration(register))
+
+	// Metrics of each component are registered.
+	reg := prometheus.NewRegistry()
+	register(reg)
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	names := map[string]bool{}
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+	for _, name := range []string{"obsctl_reloader_prom_rule_fetches_total", "obsctl_reloader_inflight_api_requests", "obsctl_reloader_tenants_with_zero_rules"} {
+		testutil.Assert(t, names[name], "metric %s not registered", name)
+	}
+
+	err = checkMetricsRegistration(func(reg prometheus.Registerer) {
+		register(reg)
+		// A second loop registers the same metrics again.
+		loop.RegisterMetrics(reg, loop.WithMetricsPrefix("obsctl_reloader"))
+	})
+	testutil.NotOk(t, err)
+	testutil.Assert(t, strings.Contains(err.Error(), "registering metrics"), "unexpected error: %v", err)
+}
+
+func TestValidateConfig(t *testing.T) {
+	validCfg := func() *cfg {
+		return &cfg{
+			observatoriumURL:              "https://observatorium.example.com",
+			managedTenants:                "a,b",
+			sleepDurationSeconds:          defaultSleepDurationSeconds,
+			configReloadInterval:          defaultConfigReloadIntervalSeconds,
+			configCheckConcurrency:        1,
+			listenInternal:                ":8081",
+			listenNetwork:                 "tcp",
+			k8sThrottleBackoff:            time.Second,
+			metricsPrefix:                 "obsctl_reloader",
+			shardTotal:                    1,
+			lokiRulesContentType:          "application/yaml",
+			tenantNameRegex:               defaultTenantNameRegex,
+			maxRangeAction:                "cap",
+			syncSuccessWindow:             20,
+			lokiAlertingEnabled:           true,
+			lokiRecordingEnabled:          true,
+			logLevel:                      "info",
+			lokiVersionConflict:           "prefer-v1",
+			requiredAlertAnnotationAction: "warn",
+			ruleSource:                    "kubernetes",
+		}
+	}
+
+	for _, tc := range []struct {
+		name    string
+		mutate  func(c *cfg)
+		wantErr bool
+	}{
+		{name: "valid", mutate: func(c *cfg) {}},
+		{name: "missing API URL", mutate: func(c *cfg) { c.observatoriumURL = "" }, wantErr: true},
+		{name: "relative API URL", mutate: func(c *cfg) { c.observatoriumURL = "observatorium:8080" }, wantErr: true},
+		{name: "malformed issuer URL", mutate: func(c *cfg) { c.issuerURL = "://sso" }, wantErr: true},
+		{name: "zero sleep duration", mutate: func(c *cfg) { c.sleepDurationSeconds = 0 }, wantErr: true},
+		{name: "zero sleep duration with run once", mutate: func(c *cfg) { c.sleepDurationSeconds = 0; c.runOnce = true }},
+		{name: "zero sleep duration with min sleep interval", mutate: func(c *cfg) { c.sleepDurationSeconds = 0; c.minSleepInterval = 5 * time.Second }},
+		{name: "negative min sleep interval", mutate: func(c *cfg) { c.minSleepInterval = -time.Second }, wantErr: true},
+		{name: "zero config reload interval disables reloads", mutate: func(c *cfg) { c.configReloadInterval = 0 }},
+		{name: "invalid log level", mutate: func(c *cfg) { c.logLevel = "verbose" }, wantErr: true},
+		{name: "no managed tenants", mutate: func(c *cfg) { c.managedTenants = " , " }, wantErr: true},
+		{name: "empty managed tenants", mutate: func(c *cfg) { c.managedTenants = "" }, wantErr: true},
+		{
+			name:    "metrics disabled for all tenants without logs",
+			mutate:  func(c *cfg) { c.metricsDisabledTenants = "a,b" },
+			wantErr: true,
+		},
+		{
+			name: "metrics disabled for all tenants with logs",
+			mutate: func(c *cfg) {
+				c.metricsDisabledTenants = "a,b"
+				c.logRulesEnabled = true
+			},
+		},
+		{
+			name: "all signals disabled",
+			mutate: func(c *cfg) {
+				c.metricsDisabledTenants = "a,b"
+				c.logRulesEnabled = true
+				c.logsDisabledTenants = "a,b"
+			},
+			wantErr: true,
+		},
+		{
+			name: "HTTP/2 forced and disabled",
+			mutate: func(c *cfg) {
+				c.apiForceHTTP2 = true
+				c.apiDisableHTTP2 = true
+			},
+			wantErr: true,
+		},
+		{name: "unmanaged active tenant", mutate: func(c *cfg) { c.activeTenants = "a,c" }, wantErr: true},
+		{
+			name: "metrics disabled for all active tenants",
+			mutate: func(c *cfg) {
+				c.activeTenants = "a"
+				c.metricsDisabledTenants = "a"
+			},
+			wantErr: true,
+		},
+		{name: "tenant path template without tenant", mutate: func(c *cfg) { c.apiTenantPathTemplate = "/api/v1" }, wantErr: true},
+		{name: "relative tenant path template", mutate: func(c *cfg) { c.apiTenantPathTemplate = "api/{tenant}" }, wantErr: true},
+		{name: "tenant path template", mutate: func(c *cfg) { c.apiTenantPathTemplate = "/api/v1/{tenant}" }},
+		{name: "invalid rule source", mutate: func(c *cfg) { c.ruleSource = "s3" }, wantErr: true},
+		{name: "git rule source without repo", mutate: func(c *cfg) { c.ruleSource = "git" }, wantErr: true},
+		{
+			name: "git rule source",
+			mutate: func(c *cfg) {
+				c.ruleSource = "git"
+				c.gitRepo = "https://github.com/example/rules"
+			},
+		},
+		{
+			name: "git rule source with log rules",
+			mutate: func(c *cfg) {
+				c.ruleSource = "git"
+				c.gitRepo = "https://github.com/example/rules"
+				c.logRulesEnabled = true
+			},
+			wantErr: true,
+		},
+		{
+			name: "status CRD rule source",
+			mutate: func(c *cfg) {
+				c.ruleSource = "status-crd"
+				c.statusCRDResource = "rulesets.v1.example.com"
+			},
+		},
+		{
+			name: "git rule source with sync status",
+			mutate: func(c *cfg) {
+				c.ruleSource = "git"
+				c.gitRepo = "https://github.com/example/rules"
+				c.writeSyncStatus = true
+			},
+			wantErr: true,
+		},
+		{name: "sync status", mutate: func(c *cfg) { c.writeSyncStatus = true }},
+		{
+			name: "status CRD rule source without version",
+			mutate: func(c *cfg) {
+				c.ruleSource = "status-crd"
+				c.statusCRDResource = "rulesets"
+			},
+			wantErr: true,
+		},
+		{name: "status CRD rule source without resource", mutate: func(c *cfg) { c.ruleSource = "status-crd" }, wantErr: true},
+		{name: "no loki rule type enabled", mutate: func(c *cfg) {
+			c.logRulesEnabled = true
+			c.lokiAlertingEnabled = false
+			c.lokiRecordingEnabled = false
+			c.metricsDisabledTenants = "a,b"
+		}, wantErr: true},
+		{name: "negative k8s throttle retries", mutate: func(c *cfg) { c.k8sThrottleRetries = -1 }, wantErr: true},
+		{name: "zero k8s throttle backoff", mutate: func(c *cfg) { c.k8sThrottleBackoff = 0 }, wantErr: true},
+		{name: "IPv6 listen address", mutate: func(c *cfg) { c.listenInternal, c.listenNetwork = "[::]:8081", "tcp6" }},
+		{name: "invalid listen address", mutate: func(c *cfg) { c.listenInternal = "8081" }, wantErr: true},
+		{name: "custom metrics prefix", mutate: func(c *cfg) { c.metricsPrefix = "rules_sync" }},
+		{name: "invalid metrics prefix", mutate: func(c *cfg) { c.metricsPrefix = "rules-sync" }, wantErr: true},
+		{name: "sharded", mutate: func(c *cfg) { c.shardIndex, c.shardTotal = 2, 3 }},
+		{name: "zero shards", mutate: func(c *cfg) { c.shardTotal = 0 }, wantErr: true},
+		{name: "shard index out of range", mutate: func(c *cfg) { c.shardIndex, c.shardTotal = 3, 3 }, wantErr: true},
+		{name: "negative shard index", mutate: func(c *cfg) { c.shardIndex = -1 }, wantErr: true},
+		{name: "json loki rules", mutate: func(c *cfg) { c.lokiRulesContentType = "application/json; charset=utf-8" }},
+		{name: "invalid loki rules content type", mutate: func(c *cfg) { c.lokiRulesContentType = "application/" }, wantErr: true},
+		{name: "invalid tenant name", mutate: func(c *cfg) { c.managedTenants = "rhobs,team a" }, wantErr: true},
+		{name: "invalid tenant name regex", mutate: func(c *cfg) { c.tenantNameRegex = "[" }, wantErr: true},
+		{name: "zero config check concurrency", mutate: func(c *cfg) { c.configCheckConcurrency = 0 }, wantErr: true},
+		{name: "tenant header name", mutate: func(c *cfg) { c.tenantHeaderName = "X-Scope-OrgID" }},
+		{name: "invalid tenant header name", mutate: func(c *cfg) { c.tenantHeaderName = "X Scope" }, wantErr: true},
+		{name: "requeue failed once", mutate: func(c *cfg) { c.requeueFailedOnce, c.requeueFailedDelay = true, time.Second }},
+		{name: "Loki rule selector", mutate: func(c *cfg) { c.lokiRuleSelector = "loki.grafana.com/operator-managed=true" }},
+		{name: "invalid Loki rule selector", mutate: func(c *cfg) { c.lokiRuleSelector = "a=b=c" }, wantErr: true},
+		{name: "negative startup jitter", mutate: func(c *cfg) { c.startupJitter = -time.Second }, wantErr: true},
+		{name: "negative requeue delay", mutate: func(c *cfg) { c.requeueFailedDelay = -time.Second }, wantErr: true},
+		{name: "zero sync success window", mutate: func(c *cfg) { c.syncSuccessWindow = 0 }, wantErr: true},
+		{name: "negative max range selector", mutate: func(c *cfg) { c.maxRangeSelector = -time.Hour }, wantErr: true},
+		{name: "negative max range duration", mutate: func(c *cfg) { c.maxRangeDuration = -time.Hour }, wantErr: true},
+		{name: "max range selector and duration", mutate: func(c *cfg) { c.maxRangeSelector, c.maxRangeDuration = time.Hour, time.Hour }, wantErr: true},
+		{name: "invalid max range duration action", mutate: func(c *cfg) { c.maxRangeAction = "drop" }, wantErr: true},
+		{name: "negative min alert for", mutate: func(c *cfg) { c.minAlertFor = -time.Minute }, wantErr: true},
+		{name: "negative max rules per type", mutate: func(c *cfg) { c.maxRulesPerType = -1 }, wantErr: true},
+		{name: "banned functions", mutate: func(c *cfg) { c.bannedFunctions = "absent_over_time, topk" }},
+		{name: "unknown banned function", mutate: func(c *cfg) { c.bannedFunctions = "absent_over_time,expensive" }, wantErr: true},
+		{name: "promoted annotations", mutate: func(c *cfg) { c.promoteAnnotationsToLabels = "team,severity" }},
+		{name: "invalid promoted annotation", mutate: func(c *cfg) { c.promoteAnnotationsToLabels = "team,run-book" }, wantErr: true},
+		{name: "invalid CA configmap", mutate: func(c *cfg) { c.apiCAConfigMap = "api-ca" }, wantErr: true},
+		{name: "invalid required alert annotations action", mutate: func(c *cfg) { c.requiredAlertAnnotationAction = "drop" }, wantErr: true},
+		{name: "invalid loki version conflict", mutate: func(c *cfg) { c.lokiVersionConflict = "newest" }, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := validCfg()
+			tc.mutate(c)
+
+			err := validateConfig(c)
+			if tc.wantErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+		})
+	}
+}
+
+func TestResolvedConfigYAML(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("observatorium-api-url", "", "")
+	fs.Uint("sleep-duration-seconds", defaultSleepDurationSeconds, "")
+	fs.Bool("log-rules-enabled", false, "")
+	fs.Bool("config-check", false, "")
+
+	testutil.Ok(t, fs.Parse([]string{"--config-check", "--log-rules-enabled"}))
+	testutil.Ok(t, applyEnvFallback(fs, func(name string) (string, bool) {
+		if name == "OBSERVATORIUM_API_URL" {
+			return "http://env", true
+		}
+		return "", false
+	}))
+
+	out, err := resolvedConfigYAML(fs)
+	testutil.Ok(t, err)
+	testutil.Equals(t, `log-rules-enabled: true
+observatorium-api-url: http://env
+sleep-duration-seconds: 15
+`, string(out))
+}
+
+func TestSyncLoopInitialSyncDelay(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		delay       time.Duration
+		wantMetrics int
+	}{
+		{name: "no delay", delay: 0, wantMetrics: 1},
+		{name: "delay elapsed", delay: 100 * time.Millisecond, wantMetrics: 1},
+		{name: "delay not elapsed", delay: time.Hour, wantMetrics: 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rl := &testRulesLoader{}
+			rs := &testRulesSyncer{}
+			reload := make(chan struct{}, 1)
+			reload <- struct{}{}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(300*time.Millisecond, func() { cancel() })
+
+			start := time.Now()
+			testutil.Ok(t, loop.SyncLoop(ctx, log.NewNopLogger(), rl, rs, false, 60, 60, reload, prometheus.NewRegistry(), loop.WithInitialSyncDelay(tc.delay)))
+			testutil.Assert(t, time.Since(start) < time.Second, "expected cancellation to interrupt the delay")
+			testutil.Equals(t, tc.wantMetrics, rs.metricsRulesCnt)
+		})
+	}
+}
+
+func TestStartupJitter(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	testutil.Equals(t, time.Duration(0), randomJitter(r, 0))
+	testutil.Equals(t, time.Duration(0), randomJitter(r, -time.Second))
+	for i := 0; i < 1000; i++ {
+		d := randomJitter(r, 10*time.Millisecond)
+		testutil.Assert(t, d >= 0 && d < 10*time.Millisecond, "jitter %v out of [0, 10ms)", d)
+	}
+
+	testutil.Ok(t, waitStartupJitter(context.Background(), log.NewNopLogger(), 0))
+	testutil.Ok(t, waitStartupJitter(context.Background(), log.NewNopLogger(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	testutil.NotOk(t, waitStartupJitter(ctx, log.NewNopLogger(), 24*time.Hour))
+	testutil.Assert(t, time.Since(start) < time.Second, "expected cancellation to interrupt the jitter")
+}
+
+type slowRulesSyncer struct {
+	testRulesSyncer
+	delay time.Duration
+}
+
+func (r *slowRulesSyncer) MetricsSet(rules monitoringv1.PrometheusRuleSpec) error {
+	time.Sleep(r.delay)
+	return r.testRulesSyncer.MetricsSet(rules)
+}
+
+func TestSyncLoopMaxCycleDuration(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		maxDuration  time.Duration
+		wantMetrics  int
+		wantLogs     int
+		wantTimeouts float64
+	}{
+		{name: "no limit", maxDuration: 0, wantMetrics: 2, wantLogs: 2, wantTimeouts: 0},
+		{name: "within limit", maxDuration: time.Second, wantMetrics: 2, wantLogs: 2, wantTimeouts: 0},
+		{name: "limit exceeded", maxDuration: 10 * time.Millisecond, wantMetrics: 1, wantLogs: 0, wantTimeouts: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rl := &partialRulesLoader{}
+			rs := &slowRulesSyncer{delay: 50 * time.Millisecond}
+			reg := prometheus.NewRegistry()
+			reload := make(chan struct{}, 1)
+			reload <- struct{}{}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(300*time.Millisecond, func() { cancel() })
+
+			testutil.Ok(t, loop.SyncLoop(ctx, log.NewNopLogger(), rl, rs, true, 60, 60, reload, reg, loop.WithMaxCycleDuration(tc.maxDuration)))
+			testutil.Equals(t, tc.wantMetrics, rs.metricsRulesCnt)
+			testutil.Equals(t, tc.wantLogs, rs.logsRulesCnt)
+			testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+# HELP obsctl_reloader_cycle_timeout_total Total number of sync cycles aborted for exceeding the maximum cycle duration.
+# TYPE obsctl_reloader_cycle_timeout_total counter
+obsctl_reloader_cycle_timeout_total %v
+`, tc.wantTimeouts)), "obsctl_reloader_cycle_timeout_total"))
+		})
+	}
+}
+
+func TestSyncLoopConfigReloadInterval(t *testing.T) {
+	rl := &testRulesLoader{}
+	rs := &testRulesSyncer{}
+
+	// Syncs are scheduled more often than config reloads, which must still happen.
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(2500*time.Millisecond, func() { cancel() })
+
+	testutil.Ok(t, loop.SyncLoop(ctx, log.NewNopLogger(), rl, rs, false, 1, 2, nil, prometheus.NewRegistry()))
+	testutil.Equals(t, 1, rs.initOrReloadCnt)
+	testutil.Assert(t, rs.metricsRulesCnt >= 1, "expected rules to be synced")
+}
+
+func TestSyncLoopPause(t *testing.T) {
+	type pauseState struct {
+		paused bool
+		err    error
+	}
+
+	for _, tc := range []struct {
+		name        string
+		states      []pauseState
+		wantMetrics int
+		wantPaused  float64
+	}{
+		{name: "not paused", states: []pauseState{{}, {}}, wantMetrics: 2, wantPaused: 0},
+		{name: "paused", states: []pauseState{{paused: true}, {paused: true}}, wantMetrics: 0, wantPaused: 1},
+		{name: "resumed", states: []pauseState{{paused: true}, {}}, wantMetrics: 1, wantPaused: 0},
+		{name: "check error keeps state", states: []pauseState{{paused: true}, {err: errors.New("unavailable")}}, wantMetrics: 0, wantPaused: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rl := &testRulesLoader{}
+			rs := &testRulesSyncer{}
+			reg := prometheus.NewRegistry()
+			reload := make(chan struct{}, len(tc.states))
+			for range tc.states {
+				reload <- struct{}{}
+			}
+
+			calls := 0
+			paused := func() (bool, error) {
+				s := tc.states[calls]
+				calls++
+				return s.paused, s.err
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(300*time.Millisecond, func() { cancel() })
+
+			testutil.Ok(t, loop.SyncLoop(ctx, log.NewNopLogger(), rl, rs, false, 60, 60, reload, reg, loop.WithPauseCheck(paused)))
+			testutil.Equals(t, len(tc.states), calls)
+			testutil.Equals(t, tc.wantMetrics, rs.metricsRulesCnt)
+			// Config reloads happen regardless.
+			testutil.Equals(t, len(tc.states), rs.initOrReloadCnt)
+			testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+# HELP obsctl_reloader_paused Whether syncing is paused; 1 if paused, 0 otherwise.
+# TYPE obsctl_reloader_paused gauge
+obsctl_reloader_paused %v
+`, tc.wantPaused)), "obsctl_reloader_paused"))
+		})
+	}
+}
+
+func TestConfigMapExists(t *testing.T) {
+	ctx := context.Background()
+	kc := fake.NewClientBuilder().Build()
+	exists := configMapExists(ctx, kc, "ns", "obsctl-reloader-pause")
+
+	paused, err := exists()
+	testutil.Ok(t, err)
+	testutil.Assert(t, !paused, "expected no sentinel ConfigMap")
+
+	testutil.Ok(t, kc.Create(ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "obsctl-reloader-pause"}}))
+	paused, err = exists()
+	testutil.Ok(t, err)
+	testutil.Assert(t, paused, "expected sentinel ConfigMap")
+}
+
+func TestSyncLoopConfigReloadDisabled(t *testing.T) {
+	rl := &testRulesLoader{}
+	rs := &testRulesSyncer{}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(2500*time.Millisecond, func() { cancel() })
+
+	testutil.Ok(t, loop.SyncLoop(ctx, log.NewNopLogger(), rl, rs, false, 1, 0, nil, prometheus.NewRegistry()))
+	testutil.Equals(t, 0, rs.initOrReloadCnt)
+	testutil.Assert(t, rs.metricsRulesCnt >= 1, "expected rules to be synced")
+}
+
+func TestSyncLoopRunOnce(t *testing.T) {
+	rl := &testRulesLoader{}
+	rs := &testRulesSyncer{}
+
+	// Returns after a single pass, without waiting for the sleep duration or cancellation.
+	start := time.Now()
+	testutil.Ok(t, loop.SyncLoop(context.Background(), log.NewNopLogger(), rl, rs, true, 0, 0, nil, prometheus.NewRegistry(), loop.WithRunOnce(true)))
+	testutil.Assert(t, time.Since(start) < time.Second, "expected a single pass to return immediately")
+	testutil.Equals(t, 1, rs.metricsRulesCnt)
+	testutil.Equals(t, 2, rs.logsRulesCnt)
+}
+
+func TestSyncLoopMetricsPrefix(t *testing.T) {
+	rl := &partialRulesLoader{}
+	rs := &testRulesSyncer{}
+	reg := prometheus.NewRegistry()
+
+	testutil.Ok(t, loop.SyncLoop(context.Background(), log.NewNopLogger(), rl, rs, true, 0, 0, nil, reg, loop.WithRunOnce(true), loop.WithMetricsPrefix("rules_sync")))
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP rules_sync_tenants_with_zero_rules Number of managed tenants without any metrics or logs rule groups in the last sync cycle.
+# TYPE rules_sync_tenants_with_zero_rules gauge
+rules_sync_tenants_with_zero_rules 1
+`), "rules_sync_tenants_with_zero_rules", "obsctl_reloader_tenants_with_zero_rules"))
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	for _, mf := range mfs {
+		testutil.Assert(t, strings.HasPrefix(mf.GetName(), "rules_sync_"), "expected prefixed metric name, got %s", mf.GetName())
+	}
+}
+
+func TestSyncLoopRecordingSyncer(t *testing.T) {
+	rl := &testRulesLoader{}
+	rs := &syncer.RecordingSyncer{}
+
+	testutil.Ok(t, loop.SyncLoop(context.Background(), log.NewNopLogger(), rl, rs, true, 0, 0, nil, prometheus.NewRegistry(), loop.WithRunOnce(true)))
+	testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{"test": {}}, rs.MetricsRules())
+
+	// Each set call follows setting its tenant.
+	for _, m := range []string{syncer.MethodMetricsSet, syncer.MethodLogsAlertingSet, syncer.MethodLogsRecordingSet} {
+		calls := rs.CallsTo(m)
+		testutil.Equals(t, 1, len(calls))
+		testutil.Equals(t, "test", calls[0].Tenant)
+	}
+}
+
+// flakyRulesSyncer fails setting the metrics rules of each tenant the first time.
+type flakyRulesSyncer struct {
+	testRulesSyncer
+	current string
+	failed  map[string]bool
+}
+
+func (r *flakyRulesSyncer) SetCurrentTenant(tenant string) error {
+	r.current = tenant
+	return r.testRulesSyncer.SetCurrentTenant(tenant)
+}
+
+func (r *flakyRulesSyncer) MetricsSet(rules monitoringv1.PrometheusRuleSpec) error {
+	_ = r.testRulesSyncer.MetricsSet(rules)
+	if !r.failed[r.current] {
+		r.failed[r.current] = true
+		return errors.New("transient error")
+	}
+	return nil
+}
+
+func TestSyncLoopRequeueFailedOnce(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		opts        []loop.Option
+		wantMetrics int
+		wantMetric  string
+	}{
+		{name: "disabled", wantMetrics: 1},
+		{
+			name:        "enabled",
+			opts:        []loop.Option{loop.WithRequeueFailedOnce(10 * time.Millisecond)},
+			wantMetrics: 2,
+			wantMetric: `
+# HELP obsctl_reloader_requeued_syncs_total Total number of failed rule syncs retried at the end of a sync cycle, by result.
+# TYPE obsctl_reloader_requeued_syncs_total counter
+obsctl_reloader_requeued_syncs_total{result="success",tenant="test",type="metrics"} 1
+`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rl := &testRulesLoader{}
+			rs := &flakyRulesSyncer{failed: map[string]bool{}}
+			reg := prometheus.NewRegistry()
+
+			opts := append([]loop.Option{loop.WithRunOnce(true)}, tc.opts...)
+			testutil.Ok(t, loop.SyncLoop(context.Background(), log.NewNopLogger(), rl, rs, true, 0, 0, nil, reg, opts...))
+			testutil.Equals(t, tc.wantMetrics, rs.metricsRulesCnt)
+			// Only failed syncs are retried.
+			testutil.Equals(t, 2, rs.logsRulesCnt)
+			testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(tc.wantMetric), "obsctl_reloader_requeued_syncs_total"))
+		})
+	}
+}
+
+// recordingSyncStatusWriter records the sync errors written for each tenant.
+type recordingSyncStatusWriter struct {
+	statuses map[string][]error
+}
+
+func (w *recordingSyncStatusWriter) WriteSyncStatus(tenant string, syncErr error) error {
+	w.statuses[tenant] = append(w.statuses[tenant], syncErr)
+	return errors.New("writing status is not allowed")
+}
+
+func TestSyncLoopSyncStatus(t *testing.T) {
+	rl := &testRulesLoader{}
+	rs := &flakyRulesSyncer{failed: map[string]bool{}}
+	w := &recordingSyncStatusWriter{statuses: map[string][]error{}}
+
+	// Failing to write the status doesn't fail syncing.
+	testutil.Ok(t, loop.SyncLoop(context.Background(), log.NewNopLogger(), rl, rs, true, 0, 0, nil, prometheus.NewRegistry(),
+		loop.WithRunOnce(true),
+		loop.WithRequeueFailedOnce(0),
+		loop.WithSyncStatusWriter(w),
+	))
+	testutil.Equals(t, 2, rs.metricsRulesCnt)
+	// The status is written both for the failed sync and its retry.
+	testutil.Equals(t, 2, len(w.statuses["test"]))
+	testutil.NotOk(t, w.statuses["test"][0])
+	testutil.Ok(t, w.statuses["test"][1])
+}
+
+type countingRulesLoader struct {
+	testRulesLoader
+	lokiAlertingFetches  int
+	lokiRecordingFetches int
+}
+
+func (r *countingRulesLoader) GetLokiAlertingRules() ([]lokiv1.AlertingRule, error) {
+	r.lokiAlertingFetches++
+	return nil, nil
+}
+
+func (r *countingRulesLoader) GetLokiRecordingRules() ([]lokiv1.RecordingRule, error) {
+	r.lokiRecordingFetches++
+	return nil, nil
+}
+
+func TestSyncLoopLokiRuleTypes(t *testing.T) {
+	for _, tc := range []struct {
+		name                string
+		alerting, recording bool
+	}{
+		{name: "both", alerting: true, recording: true},
+		{name: "alerting only", alerting: true},
+		{name: "recording only", recording: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rl := &countingRulesLoader{}
+			rs := &testRulesSyncer{}
+
+			testutil.Ok(t, loop.SyncLoop(context.Background(), log.NewNopLogger(), rl, rs, true, 0, 0, nil, prometheus.NewRegistry(), loop.WithRunOnce(true), loop.WithLokiRuleTypes(tc.alerting, tc.recording)))
+
+			want := func(enabled bool) int {
+				if enabled {
+					return 1
+				}
+				return 0
+			}
+			testutil.Equals(t, want(tc.alerting), rl.lokiAlertingFetches)
+			testutil.Equals(t, want(tc.recording), rl.lokiRecordingFetches)
+			testutil.Equals(t, want(tc.alerting)+want(tc.recording), rs.logsRulesCnt)
+			testutil.Equals(t, 1, rs.metricsRulesCnt)
+		})
+	}
+}
+
+func TestSyncLoopConfigLastReloadTimestamp(t *testing.T) {
+	rl := &testRulesLoader{}
+	rs := &testRulesSyncer{}
+	reg := prometheus.NewRegistry()
+	reload := make(chan struct{}, 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- loop.SyncLoop(ctx, log.NewNopLogger(), rl, rs, false, 60, 60, reload, reg)
+	}()
+
+	lastReload := func() float64 {
+		mfs, err := reg.Gather()
+		testutil.Ok(t, err)
+		for _, mf := range mfs {
+			if mf.GetName() == "obsctl_reloader_config_last_reload_timestamp_seconds" {
+				return mf.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		return 0
+	}
+	waitAdvanced := func(prev float64) float64 {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if v := lastReload(); v > prev {
+				return v
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		t.Fatalf("last reload timestamp didn't advance past %v", prev)
+		return 0
+	}
+
+	testutil.Equals(t, 0.0, lastReload())
+
+	reload <- struct{}{}
+	first := waitAdvanced(0)
+	testutil.Assert(t, first >= float64(time.Now().Add(-time.Minute).Unix()), "expected a recent timestamp, got %v", first)
+
+	time.Sleep(10 * time.Millisecond)
+	reload <- struct{}{}
+	waitAdvanced(first)
+
+	cancel()
+	testutil.Ok(t, <-done)
+}
+
+func TestSyncLoopTotalRuleBytes(t *testing.T) {
+	rl := &partialRulesLoader{}
+	rs := &testRulesSyncer{}
+	reg := prometheus.NewRegistry()
+
+	testutil.Ok(t, loop.SyncLoop(context.Background(), log.NewNopLogger(), rl, rs, true, 0, 0, nil, reg, loop.WithRunOnce(true), loop.WithLokiRuleTypes(true, false)))
+
+	size := func(v interface{}) int {
+		b, err := yaml.Marshal(v)
+		testutil.Ok(t, err)
+		return len(b)
+	}
+	wantMetrics := size(monitoringv1.PrometheusRuleSpec{}) + size(monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{{Name: "YoloGroup"}}})
+	wantAlerting := size(lokiv1.AlertingRuleSpec{})
+
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(fmt.Sprintf(`
+# HELP obsctl_reloader_total_rule_bytes Total size in bytes of the YAML encoded rules synced in the last complete sync cycle, across all tenants.
+# TYPE obsctl_reloader_total_rule_bytes gauge
+obsctl_reloader_total_rule_bytes{type="logs_alerting"} %d
+obsctl_reloader_total_rule_bytes{type="logs_recording"} 0
+obsctl_reloader_total_rule_bytes{type="metrics"} %d
+`, wantAlerting, wantMetrics)), "obsctl_reloader_total_rule_bytes"))
+}
+
+func TestResolveNamespace(t *testing.T) {
+	dir := t.TempDir()
+	nsFile := filepath.Join(dir, "namespace")
+	testutil.Ok(t, os.WriteFile(nsFile, []byte("from-sa\n"), 0o600))
+	emptyFile := filepath.Join(dir, "empty")
+	testutil.Ok(t, os.WriteFile(emptyFile, nil, 0o600))
+
+	ns, err := resolveNamespace("from-env", nsFile)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "from-env", ns)
+
+	ns, err = resolveNamespace("", nsFile)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "from-sa", ns)
+
+	_, err = resolveNamespace("", emptyFile)
+	testutil.NotOk(t, err)
+
+	_, err = resolveNamespace("", filepath.Join(dir, "missing"))
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,130 @@
+// Package k8sretry wraps Kubernetes clients to retry requests throttled by the API server.
+package k8sretry
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/rhobs/obsctl-reloader/pkg/metricsprefix"
+)
+
+// maxBackoff caps the delay between retries, including delays suggested by the API server.
+const maxBackoff = time.Minute
+
+// Client is a client.Client which retries requests the API server rejects with 429 Too Many Requests, e.g. under
+// API Priority and Fairness in large clusters. It waits for the delay suggested by the API server's Retry-After header
+// if any, or an exponential backoff otherwise.
+type Client struct {
+	client.Client
+
+	logger    log.Logger
+	retries   int
+	backoff   time.Duration
+	throttled *prometheus.CounterVec
+}
+
+// Option configures optional behavior of Client.
+type Option func(c *options)
+
+type options struct {
+	metricsPrefix string
+}
+
+// WithMetricsPrefix sets the prefix of the names of the client's metrics, in place of metricsprefix.Default.
+func WithMetricsPrefix(prefix string) Option {
+	return func(o *options) {
+		o.metricsPrefix = prefix
+	}
+}
+
+// NewClient wraps c to retry throttled requests up to retries times, backing off exponentially starting at backoff.
+func NewClient(c client.Client, logger log.Logger, reg prometheus.Registerer, retries int, backoff time.Duration, opts ...Option) *Client {
+	return &Client{
+		Client:    c,
+		logger:    logger,
+		retries:   retries,
+		backoff:   backoff,
+		throttled: newThrottledCounter(reg, opts...),
+	}
+}
+
+// RegisterMetrics registers the metrics of a Client configured with opts with reg, without creating one, e.g. to check
+// for duplicate metrics at startup.
+func RegisterMetrics(reg prometheus.Registerer, opts ...Option) {
+	newThrottledCounter(reg, opts...)
+}
+
+func newThrottledCounter(reg prometheus.Registerer, opts ...Option) *prometheus.CounterVec {
+	opt := options{metricsPrefix: metricsprefix.Default}
+	for _, o := range opts {
+		o(&opt)
+	}
+
+	return promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: opt.metricsPrefix,
+		Name:      "k8s_throttled_total",
+		Help:      "Total number of Kubernetes API requests throttled by the API server, by verb.",
+	}, []string{"verb"})
+}
+
+// do calls f until it isn't throttled, retries are exhausted or ctx is done, returning the last error.
+func (c *Client) do(ctx context.Context, verb string, f func() error) error {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if !apierrors.IsTooManyRequests(err) {
+			return err
+		}
+		c.throttled.WithLabelValues(verb).Inc()
+		if attempt >= c.retries {
+			return err
+		}
+
+		delay := backoff
+		if seconds, ok := apierrors.SuggestsClientDelay(err); ok {
+			delay = time.Duration(seconds) * time.Second
+		}
+		if delay > maxBackoff {
+			delay = maxBackoff
+		}
+		level.Warn(c.logger).Log("msg", "kubernetes API request throttled, retrying", "verb", verb, "delay", delay, "attempt", attempt+1, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) Get(ctx context.Context, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+	return c.do(ctx, "get", func() error { return c.Client.Get(ctx, key, obj, opts...) })
+}
+
+func (c *Client) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	return c.do(ctx, "list", func() error { return c.Client.List(ctx, list, opts...) })
+}
+
+func (c *Client) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	return c.do(ctx, "create", func() error { return c.Client.Create(ctx, obj, opts...) })
+}
+
+func (c *Client) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	return c.do(ctx, "update", func() error { return c.Client.Update(ctx, obj, opts...) })
+}
+
+func (c *Client) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	return c.do(ctx, "patch", func() error { return c.Client.Patch(ctx, obj, patch, opts...) })
+}
+
+func (c *Client) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	return c.do(ctx, "delete", func() error { return c.Client.Delete(ctx, obj, opts...) })
+}
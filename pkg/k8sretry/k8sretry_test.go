@@ -0,0 +1,107 @@
+package k8sretry
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// throttlingClient rejects the first throttle List calls with 429 Too Many Requests.
+type throttlingClient struct {
+	client.Client
+	throttle   int
+	retryAfter int
+	calls      int
+}
+
+func (c *throttlingClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	c.calls++
+	if c.calls <= c.throttle {
+		return apierrors.NewTooManyRequests("throttled", c.retryAfter)
+	}
+	return c.Client.List(ctx, list, opts...)
+}
+
+func TestClientRetriesThrottledRequests(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		throttle   int
+		retryAfter int
+		wantErr    bool
+		wantCalls  int
+	}{
+		{name: "not throttled", wantCalls: 1},
+		{name: "throttled", throttle: 2, wantCalls: 3},
+		{name: "throttled with retry after", throttle: 1, retryAfter: 1, wantCalls: 2},
+		{name: "retries exhausted", throttle: 5, wantErr: true, wantCalls: 4},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			kc := &throttlingClient{
+				Client:     fake.NewClientBuilder().Build(),
+				throttle:   tc.throttle,
+				retryAfter: tc.retryAfter,
+			}
+			reg := prometheus.NewRegistry()
+			c := NewClient(kc, log.NewNopLogger(), reg, 3, time.Millisecond)
+
+			err := c.List(context.Background(), &corev1.SecretList{})
+			testutil.Equals(t, tc.wantErr, err != nil)
+			if tc.wantErr {
+				testutil.Assert(t, apierrors.IsTooManyRequests(err), "expected the throttling error, got %v", err)
+			}
+			testutil.Equals(t, tc.wantCalls, kc.calls)
+
+			throttled := tc.throttle
+			if throttled > tc.wantCalls {
+				throttled = tc.wantCalls
+			}
+			testutil.Equals(t, float64(throttled), promtestutil.ToFloat64(c.throttled.WithLabelValues("list")))
+		})
+	}
+}
+
+func TestClientRespectsContext(t *testing.T) {
+	kc := &throttlingClient{Client: fake.NewClientBuilder().Build(), throttle: 10}
+	c := NewClient(kc, log.NewNopLogger(), prometheus.NewRegistry(), 10, time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := c.List(ctx, &corev1.SecretList{})
+	testutil.Assert(t, apierrors.IsTooManyRequests(err), "expected the throttling error, got %v", err)
+	testutil.Assert(t, time.Since(start) < time.Second, "expected retries to stop when the context is done")
+	testutil.Equals(t, 1, kc.calls)
+}
+
+func TestClientDoesNotRetryOtherErrors(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	c := NewClient(fake.NewClientBuilder().Build(), log.NewNopLogger(), reg, 3, time.Millisecond)
+
+	err := c.Get(context.Background(), client.ObjectKey{Namespace: "test", Name: "missing"}, &corev1.Secret{})
+	testutil.Assert(t, apierrors.IsNotFound(err), "expected not found error, got %v", err)
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(""), "obsctl_reloader_k8s_throttled_total"))
+}
+
+func TestClientMetricsPrefix(t *testing.T) {
+	kc := &throttlingClient{Client: fake.NewClientBuilder().Build(), throttle: 1}
+	reg := prometheus.NewRegistry()
+	c := NewClient(kc, log.NewNopLogger(), reg, 3, time.Millisecond, WithMetricsPrefix("rules_sync"))
+
+	testutil.Ok(t, c.List(context.Background(), &corev1.SecretList{}))
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP rules_sync_k8s_throttled_total Total number of Kubernetes API requests throttled by the API server, by verb.
+# TYPE rules_sync_k8s_throttled_total counter
+rules_sync_k8s_throttled_total{verb="list"} 1
+`), "rules_sync_k8s_throttled_total", "obsctl_reloader_k8s_throttled_total"))
+}
@@ -0,0 +1,120 @@
+package loader
+
+import (
+	"strings"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log/level"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/rhobs/obsctl-reloader/pkg/syncer"
+)
+
+// tenantAllowedMetricPrefixesKeys are the tenant secret keys which can override the default allowed metric prefixes.
+// As with the other tenant secret keys, both the underscored and the dashed spelling are accepted.
+var tenantAllowedMetricPrefixesKeys = []string{"allowed_metric_prefixes", "allowed-metric-prefixes"}
+
+// loadTenantAllowedMetricPrefixes reads per-tenant overrides of the allowed metric prefixes from the
+// tenant secrets, i.e. secrets labeled with the tenant name, in the loader's namespace.
+func (k *KubeRulesLoader) loadTenantAllowedMetricPrefixes() error {
+	secrets := corev1.SecretList{}
+	if err := k.k8s.List(k.ctx, &secrets, client.InNamespace(k.namespace), client.HasLabels{"tenant"}); err != nil {
+		return errors.Wrap(err, "listing tenant secrets")
+	}
+
+	tenantPrefixes := map[string][]string{}
+	for _, s := range secrets.Items {
+		for _, key := range tenantAllowedMetricPrefixesKeys {
+			if v, ok := s.Data[key]; ok {
+				tenantPrefixes[s.Labels["tenant"]] = syncer.SplitList(string(v))
+			}
+		}
+	}
+
+	k.tenantAllowedMetricPrefixes = tenantPrefixes
+	return nil
+}
+
+// allowedMetricPrefixesFor returns the metric prefixes a tenant may use in rules.
+func (k *KubeRulesLoader) allowedMetricPrefixesFor(tenant string) []string {
+	if prefixes, ok := k.tenantAllowedMetricPrefixes[tenant]; ok {
+		return prefixes
+	}
+
+	return k.allowedMetricPrefixes
+}
+
+// filterDisallowedMetrics returns the groups without the rules referencing metrics the tenant isn't allowed to use.
+// Rules whose expression can't be parsed, or which select series without an exact metric name, are dropped too, as
+// they can't be checked.
+func (k *KubeRulesLoader) filterDisallowedMetrics(tenant string, groups []monitoringv1.RuleGroup) []monitoringv1.RuleGroup {
+	prefixes := k.allowedMetricPrefixesFor(tenant)
+
+	return filterRules(groups, func(g monitoringv1.RuleGroup, i int) bool {
+		r := g.Rules[i]
+		if err := checkMetricPrefixes(r.Expr.String(), prefixes); err != nil {
+			level.Warn(k.logger).Log("msg", "skipping rule referencing disallowed metrics", "tenant", tenant, "group", g.Name, "record", r.Record, "alert", r.Alert, "error", err)
+			k.disallowedMetricRules.WithLabelValues(k.tenantLabel(tenant)).Inc()
+			return false
+		}
+		return true
+	})
+}
+
+// checkMetricPrefixes returns an error if expr selects a metric not starting with any of the given prefixes.
+func checkMetricPrefixes(expr string, prefixes []string) error {
+	e, err := parser.ParseExpr(expr)
+	if err != nil {
+		return errors.Wrap(err, "parsing expression")
+	}
+
+	var checkErr error
+	parser.Inspect(e, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok || checkErr != nil {
+			return nil
+		}
+
+		name := selectorMetricName(vs)
+		if name == "" {
+			checkErr = errors.Newf("selector %s has no exact metric name", vs.String())
+			return nil
+		}
+
+		if !hasAnyPrefix(name, prefixes) {
+			checkErr = errors.Newf("metric %s is not allowed", name)
+		}
+		return nil
+	})
+
+	return checkErr
+}
+
+// selectorMetricName returns the exact metric name selected by vs, if any.
+func selectorMetricName(vs *parser.VectorSelector) string {
+	if vs.Name != "" {
+		return vs.Name
+	}
+
+	for _, m := range vs.LabelMatchers {
+		if m.Name == labels.MetricName && m.Type == labels.MatchEqual {
+			return m.Value
+		}
+	}
+
+	return ""
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,83 @@
+package loader
+
+import (
+	"strings"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log/level"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+)
+
+// RequiredAnnotationsAction defines how PrometheusRule alerts missing required annotations are handled.
+type RequiredAnnotationsAction string
+
+const (
+	// RequiredAnnotationsWarn logs a warning, but keeps the alert.
+	RequiredAnnotationsWarn RequiredAnnotationsAction = "warn"
+	// RequiredAnnotationsSkip drops the alert.
+	RequiredAnnotationsSkip RequiredAnnotationsAction = "skip"
+	// RequiredAnnotationsError rejects the whole PrometheusRule containing the alert.
+	RequiredAnnotationsError RequiredAnnotationsAction = "error"
+)
+
+// ParseRequiredAnnotationsAction returns the action with the given name.
+func ParseRequiredAnnotationsAction(s string) (RequiredAnnotationsAction, error) {
+	switch a := RequiredAnnotationsAction(s); a {
+	case RequiredAnnotationsWarn, RequiredAnnotationsSkip, RequiredAnnotationsError:
+		return a, nil
+	default:
+		return "", errors.Newf("unknown required annotations action %q", s)
+	}
+}
+
+// WithRequiredAlertAnnotations requires each PrometheusRule alert to have non-empty values for the given annotations,
+// e.g. summary and runbook_url. Alerts missing any of them are handled according to action.
+func WithRequiredAlertAnnotations(action RequiredAnnotationsAction, keys ...string) Option {
+	return func(k *KubeRulesLoader) {
+		k.requiredAnnotationsAction = action
+		k.requiredAlertAnnotations = keys
+	}
+}
+
+// missingAnnotations returns the required annotations the rule has no value for.
+func missingAnnotations(r monitoringv1.Rule, required []string) []string {
+	var missing []string
+	for _, key := range required {
+		if r.Annotations[key] == "" {
+			missing = append(missing, key)
+		}
+	}
+
+	return missing
+}
+
+// checkRequiredAnnotations returns the groups of pr with the alerts missing required annotations handled according to
+// the configured action, or false if pr is rejected.
+func (k *KubeRulesLoader) checkRequiredAnnotations(tenant string, pr *monitoringv1.PrometheusRule) ([]monitoringv1.RuleGroup, bool) {
+	rejected := false
+	groups := filterRules(pr.Spec.Groups, func(g monitoringv1.RuleGroup, i int) bool {
+		r := g.Rules[i]
+		if r.Alert == "" {
+			return true
+		}
+		missing := missingAnnotations(r, k.requiredAlertAnnotations)
+		if len(missing) == 0 {
+			return true
+		}
+
+		k.missingAnnotationRules.WithLabelValues(k.tenantLabel(tenant)).Inc()
+		switch k.requiredAnnotationsAction {
+		case RequiredAnnotationsSkip:
+			level.Warn(k.logger).Log("msg", "skipping alert missing required annotations", "name", pr.Name, "tenant", tenant, "group", g.Name, "alert", r.Alert, "missing", strings.Join(missing, ","))
+			return false
+		case RequiredAnnotationsError:
+			level.Error(k.logger).Log("msg", "rejecting prometheus rule with alert missing required annotations", "name", pr.Name, "tenant", tenant, "group", g.Name, "alert", r.Alert, "missing", strings.Join(missing, ","))
+			rejected = true
+		default:
+			level.Warn(k.logger).Log("msg", "alert missing required annotations", "name", pr.Name, "tenant", tenant, "group", g.Name, "alert", r.Alert, "missing", strings.Join(missing, ","))
+		}
+		return true
+	})
+
+	return groups, !rejected
+}
@@ -0,0 +1,65 @@
+package loader
+
+import (
+	"github.com/go-kit/log/level"
+	lokiv1 "github.com/grafana/loki/operator/apis/loki/v1"
+	lokiv1beta1 "github.com/grafana/loki/operator/apis/loki/v1beta1"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	prometheusRuleKind        = monitoringv1.SchemeGroupVersion.WithKind(monitoringv1.PrometheusRuleKind)
+	lokiAlertingRuleKind      = lokiv1.GroupVersion.WithKind("AlertingRule")
+	lokiRecordingRuleKind     = lokiv1.GroupVersion.WithKind("RecordingRule")
+	lokiAlertingRuleKindV1b1  = lokiv1beta1.GroupVersion.WithKind("AlertingRule")
+	lokiRecordingRuleKindV1b1 = lokiv1beta1.GroupVersion.WithKind("RecordingRule")
+)
+
+// ruleKinds are the kinds of rule objects KubeRulesLoader lists.
+var ruleKinds = []schema.GroupVersionKind{
+	prometheusRuleKind,
+	lokiAlertingRuleKind,
+	lokiAlertingRuleKindV1b1,
+	lokiRecordingRuleKind,
+	lokiRecordingRuleKindV1b1,
+}
+
+// WithCRDDiscovery checks which rule CRDs are installed when the loader is created, using mapper. Rule kinds whose CRD
+// isn't installed are never listed. If no version of a kind is installed, no tenant rule groups are returned for it,
+// rather than empty ones, so that syncing doesn't delete the tenants' existing rules.
+func WithCRDDiscovery(mapper meta.RESTMapper) Option {
+	return func(k *KubeRulesLoader) {
+		k.mapper = mapper
+	}
+}
+
+// discoverRuleKinds records the rule kinds whose CRD isn't installed, and exports the availability of each.
+func (k *KubeRulesLoader) discoverRuleKinds() {
+	k.unavailableKinds = map[schema.GroupVersionKind]struct{}{}
+	for _, gvk := range ruleKinds {
+		kind := gvk.Kind + "." + gvk.Version + "." + gvk.Group
+
+		_, err := k.mapper.RESTMapping(gvk.GroupKind(), gvk.Version)
+		switch {
+		case meta.IsNoMatchError(err):
+			level.Warn(k.logger).Log("msg", "rule CRD not installed, not loading rules of this kind", "kind", kind)
+			k.unavailableKinds[gvk] = struct{}{}
+			k.crdAvailable.WithLabelValues(kind).Set(0)
+		case err != nil:
+			// Discovery may fail transiently, so keep loading the kind rather than silently dropping rules.
+			level.Warn(k.logger).Log("msg", "checking rule CRD availability, assuming installed", "kind", kind, "error", err)
+			k.crdAvailable.WithLabelValues(kind).Set(1)
+		default:
+			level.Info(k.logger).Log("msg", "rule CRD installed", "kind", kind)
+			k.crdAvailable.WithLabelValues(kind).Set(1)
+		}
+	}
+}
+
+// kindAvailable returns false if the CRD of gvk was found not to be installed.
+func (k *KubeRulesLoader) kindAvailable(gvk schema.GroupVersionKind) bool {
+	_, unavailable := k.unavailableKinds[gvk]
+	return !unavailable
+}
@@ -0,0 +1,31 @@
+package loader
+
+import (
+	"reflect"
+
+	"github.com/go-kit/log/level"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"golang.org/x/exp/slices"
+)
+
+// WithDedupRules removes PrometheusRule rules identical to a previous rule of the same group, e.g. duplicated by
+// accident. Only exact duplicates are removed; rules of the same name differing in any field are kept.
+func WithDedupRules(enabled bool) Option {
+	return func(k *KubeRulesLoader) {
+		k.dedupRules = enabled
+	}
+}
+
+// removeDuplicateRules returns a copy of groups where rules identical to a previous rule of the same group are removed.
+func (k *KubeRulesLoader) removeDuplicateRules(tenant string, groups []monitoringv1.RuleGroup) []monitoringv1.RuleGroup {
+	return filterRules(groups, func(g monitoringv1.RuleGroup, i int) bool {
+		r := g.Rules[i]
+		if slices.IndexFunc(g.Rules[:i], func(e monitoringv1.Rule) bool { return reflect.DeepEqual(e, r) }) == -1 {
+			return true
+		}
+
+		level.Warn(k.logger).Log("msg", "removing duplicate rule", "tenant", tenant, "group", g.Name, "record", r.Record, "alert", r.Alert)
+		k.duplicateRules.WithLabelValues(k.tenantLabel(tenant)).Inc()
+		return false
+	})
+}
@@ -0,0 +1,83 @@
+package loader
+
+import (
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log/level"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// WithBannedPromQLFunctions skips PrometheusRule rules whose expression calls any of the given PromQL functions or
+// aggregation operators, e.g. absent_over_time or topk, which platform operators consider too expensive.
+func WithBannedPromQLFunctions(names ...string) Option {
+	return func(k *KubeRulesLoader) {
+		k.bannedFunctions = make(map[string]struct{}, len(names))
+		for _, n := range names {
+			k.bannedFunctions[n] = struct{}{}
+		}
+	}
+}
+
+// IsPromQLFunction returns true if name is a PromQL function or aggregation operator, which can be banned.
+func IsPromQLFunction(name string) bool {
+	if _, ok := parser.Functions[name]; ok {
+		return true
+	}
+	for typ, s := range parser.ItemTypeStr {
+		if typ.IsAggregator() && s == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterBannedFunctions returns the groups without the rules calling banned functions. Rules whose expression can't
+// be parsed are dropped too, as they can't be checked. Groups are returned as is if no functions are banned.
+func (k *KubeRulesLoader) filterBannedFunctions(tenant string, groups []monitoringv1.RuleGroup) []monitoringv1.RuleGroup {
+	if len(k.bannedFunctions) == 0 {
+		return groups
+	}
+
+	return filterRules(groups, func(g monitoringv1.RuleGroup, i int) bool {
+		r := g.Rules[i]
+		if err := checkBannedFunctions(r.Expr.String(), k.bannedFunctions); err != nil {
+			level.Warn(k.logger).Log("msg", "skipping rule calling banned functions", "tenant", tenant, "group", g.Name, "record", r.Record, "alert", r.Alert, "error", err)
+			k.bannedFunctionRules.WithLabelValues(k.tenantLabel(tenant)).Inc()
+			return false
+		}
+		return true
+	})
+}
+
+// checkBannedFunctions returns an error if expr calls any of the banned functions.
+func checkBannedFunctions(expr string, banned map[string]struct{}) error {
+	e, err := parser.ParseExpr(expr)
+	if err != nil {
+		return errors.Wrap(err, "parsing expression")
+	}
+
+	var checkErr error
+	parser.Inspect(e, func(node parser.Node, _ []parser.Node) error {
+		if checkErr != nil {
+			return nil
+		}
+
+		var name string
+		switch n := node.(type) {
+		case *parser.Call:
+			name = n.Func.Name
+		case *parser.AggregateExpr:
+			name = n.Op.String()
+		default:
+			return nil
+		}
+
+		if _, ok := banned[name]; ok {
+			checkErr = errors.Newf("function %s is banned", name)
+		}
+		return nil
+	})
+
+	return checkErr
+}
@@ -0,0 +1,183 @@
+package loader
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	lokiv1 "github.com/grafana/loki/operator/apis/loki/v1"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+var _ RulesLoader = &GitRulesLoader{}
+
+// GitSource configures the Git repository GitRulesLoader reads rules from.
+type GitSource struct {
+	// Repo is the URL of the repository, as understood by git clone.
+	Repo string
+	// Branch is the branch to check out.
+	Branch string
+	// Path is the directory of the repository holding one subdirectory of rule files per tenant.
+	Path string
+	// PullInterval is the minimum interval between pulls of the repository.
+	PullInterval time.Duration
+	// CheckoutDir is the local directory the repository is cloned into.
+	CheckoutDir string
+}
+
+// GitRulesLoader implements RulesLoader interface, and loads Prometheus rules from a Git repository. Rule files are
+// read from <Path>/<tenant>/*.yaml (or *.yml), each holding rule groups in the Prometheus rule file format. Loki rules
+// are not supported, so none are ever loaded.
+//
+// Rules are filtered by tenant the same way as with KubeRulesLoader, and the same options apply.
+type GitRulesLoader struct {
+	*KubeRulesLoader
+
+	src      GitSource
+	lastPull time.Time
+	now      func() time.Time
+}
+
+func NewGitRulesLoader(
+	ctx context.Context,
+	kc client.Client,
+	logger log.Logger,
+	namespace string,
+	managedTenants string,
+	src GitSource,
+	reg prometheus.Registerer,
+	opts ...Option,
+) *GitRulesLoader {
+	return &GitRulesLoader{
+		KubeRulesLoader: NewKubeRulesLoader(ctx, kc, logger, namespace, managedTenants, reg, opts...),
+		src:             src,
+		now:             time.Now,
+	}
+}
+
+func (g *GitRulesLoader) GetLokiAlertingRules() ([]lokiv1.AlertingRule, error) {
+	return nil, nil
+}
+
+func (g *GitRulesLoader) GetLokiRecordingRules() ([]lokiv1.RecordingRule, error) {
+	return nil, nil
+}
+
+// GetPrometheusRules pulls the repository, if the pull interval elapsed since the last pull, and returns the rules of
+// each tenant directory as a PrometheusRule labeled with the tenant.
+func (g *GitRulesLoader) GetPrometheusRules() ([]*monitoringv1.PrometheusRule, error) {
+	if err := g.pull(); err != nil {
+		g.promRuleFetchFailures.Inc()
+		return nil, errors.Wrap(err, "pulling rules repository")
+	}
+
+	if g.metricAllowlistEnabled && g.k8s != nil {
+		if err := g.loadTenantAllowedMetricPrefixes(); err != nil {
+			g.promRuleFetchFailures.Inc()
+			return nil, errors.Wrap(err, "loading tenant allowed metric prefixes")
+		}
+	}
+
+	rules, err := g.readRules()
+	if err != nil {
+		g.promRuleFetchFailures.Inc()
+		return nil, errors.Wrap(err, "reading rule files")
+	}
+
+	g.promRuleFetches.Inc()
+	return rules, nil
+}
+
+// pull clones the repository on first use, and fetches the latest commit of the branch afterwards.
+func (g *GitRulesLoader) pull() error {
+	if !g.lastPull.IsZero() && g.now().Sub(g.lastPull) < g.src.PullInterval {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(g.src.CheckoutDir, ".git")); os.IsNotExist(err) {
+		if err := g.git("", "clone", "--depth", "1", "--branch", g.src.Branch, "--", g.src.Repo, g.src.CheckoutDir); err != nil {
+			return err
+		}
+	} else {
+		if err := g.git(g.src.CheckoutDir, "fetch", "--depth", "1", "origin", g.src.Branch); err != nil {
+			return err
+		}
+		if err := g.git(g.src.CheckoutDir, "reset", "--hard", "FETCH_HEAD"); err != nil {
+			return err
+		}
+	}
+
+	level.Debug(g.logger).Log("msg", "pulled rules repository", "repo", g.src.Repo, "branch", g.src.Branch)
+	g.lastPull = g.now()
+	return nil
+}
+
+func (g *GitRulesLoader) git(dir string, args ...string) error {
+	cmd := exec.CommandContext(g.ctx, "git", args...)
+	cmd.Dir = dir
+	// Never block on credential prompts.
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "git %s: %s", args[0], strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// readRules reads the rule files of each tenant directory, in lexical order.
+func (g *GitRulesLoader) readRules() ([]*monitoringv1.PrometheusRule, error) {
+	root := filepath.Join(g.src.CheckoutDir, g.src.Path)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []*monitoringv1.PrometheusRule
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+
+		tenant := e.Name()
+		files, err := filepath.Glob(filepath.Join(root, tenant, "*.y*ml"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+
+		for _, f := range files {
+			b, err := os.ReadFile(f)
+			if err != nil {
+				return nil, err
+			}
+
+			spec := monitoringv1.PrometheusRuleSpec{}
+			if err := yaml.UnmarshalStrict(b, &spec); err != nil {
+				return nil, errors.Wrapf(err, "parsing rule file %s", f)
+			}
+
+			rel, _ := filepath.Rel(root, f)
+			rules = append(rules, &monitoringv1.PrometheusRule{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   rel,
+					Labels: map[string]string{"tenant": tenant},
+				},
+				Spec: spec,
+			})
+		}
+	}
+
+	return rules, nil
+}
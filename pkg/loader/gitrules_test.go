@@ -0,0 +1,127 @@
+package loader
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// gitFixture is a local Git repository with rule files.
+type gitFixture struct {
+	t   *testing.T
+	dir string
+}
+
+func newGitFixture(t *testing.T) *gitFixture {
+	t.Helper()
+
+	f := &gitFixture{t: t, dir: t.TempDir()}
+	f.git("init", "--initial-branch", "main")
+	f.git("config", "user.name", "test")
+	f.git("config", "user.email", "test@example.com")
+	return f
+}
+
+func (f *gitFixture) git(args ...string) {
+	f.t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = f.dir
+	out, err := cmd.CombinedOutput()
+	testutil.Ok(f.t, err, string(out))
+}
+
+func (f *gitFixture) commit(files map[string]string) {
+	f.t.Helper()
+
+	for name, content := range files {
+		p := filepath.Join(f.dir, name)
+		testutil.Ok(f.t, os.MkdirAll(filepath.Dir(p), 0o755))
+		testutil.Ok(f.t, os.WriteFile(p, []byte(content), 0o600))
+	}
+	f.git("add", "-A")
+	f.git("commit", "-m", "update rules")
+}
+
+func TestGitRulesLoader(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	repo := newGitFixture(t)
+	repo.commit(map[string]string{
+		"rules/test/recording.yaml": `groups:
+- name: TestGroup
+  interval: 30s
+  rules:
+  - record: TestRecordingRule
+    expr: vector(1)
+`,
+		"rules/unmanaged/recording.yaml": `groups:
+- name: UnmanagedGroup
+  rules:
+  - record: UnmanagedRecordingRule
+    expr: vector(1)
+`,
+		"README.md": "Rules per tenant.",
+	})
+
+	now := time.Now()
+	g := NewGitRulesLoader(context.TODO(), nil, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test", GitSource{
+		Repo:         "file://" + repo.dir,
+		Branch:       "main",
+		Path:         "rules",
+		PullInterval: time.Minute,
+		CheckoutDir:  filepath.Join(t.TempDir(), "checkout"),
+	}, prometheus.NewRegistry())
+	g.now = func() time.Time { return now }
+
+	recording := monitoringv1.Rule{Record: "TestRecordingRule", Expr: intstr.FromString("vector(1)")}
+	alerting := monitoringv1.Rule{Alert: "TestAlertingRule", Expr: intstr.FromString("vector(1) > 0"), For: "5m"}
+
+	rules, err := g.GetPrometheusRules()
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{
+		"test": {Groups: []monitoringv1.RuleGroup{{Name: "TestGroup", Interval: "30s", Rules: []monitoringv1.Rule{recording}}}},
+	}, g.GetTenantMetricsRuleGroups(rules))
+
+	repo.commit(map[string]string{
+		"rules/test/alerting.yml": `groups:
+- name: AlertingGroup
+  rules:
+  - alert: TestAlertingRule
+    expr: vector(1) > 0
+    for: 5m
+`,
+	})
+
+	// Changes are only pulled once the pull interval elapsed.
+	rules, err = g.GetPrometheusRules()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(g.GetTenantMetricsRuleGroups(rules)["test"].Groups))
+
+	now = now.Add(time.Minute)
+	rules, err = g.GetPrometheusRules()
+	testutil.Ok(t, err)
+	testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{
+		"test": {Groups: []monitoringv1.RuleGroup{
+			{Name: "AlertingGroup", Rules: []monitoringv1.Rule{alerting}},
+			{Name: "TestGroup", Interval: "30s", Rules: []monitoringv1.Rule{recording}},
+		}},
+	}, g.GetTenantMetricsRuleGroups(rules))
+
+	// Invalid rule files fail loading.
+	repo.commit(map[string]string{"rules/test/invalid.yaml": "groups: {}"})
+	now = now.Add(time.Minute)
+	_, err = g.GetPrometheusRules()
+	testutil.NotOk(t, err)
+}
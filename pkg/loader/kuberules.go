@@ -2,7 +2,10 @@ package loader
 
 import (
 	"context"
+	"reflect"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/efficientgo/core/errors"
 	"github.com/go-kit/log"
@@ -12,7 +15,17 @@ import (
 	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
+	"golang.org/x/exp/slices"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/rhobs/obsctl-reloader/pkg/metricsprefix"
+	"github.com/rhobs/obsctl-reloader/pkg/syncer"
+	"github.com/rhobs/obsctl-reloader/pkg/tenantlabel"
 )
 
 var _ RulesLoader = &KubeRulesLoader{}
@@ -26,12 +39,139 @@ type KubeRulesLoader struct {
 	namespace      string
 	managedTenants string
 
-	promRuleFetches       prometheus.Counter
-	promRuleFetchFailures prometheus.Counter
-	lokiRuleFetches       *prometheus.CounterVec
-	lokiRuleFetchFailures *prometheus.CounterVec
-	lokiTenantRules       *prometheus.GaugeVec
-	promTenantRules       *prometheus.GaugeVec
+	strictTenantMatch    bool
+	mergeSameNameGroups  bool
+	dedupRules           bool
+	sanitizeTenantLabels bool
+	metricsPrefix        string
+
+	lokiVersionConflictPolicy LokiVersionConflictPolicy
+	lokiNamespaces            lokiNamespaces
+	lokiRuleSelector          labels.Selector
+
+	mapper           meta.RESTMapper
+	unavailableKinds map[schema.GroupVersionKind]struct{}
+
+	metricAllowlistEnabled      bool
+	allowedMetricPrefixes       []string
+	tenantAllowedMetricPrefixes map[string][]string
+
+	bannedFunctions map[string]struct{}
+
+	checkRecordingRuleReferences bool
+
+	syncSources *syncSources
+
+	// convertAlertingRule and convertRecordingRule convert Loki v1beta1 rules to v1, and are only replaced in tests.
+	convertAlertingRule  func(src *lokiv1beta1.AlertingRule, dst *lokiv1.AlertingRule) error
+	convertRecordingRule func(src *lokiv1beta1.RecordingRule, dst *lokiv1.RecordingRule) error
+
+	requiredAlertAnnotations  []string
+	requiredAnnotationsAction RequiredAnnotationsAction
+
+	promRuleFetches        prometheus.Counter
+	promRuleFetchFailures  prometheus.Counter
+	lokiRuleFetches        *prometheus.CounterVec
+	lokiRuleFetchFailures  *prometheus.CounterVec
+	lokiConversionFailures *prometheus.CounterVec
+	lokiTenantRules        *prometheus.GaugeVec
+	promTenantRules        *prometheus.GaugeVec
+	unmanagedTenantRules   *prometheus.CounterVec
+	disallowedMetricRules  *prometheus.CounterVec
+	bannedFunctionRules    *prometheus.CounterVec
+	missingAnnotationRules *prometheus.CounterVec
+	duplicateRules         *prometheus.CounterVec
+	danglingReferenceRules *prometheus.GaugeVec
+	ruleGroupIntervals     *prometheus.HistogramVec
+	crdAvailable           *prometheus.GaugeVec
+}
+
+// Option configures optional behavior of KubeRulesLoader.
+type Option func(k *KubeRulesLoader)
+
+// WithStrictTenantMatch makes PrometheusRules whose tenant label doesn't match any managed tenant
+// count as failures and get logged at error level, instead of being skipped silently.
+func WithStrictTenantMatch(enabled bool) Option {
+	return func(k *KubeRulesLoader) {
+		k.strictTenantMatch = enabled
+	}
+}
+
+// WithMergeSameNameGroups merges the rules of identically named PrometheusRule groups of a tenant
+// into a single group, dropping exact duplicate rules.
+func WithMergeSameNameGroups(enabled bool) Option {
+	return func(k *KubeRulesLoader) {
+		k.mergeSameNameGroups = enabled
+	}
+}
+
+// WithSanitizedTenantLabels sanitizes the tenant label values of the loader's metrics with tenantlabel.Sanitize.
+func WithSanitizedTenantLabels(enabled bool) Option {
+	return func(k *KubeRulesLoader) {
+		k.sanitizeTenantLabels = enabled
+	}
+}
+
+// WithMetricsPrefix sets the prefix of the names of the loader's metrics, in place of metricsprefix.Default.
+func WithMetricsPrefix(prefix string) Option {
+	return func(k *KubeRulesLoader) {
+		k.metricsPrefix = prefix
+	}
+}
+
+// LokiVersionConflictPolicy defines how Loki rules defined with the same namespace and name in both
+// v1 and v1beta1 are handled.
+type LokiVersionConflictPolicy string
+
+const (
+	LokiVersionConflictPreferV1      LokiVersionConflictPolicy = "prefer-v1"
+	LokiVersionConflictPreferV1beta1 LokiVersionConflictPolicy = "prefer-v1beta1"
+	LokiVersionConflictError         LokiVersionConflictPolicy = "error"
+)
+
+// ParseLokiVersionConflictPolicy returns the policy with the given name.
+func ParseLokiVersionConflictPolicy(s string) (LokiVersionConflictPolicy, error) {
+	switch p := LokiVersionConflictPolicy(s); p {
+	case LokiVersionConflictPreferV1, LokiVersionConflictPreferV1beta1, LokiVersionConflictError:
+		return p, nil
+	default:
+		return "", errors.Newf("unknown loki version conflict policy %q", s)
+	}
+}
+
+// WithLokiVersionConflictPolicy sets how Loki rules defined in both v1 and v1beta1 are handled.
+// Defaults to LokiVersionConflictPreferV1.
+func WithLokiVersionConflictPolicy(policy LokiVersionConflictPolicy) Option {
+	return func(k *KubeRulesLoader) {
+		k.lokiVersionConflictPolicy = policy
+	}
+}
+
+// WithLokiRuleSelector only loads Loki AlertingRules and RecordingRules matching selector, e.g. those labeled for
+// consumption by an operator. All of them are loaded by default.
+func WithLokiRuleSelector(selector labels.Selector) Option {
+	return func(k *KubeRulesLoader) {
+		k.lokiRuleSelector = selector
+	}
+}
+
+// lokiRuleListOptions returns the options to list Loki rules with.
+func (k *KubeRulesLoader) lokiRuleListOptions() []client.ListOption {
+	opts := []client.ListOption{client.InNamespace(k.namespace)}
+	if k.lokiRuleSelector != nil {
+		opts = append(opts, client.MatchingLabelsSelector{Selector: k.lokiRuleSelector})
+	}
+	return opts
+}
+
+// WithAllowedMetricPrefixes skips PrometheusRule rules whose expression selects metrics not starting with
+// any of the given prefixes. Tenants can override the prefixes with the allowed_metric_prefixes key of their
+// secret, as a comma-separated list.
+func WithAllowedMetricPrefixes(prefixes ...string) Option {
+	return func(k *KubeRulesLoader) {
+		k.metricAllowlistEnabled = true
+		k.allowedMetricPrefixes = prefixes
+	}
 }
 
 func NewKubeRulesLoader(
@@ -41,100 +181,206 @@ func NewKubeRulesLoader(
 	namespace string,
 	managedTenants string,
 	reg prometheus.Registerer,
+	opts ...Option,
 ) *KubeRulesLoader {
-	return &KubeRulesLoader{
+	k := &KubeRulesLoader{
 		ctx:            ctx,
 		k8s:            kc,
 		logger:         logger,
 		namespace:      namespace,
 		managedTenants: managedTenants,
+		metricsPrefix:  metricsprefix.Default,
 
-		promRuleFetches: promauto.With(reg).NewCounter(prometheus.CounterOpts{
-			Name: "obsctl_reloader_prom_rule_fetches_total",
-			Help: "Total number of list operations for monitoringv1 PrometheusRules.",
-		}),
-		promRuleFetchFailures: promauto.With(reg).NewCounter(prometheus.CounterOpts{
-			Name: "obsctl_reloader_prom_rule_fetch_failures_total",
-			Help: "Total number of failed list operations for monitoringv1 PrometheusRules.",
-		}),
-		lokiRuleFetches: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
-			Name: "obsctl_reloader_loki_rule_fetches_total",
-			Help: "Total number of list operations for lokiv1/v1beta1 rules.",
-		}, []string{"type"}),
-		lokiRuleFetchFailures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
-			Name: "obsctl_reloader_loki_rule_fetch_failures_total",
-			Help: "Total number of failed list operations for lokiv1/v1beta1 rules.",
-		}, []string{"type"}),
-
-		lokiTenantRules: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
-			Name: "obsctl_reloader_loki_tenant_rulegroups",
-			Help: "Number of Loki rules loaded per tenant.",
-		}, []string{"type", "tenant"}),
-		promTenantRules: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
-			Name: "obsctl_reloader_prom_tenant_rulegroups",
-			Help: "Number of Prometheus rules loaded per tenant.",
-		}, []string{"tenant"}),
+		lokiVersionConflictPolicy: LokiVersionConflictPreferV1,
+
+		convertAlertingRule:  func(src *lokiv1beta1.AlertingRule, dst *lokiv1.AlertingRule) error { return src.ConvertTo(dst) },
+		convertRecordingRule: func(src *lokiv1beta1.RecordingRule, dst *lokiv1.RecordingRule) error { return src.ConvertTo(dst) },
+	}
+
+	for _, opt := range opts {
+		opt(k)
+	}
+
+	k.registerMetrics(reg)
+	if k.mapper != nil {
+		k.discoverRuleKinds()
+	}
+
+	return k
+}
+
+// RegisterMetrics registers the metrics of a KubeRulesLoader configured with opts with reg, without creating one, e.g.
+// to check for duplicate metrics at startup. GitRulesLoader and StatusCRDRulesLoader register the same metrics.
+func RegisterMetrics(reg prometheus.Registerer, opts ...Option) {
+	k := &KubeRulesLoader{metricsPrefix: metricsprefix.Default}
+	for _, opt := range opts {
+		opt(k)
+	}
+	k.registerMetrics(reg)
+}
+
+func (k *KubeRulesLoader) registerMetrics(reg prometheus.Registerer) {
+	k.promRuleFetches = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "prom_rule_fetches_total",
+		Help:      "Total number of list operations for monitoringv1 PrometheusRules.",
+	})
+	k.promRuleFetchFailures = promauto.With(reg).NewCounter(prometheus.CounterOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "prom_rule_fetch_failures_total",
+		Help:      "Total number of failed list operations for monitoringv1 PrometheusRules.",
+	})
+	k.lokiRuleFetches = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "loki_rule_fetches_total",
+		Help:      "Total number of list operations for lokiv1/v1beta1 rules.",
+	}, []string{"type"})
+	k.lokiRuleFetchFailures = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "loki_rule_fetch_failures_total",
+		Help:      "Total number of failed list operations for lokiv1/v1beta1 rules.",
+	}, []string{"type"})
+	k.lokiConversionFailures = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "loki_conversion_failures_total",
+		Help:      "Total number of lokiv1beta1 rules skipped for failing to convert to lokiv1.",
+	}, []string{"type"})
+
+	k.lokiTenantRules = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "loki_tenant_rulegroups",
+		Help:      "Number of Loki rules loaded per tenant.",
+	}, []string{"type", "tenant"})
+	k.promTenantRules = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "prom_tenant_rulegroups",
+		Help:      "Number of Prometheus rules loaded per tenant. Groups with both alerting and recording rules count for both types.",
+	}, []string{"type", "tenant"})
+	k.unmanagedTenantRules = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "prom_rule_unmanaged_tenant_total",
+		Help:      "Total number of PrometheusRules loaded with a tenant label not matching any managed tenant, when strict tenant matching is enabled.",
+	}, []string{"tenant"})
+	k.disallowedMetricRules = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "prom_rule_disallowed_metrics_total",
+		Help:      "Total number of Prometheus rules skipped for referencing metrics the tenant isn't allowed to use.",
+	}, []string{"tenant"})
+	k.bannedFunctionRules = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "prom_rule_banned_functions_total",
+		Help:      "Total number of Prometheus rules skipped for calling banned PromQL functions.",
+	}, []string{"tenant"})
+	k.missingAnnotationRules = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "prom_rule_missing_annotations_total",
+		Help:      "Total number of Prometheus alerts loaded without some of the required annotations.",
+	}, []string{"tenant"})
+	k.duplicateRules = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "prom_rule_duplicates_removed_total",
+		Help:      "Total number of Prometheus rules removed for being identical to another rule of the same group.",
+	}, []string{"tenant"})
+	k.ruleGroupIntervals = promauto.With(reg).NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "rule_group_interval_seconds",
+		Help:      "Evaluation intervals of the Prometheus rule groups loaded per tenant. Groups without an interval count with the default one.",
+		Buckets:   []float64{10, 15, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"tenant"})
+	k.danglingReferenceRules = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: k.metricsPrefix,
+		Name:      "prom_rule_dangling_recording_rule_references",
+		Help:      "Number of loaded Prometheus alerts of a tenant referencing recording rules which none of the tenant's rules record.",
+	}, []string{"tenant"})
+	if k.mapper != nil {
+		k.crdAvailable = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: k.metricsPrefix,
+			Name:      "crd_available",
+			Help:      "Whether the CRD of a rule kind is installed; 1 if it is, 0 otherwise.",
+		}, []string{"kind"})
 	}
 }
 
 func (k *KubeRulesLoader) GetLokiAlertingRules() ([]lokiv1.AlertingRule, error) {
 	arV1Beta1 := lokiv1beta1.AlertingRuleList{}
-	if err := k.k8s.List(k.ctx, &arV1Beta1, client.InNamespace(k.namespace)); err != nil {
-		k.lokiRuleFetchFailures.WithLabelValues("alerting").Inc()
-		return nil, errors.Wrap(err, "listing loki alerting rule v1beta1 objects")
+	if k.kindAvailable(lokiAlertingRuleKindV1b1) {
+		if err := k.k8s.List(k.ctx, &arV1Beta1, k.lokiRuleListOptions()...); err != nil {
+			k.lokiRuleFetchFailures.WithLabelValues("alerting").Inc()
+			return nil, errors.Wrap(err, "listing loki alerting rule v1beta1 objects")
+		}
 	}
 
 	arV1 := lokiv1.AlertingRuleList{}
-	if err := k.k8s.List(k.ctx, &arV1, client.InNamespace(k.namespace)); err != nil {
-		k.lokiRuleFetchFailures.WithLabelValues("alerting").Inc()
-		return nil, errors.Wrap(err, "listing loki alerting rule v1 objects")
+	if k.kindAvailable(lokiAlertingRuleKind) {
+		if err := k.k8s.List(k.ctx, &arV1, k.lokiRuleListOptions()...); err != nil {
+			k.lokiRuleFetchFailures.WithLabelValues("alerting").Inc()
+			return nil, errors.Wrap(err, "listing loki alerting rule v1 objects")
+		}
 	}
 
-	for _, ar := range arV1Beta1.Items {
-		v1 := lokiv1.AlertingRule{}
-		if err := ar.ConvertTo(&v1); err != nil {
-			return nil, errors.Wrap(err, "converting loki v1beta1 to v1")
-		}
+	converted := convertLokiRules(k, "alerting", arV1Beta1.Items, k.convertAlertingRule, func(r lokiv1beta1.AlertingRule) types.NamespacedName {
+		return types.NamespacedName{Namespace: r.Namespace, Name: r.Name}
+	})
 
-		arV1.Items = append(arV1.Items, v1)
+	rules, err := resolveLokiVersionConflicts(k.lokiVersionConflictPolicy, arV1.Items, converted, func(r lokiv1.AlertingRule) types.NamespacedName {
+		return types.NamespacedName{Namespace: r.Namespace, Name: r.Name}
+	})
+	if err != nil {
+		k.lokiRuleFetchFailures.WithLabelValues("alerting").Inc()
+		return nil, errors.Wrap(err, "resolving loki alerting rule version conflicts")
 	}
 
 	k.lokiRuleFetches.WithLabelValues("alerting").Inc()
-	return arV1.Items, nil
+	return rules, nil
 }
 
 func (k *KubeRulesLoader) GetLokiRecordingRules() ([]lokiv1.RecordingRule, error) {
 	rrV1Beta1 := lokiv1beta1.RecordingRuleList{}
-	if err := k.k8s.List(k.ctx, &rrV1Beta1, client.InNamespace(k.namespace)); err != nil {
-		k.lokiRuleFetchFailures.WithLabelValues("recording").Inc()
-		return nil, errors.Wrap(err, "listing loki recording rule v1beta1 objects")
+	if k.kindAvailable(lokiRecordingRuleKindV1b1) {
+		if err := k.k8s.List(k.ctx, &rrV1Beta1, k.lokiRuleListOptions()...); err != nil {
+			k.lokiRuleFetchFailures.WithLabelValues("recording").Inc()
+			return nil, errors.Wrap(err, "listing loki recording rule v1beta1 objects")
+		}
 	}
 
 	rrV1 := lokiv1.RecordingRuleList{}
-	if err := k.k8s.List(k.ctx, &rrV1, client.InNamespace(k.namespace)); err != nil {
-		k.lokiRuleFetchFailures.WithLabelValues("recording").Inc()
-		return nil, errors.Wrap(err, "listing loki recording rule v1 objects")
+	if k.kindAvailable(lokiRecordingRuleKind) {
+		if err := k.k8s.List(k.ctx, &rrV1, k.lokiRuleListOptions()...); err != nil {
+			k.lokiRuleFetchFailures.WithLabelValues("recording").Inc()
+			return nil, errors.Wrap(err, "listing loki recording rule v1 objects")
+		}
 	}
 
-	for _, ar := range rrV1Beta1.Items {
-		v1 := lokiv1.RecordingRule{}
-		if err := ar.ConvertTo(&v1); err != nil {
-			return nil, errors.Wrap(err, "converting loki v1beta1 to v1")
-		}
+	converted := convertLokiRules(k, "recording", rrV1Beta1.Items, k.convertRecordingRule, func(r lokiv1beta1.RecordingRule) types.NamespacedName {
+		return types.NamespacedName{Namespace: r.Namespace, Name: r.Name}
+	})
 
-		rrV1.Items = append(rrV1.Items, v1)
+	rules, err := resolveLokiVersionConflicts(k.lokiVersionConflictPolicy, rrV1.Items, converted, func(r lokiv1.RecordingRule) types.NamespacedName {
+		return types.NamespacedName{Namespace: r.Namespace, Name: r.Name}
+	})
+	if err != nil {
+		k.lokiRuleFetchFailures.WithLabelValues("recording").Inc()
+		return nil, errors.Wrap(err, "resolving loki recording rule version conflicts")
 	}
 
 	k.lokiRuleFetches.WithLabelValues("recording").Inc()
-	return rrV1.Items, nil
+	return rules, nil
 }
 
 func (k *KubeRulesLoader) GetPrometheusRules() ([]*monitoringv1.PrometheusRule, error) {
 	prometheusRules := monitoringv1.PrometheusRuleList{}
-	err := k.k8s.List(k.ctx, &prometheusRules, client.InNamespace(k.namespace))
-	if err != nil {
-		k.promRuleFetchFailures.Inc()
-		return nil, errors.Wrap(err, "listing prometheus rule objects")
+	if k.kindAvailable(prometheusRuleKind) {
+		if err := k.k8s.List(k.ctx, &prometheusRules, client.InNamespace(k.namespace)); err != nil {
+			k.promRuleFetchFailures.Inc()
+			return nil, errors.Wrap(err, "listing prometheus rule objects")
+		}
+	}
+
+	if k.metricAllowlistEnabled {
+		if err := k.loadTenantAllowedMetricPrefixes(); err != nil {
+			k.promRuleFetchFailures.Inc()
+			return nil, errors.Wrap(err, "loading tenant allowed metric prefixes")
+		}
 	}
 
 	k.promRuleFetches.Inc()
@@ -142,14 +388,16 @@ func (k *KubeRulesLoader) GetPrometheusRules() ([]*monitoringv1.PrometheusRule,
 }
 
 func (k *KubeRulesLoader) GetTenantLogsAlertingRuleGroups(alertingRules []lokiv1.AlertingRule) map[string]lokiv1.AlertingRuleSpec {
+	if !k.kindAvailable(lokiAlertingRuleKind) && !k.kindAvailable(lokiAlertingRuleKindV1b1) {
+		return map[string]lokiv1.AlertingRuleSpec{}
+	}
+
 	tenantRules := make(map[string][]*lokiv1.AlertingRuleGroup)
-	managedTenants := strings.Split(k.managedTenants, ",")
-	for _, tenant := range managedTenants {
-		if tenant != "" {
-			tenantRules[tenant] = []*lokiv1.AlertingRuleGroup{}
-		}
+	for _, tenant := range syncer.SplitList(k.managedTenants) {
+		tenantRules[tenant] = []*lokiv1.AlertingRuleGroup{}
 	}
 
+	pinned := map[string]map[string]string{}
 	for _, ar := range alertingRules {
 		level.Debug(k.logger).Log("msg", "checking Loki alerting rule for tenant", "name", ar.Name)
 		if _, found := tenantRules[ar.Spec.TenantID]; !found {
@@ -159,11 +407,18 @@ func (k *KubeRulesLoader) GetTenantLogsAlertingRuleGroups(alertingRules []lokiv1
 
 		level.Debug(k.logger).Log("msg", "checking Loki alerting rule tenant rules", "name", ar.Name, "tenant", ar.Spec.TenantID)
 		tenantRules[ar.Spec.TenantID] = append(tenantRules[ar.Spec.TenantID], ar.Spec.Groups...)
+
+		names := make([]string, 0, len(ar.Spec.Groups))
+		for _, g := range ar.Spec.Groups {
+			names = append(names, g.Name)
+		}
+		k.pinLokiNamespace(pinned, ar.ObjectMeta, ar.Spec.TenantID, names)
 	}
+	k.resetLokiNamespaces("alerting", pinned)
 
 	tenantRuleGroups := make(map[string]lokiv1.AlertingRuleSpec, len(tenantRules))
 	for tenant, tr := range tenantRules {
-		k.lokiTenantRules.WithLabelValues("alerting", tenant).Set(float64(len(tr)))
+		k.lokiTenantRules.WithLabelValues("alerting", k.tenantLabel(tenant)).Set(float64(len(tr)))
 		tenantRuleGroups[tenant] = lokiv1.AlertingRuleSpec{Groups: tr}
 	}
 
@@ -171,14 +426,16 @@ func (k *KubeRulesLoader) GetTenantLogsAlertingRuleGroups(alertingRules []lokiv1
 }
 
 func (k *KubeRulesLoader) GetTenantLogsRecordingRuleGroups(recordingRules []lokiv1.RecordingRule) map[string]lokiv1.RecordingRuleSpec {
+	if !k.kindAvailable(lokiRecordingRuleKind) && !k.kindAvailable(lokiRecordingRuleKindV1b1) {
+		return map[string]lokiv1.RecordingRuleSpec{}
+	}
+
 	tenantRules := make(map[string][]*lokiv1.RecordingRuleGroup)
-	managedTenants := strings.Split(k.managedTenants, ",")
-	for _, tenant := range managedTenants {
-		if tenant != "" {
-			tenantRules[tenant] = []*lokiv1.RecordingRuleGroup{}
-		}
+	for _, tenant := range syncer.SplitList(k.managedTenants) {
+		tenantRules[tenant] = []*lokiv1.RecordingRuleGroup{}
 	}
 
+	pinned := map[string]map[string]string{}
 	for _, ar := range recordingRules {
 		level.Debug(k.logger).Log("msg", "checking Loki Recording rule for tenant", "name", ar.Name)
 		if _, found := tenantRules[ar.Spec.TenantID]; !found {
@@ -188,11 +445,18 @@ func (k *KubeRulesLoader) GetTenantLogsRecordingRuleGroups(recordingRules []loki
 
 		level.Debug(k.logger).Log("msg", "checking Loki Recording rule tenant rules", "name", ar.Name, "tenant", ar.Spec.TenantID)
 		tenantRules[ar.Spec.TenantID] = append(tenantRules[ar.Spec.TenantID], ar.Spec.Groups...)
+
+		names := make([]string, 0, len(ar.Spec.Groups))
+		for _, g := range ar.Spec.Groups {
+			names = append(names, g.Name)
+		}
+		k.pinLokiNamespace(pinned, ar.ObjectMeta, ar.Spec.TenantID, names)
 	}
+	k.resetLokiNamespaces("recording", pinned)
 
 	tenantRuleGroups := make(map[string]lokiv1.RecordingRuleSpec, len(tenantRules))
 	for tenant, tr := range tenantRules {
-		k.lokiTenantRules.WithLabelValues("recording", tenant).Set(float64(len(tr)))
+		k.lokiTenantRules.WithLabelValues("recording", k.tenantLabel(tenant)).Set(float64(len(tr)))
 		tenantRuleGroups[tenant] = lokiv1.RecordingRuleSpec{Groups: tr}
 	}
 
@@ -200,23 +464,46 @@ func (k *KubeRulesLoader) GetTenantLogsRecordingRuleGroups(recordingRules []loki
 }
 
 func (k *KubeRulesLoader) GetTenantMetricsRuleGroups(prometheusRules []*monitoringv1.PrometheusRule) map[string]monitoringv1.PrometheusRuleSpec {
+	if !k.kindAvailable(prometheusRuleKind) {
+		return map[string]monitoringv1.PrometheusRuleSpec{}
+	}
+
 	tenantRules := make(map[string][]monitoringv1.RuleGroup)
-	managedTenants := strings.Split(k.managedTenants, ",")
-	for _, tenant := range managedTenants {
-		if tenant != "" {
-			tenantRules[tenant] = []monitoringv1.RuleGroup{}
-		}
+	for _, tenant := range syncer.SplitList(k.managedTenants) {
+		tenantRules[tenant] = []monitoringv1.RuleGroup{}
 	}
+	sources := make(map[string][]ruleSource)
 
-	for _, pr := range prometheusRules {
+	for _, pr := range sortedPrometheusRules(prometheusRules) {
 		level.Debug(k.logger).Log("msg", "checking prometheus rule for tenant", "name", pr.Name)
-		if tenant, ok := pr.Labels["tenant"]; ok {
-			if _, found := tenantRules[tenant]; !found {
-				level.Debug(k.logger).Log("msg", "skipping prometheus rule with unmanaged tenant", "name", pr.Name, "tenant", tenant)
-				continue
+		if tenantLabel, ok := pr.Labels["tenant"]; ok {
+			// Objects shared across tenants can list them comma-separated, e.g. tenant: "a,b".
+			for _, tenant := range strings.Split(tenantLabel, ",") {
+				tenant = strings.TrimSpace(tenant)
+				if _, found := tenantRules[tenant]; !found {
+					if k.strictTenantMatch {
+						level.Error(k.logger).Log("msg", "prometheus rule tenant label doesn't match any managed tenant", "name", pr.Name, "tenant", tenant)
+						k.unmanagedTenantRules.WithLabelValues(k.tenantLabel(tenant)).Inc()
+						continue
+					}
+					level.Debug(k.logger).Log("msg", "skipping prometheus rule with unmanaged tenant", "name", pr.Name, "tenant", tenant)
+					continue
+				}
+				level.Debug(k.logger).Log("msg", "checking prometheus rule tenant rules", "name", pr.Name, "tenant", tenant)
+				groups := pr.Spec.Groups
+				if len(k.requiredAlertAnnotations) > 0 {
+					var ok bool
+					if groups, ok = k.checkRequiredAnnotations(tenant, pr); !ok {
+						continue
+					}
+				}
+				tenantRules[tenant] = append(tenantRules[tenant], groups...)
+				sources[tenant] = append(sources[tenant], ruleSource{
+					key:   types.NamespacedName{Namespace: pr.Namespace, Name: pr.Name},
+					uid:   pr.UID,
+					rules: countRules(groups),
+				})
 			}
-			level.Debug(k.logger).Log("msg", "checking prometheus rule tenant rules", "name", pr.Name, "tenant", tenant)
-			tenantRules[tenant] = append(tenantRules[tenant], pr.Spec.Groups...)
 		} else {
 			level.Debug(k.logger).Log("msg", "skipping prometheus rule without tenant label", "name", pr.Name)
 		}
@@ -224,9 +511,197 @@ func (k *KubeRulesLoader) GetTenantMetricsRuleGroups(prometheusRules []*monitori
 
 	tenantRuleGroups := make(map[string]monitoringv1.PrometheusRuleSpec, len(tenantRules))
 	for tenant, tr := range tenantRules {
-		k.promTenantRules.WithLabelValues(tenant).Set(float64(len(tr)))
+		if k.metricAllowlistEnabled {
+			tr = k.filterDisallowedMetrics(tenant, tr)
+		}
+		tr = k.filterBannedFunctions(tenant, tr)
+		if k.dedupRules {
+			tr = k.removeDuplicateRules(tenant, tr)
+		}
+		if k.checkRecordingRuleReferences {
+			k.reportDanglingReferences(tenant, tr)
+		}
+		sortRuleGroups(tr)
+		if k.mergeSameNameGroups {
+			tr = mergeSameNameGroups(tr)
+		}
+		k.observeRuleGroupIntervals(tenant, tr)
+		alerting, recording := countRuleGroupTypes(tr)
+		k.promTenantRules.WithLabelValues("alerting", k.tenantLabel(tenant)).Set(float64(alerting))
+		k.promTenantRules.WithLabelValues("recording", k.tenantLabel(tenant)).Set(float64(recording))
 		tenantRuleGroups[tenant] = monitoringv1.PrometheusRuleSpec{Groups: tr}
 	}
+	k.recordSyncSources(sources)
 
 	return tenantRuleGroups
 }
+
+// convertLokiRules converts v1beta1 rules to v1 with convert. Rules failing to convert are skipped and reported, so that
+// a single malformed object doesn't prevent loading the others.
+func convertLokiRules[S, D any](k *KubeRulesLoader, typ string, rules []S, convert func(*S, *D) error, key func(S) types.NamespacedName) []D {
+	converted := make([]D, 0, len(rules))
+	for i := range rules {
+		var v1 D
+		if err := convert(&rules[i], &v1); err != nil {
+			level.Error(k.logger).Log("msg", "skipping loki rule failing to convert from v1beta1 to v1", "type", typ, "name", key(rules[i]), "error", err)
+			k.lokiConversionFailures.WithLabelValues(typ).Inc()
+			continue
+		}
+
+		converted = append(converted, v1)
+	}
+
+	return converted
+}
+
+// resolveLokiVersionConflicts combines v1 rules with v1beta1 rules converted to v1, keeping only one of the rules
+// defined with the same namespace and name in both versions, according to policy. Order is preserved, with v1 rules
+// first.
+func resolveLokiVersionConflicts[T any](policy LokiVersionConflictPolicy, v1, v1beta1 []T, key func(T) types.NamespacedName) ([]T, error) {
+	v1Index := make(map[types.NamespacedName]int, len(v1))
+	for i, r := range v1 {
+		v1Index[key(r)] = i
+	}
+
+	rules := append(make([]T, 0, len(v1)+len(v1beta1)), v1...)
+	for _, r := range v1beta1 {
+		i, conflict := v1Index[key(r)]
+		if !conflict {
+			rules = append(rules, r)
+			continue
+		}
+
+		switch policy {
+		case LokiVersionConflictPreferV1beta1:
+			rules[i] = r
+		case LokiVersionConflictError:
+			return nil, errors.Newf("rule %s is defined in both v1 and v1beta1", key(r))
+		}
+	}
+
+	return rules, nil
+}
+
+// tenantLabel returns the tenant label value of metrics for tenant.
+func (k *KubeRulesLoader) tenantLabel(tenant string) string {
+	if k.sanitizeTenantLabels {
+		return tenantlabel.Sanitize(tenant)
+	}
+
+	return tenant
+}
+
+// defaultRuleGroupInterval is the evaluation interval of rule groups without one, as defaulted by Thanos Ruler.
+const defaultRuleGroupInterval = time.Minute
+
+// observeRuleGroupIntervals records the evaluation interval of each of the tenant's groups. Groups with an invalid
+// interval are skipped, as they're rejected when syncing.
+func (k *KubeRulesLoader) observeRuleGroupIntervals(tenant string, groups []monitoringv1.RuleGroup) {
+	for _, g := range groups {
+		interval := defaultRuleGroupInterval
+		if g.Interval != "" {
+			d, err := model.ParseDuration(g.Interval)
+			if err != nil {
+				level.Debug(k.logger).Log("msg", "skipping rule group with invalid interval", "tenant", tenant, "group", g.Name, "interval", g.Interval, "error", err)
+				continue
+			}
+			interval = time.Duration(d)
+		}
+
+		k.ruleGroupIntervals.WithLabelValues(k.tenantLabel(tenant)).Observe(interval.Seconds())
+	}
+}
+
+// countRuleGroupTypes returns the number of groups containing alerting rules, and the number of groups containing
+// recording rules. Mixed groups are counted in both.
+func countRuleGroupTypes(groups []monitoringv1.RuleGroup) (alerting, recording int) {
+	for _, g := range groups {
+		var hasAlert, hasRecord bool
+		for _, r := range g.Rules {
+			hasAlert = hasAlert || r.Alert != ""
+			hasRecord = hasRecord || r.Record != ""
+		}
+
+		if hasAlert {
+			alerting++
+		}
+		if hasRecord {
+			recording++
+		}
+	}
+
+	return alerting, recording
+}
+
+// sortedPrometheusRules returns a copy of prometheusRules sorted by namespace and name, so that tenant rules are
+// assembled in the same order whatever order they were listed in.
+func sortedPrometheusRules(prometheusRules []*monitoringv1.PrometheusRule) []*monitoringv1.PrometheusRule {
+	sorted := append([]*monitoringv1.PrometheusRule(nil), prometheusRules...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Namespace != sorted[j].Namespace {
+			return sorted[i].Namespace < sorted[j].Namespace
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	return sorted
+}
+
+// filterRules returns a copy of groups with only the rules for which keep returns true, given their group and index in
+// it. Rules are copied, as the source slices may be shared with other tenants.
+func filterRules(groups []monitoringv1.RuleGroup, keep func(g monitoringv1.RuleGroup, i int) bool) []monitoringv1.RuleGroup {
+	filtered := make([]monitoringv1.RuleGroup, 0, len(groups))
+	for _, g := range groups {
+		rules := make([]monitoringv1.Rule, 0, len(g.Rules))
+		for i, r := range g.Rules {
+			if keep(g, i) {
+				rules = append(rules, r)
+			}
+		}
+
+		g.Rules = rules
+		filtered = append(filtered, g)
+	}
+
+	return filtered
+}
+
+// sortRuleGroups sorts groups by name, keeping groups with the same name in the order of the objects they come from, so
+// that the synced rules only change when the rules themselves do.
+func sortRuleGroups(groups []monitoringv1.RuleGroup) {
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+}
+
+// mergeSameNameGroups merges groups sharing the same name into the first group with that name, keeping its other
+// settings (e.g. interval) and dropping rules identical to one already in the group. Group order is preserved.
+func mergeSameNameGroups(groups []monitoringv1.RuleGroup) []monitoringv1.RuleGroup {
+	merged := make([]monitoringv1.RuleGroup, 0, len(groups))
+	index := make(map[string]int, len(groups))
+
+	for _, g := range groups {
+		i, ok := index[g.Name]
+		if !ok {
+			index[g.Name] = len(merged)
+			// Copy rules, as the source slice may be shared with other tenants.
+			g.Rules = appendUniqueRules(nil, g.Rules...)
+			merged = append(merged, g)
+			continue
+		}
+
+		merged[i].Rules = appendUniqueRules(merged[i].Rules, g.Rules...)
+	}
+
+	return merged
+}
+
+func appendUniqueRules(rules []monitoringv1.Rule, add ...monitoringv1.Rule) []monitoringv1.Rule {
+	for _, r := range add {
+		if slices.IndexFunc(rules, func(e monitoringv1.Rule) bool { return reflect.DeepEqual(e, r) }) == -1 {
+			rules = append(rules, r)
+		}
+	}
+
+	return rules
+}
@@ -0,0 +1,64 @@
+package loader
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log/level"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// LokiNamespaceAnnotation pins the rule groups of a Loki AlertingRule or RecordingRule to the given Loki rules
+// namespace, instead of the namespace derived from the tenant.
+const LokiNamespaceAnnotation = "obsctl.rhobs.io/loki-namespace"
+
+// lokiNamespaces records the Loki rules namespace each rule group of a tenant is pinned to, per rule type.
+type lokiNamespaces struct {
+	mu sync.Mutex
+	// pinned maps rule types to tenants to rule group names to namespaces.
+	pinned map[string]map[string]map[string]string
+}
+
+// resetLokiNamespaces replaces the pinned namespaces of the rule groups of typ.
+func (k *KubeRulesLoader) resetLokiNamespaces(typ string, pinned map[string]map[string]string) {
+	k.lokiNamespaces.mu.Lock()
+	defer k.lokiNamespaces.mu.Unlock()
+
+	if k.lokiNamespaces.pinned == nil {
+		k.lokiNamespaces.pinned = map[string]map[string]map[string]string{}
+	}
+	k.lokiNamespaces.pinned[typ] = pinned
+}
+
+// pinLokiNamespace records the namespace the groups of a Loki rule object are pinned to by its annotation, if any, in
+// pinned.
+func (k *KubeRulesLoader) pinLokiNamespace(pinned map[string]map[string]string, meta metav1.ObjectMeta, tenant string, groups []string) {
+	ns, ok := meta.Annotations[LokiNamespaceAnnotation]
+	if !ok {
+		return
+	}
+	if ns == "" || strings.Contains(ns, "/") {
+		level.Warn(k.logger).Log("msg", "ignoring invalid loki namespace annotation", "name", meta.Name, "tenant", tenant, "namespace", ns)
+		return
+	}
+
+	if pinned[tenant] == nil {
+		pinned[tenant] = map[string]string{}
+	}
+	for _, g := range groups {
+		if prev, ok := pinned[tenant][g]; ok && prev != ns {
+			level.Warn(k.logger).Log("msg", "loki rule group pinned to conflicting namespaces, using the last one", "name", meta.Name, "tenant", tenant, "group", g, "namespace", ns, "previous", prev)
+		}
+		pinned[tenant][g] = ns
+	}
+}
+
+// LokiNamespace returns the Loki rules namespace the tenant's rule group of type typ, either "alerting" or
+// "recording", is pinned to with LokiNamespaceAnnotation, or an empty string if it isn't pinned. It reflects the rule
+// groups last returned by GetTenantLogsAlertingRuleGroups and GetTenantLogsRecordingRuleGroups.
+func (k *KubeRulesLoader) LokiNamespace(typ, tenant, group string) string {
+	k.lokiNamespaces.mu.Lock()
+	defer k.lokiNamespaces.mu.Unlock()
+
+	return k.lokiNamespaces.pinned[typ][tenant][group]
+}
@@ -0,0 +1,82 @@
+package loader
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/go-kit/log/level"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// WithRecordingRuleReferenceCheck reports alerts referencing recording rules which none of the tenant's rules
+// record, e.g. because the recording rule was removed. As raw metrics aren't known, only metric names following the
+// level:metric:operations naming convention of recording rules, i.e. containing a colon, are checked.
+func WithRecordingRuleReferenceCheck(enabled bool) Option {
+	return func(k *KubeRulesLoader) {
+		k.checkRecordingRuleReferences = enabled
+	}
+}
+
+// reportDanglingReferences logs the alerts of groups referencing recording rules which aren't recorded by any rule
+// of groups, and exports the number of such alerts of tenant.
+func (k *KubeRulesLoader) reportDanglingReferences(tenant string, groups []monitoringv1.RuleGroup) {
+	recorded := map[string]struct{}{}
+	for _, g := range groups {
+		for _, r := range g.Rules {
+			if r.Record != "" {
+				recorded[r.Record] = struct{}{}
+			}
+		}
+	}
+
+	dangling := 0
+	for _, g := range groups {
+		for _, r := range g.Rules {
+			if r.Alert == "" {
+				continue
+			}
+
+			if missing := missingRecordingRules(r.Expr.String(), recorded); len(missing) > 0 {
+				level.Warn(k.logger).Log("msg", "alert references recording rules which aren't recorded", "tenant", tenant, "group", g.Name, "alert", r.Alert, "missing", strings.Join(missing, ","))
+				dangling++
+			}
+		}
+	}
+
+	k.danglingReferenceRules.WithLabelValues(k.tenantLabel(tenant)).Set(float64(dangling))
+}
+
+// missingRecordingRules returns the sorted recording rule names selected by expr which aren't in recorded. Invalid
+// expressions are ignored, as the API rejects them anyway.
+func missingRecordingRules(expr string, recorded map[string]struct{}) []string {
+	e, err := parser.ParseExpr(expr)
+	if err != nil {
+		return nil
+	}
+
+	missing := map[string]struct{}{}
+	parser.Inspect(e, func(node parser.Node, _ []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		name := selectorMetricName(vs)
+		if !strings.Contains(name, ":") {
+			return nil
+		}
+		if _, ok := recorded[name]; !ok {
+			missing[name] = struct{}{}
+		}
+		return nil
+	})
+
+	res := make([]string, 0, len(missing))
+	for name := range missing {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+
+	return res
+}
@@ -3,16 +3,25 @@ package loader
 import (
 	"context"
 	"os"
+	"strings"
 	"testing"
 
+	"github.com/efficientgo/core/errors"
 	"github.com/efficientgo/core/testutil"
 	"github.com/go-kit/log"
 	lokiv1 "github.com/grafana/loki/operator/apis/loki/v1"
+	lokiv1beta1 "github.com/grafana/loki/operator/apis/loki/v1beta1"
 	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 func TestGetTenantMetricsRuleGroups(t *testing.T) {
@@ -22,6 +31,10 @@ func TestGetTenantMetricsRuleGroups(t *testing.T) {
 		promTenantRules: promauto.With(prometheus.NewRegistry()).NewGaugeVec(prometheus.GaugeOpts{
 			Name: "obsctl_reloader_prom_tenant_rulegroups",
 			Help: "Number of Prometheus rules loaded per tenant.",
+		}, []string{"type", "tenant"}),
+		ruleGroupIntervals: promauto.With(prometheus.NewRegistry()).NewHistogramVec(prometheus.HistogramOpts{
+			Name: "obsctl_reloader_rule_group_interval_seconds",
+			Help: "Evaluation intervals of the Prometheus rule groups loaded per tenant.",
 		}, []string{"tenant"}),
 	}
 
@@ -43,6 +56,12 @@ func TestGetTenantMetricsRuleGroups(t *testing.T) {
 			input:   []*monitoringv1.PrometheusRule{},
 			want:    map[string]monitoringv1.PrometheusRuleSpec{"test": {Groups: []monitoringv1.RuleGroup{}}},
 		},
+		{
+			name:    "no rules and tenants with whitespace and empty entries",
+			tenants: " test, ,",
+			input:   []*monitoringv1.PrometheusRule{},
+			want:    map[string]monitoringv1.PrometheusRuleSpec{"test": {Groups: []monitoringv1.RuleGroup{}}},
+		},
 		{
 			name:    "one tenant with one rulegroup",
 			tenants: "test",
@@ -247,6 +266,63 @@ func TestGetTenantMetricsRuleGroups(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:    "one object shared by multiple tenants",
+			tenants: "test,yolo",
+			input: []*monitoringv1.PrometheusRule{
+				{
+					Spec: monitoringv1.PrometheusRuleSpec{
+						Groups: []monitoringv1.RuleGroup{
+							{
+								Name:     "SharedGroup",
+								Interval: "30s",
+								Rules: []monitoringv1.Rule{
+									{
+										Record: "SharedRecordingRule",
+										Expr:   intstr.FromString("vector(1)"),
+									},
+								},
+							},
+						},
+					},
+					ObjectMeta: metav1.ObjectMeta{
+						Labels: map[string]string{
+							"tenant": "test, yolo,unmanaged",
+						},
+					},
+				},
+			},
+			want: map[string]monitoringv1.PrometheusRuleSpec{
+				"test": {
+					Groups: []monitoringv1.RuleGroup{
+						{
+							Name:     "SharedGroup",
+							Interval: "30s",
+							Rules: []monitoringv1.Rule{
+								{
+									Record: "SharedRecordingRule",
+									Expr:   intstr.FromString("vector(1)"),
+								},
+							},
+						},
+					},
+				},
+				"yolo": {
+					Groups: []monitoringv1.RuleGroup{
+						{
+							Name:     "SharedGroup",
+							Interval: "30s",
+							Rules: []monitoringv1.Rule{
+								{
+									Record: "SharedRecordingRule",
+									Expr:   intstr.FromString("vector(1)"),
+								},
+							},
+						},
+					},
+				},
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
 			k.managedTenants = tc.tenants
@@ -742,3 +818,704 @@ func TestGetTenantLokiRecordingRuleGroups(t *testing.T) {
 		})
 	}
 }
+
+func TestGetTenantMetricsRuleGroupsStrictTenantMatch(t *testing.T) {
+	input := []*monitoringv1.PrometheusRule{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "managed",
+				Labels: map[string]string{"tenant": "test"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "unmanaged",
+				Labels: map[string]string{"tenant": "typo"},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		name          string
+		strict        bool
+		wantUnmanaged float64
+	}{
+		{name: "silent skip by default", strict: false, wantUnmanaged: 0},
+		{name: "strict tenant match", strict: true, wantUnmanaged: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k := NewKubeRulesLoader(context.TODO(), nil, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test", prometheus.NewRegistry(), WithStrictTenantMatch(tc.strict))
+
+			testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{"test": {Groups: []monitoringv1.RuleGroup{}}}, k.GetTenantMetricsRuleGroups(input))
+			testutil.Equals(t, tc.wantUnmanaged, promtestutil.ToFloat64(k.unmanagedTenantRules.WithLabelValues("typo")))
+		})
+	}
+}
+
+func TestGetTenantMetricsRuleGroupsStableOrder(t *testing.T) {
+	rule := func(namespace, name string, groups ...string) *monitoringv1.PrometheusRule {
+		pr := &monitoringv1.PrometheusRule{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: map[string]string{"tenant": "test"}},
+		}
+		for _, g := range groups {
+			pr.Spec.Groups = append(pr.Spec.Groups, monitoringv1.RuleGroup{
+				Name:  g,
+				Rules: []monitoringv1.Rule{{Record: namespace + ":" + name, Expr: intstr.FromString("vector(1)")}},
+			})
+		}
+		return pr
+	}
+	input := []*monitoringv1.PrometheusRule{
+		rule("b", "z", "Beta", "Alpha"),
+		rule("a", "y", "Gamma", "Beta"),
+		rule("a", "x", "Beta"),
+	}
+
+	k := NewKubeRulesLoader(context.TODO(), nil, log.NewNopLogger(), "test", "test", prometheus.NewRegistry())
+	first := k.GetTenantMetricsRuleGroups(input)
+
+	var got []string
+	for _, g := range first["test"].Groups {
+		got = append(got, g.Name+"/"+g.Rules[0].Record)
+	}
+	// Groups are sorted by name, and same-name groups by the namespace and name of their object.
+	testutil.Equals(t, []string{"Alpha/b:z", "Beta/a:x", "Beta/a:y", "Beta/b:z", "Gamma/a:y"}, got)
+
+	// Any listing order gives the same result.
+	reversed := []*monitoringv1.PrometheusRule{input[2], input[1], input[0]}
+	testutil.Equals(t, first, k.GetTenantMetricsRuleGroups(reversed))
+	// The input order isn't modified.
+	testutil.Equals(t, "z", reversed[2].Name)
+	testutil.Equals(t, "Beta", input[0].Spec.Groups[0].Name)
+}
+
+func TestGetTenantMetricsRuleGroupsMergeSameNameGroups(t *testing.T) {
+	recording := monitoringv1.Rule{Record: "TestRecordingRule", Expr: intstr.FromString("vector(1)")}
+	alerting := monitoringv1.Rule{Alert: "TestAlertingRule", Expr: intstr.FromString("vector(1)")}
+	input := []*monitoringv1.PrometheusRule{
+		{
+			Spec: monitoringv1.PrometheusRuleSpec{
+				Groups: []monitoringv1.RuleGroup{
+					{Name: "Shared", Interval: "30s", Rules: []monitoringv1.Rule{recording}},
+					{Name: "Other", Interval: "1m", Rules: []monitoringv1.Rule{alerting}},
+				},
+			},
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"tenant": "test"}},
+		},
+		{
+			Spec: monitoringv1.PrometheusRuleSpec{
+				Groups: []monitoringv1.RuleGroup{
+					{Name: "Shared", Interval: "1m", Rules: []monitoringv1.Rule{recording, alerting}},
+				},
+			},
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"tenant": "test"}},
+		},
+	}
+
+	for _, tc := range []struct {
+		name  string
+		merge bool
+		want  []monitoringv1.RuleGroup
+	}{
+		{
+			name:  "duplicated groups by default",
+			merge: false,
+			want: []monitoringv1.RuleGroup{
+				{Name: "Other", Interval: "1m", Rules: []monitoringv1.Rule{alerting}},
+				{Name: "Shared", Interval: "30s", Rules: []monitoringv1.Rule{recording}},
+				{Name: "Shared", Interval: "1m", Rules: []monitoringv1.Rule{recording, alerting}},
+			},
+		},
+		{
+			name:  "merged and deduplicated groups",
+			merge: true,
+			want: []monitoringv1.RuleGroup{
+				{Name: "Other", Interval: "1m", Rules: []monitoringv1.Rule{alerting}},
+				{Name: "Shared", Interval: "30s", Rules: []monitoringv1.Rule{recording, alerting}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k := NewKubeRulesLoader(context.TODO(), nil, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test", prometheus.NewRegistry(), WithMergeSameNameGroups(tc.merge))
+
+			testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{"test": {Groups: tc.want}}, k.GetTenantMetricsRuleGroups(input))
+		})
+	}
+
+	// Source objects must not be modified by merging.
+	testutil.Equals(t, []monitoringv1.Rule{recording}, input[0].Spec.Groups[0].Rules)
+}
+
+func TestGetTenantMetricsRuleGroupsDedupRules(t *testing.T) {
+	recording := monitoringv1.Rule{Record: "TestRecordingRule", Expr: intstr.FromString("vector(1)"), Labels: map[string]string{"team": "a"}}
+	alerting := monitoringv1.Rule{Alert: "TestAlertingRule", Expr: intstr.FromString("vector(1)")}
+	// Same name and expr, but a different for duration, so not a duplicate.
+	alertingLonger := monitoringv1.Rule{Alert: "TestAlertingRule", Expr: intstr.FromString("vector(1)"), For: "5m"}
+	input := []*monitoringv1.PrometheusRule{
+		{
+			Spec: monitoringv1.PrometheusRuleSpec{
+				Groups: []monitoringv1.RuleGroup{
+					{Name: "A", Rules: []monitoringv1.Rule{recording, alerting, recording, alertingLonger, alerting}},
+					// Rules identical to ones of another group are kept.
+					{Name: "B", Rules: []monitoringv1.Rule{recording}},
+				},
+			},
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"tenant": "test"}},
+		},
+	}
+
+	for _, tc := range []struct {
+		name        string
+		dedup       bool
+		want        []monitoringv1.RuleGroup
+		wantRemoved float64
+	}{
+		{
+			name: "duplicates kept by default",
+			want: []monitoringv1.RuleGroup{
+				{Name: "A", Rules: []monitoringv1.Rule{recording, alerting, recording, alertingLonger, alerting}},
+				{Name: "B", Rules: []monitoringv1.Rule{recording}},
+			},
+		},
+		{
+			name:  "duplicates removed",
+			dedup: true,
+			want: []monitoringv1.RuleGroup{
+				{Name: "A", Rules: []monitoringv1.Rule{recording, alerting, alertingLonger}},
+				{Name: "B", Rules: []monitoringv1.Rule{recording}},
+			},
+			wantRemoved: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k := NewKubeRulesLoader(context.TODO(), nil, log.NewNopLogger(), "test", "test", prometheus.NewRegistry(), WithDedupRules(tc.dedup))
+
+			testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{"test": {Groups: tc.want}}, k.GetTenantMetricsRuleGroups(input))
+			testutil.Equals(t, tc.wantRemoved, promtestutil.ToFloat64(k.duplicateRules.WithLabelValues("test")))
+		})
+	}
+
+	// Source objects must not be modified by deduplication.
+	testutil.Equals(t, 5, len(input[0].Spec.Groups[0].Rules))
+}
+
+func TestGetTenantMetricsRuleGroupsAllowedMetricPrefixes(t *testing.T) {
+	allowed := monitoringv1.Rule{Record: "tenant:up:sum", Expr: intstr.FromString(`sum(tenant_up{job="a"}) / sum(rate(tenant_requests_total[5m]))`)}
+	disallowed := monitoringv1.Rule{Alert: "HighCardinality", Expr: intstr.FromString(`count(apiserver_request_total) > 0`)}
+	noName := monitoringv1.Rule{Record: "tenant:any:count", Expr: intstr.FromString(`count({job="a"})`)}
+	input := []*monitoringv1.PrometheusRule{
+		{
+			Spec: monitoringv1.PrometheusRuleSpec{
+				Groups: []monitoringv1.RuleGroup{
+					{Name: "TestGroup", Interval: "30s", Rules: []monitoringv1.Rule{allowed, disallowed, noName}},
+				},
+			},
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"tenant": "test,other"}},
+		},
+	}
+
+	kc := fake.NewClientBuilder().WithObjects(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "other-secret", Labels: map[string]string{"tenant": "other"}},
+		Data:       map[string][]byte{"allowed_metric_prefixes": []byte("tenant_, apiserver_")},
+	}).Build()
+	k := NewKubeRulesLoader(context.TODO(), kc, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test,other", prometheus.NewRegistry(), WithAllowedMetricPrefixes("tenant_"))
+
+	testutil.Ok(t, k.loadTenantAllowedMetricPrefixes())
+
+	testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{
+		"test": {Groups: []monitoringv1.RuleGroup{
+			{Name: "TestGroup", Interval: "30s", Rules: []monitoringv1.Rule{allowed}},
+		}},
+		"other": {Groups: []monitoringv1.RuleGroup{
+			{Name: "TestGroup", Interval: "30s", Rules: []monitoringv1.Rule{allowed, disallowed}},
+		}},
+	}, k.GetTenantMetricsRuleGroups(input))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(k.disallowedMetricRules.WithLabelValues("test")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(k.disallowedMetricRules.WithLabelValues("other")))
+
+	// Source objects must not be modified by filtering.
+	testutil.Equals(t, []monitoringv1.Rule{allowed, disallowed, noName}, input[0].Spec.Groups[0].Rules)
+}
+
+func TestGetTenantMetricsRuleGroupsBannedFunctions(t *testing.T) {
+	allowed := monitoringv1.Rule{Record: "job:up:sum", Expr: intstr.FromString(`sum by (job) (rate(up[5m]))`)}
+	absent := monitoringv1.Rule{Alert: "Absent", Expr: intstr.FromString(`absent_over_time(up[30d])`)}
+	nested := monitoringv1.Rule{Record: "job:up:top", Expr: intstr.FromString(`sum(topk(5, up))`)}
+	invalid := monitoringv1.Rule{Record: "job:up:invalid", Expr: intstr.FromString(`sum(`)}
+	input := []*monitoringv1.PrometheusRule{
+		{
+			Spec: monitoringv1.PrometheusRuleSpec{
+				Groups: []monitoringv1.RuleGroup{
+					{Name: "Rules", Rules: []monitoringv1.Rule{allowed, absent, nested, invalid}},
+				},
+			},
+			ObjectMeta: metav1.ObjectMeta{Name: "rules", Labels: map[string]string{"tenant": "test"}},
+		},
+	}
+
+	k := NewKubeRulesLoader(context.TODO(), nil, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test", prometheus.NewRegistry(), WithBannedPromQLFunctions("absent_over_time", "topk"))
+	testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{
+		"test": {Groups: []monitoringv1.RuleGroup{{Name: "Rules", Rules: []monitoringv1.Rule{allowed}}}},
+	}, k.GetTenantMetricsRuleGroups(input))
+	testutil.Equals(t, 3.0, promtestutil.ToFloat64(k.bannedFunctionRules.WithLabelValues("test")))
+
+	// Source objects must not be modified.
+	testutil.Equals(t, []monitoringv1.Rule{allowed, absent, nested, invalid}, input[0].Spec.Groups[0].Rules)
+
+	k = NewKubeRulesLoader(context.TODO(), nil, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test", prometheus.NewRegistry(), WithBannedPromQLFunctions("label_replace"))
+	testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{
+		"test": {Groups: []monitoringv1.RuleGroup{{Name: "Rules", Rules: []monitoringv1.Rule{allowed, absent, nested}}}},
+	}, k.GetTenantMetricsRuleGroups(input))
+
+	// Without banned functions, expressions aren't checked, so unparseable ones are kept.
+	k = NewKubeRulesLoader(context.TODO(), nil, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test", prometheus.NewRegistry(), WithBannedPromQLFunctions())
+	testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{
+		"test": {Groups: []monitoringv1.RuleGroup{{Name: "Rules", Rules: []monitoringv1.Rule{allowed, absent, nested, invalid}}}},
+	}, k.GetTenantMetricsRuleGroups(input))
+	testutil.Equals(t, 0, promtestutil.CollectAndCount(k.bannedFunctionRules))
+}
+
+func TestGetTenantMetricsRuleGroupsIntervals(t *testing.T) {
+	rules := []monitoringv1.Rule{{Record: "TestRecordingRule", Expr: intstr.FromString("vector(1)")}}
+	input := []*monitoringv1.PrometheusRule{
+		{
+			Spec: monitoringv1.PrometheusRuleSpec{
+				Groups: []monitoringv1.RuleGroup{
+					{Name: "Fast", Interval: "15s", Rules: rules},
+					{Name: "Default", Rules: rules},
+					{Name: "Slow", Interval: "5m", Rules: rules},
+					{Name: "Invalid", Interval: "often", Rules: rules},
+				},
+			},
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Labels: map[string]string{"tenant": "test"}},
+		},
+	}
+
+	reg := prometheus.NewRegistry()
+	k := NewKubeRulesLoader(context.TODO(), nil, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test", reg)
+	k.GetTenantMetricsRuleGroups(input)
+
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP obsctl_reloader_rule_group_interval_seconds Evaluation intervals of the Prometheus rule groups loaded per tenant. Groups without an interval count with the default one.
+# TYPE obsctl_reloader_rule_group_interval_seconds histogram
+obsctl_reloader_rule_group_interval_seconds_bucket{tenant="test",le="10"} 0
+obsctl_reloader_rule_group_interval_seconds_bucket{tenant="test",le="15"} 1
+obsctl_reloader_rule_group_interval_seconds_bucket{tenant="test",le="30"} 1
+obsctl_reloader_rule_group_interval_seconds_bucket{tenant="test",le="60"} 2
+obsctl_reloader_rule_group_interval_seconds_bucket{tenant="test",le="120"} 2
+obsctl_reloader_rule_group_interval_seconds_bucket{tenant="test",le="300"} 3
+obsctl_reloader_rule_group_interval_seconds_bucket{tenant="test",le="600"} 3
+obsctl_reloader_rule_group_interval_seconds_bucket{tenant="test",le="1800"} 3
+obsctl_reloader_rule_group_interval_seconds_bucket{tenant="test",le="3600"} 3
+obsctl_reloader_rule_group_interval_seconds_bucket{tenant="test",le="+Inf"} 3
+obsctl_reloader_rule_group_interval_seconds_sum{tenant="test"} 375
+obsctl_reloader_rule_group_interval_seconds_count{tenant="test"} 3
+`), "obsctl_reloader_rule_group_interval_seconds"))
+}
+
+func TestGetLokiRulesVersionConflicts(t *testing.T) {
+	s := runtime.NewScheme()
+	testutil.Ok(t, lokiv1.AddToScheme(s))
+	testutil.Ok(t, lokiv1beta1.AddToScheme(s))
+
+	kc := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		&lokiv1.AlertingRule{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "shared"},
+			Spec:       lokiv1.AlertingRuleSpec{TenantID: "v1"},
+		},
+		&lokiv1beta1.AlertingRule{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "shared"},
+			Spec:       lokiv1beta1.AlertingRuleSpec{TenantID: "v1beta1"},
+		},
+		&lokiv1beta1.AlertingRule{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "only-v1beta1"},
+			Spec:       lokiv1beta1.AlertingRuleSpec{TenantID: "v1beta1"},
+		},
+		&lokiv1.RecordingRule{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "shared"},
+			Spec:       lokiv1.RecordingRuleSpec{TenantID: "v1"},
+		},
+		&lokiv1beta1.RecordingRule{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "shared"},
+			Spec:       lokiv1beta1.RecordingRuleSpec{TenantID: "v1beta1"},
+		},
+	).Build()
+
+	for _, tc := range []struct {
+		name          string
+		policy        LokiVersionConflictPolicy
+		wantErr       bool
+		wantAlerting  map[string]string
+		wantRecording map[string]string
+	}{
+		{
+			name:          "prefer v1",
+			policy:        LokiVersionConflictPreferV1,
+			wantAlerting:  map[string]string{"shared": "v1", "only-v1beta1": "v1beta1"},
+			wantRecording: map[string]string{"shared": "v1"},
+		},
+		{
+			name:          "prefer v1beta1",
+			policy:        LokiVersionConflictPreferV1beta1,
+			wantAlerting:  map[string]string{"shared": "v1beta1", "only-v1beta1": "v1beta1"},
+			wantRecording: map[string]string{"shared": "v1beta1"},
+		},
+		{
+			name:    "error",
+			policy:  LokiVersionConflictError,
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			k := NewKubeRulesLoader(context.TODO(), kc, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "v1,v1beta1", prometheus.NewRegistry(), WithLokiVersionConflictPolicy(tc.policy))
+
+			ar, err := k.GetLokiAlertingRules()
+			if tc.wantErr {
+				testutil.NotOk(t, err)
+			} else {
+				testutil.Ok(t, err)
+				got := map[string]string{}
+				for _, r := range ar {
+					got[r.Name] = r.Spec.TenantID
+				}
+				testutil.Equals(t, tc.wantAlerting, got)
+			}
+
+			rr, err := k.GetLokiRecordingRules()
+			if tc.wantErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			got := map[string]string{}
+			for _, r := range rr {
+				got[r.Name] = r.Spec.TenantID
+			}
+			testutil.Equals(t, tc.wantRecording, got)
+		})
+	}
+}
+
+func TestLokiNamespace(t *testing.T) {
+	k := NewKubeRulesLoader(context.TODO(), nil, log.NewNopLogger(), "test", "test,other", prometheus.NewRegistry())
+
+	pinned := func(ns string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: ns, Annotations: map[string]string{LokiNamespaceAnnotation: ns}}
+	}
+	k.GetTenantLogsAlertingRuleGroups([]lokiv1.AlertingRule{
+		{ObjectMeta: pinned("shared"), Spec: lokiv1.AlertingRuleSpec{TenantID: "test", Groups: []*lokiv1.AlertingRuleGroup{{Name: "A"}, {Name: "B"}}}},
+		{Spec: lokiv1.AlertingRuleSpec{TenantID: "test", Groups: []*lokiv1.AlertingRuleGroup{{Name: "C"}}}},
+		{ObjectMeta: pinned("a/b"), Spec: lokiv1.AlertingRuleSpec{TenantID: "test", Groups: []*lokiv1.AlertingRuleGroup{{Name: "D"}}}},
+		{ObjectMeta: pinned("unmanaged"), Spec: lokiv1.AlertingRuleSpec{TenantID: "unmanaged", Groups: []*lokiv1.AlertingRuleGroup{{Name: "A"}}}},
+	})
+	k.GetTenantLogsRecordingRuleGroups([]lokiv1.RecordingRule{
+		{ObjectMeta: pinned("recordings"), Spec: lokiv1.RecordingRuleSpec{TenantID: "other", Groups: []*lokiv1.RecordingRuleGroup{{Name: "A"}}}},
+	})
+
+	testutil.Equals(t, "shared", k.LokiNamespace("alerting", "test", "A"))
+	testutil.Equals(t, "shared", k.LokiNamespace("alerting", "test", "B"))
+	testutil.Equals(t, "", k.LokiNamespace("alerting", "test", "C"))
+	// Invalid namespaces are ignored.
+	testutil.Equals(t, "", k.LokiNamespace("alerting", "test", "D"))
+	testutil.Equals(t, "", k.LokiNamespace("alerting", "unmanaged", "A"))
+	testutil.Equals(t, "", k.LokiNamespace("recording", "test", "A"))
+	testutil.Equals(t, "recordings", k.LokiNamespace("recording", "other", "A"))
+
+	// Pins are replaced on each load.
+	k.GetTenantLogsAlertingRuleGroups(nil)
+	testutil.Equals(t, "", k.LokiNamespace("alerting", "test", "A"))
+	testutil.Equals(t, "recordings", k.LokiNamespace("recording", "other", "A"))
+}
+
+func TestGetLokiRulesConversionFailures(t *testing.T) {
+	s := runtime.NewScheme()
+	testutil.Ok(t, lokiv1.AddToScheme(s))
+	testutil.Ok(t, lokiv1beta1.AddToScheme(s))
+
+	kc := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		&lokiv1beta1.AlertingRule{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "good"}, Spec: lokiv1beta1.AlertingRuleSpec{TenantID: "test"}},
+		&lokiv1beta1.AlertingRule{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "bad"}, Spec: lokiv1beta1.AlertingRuleSpec{TenantID: "test"}},
+		&lokiv1.AlertingRule{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "v1"}, Spec: lokiv1.AlertingRuleSpec{TenantID: "test"}},
+		&lokiv1beta1.RecordingRule{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "bad"}, Spec: lokiv1beta1.RecordingRuleSpec{TenantID: "test"}},
+	).Build()
+
+	reg := prometheus.NewRegistry()
+	k := NewKubeRulesLoader(context.TODO(), kc, log.NewNopLogger(), "test", "test", reg)
+	// The upstream conversions can't fail, so fail them for objects named bad.
+	k.convertAlertingRule = func(src *lokiv1beta1.AlertingRule, dst *lokiv1.AlertingRule) error {
+		if src.Name == "bad" {
+			return errors.New("unconvertible")
+		}
+		return src.ConvertTo(dst)
+	}
+	k.convertRecordingRule = func(src *lokiv1beta1.RecordingRule, dst *lokiv1.RecordingRule) error {
+		if src.Name == "bad" {
+			return errors.New("unconvertible")
+		}
+		return src.ConvertTo(dst)
+	}
+
+	ar, err := k.GetLokiAlertingRules()
+	testutil.Ok(t, err)
+	names := []string{}
+	for _, r := range ar {
+		names = append(names, r.Name)
+	}
+	testutil.Equals(t, []string{"v1", "good"}, names)
+
+	rr, err := k.GetLokiRecordingRules()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(rr))
+
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP obsctl_reloader_loki_conversion_failures_total Total number of lokiv1beta1 rules skipped for failing to convert to lokiv1.
+# TYPE obsctl_reloader_loki_conversion_failures_total counter
+obsctl_reloader_loki_conversion_failures_total{type="alerting"} 1
+obsctl_reloader_loki_conversion_failures_total{type="recording"} 1
+`), "obsctl_reloader_loki_conversion_failures_total"))
+	// Fetches still succeed.
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(k.lokiRuleFetches.WithLabelValues("alerting")))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(k.lokiRuleFetchFailures.WithLabelValues("alerting")))
+}
+
+func TestGetLokiRulesSelector(t *testing.T) {
+	s := runtime.NewScheme()
+	testutil.Ok(t, lokiv1.AddToScheme(s))
+	testutil.Ok(t, lokiv1beta1.AddToScheme(s))
+
+	managed := map[string]string{"loki.grafana.com/operator-managed": "true"}
+	kc := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		&lokiv1.AlertingRule{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "managed", Labels: managed}, Spec: lokiv1.AlertingRuleSpec{TenantID: "test"}},
+		&lokiv1.AlertingRule{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "unlabeled"}, Spec: lokiv1.AlertingRuleSpec{TenantID: "test"}},
+		&lokiv1beta1.AlertingRule{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "managed-v1beta1", Labels: managed}, Spec: lokiv1beta1.AlertingRuleSpec{TenantID: "test"}},
+		&lokiv1.RecordingRule{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "managed", Labels: managed}, Spec: lokiv1.RecordingRuleSpec{TenantID: "test"}},
+		&lokiv1beta1.RecordingRule{ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "unlabeled"}, Spec: lokiv1beta1.RecordingRuleSpec{TenantID: "test"}},
+	).Build()
+
+	names := func(k *KubeRulesLoader) ([]string, []string) {
+		ar, err := k.GetLokiAlertingRules()
+		testutil.Ok(t, err)
+		rr, err := k.GetLokiRecordingRules()
+		testutil.Ok(t, err)
+
+		alerting, recording := []string{}, []string{}
+		for _, r := range ar {
+			alerting = append(alerting, r.Name)
+		}
+		for _, r := range rr {
+			recording = append(recording, r.Name)
+		}
+		return alerting, recording
+	}
+
+	// All rules are loaded by default.
+	alerting, recording := names(NewKubeRulesLoader(context.TODO(), kc, log.NewNopLogger(), "test", "test", prometheus.NewRegistry()))
+	testutil.Equals(t, []string{"managed", "unlabeled", "managed-v1beta1"}, alerting)
+	testutil.Equals(t, []string{"managed", "unlabeled"}, recording)
+
+	selector, err := labels.Parse("loki.grafana.com/operator-managed=true")
+	testutil.Ok(t, err)
+	alerting, recording = names(NewKubeRulesLoader(context.TODO(), kc, log.NewNopLogger(), "test", "test", prometheus.NewRegistry(), WithLokiRuleSelector(selector)))
+	testutil.Equals(t, []string{"managed", "managed-v1beta1"}, alerting)
+	testutil.Equals(t, []string{"managed"}, recording)
+}
+
+func TestGetTenantMetricsRuleGroupsTypes(t *testing.T) {
+	recording := monitoringv1.Rule{Record: "TestRecordingRule", Expr: intstr.FromString("vector(1)")}
+	alerting := monitoringv1.Rule{Alert: "TestAlertingRule", Expr: intstr.FromString("vector(1)")}
+	input := []*monitoringv1.PrometheusRule{
+		{
+			Spec: monitoringv1.PrometheusRuleSpec{
+				Groups: []monitoringv1.RuleGroup{
+					{Name: "Recording", Rules: []monitoringv1.Rule{recording}},
+					{Name: "Alerting", Rules: []monitoringv1.Rule{alerting, alerting}},
+					{Name: "Mixed", Rules: []monitoringv1.Rule{recording, alerting}},
+					{Name: "Empty"},
+				},
+			},
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"tenant": "test"}},
+		},
+	}
+
+	k := NewKubeRulesLoader(context.TODO(), nil, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test,other", prometheus.NewRegistry())
+	k.GetTenantMetricsRuleGroups(input)
+
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(k.promTenantRules.WithLabelValues("alerting", "test")))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(k.promTenantRules.WithLabelValues("recording", "test")))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(k.promTenantRules.WithLabelValues("alerting", "other")))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(k.promTenantRules.WithLabelValues("recording", "other")))
+}
+
+func TestGetTenantMetricsRuleGroupsRequiredAlertAnnotations(t *testing.T) {
+	record := monitoringv1.Rule{Record: "tenant:up:sum", Expr: intstr.FromString(`sum(up)`)}
+	compliant := monitoringv1.Rule{Alert: "Compliant", Expr: intstr.FromString(`up == 0`), Annotations: map[string]string{"summary": "Down.", "runbook_url": "https://example.com/runbook"}}
+	nonCompliant := monitoringv1.Rule{Alert: "NonCompliant", Expr: intstr.FromString(`up == 0`), Annotations: map[string]string{"summary": "Down.", "runbook_url": ""}}
+	input := []*monitoringv1.PrometheusRule{
+		{
+			Spec: monitoringv1.PrometheusRuleSpec{
+				Groups: []monitoringv1.RuleGroup{
+					{Name: "Compliant", Rules: []monitoringv1.Rule{record, compliant}},
+				},
+			},
+			ObjectMeta: metav1.ObjectMeta{Name: "compliant", Labels: map[string]string{"tenant": "test"}},
+		},
+		{
+			Spec: monitoringv1.PrometheusRuleSpec{
+				Groups: []monitoringv1.RuleGroup{
+					{Name: "Mixed", Rules: []monitoringv1.Rule{record, compliant, nonCompliant}},
+				},
+			},
+			ObjectMeta: metav1.ObjectMeta{Name: "mixed", Labels: map[string]string{"tenant": "test"}},
+		},
+	}
+
+	for _, tc := range []struct {
+		action RequiredAnnotationsAction
+		want   []monitoringv1.RuleGroup
+	}{
+		{
+			action: RequiredAnnotationsWarn,
+			want: []monitoringv1.RuleGroup{
+				{Name: "Compliant", Rules: []monitoringv1.Rule{record, compliant}},
+				{Name: "Mixed", Rules: []monitoringv1.Rule{record, compliant, nonCompliant}},
+			},
+		},
+		{
+			action: RequiredAnnotationsSkip,
+			want: []monitoringv1.RuleGroup{
+				{Name: "Compliant", Rules: []monitoringv1.Rule{record, compliant}},
+				{Name: "Mixed", Rules: []monitoringv1.Rule{record, compliant}},
+			},
+		},
+		{
+			action: RequiredAnnotationsError,
+			want: []monitoringv1.RuleGroup{
+				{Name: "Compliant", Rules: []monitoringv1.Rule{record, compliant}},
+			},
+		},
+	} {
+		t.Run(string(tc.action), func(t *testing.T) {
+			k := NewKubeRulesLoader(context.TODO(), nil, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test", prometheus.NewRegistry(), WithRequiredAlertAnnotations(tc.action, "summary", "runbook_url"))
+
+			testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{
+				"test": {Groups: tc.want},
+			}, k.GetTenantMetricsRuleGroups(input))
+			testutil.Equals(t, 1.0, promtestutil.ToFloat64(k.missingAnnotationRules.WithLabelValues("test")))
+
+			// Source objects must not be modified.
+			testutil.Equals(t, []monitoringv1.Rule{record, compliant, nonCompliant}, input[1].Spec.Groups[0].Rules)
+		})
+	}
+}
+
+func TestCRDDiscovery(t *testing.T) {
+	// Only the Loki v1 CRDs are installed, so listing other kinds would fail.
+	s := runtime.NewScheme()
+	testutil.Ok(t, lokiv1.AddToScheme(s))
+
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(lokiv1.GroupVersion.WithKind("AlertingRule"), meta.RESTScopeNamespace)
+	mapper.Add(lokiv1.GroupVersion.WithKind("RecordingRule"), meta.RESTScopeNamespace)
+
+	kc := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		&lokiv1.AlertingRule{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "alerts"},
+			Spec:       lokiv1.AlertingRuleSpec{TenantID: "test"},
+		},
+	).Build()
+	reg := prometheus.NewRegistry()
+	k := NewKubeRulesLoader(context.TODO(), kc, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test", reg, WithCRDDiscovery(mapper))
+
+	promRules, err := k.GetPrometheusRules()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(promRules))
+
+	alertingRules, err := k.GetLokiAlertingRules()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(alertingRules))
+
+	recordingRules, err := k.GetLokiRecordingRules()
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(recordingRules))
+
+	// Tenants aren't synced at all for kinds whose CRDs are missing.
+	testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{}, k.GetTenantMetricsRuleGroups(promRules))
+	testutil.Equals(t, 1, len(k.GetTenantLogsAlertingRuleGroups(alertingRules)))
+
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP obsctl_reloader_crd_available Whether the CRD of a rule kind is installed; 1 if it is, 0 otherwise.
+# TYPE obsctl_reloader_crd_available gauge
+obsctl_reloader_crd_available{kind="AlertingRule.v1.loki.grafana.com"} 1
+obsctl_reloader_crd_available{kind="AlertingRule.v1beta1.loki.grafana.com"} 0
+obsctl_reloader_crd_available{kind="PrometheusRule.v1.monitoring.coreos.com"} 0
+obsctl_reloader_crd_available{kind="RecordingRule.v1.loki.grafana.com"} 1
+obsctl_reloader_crd_available{kind="RecordingRule.v1beta1.loki.grafana.com"} 0
+`), "obsctl_reloader_crd_available"))
+}
+
+func TestGetTenantMetricsRuleGroupsRecordingRuleReferences(t *testing.T) {
+	input := []*monitoringv1.PrometheusRule{
+		{
+			Spec: monitoringv1.PrometheusRuleSpec{
+				Groups: []monitoringv1.RuleGroup{
+					{
+						Name: "Recording",
+						Rules: []monitoringv1.Rule{
+							{Record: "job:up:sum", Expr: intstr.FromString(`sum by (job) (up)`)},
+						},
+					},
+				},
+			},
+			ObjectMeta: metav1.ObjectMeta{Name: "recording", Labels: map[string]string{"tenant": "test"}},
+		},
+		{
+			Spec: monitoringv1.PrometheusRuleSpec{
+				Groups: []monitoringv1.RuleGroup{
+					{
+						Name: "Alerting",
+						Rules: []monitoringv1.Rule{
+							{Alert: "Recorded", Expr: intstr.FromString(`job:up:sum == 0`)},
+							{Alert: "Raw", Expr: intstr.FromString(`up == 0`)},
+							{Alert: "Dangling", Expr: intstr.FromString(`job:up:avg == 0 or {__name__="job:up:max"} == 0`)},
+							{Alert: "Invalid", Expr: intstr.FromString(`job:up:min ==`)},
+						},
+					},
+				},
+			},
+			ObjectMeta: metav1.ObjectMeta{Name: "alerting", Labels: map[string]string{"tenant": "test"}},
+		},
+	}
+
+	testutil.Equals(t, []string{"job:up:avg", "job:up:max"}, missingRecordingRules(`job:up:avg == 0 or {__name__="job:up:max"} == 0`, map[string]struct{}{}))
+
+	k := NewKubeRulesLoader(context.TODO(), nil, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test", prometheus.NewRegistry(), WithRecordingRuleReferenceCheck(true))
+	got := k.GetTenantMetricsRuleGroups(input)
+	testutil.Equals(t, 2, len(got["test"].Groups))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(k.danglingReferenceRules.WithLabelValues("test")))
+
+	// Without the recording rule, the previously recorded reference dangles too.
+	got = k.GetTenantMetricsRuleGroups(input[1:])
+	testutil.Equals(t, 1, len(got["test"].Groups))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(k.danglingReferenceRules.WithLabelValues("test")))
+
+	k = NewKubeRulesLoader(context.TODO(), nil, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test", prometheus.NewRegistry())
+	k.GetTenantMetricsRuleGroups(input[1:])
+	testutil.Equals(t, 0, promtestutil.CollectAndCount(k.danglingReferenceRules))
+}
+
+func TestMetricsPrefix(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	NewKubeRulesLoader(context.TODO(), nil, log.NewNopLogger(), "test", "test", reg, WithMetricsPrefix("rules_sync"))
+
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP rules_sync_prom_rule_fetches_total Total number of list operations for monitoringv1 PrometheusRules.
+# TYPE rules_sync_prom_rule_fetches_total counter
+rules_sync_prom_rule_fetches_total 0
+`), "rules_sync_prom_rule_fetches_total"))
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	for _, mf := range mfs {
+		testutil.Assert(t, strings.HasPrefix(mf.GetName(), "rules_sync_"), "expected prefixed metric name, got %s", mf.GetName())
+	}
+}
@@ -0,0 +1,150 @@
+package loader
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	lokiv1 "github.com/grafana/loki/operator/apis/loki/v1"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+var _ RulesLoader = &StatusCRDRulesLoader{}
+
+// StatusCRDSource configures the custom resources StatusCRDRulesLoader reads rules from.
+type StatusCRDSource struct {
+	// Kind is the kind of the custom resources.
+	Kind schema.GroupVersionKind
+	// Path is the JSONPath of the rules within each resource, e.g. {.status.rules}. It must select either an object
+	// with rule groups, like the spec of a PrometheusRule, or a string holding a Prometheus rule file.
+	Path string
+}
+
+// StatusCRDRulesLoader implements RulesLoader interface, and loads Prometheus rules rendered into custom resources,
+// typically into their status by another controller. Each resource of the configured kind is read as a PrometheusRule
+// with the same metadata, so resources are assigned to tenants by their tenant label, as with KubeRulesLoader. Loki
+// rules are not supported, so none are ever loaded.
+type StatusCRDRulesLoader struct {
+	*KubeRulesLoader
+
+	src  StatusCRDSource
+	path *jsonpath.JSONPath
+}
+
+func NewStatusCRDRulesLoader(
+	ctx context.Context,
+	kc client.Client,
+	logger log.Logger,
+	namespace string,
+	managedTenants string,
+	src StatusCRDSource,
+	reg prometheus.Registerer,
+	opts ...Option,
+) (*StatusCRDRulesLoader, error) {
+	path := jsonpath.New("rules").AllowMissingKeys(true)
+	if err := path.Parse(src.Path); err != nil {
+		return nil, errors.Wrapf(err, "parsing JSONPath %s", src.Path)
+	}
+
+	return &StatusCRDRulesLoader{
+		KubeRulesLoader: NewKubeRulesLoader(ctx, kc, logger, namespace, managedTenants, reg, opts...),
+		src:             src,
+		path:            path,
+	}, nil
+}
+
+func (s *StatusCRDRulesLoader) GetLokiAlertingRules() ([]lokiv1.AlertingRule, error) {
+	return nil, nil
+}
+
+func (s *StatusCRDRulesLoader) GetLokiRecordingRules() ([]lokiv1.RecordingRule, error) {
+	return nil, nil
+}
+
+// GetPrometheusRules lists the custom resources in the loader's namespace, and returns the rules of each as a
+// PrometheusRule. Resources without rules at the configured path, e.g. not rendered yet, are skipped.
+func (s *StatusCRDRulesLoader) GetPrometheusRules() ([]*monitoringv1.PrometheusRule, error) {
+	if s.metricAllowlistEnabled {
+		if err := s.loadTenantAllowedMetricPrefixes(); err != nil {
+			s.promRuleFetchFailures.Inc()
+			return nil, errors.Wrap(err, "loading tenant allowed metric prefixes")
+		}
+	}
+
+	list := unstructured.UnstructuredList{}
+	list.SetGroupVersionKind(s.src.Kind.GroupVersion().WithKind(s.src.Kind.Kind + "List"))
+	if err := s.k8s.List(s.ctx, &list, client.InNamespace(s.namespace)); err != nil {
+		s.promRuleFetchFailures.Inc()
+		return nil, errors.Wrapf(err, "listing %s", s.src.Kind.Kind)
+	}
+
+	rules := make([]*monitoringv1.PrometheusRule, 0, len(list.Items))
+	for _, obj := range list.Items {
+		spec, ok, err := s.readSpec(obj.Object)
+		if err != nil {
+			level.Error(s.logger).Log("msg", "skipping resource with invalid rules", "kind", s.src.Kind.Kind, "name", obj.GetName(), "error", err)
+			continue
+		}
+		if !ok {
+			level.Debug(s.logger).Log("msg", "skipping resource without rules", "kind", s.src.Kind.Kind, "name", obj.GetName())
+			continue
+		}
+
+		rules = append(rules, &monitoringv1.PrometheusRule{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        obj.GetName(),
+				Namespace:   obj.GetNamespace(),
+				Labels:      obj.GetLabels(),
+				Annotations: obj.GetAnnotations(),
+			},
+			Spec: spec,
+		})
+	}
+
+	s.promRuleFetches.Inc()
+	return rules, nil
+}
+
+// readSpec returns the rules at the configured path of obj, or false if there are none.
+func (s *StatusCRDRulesLoader) readSpec(obj map[string]interface{}) (monitoringv1.PrometheusRuleSpec, bool, error) {
+	spec := monitoringv1.PrometheusRuleSpec{}
+
+	results, err := s.path.FindResults(obj)
+	if err != nil {
+		return spec, false, errors.Wrap(err, "evaluating JSONPath")
+	}
+	// Missing fields are expected until the rules are rendered.
+	if len(results) == 0 || len(results[0]) == 0 {
+		return spec, false, nil
+	}
+
+	var b []byte
+	switch v := results[0][0].Interface().(type) {
+	case nil:
+		return spec, false, nil
+	case string:
+		if v == "" {
+			return spec, false, nil
+		}
+		b = []byte(v)
+	default:
+		if b, err = json.Marshal(v); err != nil {
+			return spec, false, errors.Wrap(err, "encoding rules")
+		}
+	}
+
+	if err := yaml.UnmarshalStrict(b, &spec); err != nil {
+		return spec, false, errors.Wrap(err, "parsing rules")
+	}
+
+	return spec, true, nil
+}
@@ -0,0 +1,91 @@
+package loader
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var testRuleSetKind = schema.GroupVersionKind{Group: "example.com", Version: "v1", Kind: "RuleSet"}
+
+func newTestRuleSet(name, namespace, tenant string, status map[string]interface{}) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{Object: map[string]interface{}{}}
+	u.SetGroupVersionKind(testRuleSetKind)
+	u.SetName(name)
+	u.SetNamespace(namespace)
+	u.SetLabels(map[string]string{"tenant": tenant})
+	if status != nil {
+		u.Object["status"] = status
+	}
+
+	return u
+}
+
+func TestStatusCRDRulesLoader(t *testing.T) {
+	recording := monitoringv1.Rule{Record: "TestRecordingRule", Expr: intstr.FromString("vector(1)")}
+	alerting := monitoringv1.Rule{Alert: "TestAlertingRule", Expr: intstr.FromString("vector(1) > 0"), For: "5m"}
+
+	kc := fake.NewClientBuilder().WithObjects(
+		newTestRuleSet("object", "test", "test", map[string]interface{}{
+			"rules": map[string]interface{}{
+				"groups": []interface{}{
+					map[string]interface{}{
+						"name":     "TestGroup",
+						"interval": "30s",
+						"rules":    []interface{}{map[string]interface{}{"record": "TestRecordingRule", "expr": "vector(1)"}},
+					},
+				},
+			},
+		}),
+		newTestRuleSet("rule-file", "test", "test", map[string]interface{}{
+			"rules": `groups:
+- name: AlertingGroup
+  rules:
+  - alert: TestAlertingRule
+    expr: vector(1) > 0
+    for: 5m
+`,
+		}),
+		newTestRuleSet("not-rendered", "test", "test", nil),
+		newTestRuleSet("invalid", "test", "test", map[string]interface{}{"rules": "groups: {}"}),
+		newTestRuleSet("unmanaged", "test", "unmanaged", map[string]interface{}{"rules": "groups: []"}),
+		newTestRuleSet("other-namespace", "other", "test", map[string]interface{}{"rules": "groups: []"}),
+	).Build()
+
+	s, err := NewStatusCRDRulesLoader(context.TODO(), kc, log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)), "test", "test", StatusCRDSource{
+		Kind: testRuleSetKind,
+		Path: "{.status.rules}",
+	}, prometheus.NewRegistry())
+	testutil.Ok(t, err)
+
+	rules, err := s.GetPrometheusRules()
+	testutil.Ok(t, err)
+
+	names := []string{}
+	for _, r := range rules {
+		names = append(names, r.Name)
+	}
+	testutil.Equals(t, []string{"object", "rule-file", "unmanaged"}, names)
+
+	testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{
+		"test": {Groups: []monitoringv1.RuleGroup{
+			{Name: "AlertingGroup", Rules: []monitoringv1.Rule{alerting}},
+			{Name: "TestGroup", Interval: "30s", Rules: []monitoringv1.Rule{recording}},
+		}},
+	}, s.GetTenantMetricsRuleGroups(rules))
+
+	_, err = NewStatusCRDRulesLoader(context.TODO(), kc, log.NewNopLogger(), "test", "test", StatusCRDSource{
+		Kind: testRuleSetKind,
+		Path: "{.status.rules",
+	}, prometheus.NewRegistry())
+	testutil.NotOk(t, err)
+}
@@ -0,0 +1,152 @@
+package loader
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// SyncStatusAnnotationPrefix prefixes the PrometheusRule annotations holding the sync status of each tenant, e.g.
+// sync-status.obsctl-reloader.rhobs/<tenant>.
+const SyncStatusAnnotationPrefix = "sync-status.obsctl-reloader.rhobs/"
+
+// SyncStatus is the outcome of the last sync of a tenant's rules, as written to the PrometheusRules they were loaded
+// from.
+type SyncStatus struct {
+	// LastSyncTime is the time of the first sync with this outcome, as an unchanged status isn't written again.
+	LastSyncTime time.Time `json:"lastSyncTime"`
+	// RuleCount is the number of rules the PrometheusRule contributed to the tenant.
+	RuleCount int    `json:"ruleCount"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ruleSource is a PrometheusRule which contributed rules to a tenant.
+type ruleSource struct {
+	key   types.NamespacedName
+	uid   types.UID
+	rules int
+}
+
+// writtenStatus identifies a sync status written to a PrometheusRule, regardless of the sync time.
+type writtenStatus struct {
+	tenant string
+	source ruleSource
+}
+
+// syncSources records the PrometheusRules each tenant's rules were last loaded from, and the last sync status written
+// to them, so that unchanged statuses aren't patched again on every sync.
+type syncSources struct {
+	mu      sync.Mutex
+	tenants map[string][]ruleSource
+	written map[writtenStatus]string
+}
+
+// WithSyncStatus makes the loader remember which PrometheusRules each tenant's rules were loaded from, so that
+// WriteSyncStatus can annotate them with the outcome of the tenant's sync. This requires patch permissions on
+// PrometheusRules.
+func WithSyncStatus(enabled bool) Option {
+	return func(k *KubeRulesLoader) {
+		if enabled {
+			k.syncSources = &syncSources{tenants: map[string][]ruleSource{}, written: map[writtenStatus]string{}}
+		}
+	}
+}
+
+// recordSyncSources replaces the PrometheusRules the rules of each tenant were loaded from, if sync status is enabled.
+func (k *KubeRulesLoader) recordSyncSources(sources map[string][]ruleSource) {
+	if k.syncSources == nil {
+		return
+	}
+
+	k.syncSources.mu.Lock()
+	defer k.syncSources.mu.Unlock()
+	k.syncSources.tenants = sources
+
+	// Forget the statuses written to PrometheusRules which no longer contribute the same rules to the tenant.
+	current := map[writtenStatus]struct{}{}
+	for tenant, srcs := range sources {
+		for _, src := range srcs {
+			current[writtenStatus{tenant: tenant, source: src}] = struct{}{}
+		}
+	}
+	for w := range k.syncSources.written {
+		if _, ok := current[w]; !ok {
+			delete(k.syncSources.written, w)
+		}
+	}
+}
+
+// WriteSyncStatus annotates the PrometheusRules the tenant's rules were last loaded from with the outcome of syncing
+// them, syncErr being nil on success. PrometheusRules whose rule count and error are unchanged since the last status
+// written to them aren't patched again. It does nothing unless sync status is enabled.
+func (k *KubeRulesLoader) WriteSyncStatus(tenant string, syncErr error) error {
+	if k.syncSources == nil {
+		return nil
+	}
+
+	k.syncSources.mu.Lock()
+	sources := k.syncSources.tenants[tenant]
+	k.syncSources.mu.Unlock()
+
+	var errMsg string
+	if syncErr != nil {
+		errMsg = syncErr.Error()
+	}
+
+	now := time.Now().UTC()
+	// Keep annotating the remaining PrometheusRules if one fails, e.g. because it was just deleted.
+	var firstErr error
+	for _, src := range sources {
+		w := writtenStatus{tenant: tenant, source: src}
+		k.syncSources.mu.Lock()
+		last, ok := k.syncSources.written[w]
+		k.syncSources.mu.Unlock()
+		if ok && last == errMsg {
+			continue
+		}
+
+		status := SyncStatus{LastSyncTime: now, RuleCount: src.rules, Error: errMsg}
+		value, err := json.Marshal(status)
+		if err != nil {
+			return errors.Wrap(err, "encoding sync status")
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"annotations": map[string]string{SyncStatusAnnotationPrefix + tenant: string(value)},
+			},
+		})
+		if err != nil {
+			return errors.Wrap(err, "encoding sync status patch")
+		}
+
+		pr := &monitoringv1.PrometheusRule{}
+		pr.Namespace, pr.Name = src.key.Namespace, src.key.Name
+		if err := k.k8s.Patch(k.ctx, pr, client.RawPatch(types.MergePatchType, patch)); err != nil {
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "writing sync status of prometheus rule %s", src.key)
+			}
+			continue
+		}
+
+		k.syncSources.mu.Lock()
+		k.syncSources.written[w] = errMsg
+		k.syncSources.mu.Unlock()
+	}
+
+	return firstErr
+}
+
+// countRules returns the number of rules in groups.
+func countRules(groups []monitoringv1.RuleGroup) int {
+	n := 0
+	for _, g := range groups {
+		n += len(g.Rules)
+	}
+
+	return n
+}
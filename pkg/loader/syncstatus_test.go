@@ -0,0 +1,144 @@
+package loader
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// patchCountingClient counts Patch calls.
+type patchCountingClient struct {
+	client.Client
+	patches int
+}
+
+func (c *patchCountingClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	c.patches++
+	return c.Client.Patch(ctx, obj, patch, opts...)
+}
+
+func TestWriteSyncStatus(t *testing.T) {
+	s := runtime.NewScheme()
+	testutil.Ok(t, monitoringv1.AddToScheme(s))
+
+	rule := func(name, tenant string, rules ...string) *monitoringv1.PrometheusRule {
+		var rs []monitoringv1.Rule
+		for _, r := range rules {
+			rs = append(rs, monitoringv1.Rule{Record: r, Expr: intstr.FromString("up")})
+		}
+		return &monitoringv1.PrometheusRule{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "test",
+				Name:        name,
+				Labels:      map[string]string{"tenant": tenant},
+				Annotations: map[string]string{"team": "observability"},
+			},
+			Spec: monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{{Name: "TestGroup", Rules: rs}}},
+		}
+	}
+	kc := fake.NewClientBuilder().WithScheme(s).WithObjects(
+		rule("shared", "a,b", "a:up", "b:up"),
+		rule("only-a", "a", "c:up"),
+	).Build()
+
+	k := NewKubeRulesLoader(context.TODO(), kc, log.NewNopLogger(), "test", "a,b", prometheus.NewRegistry(), WithSyncStatus(true))
+	prs, err := k.GetPrometheusRules()
+	testutil.Ok(t, err)
+	k.GetTenantMetricsRuleGroups(prs)
+
+	testutil.Ok(t, k.WriteSyncStatus("a", nil))
+	testutil.Ok(t, k.WriteSyncStatus("b", errors.New("rejected by API")))
+
+	status := func(name, tenant string) (SyncStatus, bool) {
+		var pr monitoringv1.PrometheusRule
+		testutil.Ok(t, kc.Get(context.TODO(), types.NamespacedName{Namespace: "test", Name: name}, &pr))
+		// Existing annotations are kept.
+		testutil.Equals(t, "observability", pr.Annotations["team"])
+
+		v, ok := pr.Annotations[SyncStatusAnnotationPrefix+tenant]
+		if !ok {
+			return SyncStatus{}, false
+		}
+		var st SyncStatus
+		testutil.Ok(t, json.Unmarshal([]byte(v), &st))
+		return st, true
+	}
+
+	st, ok := status("shared", "a")
+	testutil.Assert(t, ok, "expected status of tenant a on shared rule")
+	testutil.Equals(t, 2, st.RuleCount)
+	testutil.Equals(t, "", st.Error)
+	testutil.Assert(t, !st.LastSyncTime.IsZero(), "expected last sync time")
+
+	st, ok = status("shared", "b")
+	testutil.Assert(t, ok, "expected status of tenant b on shared rule")
+	testutil.Equals(t, "rejected by API", st.Error)
+
+	st, ok = status("only-a", "a")
+	testutil.Assert(t, ok, "expected status of tenant a")
+	testutil.Equals(t, 1, st.RuleCount)
+	_, ok = status("only-a", "b")
+	testutil.Assert(t, !ok, "expected no status of tenant b on a rule it has no rules in")
+}
+
+func TestWriteSyncStatusOnlyPatchesChanges(t *testing.T) {
+	s := runtime.NewScheme()
+	testutil.Ok(t, monitoringv1.AddToScheme(s))
+
+	pr := &monitoringv1.PrometheusRule{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "rule", Labels: map[string]string{"tenant": "a"}},
+		Spec: monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{{
+			Name:  "TestGroup",
+			Rules: []monitoringv1.Rule{{Record: "a:up", Expr: intstr.FromString("up")}},
+		}}},
+	}
+	kc := &patchCountingClient{Client: fake.NewClientBuilder().WithScheme(s).WithObjects(pr).Build()}
+	k := NewKubeRulesLoader(context.TODO(), kc, log.NewNopLogger(), "test", "a", prometheus.NewRegistry(), WithSyncStatus(true))
+
+	sync := func(syncErr error) {
+		prs, err := k.GetPrometheusRules()
+		testutil.Ok(t, err)
+		k.GetTenantMetricsRuleGroups(prs)
+		testutil.Ok(t, k.WriteSyncStatus("a", syncErr))
+	}
+
+	sync(nil)
+	testutil.Equals(t, 1, kc.patches)
+	// Unchanged status.
+	sync(nil)
+	testutil.Equals(t, 1, kc.patches)
+
+	// Changed error.
+	sync(errors.New("rejected by API"))
+	testutil.Equals(t, 2, kc.patches)
+	sync(errors.New("rejected by API"))
+	testutil.Equals(t, 2, kc.patches)
+
+	// Changed rule count.
+	testutil.Ok(t, kc.Get(context.TODO(), types.NamespacedName{Namespace: "test", Name: "rule"}, pr))
+	pr.Spec.Groups[0].Rules = append(pr.Spec.Groups[0].Rules, monitoringv1.Rule{Record: "b:up", Expr: intstr.FromString("up")})
+	testutil.Ok(t, kc.Update(context.TODO(), pr))
+	sync(errors.New("rejected by API"))
+	testutil.Equals(t, 3, kc.patches)
+}
+
+func TestWriteSyncStatusDisabled(t *testing.T) {
+	// Without sync status enabled, nothing is written, so no client is needed.
+	k := NewKubeRulesLoader(context.TODO(), nil, log.NewNopLogger(), "test", "a", prometheus.NewRegistry())
+	k.GetTenantMetricsRuleGroups([]*monitoringv1.PrometheusRule{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "test", Name: "rule", Labels: map[string]string{"tenant": "a"}},
+	}})
+	testutil.Ok(t, k.WriteSyncStatus("a", nil))
+}
@@ -0,0 +1,86 @@
+package loop
+
+import (
+	"sort"
+	"strings"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+type recordingRuleKey struct {
+	tenant string
+	group  string
+	record string
+}
+
+// recordingRuleIdentities tracks the output label set of each tenant's recording rules across sync cycles, to detect
+// changes which make a rule produce new series, orphaning the previous ones.
+type recordingRuleIdentities struct {
+	previous map[recordingRuleKey]string
+}
+
+func newRecordingRuleIdentities() *recordingRuleIdentities {
+	return &recordingRuleIdentities{previous: map[recordingRuleKey]string{}}
+}
+
+// observe records the output label sets of a tenant's recording rules and returns the names of the rules whose
+// output label set changed since they were last observed. Rules observed for the first time are not reported.
+func (r *recordingRuleIdentities) observe(tenant string, spec monitoringv1.PrometheusRuleSpec) []string {
+	var changed []string
+	for _, g := range spec.Groups {
+		for _, rule := range g.Rules {
+			if rule.Record == "" {
+				continue
+			}
+
+			k := recordingRuleKey{tenant: tenant, group: g.Name, record: rule.Record}
+			id := outputLabels(rule)
+			if prev, ok := r.previous[k]; ok && prev != id {
+				changed = append(changed, rule.Record)
+			}
+			r.previous[k] = id
+		}
+	}
+
+	return changed
+}
+
+// outputLabels returns a representation of the labels a recording rule's series are identified by: its static labels,
+// plus the grouping of the expression's outermost aggregation, if any. Changes to other parts of the expression
+// usually keep series identity, so they are ignored.
+func outputLabels(rule monitoringv1.Rule) string {
+	lbls := make([]string, 0, len(rule.Labels))
+	for k, v := range rule.Labels {
+		lbls = append(lbls, k+"="+v)
+	}
+	sort.Strings(lbls)
+	id := "{" + strings.Join(lbls, ",") + "}"
+
+	expr, err := parser.ParseExpr(rule.Expr.String())
+	if err != nil {
+		// Invalid expressions are rejected by the API anyway.
+		return id
+	}
+
+	for {
+		p, ok := expr.(*parser.ParenExpr)
+		if !ok {
+			break
+		}
+		expr = p.Expr
+	}
+
+	if agg, ok := expr.(*parser.AggregateExpr); ok {
+		grouping := append([]string(nil), agg.Grouping...)
+		sort.Strings(grouping)
+
+		mod := " by "
+		if agg.Without {
+			mod = " without "
+		}
+		id += mod + "(" + strings.Join(grouping, ",") + ")"
+	}
+
+	return id
+}
@@ -0,0 +1,52 @@
+package loop
+
+import (
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestRecordingRuleIdentities(t *testing.T) {
+	spec := func(rule monitoringv1.Rule) monitoringv1.PrometheusRuleSpec {
+		return monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{{Name: "TestGroup", Rules: []monitoringv1.Rule{rule}}}}
+	}
+	r := newRecordingRuleIdentities()
+
+	// First observation is not a change.
+	testutil.Equals(t, []string(nil), r.observe("test", spec(monitoringv1.Rule{
+		Record: "job:up:sum",
+		Expr:   intstr.FromString("sum by (job) (up)"),
+	})))
+
+	// Changing the expression without changing the output labels keeps series identity.
+	testutil.Equals(t, []string(nil), r.observe("test", spec(monitoringv1.Rule{
+		Record: "job:up:sum",
+		Expr:   intstr.FromString(`(sum by (job) (up{env="prod"}))`),
+	})))
+
+	// Adding a static label creates new series.
+	testutil.Equals(t, []string{"job:up:sum"}, r.observe("test", spec(monitoringv1.Rule{
+		Record: "job:up:sum",
+		Expr:   intstr.FromString(`sum by (job) (up{env="prod"})`),
+		Labels: map[string]string{"tenant": "test"},
+	})))
+
+	// Adding a grouping label creates new series.
+	testutil.Equals(t, []string{"job:up:sum"}, r.observe("test", spec(monitoringv1.Rule{
+		Record: "job:up:sum",
+		Expr:   intstr.FromString(`sum by (job, instance) (up{env="prod"})`),
+		Labels: map[string]string{"tenant": "test"},
+	})))
+
+	// Other tenants and alerting rules are tracked separately.
+	testutil.Equals(t, []string(nil), r.observe("other", spec(monitoringv1.Rule{
+		Record: "job:up:sum",
+		Expr:   intstr.FromString("sum(up)"),
+	})))
+	testutil.Equals(t, []string(nil), r.observe("test", spec(monitoringv1.Rule{
+		Alert: "Down",
+		Expr:  intstr.FromString("up == 0"),
+	})))
+}
@@ -0,0 +1,81 @@
+package loop
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metrics are the metrics exported by SyncLoop.
+type metrics struct {
+	tenantsWithZeroRules         prometheus.Gauge
+	pendingChangeAge             *prometheus.GaugeVec
+	recordingRuleIdentityChanges *prometheus.CounterVec
+	estimatedSeriesDelta         *prometheus.GaugeVec
+	cycleTimeouts                prometheus.Counter
+	lastConfigReload             prometheus.Gauge
+	totalRuleBytes               *prometheus.GaugeVec
+	requeues                     *prometheus.CounterVec
+	lokiUnavailable              *prometheus.CounterVec
+	pausedGauge                  prometheus.Gauge
+}
+
+// RegisterMetrics registers the metrics of SyncLoop configured with opts with reg, without running it, e.g. to check
+// for duplicate metrics at startup.
+func RegisterMetrics(reg prometheus.Registerer, opts ...Option) {
+	newMetrics(reg, newOptions(opts...))
+}
+
+func newMetrics(reg prometheus.Registerer, opt options) *metrics {
+	return &metrics{
+		tenantsWithZeroRules: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Namespace: opt.metricsPrefix,
+			Name:      "tenants_with_zero_rules",
+			Help:      "Number of managed tenants without any metrics or logs rule groups in the last sync cycle.",
+		}),
+		pendingChangeAge: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: opt.metricsPrefix,
+			Name:      "pending_change_age_seconds",
+			Help:      "Age of the oldest rule change of a tenant which was loaded but not yet synced successfully.",
+		}, []string{"tenant"}),
+		recordingRuleIdentityChanges: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Namespace: opt.metricsPrefix,
+			Name:      "recording_rule_identity_change_total",
+			Help:      "Total number of recording rules whose output labels changed between sync cycles, creating new series.",
+		}, []string{"tenant"}),
+		estimatedSeriesDelta: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: opt.metricsPrefix,
+			Name:      "estimated_series_delta",
+			Help:      "Change of the estimated number of series produced by a tenant's recording rules, as of their last change.",
+		}, []string{"tenant"}),
+		cycleTimeouts: promauto.With(reg).NewCounter(prometheus.CounterOpts{
+			Namespace: opt.metricsPrefix,
+			Name:      "cycle_timeout_total",
+			Help:      "Total number of sync cycles aborted for exceeding the maximum cycle duration.",
+		}),
+		lastConfigReload: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Namespace: opt.metricsPrefix,
+			Name:      "config_last_reload_timestamp_seconds",
+			Help:      "Unix timestamp of the last successful obsctl config reload.",
+		}),
+		totalRuleBytes: promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: opt.metricsPrefix,
+			Name:      "total_rule_bytes",
+			Help:      "Total size in bytes of the YAML encoded rules synced in the last complete sync cycle, across all tenants.",
+		}, []string{"type"}),
+		requeues: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Namespace: opt.metricsPrefix,
+			Name:      "requeued_syncs_total",
+			Help:      "Total number of failed rule syncs retried at the end of a sync cycle, by result.",
+		}, []string{"tenant", "type", "result"}),
+		lokiUnavailable: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+			Namespace: opt.metricsPrefix,
+			Name:      "loki_unavailable_total",
+			Help:      "Total number of sync cycles which skipped Loki rules of a type, because listing them failed.",
+		}, []string{"type"}),
+		pausedGauge: promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+			Namespace: opt.metricsPrefix,
+			Name:      "paused",
+			Help:      "Whether syncing is paused; 1 if paused, 0 otherwise.",
+		}),
+	}
+}
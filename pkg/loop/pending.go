@@ -0,0 +1,80 @@
+package loop
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"time"
+)
+
+type pendingKey struct {
+	tenant string
+	signal string
+}
+
+// pendingChanges tracks, per tenant and signal, since when the loaded rules differ from the last
+// successfully synced ones.
+type pendingChanges struct {
+	now func() time.Time
+
+	synced map[pendingKey]uint64
+	since  map[pendingKey]time.Time
+}
+
+func newPendingChanges() *pendingChanges {
+	return &pendingChanges{
+		now:    time.Now,
+		synced: map[pendingKey]uint64{},
+		since:  map[pendingKey]time.Time{},
+	}
+}
+
+// observe records the currently loaded rules of a tenant's signal and returns their hash, which should be passed
+// to markSynced once they are synced successfully.
+func (p *pendingChanges) observe(tenant, signal string, rules interface{}) uint64 {
+	k := pendingKey{tenant: tenant, signal: signal}
+	h := hashRules(rules)
+
+	if synced, ok := p.synced[k]; ok && synced == h {
+		delete(p.since, k)
+		return h
+	}
+
+	if _, ok := p.since[k]; !ok {
+		p.since[k] = p.now()
+	}
+
+	return h
+}
+
+// markSynced clears the pending change of a tenant's signal, if the synced rules are still the latest observed ones.
+func (p *pendingChanges) markSynced(tenant, signal string, h uint64) {
+	k := pendingKey{tenant: tenant, signal: signal}
+	p.synced[k] = h
+	delete(p.since, k)
+}
+
+// ages returns the age of the oldest pending change of each observed tenant, zero if there's none.
+func (p *pendingChanges) ages() map[string]time.Duration {
+	res := map[string]time.Duration{}
+	for k := range p.synced {
+		res[k.tenant] = 0
+	}
+
+	now := p.now()
+	for k, since := range p.since {
+		if age := now.Sub(since); age > res[k.tenant] {
+			res[k.tenant] = age
+		}
+	}
+
+	return res
+}
+
+func hashRules(rules interface{}) uint64 {
+	// Rule specs are plain data, so marshaling them can't fail.
+	b, _ := json.Marshal(rules)
+
+	h := fnv.New64a()
+	_, _ = h.Write(b)
+	return h.Sum64()
+}
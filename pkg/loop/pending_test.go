@@ -0,0 +1,52 @@
+package loop
+
+import (
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/testutil"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+)
+
+func TestPendingChanges(t *testing.T) {
+	now := time.Unix(0, 0)
+	p := newPendingChanges()
+	p.now = func() time.Time { return now }
+
+	v1 := monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{{Name: "v1"}}}
+	v2 := monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{{Name: "v2"}}}
+
+	// Rules loaded for the first time are pending until synced.
+	h := p.observe("test", "metrics", v1)
+	now = now.Add(10 * time.Second)
+	testutil.Equals(t, map[string]time.Duration{"test": 10 * time.Second}, p.ages())
+
+	p.markSynced("test", "metrics", h)
+	testutil.Equals(t, map[string]time.Duration{"test": 0}, p.ages())
+
+	// Unchanged rules are not pending.
+	p.observe("test", "metrics", v1)
+	now = now.Add(10 * time.Second)
+	testutil.Equals(t, map[string]time.Duration{"test": 0}, p.ages())
+
+	// A change stays pending across failed syncs, keeping the time it was first observed.
+	p.observe("test", "metrics", v2)
+	now = now.Add(10 * time.Second)
+	h = p.observe("test", "metrics", v2)
+	now = now.Add(5 * time.Second)
+	testutil.Equals(t, map[string]time.Duration{"test": 15 * time.Second}, p.ages())
+
+	// The oldest pending signal determines the tenant's age.
+	p.observe("test", "logs_alerting", v1)
+	now = now.Add(5 * time.Second)
+	testutil.Equals(t, map[string]time.Duration{"test": 20 * time.Second}, p.ages())
+
+	p.markSynced("test", "metrics", h)
+	testutil.Equals(t, map[string]time.Duration{"test": 5 * time.Second}, p.ages())
+
+	// Reverting to the synced rules clears the pending change.
+	p.markSynced("test", "logs_alerting", p.observe("test", "logs_alerting", v1))
+	p.observe("test", "metrics", v1)
+	p.observe("test", "metrics", v2)
+	testutil.Equals(t, map[string]time.Duration{"test": 0}, p.ages())
+}
@@ -0,0 +1,74 @@
+package loop
+
+import (
+	"math"
+
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	// assumedLabelValues is the number of distinct values assumed for each label a recording rule aggregates by.
+	assumedLabelValues = 10
+	// assumedUngroupedSeries is the number of series assumed for a recording rule whose output keeps the labels of
+	// the selected series, i.e. which doesn't aggregate, or aggregates without some labels.
+	assumedUngroupedSeries = 1000
+)
+
+// seriesEstimates tracks a rough estimate of the number of series produced by each tenant's recording rules across
+// sync cycles. As the actual cardinality of labels isn't known, it's only meant to point at changes with a large
+// impact, e.g. a new label to aggregate by.
+type seriesEstimates struct {
+	previous map[string]float64
+}
+
+func newSeriesEstimates() *seriesEstimates {
+	return &seriesEstimates{previous: map[string]float64{}}
+}
+
+// observe records the estimated number of series of a tenant's recording rules, and returns how much it changed since
+// it was last observed, or false if it didn't change. The first observation of a tenant is not reported.
+func (s *seriesEstimates) observe(tenant string, spec monitoringv1.PrometheusRuleSpec) (float64, bool) {
+	total := 0.0
+	for _, g := range spec.Groups {
+		for _, rule := range g.Rules {
+			if rule.Record != "" {
+				total += estimateSeries(rule.Expr.String())
+			}
+		}
+	}
+
+	prev, ok := s.previous[tenant]
+	s.previous[tenant] = total
+	if !ok || prev == total {
+		return 0, false
+	}
+
+	return total - prev, true
+}
+
+// estimateSeries returns the estimated number of series produced by a recording rule expression, based on the
+// grouping of its outermost aggregation: one series without grouping labels, and assumedLabelValues times as many for
+// each grouping label.
+func estimateSeries(expr string) float64 {
+	e, err := parser.ParseExpr(expr)
+	if err != nil {
+		// Invalid expressions are rejected by the API anyway.
+		return 0
+	}
+
+	for {
+		p, ok := e.(*parser.ParenExpr)
+		if !ok {
+			break
+		}
+		e = p.Expr
+	}
+
+	agg, ok := e.(*parser.AggregateExpr)
+	if !ok || agg.Without {
+		return assumedUngroupedSeries
+	}
+
+	return math.Pow(assumedLabelValues, float64(len(agg.Grouping)))
+}
@@ -0,0 +1,64 @@
+package loop
+
+import (
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestEstimateSeries(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		want float64
+	}{
+		{expr: "sum(up)", want: 1},
+		{expr: "(sum(rate(http_requests_total[5m])))", want: 1},
+		{expr: "sum by (job) (up)", want: 10},
+		{expr: "topk by (job, instance) (5, up)", want: 100},
+		{expr: "sum without (instance) (up)", want: assumedUngroupedSeries},
+		{expr: "rate(http_requests_total[5m])", want: assumedUngroupedSeries},
+		{expr: "sum(", want: 0},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			testutil.Equals(t, tc.want, estimateSeries(tc.expr))
+		})
+	}
+}
+
+func TestSeriesEstimates(t *testing.T) {
+	spec := func(exprs ...string) monitoringv1.PrometheusRuleSpec {
+		rules := []monitoringv1.Rule{{Alert: "Ignored", Expr: intstr.FromString("up == 0")}}
+		for _, e := range exprs {
+			rules = append(rules, monitoringv1.Rule{Record: "record", Expr: intstr.FromString(e)})
+		}
+		return monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{{Name: "TestGroup", Rules: rules}}}
+	}
+	s := newSeriesEstimates()
+
+	// First observation is not a change.
+	_, changed := s.observe("test", spec("sum by (job) (up)"))
+	testutil.Assert(t, !changed, "expected no change on first observation")
+
+	// Changing the expression without changing the output dimensions keeps the estimate.
+	_, changed = s.observe("test", spec(`sum by (job) (up{env="prod"})`))
+	testutil.Assert(t, !changed, "expected no change for the same grouping")
+
+	// Aggregating by another label multiplies the series.
+	delta, changed := s.observe("test", spec("sum by (job, instance) (up)"))
+	testutil.Assert(t, changed, "expected a change for an added grouping label")
+	testutil.Equals(t, 90.0, delta)
+
+	// Adding a recording rule adds its series.
+	delta, changed = s.observe("test", spec("sum by (job, instance) (up)", "sum(up)"))
+	testutil.Assert(t, changed, "expected a change for an added rule")
+	testutil.Equals(t, 1.0, delta)
+
+	// Removing rules is a negative change, and tenants are tracked separately.
+	delta, changed = s.observe("test", spec())
+	testutil.Assert(t, changed, "expected a change for removed rules")
+	testutil.Equals(t, -101.0, delta)
+	_, changed = s.observe("other", spec("sum(up)"))
+	testutil.Assert(t, !changed, "expected no change on first observation of another tenant")
+}
@@ -0,0 +1,57 @@
+package loop
+
+import (
+	"hash/fnv"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// WithShard restricts syncing to the managed tenants in shard index of total, so that tenants can be split across
+// replicas without leader election. Each tenant belongs to exactly one shard, and changing total only moves the
+// tenants of about 1/total of the shards. SyncLoop fails if index isn't between 0 and total-1.
+func WithShard(index, total int) Option {
+	return func(o *options) {
+		o.shardIndex = index
+		o.shardTotal = total
+	}
+}
+
+// validateShard returns an error if the configured shard doesn't exist, as its replica would sync no tenants, or all
+// tenants if total is below 1, along with the other replicas.
+func (o options) validateShard() error {
+	if o.shardTotal < 1 {
+		return errors.Newf("invalid shard total %d, must be at least 1", o.shardTotal)
+	}
+	if o.shardIndex < 0 || o.shardIndex >= o.shardTotal {
+		return errors.Newf("invalid shard index %d, must be between 0 and %d", o.shardIndex, o.shardTotal-1)
+	}
+
+	return nil
+}
+
+// inShard returns true if tenant belongs to the configured shard, or if tenants aren't sharded.
+func (o options) inShard(tenant string) bool {
+	if o.shardTotal <= 1 {
+		return true
+	}
+
+	return tenantShard(tenant, o.shardTotal) == o.shardIndex
+}
+
+// tenantShard returns the shard of tenant out of total, using jump consistent hashing of the tenant name's FNV-1a
+// hash.
+func tenantShard(tenant string, total int) int {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(tenant))
+	key := h.Sum64()
+
+	// See "A Fast, Minimal Memory, Consistent Hash Algorithm", Lamping and Veach.
+	b, j := int64(-1), int64(0)
+	for j < int64(total) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
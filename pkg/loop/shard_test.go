@@ -0,0 +1,67 @@
+package loop
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestTenantShard(t *testing.T) {
+	tenants := make([]string, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		tenants = append(tenants, fmt.Sprintf("tenant-%d", i))
+	}
+
+	for _, total := range []int{1, 2, 3, 7} {
+		t.Run(fmt.Sprint(total), func(t *testing.T) {
+			perShard := make([]int, total)
+			for _, tenant := range tenants {
+				// Each tenant is synced by exactly one shard.
+				synced := 0
+				for index := 0; index < total; index++ {
+					if (options{shardIndex: index, shardTotal: total}).inShard(tenant) {
+						synced++
+						perShard[index]++
+					}
+				}
+				testutil.Equals(t, 1, synced, "tenant %s", tenant)
+				testutil.Equals(t, tenantShard(tenant, total), tenantShard(tenant, total))
+			}
+
+			// All tenants are covered, and spread roughly evenly.
+			sum := 0
+			for index, n := range perShard {
+				sum += n
+				testutil.Assert(t, n > len(tenants)/total/2, "shard %d only has %d tenants", index, n)
+			}
+			testutil.Equals(t, len(tenants), sum)
+		})
+	}
+
+	// Adding a shard only moves tenants to the new shard.
+	for _, tenant := range tenants {
+		if s := tenantShard(tenant, 4); s != 3 {
+			testutil.Equals(t, tenantShard(tenant, 3), s, "tenant %s", tenant)
+		}
+	}
+}
+
+func TestInactiveShard(t *testing.T) {
+	o := options{shardIndex: tenantShard("a", 3), shardTotal: 3}
+	testutil.Assert(t, !o.inactive("a"))
+
+	o.shardIndex = (o.shardIndex + 1) % 3
+	testutil.Assert(t, o.inactive("a"))
+
+	// Tenants aren't sharded by default.
+	testutil.Assert(t, !(options{}).inactive("a"))
+}
+
+func TestValidateShard(t *testing.T) {
+	testutil.Ok(t, newOptions().validateShard())
+	testutil.Ok(t, newOptions(WithShard(2, 3)).validateShard())
+	testutil.NotOk(t, newOptions(WithShard(3, 3)).validateShard())
+	testutil.NotOk(t, newOptions(WithShard(-1, 3)).validateShard())
+	testutil.NotOk(t, newOptions(WithShard(0, 0)).validateShard())
+}
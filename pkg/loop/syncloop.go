@@ -6,13 +6,198 @@ import (
 
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
+	lokiv1 "github.com/grafana/loki/operator/apis/loki/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
 
 	"github.com/rhobs/obsctl-reloader/pkg/loader"
+	"github.com/rhobs/obsctl-reloader/pkg/metricsprefix"
 	"github.com/rhobs/obsctl-reloader/pkg/syncer"
+	"github.com/rhobs/obsctl-reloader/pkg/tenantlabel"
 )
 
+// Option configures optional behavior of SyncLoop.
+type Option func(o *options)
+
+type options struct {
+	initialSyncDelay       time.Duration
+	maxCycleDuration       time.Duration
+	activeTenants          map[string]struct{}
+	shardIndex             int
+	shardTotal             int
+	metricsDisabledTenants map[string]struct{}
+	logsDisabledTenants    map[string]struct{}
+	sanitizeTenantLabels   bool
+	metricsPrefix          string
+	pauseCheck             func() (bool, error)
+	runOnce                bool
+	lokiAlerting           bool
+	lokiRecording          bool
+	requeueFailed          bool
+	requeueDelay           time.Duration
+	estimateSeriesImpact   bool
+	syncStatus             SyncStatusWriter
+}
+
+// SyncStatusWriter records the outcome of syncing a tenant's metrics rules, e.g. where GitOps tooling can watch it.
+type SyncStatusWriter interface {
+	WriteSyncStatus(tenant string, syncErr error) error
+}
+
+// tenantLabel returns the tenant label value of metrics for tenant.
+func (o options) tenantLabel(tenant string) string {
+	if o.sanitizeTenantLabels {
+		return tenantlabel.Sanitize(tenant)
+	}
+
+	return tenant
+}
+
+// inactive returns true if syncing is restricted to a set of active tenants which doesn't include tenant, or to a
+// shard which tenant doesn't belong to.
+func (o options) inactive(tenant string) bool {
+	if !o.inShard(tenant) {
+		return true
+	}
+	if o.activeTenants == nil {
+		return false
+	}
+
+	_, active := o.activeTenants[tenant]
+	return !active
+}
+
+// WithSanitizedTenantLabels sanitizes the tenant label values of the loop's metrics with tenantlabel.Sanitize.
+func WithSanitizedTenantLabels(enabled bool) Option {
+	return func(o *options) {
+		o.sanitizeTenantLabels = enabled
+	}
+}
+
+// WithMetricsPrefix sets the prefix of the names of the loop's metrics, in place of metricsprefix.Default.
+func WithMetricsPrefix(prefix string) Option {
+	return func(o *options) {
+		o.metricsPrefix = prefix
+	}
+}
+
+// WithInitialSyncDelay delays the first sync, including one triggered by a reload, by d after SyncLoop starts.
+func WithInitialSyncDelay(d time.Duration) Option {
+	return func(o *options) {
+		o.initialSyncDelay = d
+	}
+}
+
+// WithMaxCycleDuration caps the duration of a sync cycle. Once exceeded, rules of the remaining tenants are not synced
+// until the next cycle, so that e.g. many slow tenants can't delay config reloads indefinitely. Zero means no limit.
+func WithMaxCycleDuration(d time.Duration) Option {
+	return func(o *options) {
+		o.maxCycleDuration = d
+	}
+}
+
+// WithLokiRuleTypes sets which types of Loki rules are synced, if syncing Loki rules is enabled. Both are synced by
+// default. Disabled types aren't loaded either.
+func WithLokiRuleTypes(alerting, recording bool) Option {
+	return func(o *options) {
+		o.lokiAlerting = alerting
+		o.lokiRecording = recording
+	}
+}
+
+// WithRunOnce makes SyncLoop sync rules a single time, after the initial sync delay, and return.
+func WithRunOnce(enabled bool) Option {
+	return func(o *options) {
+		o.runOnce = enabled
+	}
+}
+
+// WithRequeueFailedOnce retries the failed syncs of a cycle once more, delay after all other tenants were synced,
+// rather than waiting for the next cycle, e.g. to recover from transient Observatorium API errors faster.
+func WithRequeueFailedOnce(delay time.Duration) Option {
+	return func(o *options) {
+		o.requeueFailed = true
+		o.requeueDelay = delay
+	}
+}
+
+// WithSeriesImpactEstimate estimates the number of series produced by each tenant's recording rules from the labels
+// they aggregate by, and reports changes of the estimate between sync cycles. The estimate is a rough heuristic, only
+// meant to flag rule changes likely to affect cardinality.
+func WithSeriesImpactEstimate(enabled bool) Option {
+	return func(o *options) {
+		o.estimateSeriesImpact = enabled
+	}
+}
+
+// WithSyncStatusWriter writes the outcome of each sync of a tenant's metrics rules, including retries, with w. Failing to
+// write it is logged, but doesn't fail the sync.
+func WithSyncStatusWriter(w SyncStatusWriter) Option {
+	return func(o *options) {
+		o.syncStatus = w
+	}
+}
+
+// WithPauseCheck makes each sync cycle call paused first, and skip syncing while it returns true, e.g. to freeze
+// syncing during incidents. Config reloads still happen. If paused fails, the previous pause state is kept.
+func WithPauseCheck(paused func() (bool, error)) Option {
+	return func(o *options) {
+		o.pauseCheck = paused
+	}
+}
+
+// WithActiveTenants restricts syncing to the given subset of managed tenants, e.g. for canary rollouts. Rules of
+// other managed tenants are still loaded, but not synced. If no tenants are given, all managed tenants are synced.
+func WithActiveTenants(tenants ...string) Option {
+	return func(o *options) {
+		if len(tenants) == 0 {
+			return
+		}
+
+		o.activeTenants = map[string]struct{}{}
+		for _, t := range tenants {
+			o.activeTenants[t] = struct{}{}
+		}
+	}
+}
+
+// WithMetricsDisabledTenants disables syncing metrics rules for the given tenants.
+func WithMetricsDisabledTenants(tenants ...string) Option {
+	return func(o *options) {
+		for _, t := range tenants {
+			o.metricsDisabledTenants[t] = struct{}{}
+		}
+	}
+}
+
+// WithLogsDisabledTenants disables syncing Loki rules for the given tenants.
+func WithLogsDisabledTenants(tenants ...string) Option {
+	return func(o *options) {
+		for _, t := range tenants {
+			o.logsDisabledTenants[t] = struct{}{}
+		}
+	}
+}
+
+// newOptions returns the default options, with opts applied.
+func newOptions(opts ...Option) options {
+	opt := options{
+		metricsDisabledTenants: map[string]struct{}{},
+		logsDisabledTenants:    map[string]struct{}{},
+		lokiAlerting:           true,
+		lokiRecording:          true,
+		metricsPrefix:          metricsprefix.Default,
+		shardTotal:             1,
+	}
+	for _, o := range opts {
+		o(&opt)
+	}
+	return opt
+}
+
 // SyncLoop represents the main loop of this controller, which syncs PrometheusRule and Loki's AlertingRule/RecordingRule
-// objects of each managed tenant with Observatorium API every n seconds.
+// objects of each managed tenant with Observatorium API every n seconds. A receive on reload triggers an immediate
+// obsctl config reload followed by a sync.
 func SyncLoop(
 	ctx context.Context,
 	logger log.Logger,
@@ -21,77 +206,343 @@ func SyncLoop(
 	logRulesEnabled bool,
 	sleepDurationSeconds uint,
 	configReloadIntervalSeconds uint,
+	reload <-chan struct{},
+	reg prometheus.Registerer,
+	opts ...Option,
 ) error {
-	for {
-		select {
-		case <-time.After(time.Duration(configReloadIntervalSeconds) * time.Second):
-			if err := o.InitOrReloadObsctlConfig(); err != nil {
-				level.Error(logger).Log("msg", "error reloading obsctl config", "error", err)
+	opt := newOptions(opts...)
+	if err := opt.validateShard(); err != nil {
+		return err
+	}
+	m := newMetrics(reg, opt)
+
+	// Tenants already reported as having zero rules, so that we only log them once.
+	reportedZeroRuleTenants := map[string]struct{}{}
+	pending := newPendingChanges()
+	identities := newRecordingRuleIdentities()
+	seriesEstimates := newSeriesEstimates()
+
+	reloadConfig := func() {
+		if err := o.InitOrReloadObsctlConfig(); err != nil {
+			level.Error(logger).Log("msg", "error reloading obsctl config", "error", err)
+			return
+		}
+		m.lastConfigReload.SetToCurrentTime()
+	}
+
+	paused := false
+
+	syncRules := func() error {
+		if opt.pauseCheck != nil {
+			p, err := opt.pauseCheck()
+			switch {
+			case err != nil:
+				level.Warn(logger).Log("msg", "error checking pause state, keeping previous state", "paused", paused, "error", err)
+			case p != paused:
+				level.Info(logger).Log("msg", "pause state changed", "paused", p)
+				paused = p
 			}
-		case <-time.After(time.Duration(sleepDurationSeconds) * time.Second):
-			prometheusRules, err := k.GetPrometheusRules()
-			if err != nil {
-				level.Error(logger).Log("msg", "error getting prometheus rules", "error", err, "rules", len(prometheusRules))
-				return err
+		}
+		if paused {
+			m.pausedGauge.Set(1)
+			level.Debug(logger).Log("msg", "syncing is paused, skipping sync")
+			return nil
+		}
+		m.pausedGauge.Set(0)
+
+		// Track the number of rule groups per tenant, across all signals.
+		tenantRuleGroups := map[string]int{}
+		// Track the size of synced rules per type, across all tenants.
+		cycleRuleBytes := map[string]int{"metrics": 0, "logs_alerting": 0, "logs_recording": 0}
+
+		// Track failed syncs, to retry them at the end of the cycle.
+		var failed []requeuedSync
+
+		start := time.Now()
+		timedOut := false
+		// overBudget returns true once the cycle took longer than allowed, reporting it the first time.
+		overBudget := func() bool {
+			if timedOut || opt.maxCycleDuration <= 0 || time.Since(start) <= opt.maxCycleDuration {
+				return timedOut
 			}
 
-			// Set each tenant as current and set rules.
-			for tenant, ruleGroups := range k.GetTenantMetricsRuleGroups(prometheusRules) {
+			level.Warn(logger).Log("msg", "sync cycle exceeded maximum duration, skipping remaining tenants", "max", opt.maxCycleDuration)
+			m.cycleTimeouts.Inc()
+			timedOut = true
+			return true
+		}
+
+		prometheusRules, err := k.GetPrometheusRules()
+		if err != nil {
+			level.Error(logger).Log("msg", "error getting prometheus rules", "error", err, "rules", len(prometheusRules))
+			return err
+		}
+
+		// Set each tenant as current and set rules.
+		for tenant, ruleGroups := range k.GetTenantMetricsRuleGroups(prometheusRules) {
+			if overBudget() {
+				break
+			}
+			if opt.inactive(tenant) {
+				level.Debug(logger).Log("msg", "skipping metrics rules for inactive tenant", "tenant", tenant)
+				continue
+			}
+			if _, disabled := opt.metricsDisabledTenants[tenant]; disabled {
+				level.Debug(logger).Log("msg", "skipping metrics rules for tenant with metrics disabled", "tenant", tenant)
+				continue
+			}
+			tenantRuleGroups[tenant] += len(ruleGroups.Groups)
+			h := pending.observe(tenant, "metrics", ruleGroups)
+			cycleRuleBytes["metrics"] += ruleBytes(ruleGroups)
+
+			for _, record := range identities.observe(tenant, ruleGroups) {
+				level.Warn(logger).Log("msg", "recording rule output labels changed, previous series will be orphaned", "tenant", tenant, "record", record)
+				m.recordingRuleIdentityChanges.WithLabelValues(opt.tenantLabel(tenant)).Inc()
+			}
+			if opt.estimateSeriesImpact {
+				if delta, changed := seriesEstimates.observe(tenant, ruleGroups); changed {
+					level.Info(logger).Log("msg", "estimated series of recording rules changed", "tenant", tenant, "delta", delta)
+					m.estimatedSeriesDelta.WithLabelValues(opt.tenantLabel(tenant)).Set(delta)
+				}
+			}
+
+			tenant, ruleGroups := tenant, ruleGroups
+			setRules := func() error {
 				if err := o.SetCurrentTenant(tenant); err != nil {
 					level.Error(logger).Log("msg", "error setting tenant", "tenant", tenant, "error", err)
-					continue
+					return err
 				}
 
-				err = o.MetricsSet(ruleGroups)
-				if err != nil {
+				if err := o.MetricsSet(ruleGroups); err != nil {
 					level.Error(logger).Log("msg", "error setting rules", "tenant", tenant, "error", err)
-					continue
+					return err
 				}
+				pending.markSynced(tenant, "metrics", h)
+				return nil
 			}
+			syncTenant := func() error {
+				err := setRules()
+				if opt.syncStatus != nil {
+					if werr := opt.syncStatus.WriteSyncStatus(tenant, err); werr != nil {
+						level.Warn(logger).Log("msg", "error writing sync status", "tenant", tenant, "error", werr)
+					}
+				}
+				return err
+			}
+			if err := syncTenant(); err != nil {
+				failed = append(failed, requeuedSync{tenant: tenant, typ: "metrics", sync: syncTenant})
+			}
+		}
 
-			if logRulesEnabled {
-				lokiAlertingRules, err := k.GetLokiAlertingRules()
-				if err != nil {
-					level.Error(logger).Log("msg", "error getting loki alerting rules", "error", err, "rules", len(lokiAlertingRules))
-					return err
+		if logRulesEnabled && opt.lokiAlerting && !overBudget() {
+			var tenantAlertingGroups map[string]lokiv1.AlertingRuleSpec
+			if lokiAlertingRules, err := k.GetLokiAlertingRules(); err != nil {
+				// Keep syncing metrics rules when only Loki rules are unavailable. Tenants' Loki rules are left as is.
+				level.Error(logger).Log("msg", "error getting loki alerting rules, skipping them this cycle", "error", err)
+				m.lokiUnavailable.WithLabelValues("alerting").Inc()
+				delete(cycleRuleBytes, "logs_alerting")
+			} else {
+				tenantAlertingGroups = k.GetTenantLogsAlertingRuleGroups(lokiAlertingRules)
+			}
+
+			for tenant, ruleGroups := range tenantAlertingGroups {
+				if overBudget() {
+					break
+				}
+				if opt.inactive(tenant) {
+					level.Debug(logger).Log("msg", "skipping loki alerting rules for inactive tenant", "tenant", tenant)
+					continue
 				}
+				if _, disabled := opt.logsDisabledTenants[tenant]; disabled {
+					level.Debug(logger).Log("msg", "skipping loki alerting rules for tenant with logs disabled", "tenant", tenant)
+					continue
+				}
+				tenantRuleGroups[tenant] += len(ruleGroups.Groups)
+				h := pending.observe(tenant, "logs_alerting", ruleGroups)
+				cycleRuleBytes["logs_alerting"] += ruleBytes(ruleGroups)
 
-				for tenant, ruleGroups := range k.GetTenantLogsAlertingRuleGroups(lokiAlertingRules) {
+				tenant, ruleGroups := tenant, ruleGroups
+				syncTenant := func() error {
 					if err := o.SetCurrentTenant(tenant); err != nil {
 						level.Error(logger).Log("msg", "error setting tenant", "tenant", tenant, "error", err)
-						continue
+						return err
 					}
 
-					err = o.LogsAlertingSet(ruleGroups)
-					if err != nil {
+					if err := o.LogsAlertingSet(ruleGroups); err != nil {
 						level.Error(logger).Log("msg", "error setting loki alerting rules", "tenant", tenant, "error", err)
-						continue
+						return err
 					}
+					pending.markSynced(tenant, "logs_alerting", h)
+					return nil
+				}
+				if err := syncTenant(); err != nil {
+					failed = append(failed, requeuedSync{tenant: tenant, typ: "logs_alerting", sync: syncTenant})
 				}
+			}
+		}
 
-				lokiRecordingRules, err := k.GetLokiRecordingRules()
-				if err != nil {
-					level.Error(logger).Log("msg", "error getting loki recording rules", "error", err, "rules", len(lokiRecordingRules))
-					return err
+		if logRulesEnabled && opt.lokiRecording && !overBudget() {
+			var tenantRecordingGroups map[string]lokiv1.RecordingRuleSpec
+			if lokiRecordingRules, err := k.GetLokiRecordingRules(); err != nil {
+				// Keep syncing metrics rules when only Loki rules are unavailable. Tenants' Loki rules are left as is.
+				level.Error(logger).Log("msg", "error getting loki recording rules, skipping them this cycle", "error", err)
+				m.lokiUnavailable.WithLabelValues("recording").Inc()
+				delete(cycleRuleBytes, "logs_recording")
+			} else {
+				tenantRecordingGroups = k.GetTenantLogsRecordingRuleGroups(lokiRecordingRules)
+			}
+
+			for tenant, ruleGroups := range tenantRecordingGroups {
+				if overBudget() {
+					break
 				}
+				if opt.inactive(tenant) {
+					level.Debug(logger).Log("msg", "skipping loki recording rules for inactive tenant", "tenant", tenant)
+					continue
+				}
+				if _, disabled := opt.logsDisabledTenants[tenant]; disabled {
+					level.Debug(logger).Log("msg", "skipping loki recording rules for tenant with logs disabled", "tenant", tenant)
+					continue
+				}
+				tenantRuleGroups[tenant] += len(ruleGroups.Groups)
+				h := pending.observe(tenant, "logs_recording", ruleGroups)
+				cycleRuleBytes["logs_recording"] += ruleBytes(ruleGroups)
 
-				for tenant, ruleGroups := range k.GetTenantLogsRecordingRuleGroups(lokiRecordingRules) {
+				tenant, ruleGroups := tenant, ruleGroups
+				syncTenant := func() error {
 					if err := o.SetCurrentTenant(tenant); err != nil {
 						level.Error(logger).Log("msg", "error setting tenant", "tenant", tenant, "error", err)
-						continue
+						return err
 					}
 
-					err = o.LogsRecordingSet(ruleGroups)
-					if err != nil {
+					if err := o.LogsRecordingSet(ruleGroups); err != nil {
 						level.Error(logger).Log("msg", "error setting loki recording rules", "tenant", tenant, "error", err)
-						continue
+						return err
 					}
+					pending.markSynced(tenant, "logs_recording", h)
+					return nil
+				}
+				if err := syncTenant(); err != nil {
+					failed = append(failed, requeuedSync{tenant: tenant, typ: "logs_recording", sync: syncTenant})
+				}
+			}
+		}
+
+		if opt.requeueFailed && len(failed) > 0 && !overBudget() {
+			level.Info(logger).Log("msg", "retrying failed syncs", "count", len(failed), "delay", opt.requeueDelay)
+			select {
+			case <-time.After(opt.requeueDelay):
+			case <-ctx.Done():
+				return nil
+			}
+
+			for _, f := range failed {
+				if overBudget() {
+					break
+				}
+
+				result := "success"
+				if err := f.sync(); err != nil {
+					result = "failure"
 				}
+				m.requeues.WithLabelValues(opt.tenantLabel(f.tenant), f.typ, result).Inc()
+			}
+		}
+
+		// Rule counts are incomplete if the cycle was cut short.
+		if timedOut {
+			return nil
+		}
+
+		zeroRuleTenants := 0
+		for tenant, groups := range tenantRuleGroups {
+			if groups != 0 {
+				delete(reportedZeroRuleTenants, tenant)
+				continue
+			}
+
+			zeroRuleTenants++
+			if _, ok := reportedZeroRuleTenants[tenant]; !ok {
+				level.Info(logger).Log("msg", "managed tenant has no rules", "tenant", tenant)
+				reportedZeroRuleTenants[tenant] = struct{}{}
+			}
+		}
+		m.tenantsWithZeroRules.Set(float64(zeroRuleTenants))
+
+		for typ, n := range cycleRuleBytes {
+			m.totalRuleBytes.WithLabelValues(typ).Set(float64(n))
+		}
+
+		for tenant, age := range pending.ages() {
+			m.pendingChangeAge.WithLabelValues(opt.tenantLabel(tenant)).Set(age.Seconds())
+		}
+
+		return nil
+	}
+
+	if opt.initialSyncDelay > 0 {
+		level.Info(logger).Log("msg", "delaying first sync", "delay", opt.initialSyncDelay)
+		select {
+		case <-time.After(opt.initialSyncDelay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	if opt.runOnce {
+		return syncRules()
+	}
+
+	// Unlike the sync timer, config reloads are scheduled independently of syncs, so that they still happen when
+	// syncing takes longer than, or is scheduled more often than, the reload interval.
+	var configReload <-chan time.Time
+	if configReloadIntervalSeconds > 0 {
+		t := time.NewTicker(time.Duration(configReloadIntervalSeconds) * time.Second)
+		defer t.Stop()
+		configReload = t.C
+	}
+
+	for {
+		select {
+		case <-configReload:
+			reloadConfig()
+		case <-time.After(time.Duration(sleepDurationSeconds) * time.Second):
+			// Select picks randomly among ready cases, so don't start another sync if shutdown was requested meanwhile.
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			if err := syncRules(); err != nil {
+				return err
 			}
 
 			level.Debug(logger).Log("msg", "sleeping", "duration", sleepDurationSeconds)
+		case <-reload:
+			level.Info(logger).Log("msg", "reload triggered")
+			reloadConfig()
+
+			if err := syncRules(); err != nil {
+				return err
+			}
 		case <-ctx.Done():
 			return nil
 		}
 	}
 }
+
+// requeuedSync is a failed sync of a tenant's rules of one type, to be retried.
+type requeuedSync struct {
+	tenant string
+	typ    string
+	sync   func() error
+}
+
+// ruleBytes returns the size of the YAML encoding of rules, the format rules are sent to Observatorium API in.
+func ruleBytes(rules interface{}) int {
+	b, err := yaml.Marshal(rules)
+	if err != nil {
+		return 0
+	}
+
+	return len(b)
+}
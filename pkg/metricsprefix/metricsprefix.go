@@ -0,0 +1,23 @@
+// Package metricsprefix defines the prefix of the names of obsctl-reloader's own metrics.
+package metricsprefix
+
+import (
+	"regexp"
+
+	"github.com/efficientgo/core/errors"
+)
+
+// Default is the prefix metric names have unless configured otherwise.
+const Default = "obsctl_reloader"
+
+var prefixRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Validate returns an error if prefix can't start a Prometheus metric name. Colons are rejected, as they are reserved
+// for recording rules.
+func Validate(prefix string) error {
+	if !prefixRe.MatchString(prefix) {
+		return errors.Newf("invalid metrics prefix %q, must match %s", prefix, prefixRe)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package metricsprefix
+
+import (
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tc := range []struct {
+		prefix  string
+		wantErr bool
+	}{
+		{prefix: Default},
+		{prefix: "rules_sync"},
+		{prefix: "_internal"},
+		{prefix: "Rules2"},
+		{prefix: "", wantErr: true},
+		{prefix: "2rules", wantErr: true},
+		{prefix: "rules-sync", wantErr: true},
+		{prefix: "rules:sync", wantErr: true},
+		{prefix: "rules sync", wantErr: true},
+	} {
+		t.Run(tc.prefix, func(t *testing.T) {
+			err := Validate(tc.prefix)
+			if tc.wantErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+		})
+	}
+}
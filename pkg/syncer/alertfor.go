@@ -0,0 +1,37 @@
+package syncer
+
+import (
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client/parameters"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/common/model"
+)
+
+// WithMinAlertFor raises the for duration of each synced metrics alert to at least d, including alerts without one,
+// to prevent flapping alerts. Zero disables it.
+func WithMinAlertFor(d time.Duration) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.minAlertFor = d
+	}
+}
+
+// applyMinAlertFor returns a copy of rules where the for duration of alerts shorter than the configured minimum is
+// raised to it. Invalid durations are kept, to be rejected by validation.
+func (o *ObsctlRulesSyncer) applyMinAlertFor(tenant parameters.Tenant, rules monitoringv1.PrometheusRuleSpec) monitoringv1.PrometheusRuleSpec {
+	floor := model.Duration(o.minAlertFor).String()
+
+	// Raising for durations never fails.
+	rules, _ = mapRules(rules, func(g monitoringv1.RuleGroup, r monitoringv1.Rule) (monitoringv1.Rule, error) {
+		if r.Alert != "" {
+			d, err := model.ParseDuration(r.For)
+			if r.For == "" || (err == nil && time.Duration(d) < o.minAlertFor) {
+				level.Debug(o.logger).Log("msg", "raising alert for duration to minimum", "tenant", tenant, "group", g.Name, "alert", r.Alert, "for", r.For, "min", floor)
+				r.For = floor
+			}
+		}
+		return r, nil
+	})
+	return rules
+}
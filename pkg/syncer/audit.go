@@ -0,0 +1,76 @@
+package syncer
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client/parameters"
+)
+
+// Types of set operations, as recorded in audit entries.
+const (
+	auditTypeMetrics       = "metrics"
+	auditTypeLogsAlerting  = "logs_alerting"
+	auditTypeLogsRecording = "logs_recording"
+)
+
+// auditEntry is a single line of the audit log, describing one rules set operation.
+type auditEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Tenant    string    `json:"tenant"`
+	Type      string    `json:"type"`
+	Groups    []string  `json:"groups"`
+	Rules     int       `json:"rules"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// auditLog writes audit entries as JSON lines. Each entry is written with a single write, so appending to a file
+// opened with O_APPEND never interleaves entries.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// WithAuditLog writes an audit entry for each rules set operation to w, as a JSON line. Audit entries are separate from
+// the operational logs.
+func WithAuditLog(w io.Writer) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.audit = &auditLog{w: w}
+	}
+}
+
+// recordAudit writes an audit entry for a set operation of the given type, if an audit log is configured.
+func (o *ObsctlRulesSyncer) recordAudit(tenant parameters.Tenant, typ string, groups []string, rules int, err error) {
+	if o.audit == nil {
+		return
+	}
+
+	e := auditEntry{
+		Timestamp: time.Now().UTC(),
+		Tenant:    string(tenant),
+		Type:      typ,
+		Groups:    groups,
+		Rules:     rules,
+		Status:    "success",
+	}
+	if err != nil {
+		e.Status = "failure"
+		e.Error = err.Error()
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		level.Error(o.logger).Log("msg", "encoding audit entry", "error", err)
+		return
+	}
+
+	o.audit.mu.Lock()
+	defer o.audit.mu.Unlock()
+	if _, err := o.audit.w.Write(append(b, '\n')); err != nil {
+		level.Error(o.logger).Log("msg", "writing audit entry", "error", err)
+	}
+}
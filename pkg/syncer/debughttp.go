@@ -0,0 +1,72 @@
+package syncer
+
+import (
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client"
+	"github.com/observatorium/api/client/parameters"
+)
+
+// redactedHeaders are the headers whose values are never logged, as they carry credentials.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// WithDebugHTTP logs each Loki rules set request and response in full at debug level, e.g. to diagnose content type or
+// encoding issues behind rejections. Credential headers are redacted.
+func WithDebugHTTP(enabled bool) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.debugHTTP = enabled
+	}
+}
+
+// redactHeaders returns a copy of h with the values of credential headers replaced.
+func redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range redactedHeaders {
+		if _, ok := h[k]; ok {
+			h.Set(k, "REDACTED")
+		}
+	}
+
+	return h
+}
+
+// dumpRequest returns req with body as sent on the wire, with credential headers redacted.
+func dumpRequest(req *http.Request, body []byte) string {
+	r := req.Clone(req.Context())
+	r.Header = redactHeaders(req.Header)
+
+	b, err := httputil.DumpRequest(r, false)
+	if err != nil {
+		return "dumping request: " + err.Error()
+	}
+
+	return string(append(b, body...))
+}
+
+// dumpResponse returns resp with body as received on the wire, with credential headers redacted.
+func dumpResponse(resp *http.Response, body []byte) string {
+	r := *resp
+	r.Header = redactHeaders(resp.Header)
+
+	b, err := httputil.DumpResponse(&r, false)
+	if err != nil {
+		return "dumping response: " + err.Error()
+	}
+
+	return string(append(b, body...))
+}
+
+// logLogsRulesExchange logs a Loki rules set request with body and its response, if enabled.
+func (o *ObsctlRulesSyncer) logLogsRulesExchange(tenant parameters.Tenant, body []byte, resp *client.SetLogsRulesResponse) {
+	if !o.debugHTTP || resp == nil || resp.HTTPResponse == nil {
+		return
+	}
+
+	req := ""
+	if resp.HTTPResponse.Request != nil {
+		req = dumpRequest(resp.HTTPResponse.Request, body)
+	}
+	level.Debug(o.logger).Log("msg", "loki rules set request", "tenant", tenant, "request", req, "response", dumpResponse(resp.HTTPResponse, resp.Body))
+}
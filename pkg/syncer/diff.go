@@ -0,0 +1,108 @@
+package syncer
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client/parameters"
+)
+
+// WithRuleDiffLogging logs the rule groups added, removed and modified by each successful set operation of a tenant,
+// compared to the previous one. Nothing is logged for the first set operation of each tenant and rule type, as the
+// previously synced rules aren't known.
+func WithRuleDiffLogging(enabled bool) Option {
+	return func(o *ObsctlRulesSyncer) {
+		if enabled {
+			o.ruleDiffs = &ruleDiffCache{prev: map[string]map[string]string{}}
+		}
+	}
+}
+
+// ruleDiffCache holds the rule groups of the last successful set operation per rule type and tenant.
+type ruleDiffCache struct {
+	mu sync.Mutex
+	// prev maps rule type and tenant to the JSON encoding of each rule group by name.
+	prev map[string]map[string]string
+}
+
+// ruleGroupsDiff lists the names of the rule groups changed between two set operations.
+type ruleGroupsDiff struct {
+	Added    []string
+	Removed  []string
+	Modified []string
+}
+
+func (d ruleGroupsDiff) empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// snapshotRuleGroups returns the JSON encoding of each of groups by name, as compared by diffRuleGroups.
+func snapshotRuleGroups[G any](groups []G, name func(G) string) map[string]string {
+	res := make(map[string]string, len(groups))
+	for _, g := range groups {
+		b, err := json.Marshal(g)
+		if err != nil {
+			// Groups which can't be encoded can't have been set either.
+			continue
+		}
+		res[name(g)] = string(b)
+	}
+
+	return res
+}
+
+// diffRuleGroups returns the sorted names of the groups added, removed and modified in cur compared to prev.
+func diffRuleGroups(prev, cur map[string]string) ruleGroupsDiff {
+	var d ruleGroupsDiff
+	for name, g := range cur {
+		p, ok := prev[name]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, name)
+		case p != g:
+			d.Modified = append(d.Modified, name)
+		}
+	}
+	for name := range prev {
+		if _, ok := cur[name]; !ok {
+			d.Removed = append(d.Removed, name)
+		}
+	}
+
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Modified)
+
+	return d
+}
+
+// logRuleDiff logs how groups, successfully set for tenant, differ from the previously set groups of the same type.
+func (o *ObsctlRulesSyncer) logRuleDiff(tenant parameters.Tenant, typ string, groups map[string]string) {
+	key := typ + "/" + string(tenant)
+
+	o.ruleDiffs.mu.Lock()
+	prev, ok := o.ruleDiffs.prev[key]
+	o.ruleDiffs.prev[key] = groups
+	o.ruleDiffs.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	d := diffRuleGroups(prev, groups)
+	if d.empty() {
+		return
+	}
+
+	level.Info(o.logger).Log(
+		"msg", "synced rule groups changed",
+		"tenant", tenant,
+		"type", typ,
+		"added", strings.Join(d.Added, ","),
+		"removed", strings.Join(d.Removed, ","),
+		"modified", strings.Join(d.Modified, ","),
+	)
+}
@@ -0,0 +1,44 @@
+package syncer
+
+import (
+	"github.com/efficientgo/core/errors"
+	"github.com/observatorium/api/client/parameters"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/prometheus/promql/parser"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// ExprTransform modifies the parsed expression of a metrics rule of tenant, e.g. to add offsets. It may modify expr in
+// place, and returns the expression to sync, or an error to reject the tenant's rules.
+type ExprTransform func(tenant parameters.Tenant, expr parser.Expr) (parser.Expr, error)
+
+// WithExprTransforms applies the given transforms, in order, to the expression of each synced metrics rule.
+// Expressions which can't be parsed are left as is, to be rejected by validation.
+func WithExprTransforms(transforms ...ExprTransform) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.exprTransforms = append(o.exprTransforms, transforms...)
+	}
+}
+
+// applyExprTransforms returns a copy of rules where the configured transforms are applied to the expr of each rule.
+func (o *ObsctlRulesSyncer) applyExprTransforms(tenant parameters.Tenant, rules monitoringv1.PrometheusRuleSpec) (monitoringv1.PrometheusRuleSpec, error) {
+	return mapRules(rules, func(g monitoringv1.RuleGroup, r monitoringv1.Rule) (monitoringv1.Rule, error) {
+		expr, err := parser.ParseExpr(r.Expr.String())
+		if err != nil {
+			return r, nil
+		}
+
+		for _, transform := range o.exprTransforms {
+			if expr, err = transform(tenant, expr); err != nil {
+				name := r.Alert
+				if name == "" {
+					name = r.Record
+				}
+				return r, errors.Wrapf(err, "transforming expr of rule %q of group %q", name, g.Name)
+			}
+		}
+
+		r.Expr = intstr.FromString(expr.String())
+		return r, nil
+	})
+}
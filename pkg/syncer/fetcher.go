@@ -0,0 +1,194 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client"
+	"github.com/observatorium/api/client/parameters"
+	"golang.org/x/net/http2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// DefaultAPIMaxIdleConnsPerHost is the default maximum number of idle connections kept per Observatorium API host.
+const DefaultAPIMaxIdleConnsPerHost = 10
+
+// systemCertPool returns the system CAs. It's a variable so that tests can trust their own CAs as system ones.
+var systemCertPool = x509.SystemCertPool
+
+// HTTP2Mode defines whether HTTP/2 is used for requests to Observatorium API.
+type HTTP2Mode int
+
+const (
+	// HTTP2Auto negotiates HTTP/2 over TLS if the server supports it, falling back to HTTP/1.1.
+	HTTP2Auto HTTP2Mode = iota
+	// HTTP2Force only allows HTTP/2 over TLS, failing requests to servers which don't support it.
+	HTTP2Force
+	// HTTP2Disable always uses HTTP/1.1.
+	HTTP2Disable
+)
+
+// newAPITransport returns the HTTP transport used for all requests to Observatorium API. Connections are kept alive
+// and reused across set operations, so that syncing many tenants doesn't pay for a new TLS handshake every time.
+// If rootCAs is nil, the system CAs are trusted.
+func newAPITransport(maxIdleConnsPerHost int, http2Mode HTTP2Mode, rootCAs *x509.CertPool) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	if t.MaxIdleConns != 0 && t.MaxIdleConns < maxIdleConnsPerHost {
+		t.MaxIdleConns = maxIdleConnsPerHost
+	}
+
+	if rootCAs != nil {
+		t.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: rootCAs}
+	}
+
+	switch http2Mode {
+	case HTTP2Force:
+		// ConfigureTransports only fails if HTTP/2 is already configured, which can't be the case for a new transport.
+		_, _ = http2.ConfigureTransports(t)
+		// Only offer HTTP/2 during ALPN, so the TLS handshake fails if the server doesn't support it.
+		t.TLSClientConfig.NextProtos = []string{http2.NextProtoTLS}
+	case HTTP2Disable:
+		// A non-nil, empty TLSNextProto disables HTTP/2, see net/http docs.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+
+	return t
+}
+
+// reloadAPICA reads the Observatorium API CA bundle from the configured ConfigMap key and, if it changed,
+// makes the API transport trust it, in addition to the system CAs. This lets rotated CAs get picked up on config reload.
+func (o *ObsctlRulesSyncer) reloadAPICA() error {
+	if o.apiCAConfigMap == nil {
+		return nil
+	}
+
+	cm := corev1.ConfigMap{}
+	if err := o.k8s.Get(o.ctx, types.NamespacedName{Namespace: o.apiCAConfigMap.Namespace, Name: o.apiCAConfigMap.Name}, &cm); err != nil {
+		return errors.Wrapf(err, "getting API CA configmap %s/%s", o.apiCAConfigMap.Namespace, o.apiCAConfigMap.Name)
+	}
+
+	ca, ok := cm.Data[o.apiCAConfigMap.Key]
+	if !ok {
+		return errors.Newf("key %s not found in API CA configmap %s/%s", o.apiCAConfigMap.Key, o.apiCAConfigMap.Namespace, o.apiCAConfigMap.Name)
+	}
+
+	if bytes.Equal(o.apiCA, []byte(ca)) {
+		return nil
+	}
+
+	// Keep trusting the system CAs, as the API transport is also used to reach OIDC issuers, which are usually signed
+	// by other CAs than the API.
+	pool, err := systemCertPool()
+	if err != nil {
+		level.Warn(o.logger).Log("msg", "error loading system CAs, only trusting the API CA", "error", err)
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM([]byte(ca)) {
+		return errors.Newf("no valid PEM certificates in API CA configmap %s/%s key %s", o.apiCAConfigMap.Namespace, o.apiCAConfigMap.Name, o.apiCAConfigMap.Key)
+	}
+
+	old := o.httpClient.Transport
+	o.apiRootCAs = pool
+	o.httpClient.Transport = newAPITransport(o.apiMaxIdleConnsPerHost, o.apiHTTP2Mode, o.apiRootCAs)
+	if t, ok := old.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
+	}
+
+	o.apiCA = []byte(ca)
+	level.Info(o.logger).Log("msg", "loaded API CA from configmap", "namespace", o.apiCAConfigMap.Namespace, "name", o.apiCAConfigMap.Name, "key", o.apiCAConfigMap.Key)
+
+	return nil
+}
+
+// defaultTenantPathTemplate is the prefix of tenant-specific Observatorium API paths.
+const defaultTenantPathTemplate = "/api/{signal}/v1/{tenant}"
+
+// rewriteTenantPath replaces the /api/{signal}/v1/{tenant} prefix of Observatorium API paths in u with tmpl, where
+// {signal} (metrics or logs) and {tenant} placeholders are expanded, the latter to tenantID.
+func rewriteTenantPath(u *url.URL, tmpl, tenant, tenantID string) {
+	for _, signal := range []string{"metrics", "logs"} {
+		prefix := "/api/" + signal + "/v1/" + tenant
+		i := strings.Index(u.Path, prefix+"/")
+		if i == -1 {
+			continue
+		}
+
+		expanded := strings.NewReplacer("{signal}", signal, "{tenant}", tenantID).Replace(tmpl)
+		u.Path = u.Path[:i] + strings.TrimSuffix(expanded, "/") + u.Path[i+len(prefix):]
+		u.RawPath = ""
+		return
+	}
+}
+
+// newFetcher returns a Observatorium API client for the current obsctl context. It mirrors obsctl's
+// fetcher.NewCustomFetcher, except that the underlying HTTP client is the one configured on the syncer.
+func (o *ObsctlRulesSyncer) newFetcher() (*client.ClientWithResponses, parameters.Tenant, error) {
+	cfg, err := o.currentConfig()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "reading obsctl config")
+	}
+
+	tenantCfg, _, err := cfg.GetCurrentContext()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "getting current context")
+	}
+
+	c := o.httpClient
+	if tenantCfg.OIDC != nil {
+		// Both OIDC discovery and the oauth2 token source pick up the HTTP client from the context.
+		// The token is acquired right away, so failing here is an OIDC token failure.
+		ctx := oidc.ClientContext(o.ctx, o.httpClient)
+		if o.inMemoryConfig {
+			c, err = o.oidcClient(ctx, cfg)
+		} else {
+			c, err = cfg.Client(ctx, o.logger)
+		}
+		if err != nil {
+			o.oidcTokenFailures.WithLabelValues(o.tenantLabel(parameters.Tenant(cfg.Current.Tenant))).Inc()
+			return nil, parameters.Tenant(cfg.Current.Tenant), errors.Wrap(err, "getting current client")
+		}
+	}
+
+	fc, err := client.NewClientWithResponses(cfg.APIs[cfg.Current.API].URL, func(f *client.Client) error {
+		f.Client = c
+		return nil
+	}, client.WithRequestEditorFn(func(ctx context.Context, req *http.Request) error {
+		// Requests are made for the tenant's name in Observatorium API, which may differ from its managed name.
+		tenantID := tenantCfg.Tenant
+		if tenantID == "" {
+			tenantID = cfg.Current.Tenant
+		}
+
+		switch {
+		case o.apiTenantPathTemplate != "":
+			rewriteTenantPath(req.URL, o.apiTenantPathTemplate, cfg.Current.Tenant, tenantID)
+		case tenantID != cfg.Current.Tenant:
+			rewriteTenantPath(req.URL, defaultTenantPathTemplate, cfg.Current.Tenant, tenantID)
+		}
+		if o.tenantHeaderName != "" {
+			req.Header.Set(o.tenantHeaderName, tenantID)
+		}
+
+		level.Debug(o.logger).Log(
+			"method", req.Method,
+			"URL", req.URL,
+		)
+		return nil
+	}))
+	if err != nil {
+		return nil, "", errors.Wrap(err, "creating fetcher client")
+	}
+
+	return fc, parameters.Tenant(cfg.Current.Tenant), nil
+}
@@ -0,0 +1,25 @@
+package syncer
+
+import (
+	"bytes"
+
+	"github.com/observatorium/api/client"
+	"github.com/observatorium/api/client/parameters"
+)
+
+// setRawRules sends the metrics rules of tenant, counting the request as in flight until it completes.
+func (o *ObsctlRulesSyncer) setRawRules(fc *client.ClientWithResponses, tenant parameters.Tenant, body []byte) (*client.SetRawRulesResponse, error) {
+	o.inflightRequests.Inc()
+	defer o.inflightRequests.Dec()
+
+	return fc.SetRawRulesWithBodyWithResponse(o.ctx, tenant, "application/yaml", bytes.NewReader(body))
+}
+
+// setLogsRulesOnce sends a Loki rule group of tenant to namespace, counting the request as in flight until it
+// completes. Unlike setLogsRules, it doesn't retry.
+func (o *ObsctlRulesSyncer) setLogsRulesOnce(fc *client.ClientWithResponses, tenant parameters.Tenant, namespace parameters.LogRulesNamespace, body []byte) (*client.SetLogsRulesResponse, error) {
+	o.inflightRequests.Inc()
+	defer o.inflightRequests.Dec()
+
+	return fc.SetLogsRulesWithBodyWithResponse(o.ctx, tenant, namespace, o.lokiRulesContentType, bytes.NewReader(body))
+}
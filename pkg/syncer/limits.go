@@ -0,0 +1,28 @@
+package syncer
+
+import (
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client/parameters"
+)
+
+// WithMaxRulesPerType rejects set operations with more than n rules as a whole, rather than syncing only some of the
+// rules. As each set operation replaces the rules of one type, i.e. metrics, Loki alerting or Loki recording rules, the
+// limit applies to each type of a tenant's rules separately. Zero means no limit.
+func WithMaxRulesPerType(n int) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.maxRulesPerType = n
+	}
+}
+
+// checkRuleLimit returns an error if n rules of type typ exceed the rule limit of tenant.
+func (o *ObsctlRulesSyncer) checkRuleLimit(tenant parameters.Tenant, typ string, n int) error {
+	if o.maxRulesPerType <= 0 || n <= o.maxRulesPerType {
+		return nil
+	}
+
+	level.Error(o.logger).Log("msg", "tenant exceeds rule limit, rejecting rules", "tenant", tenant, "type", typ, "rules", n, "limit", o.maxRulesPerType)
+	o.ruleLimitExceeded.WithLabelValues(o.tenantLabel(tenant)).Inc()
+	o.setTenantLastError(tenant, errorReasonValidation)
+	return errors.Newf("tenant %s has %d %s rules, exceeding the limit of %d per rule type", tenant, n, typ, o.maxRulesPerType)
+}
@@ -0,0 +1,71 @@
+package syncer
+
+import (
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client"
+	"github.com/observatorium/api/client/parameters"
+)
+
+// WithLokiBatchGroups makes Loki rules set operations try to send all of a tenant's rule groups of a type in a single
+// request, as a rule file with multiple groups, rather than one request per group. If Observatorium API rejects the
+// batch, e.g. because its Loki ruler only accepts a single group per request, groups are sent one by one instead.
+func WithLokiBatchGroups(enabled bool) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.lokiBatchGroups = enabled
+	}
+}
+
+// lokiRuleFile is a Loki rule file holding multiple rule groups.
+type lokiRuleFile struct {
+	Groups interface{} `json:"groups" yaml:"groups"`
+}
+
+// setLogsRuleGroupsBatches sends the Loki rule groups of typ for tenant with one request per Loki rules namespace they
+// are set in, applying the managed group prefix. It returns false if any request failed and the groups must be sent
+// one by one.
+func setLogsRuleGroupsBatches[G any](o *ObsctlRulesSyncer, fc *client.ClientWithResponses, tenant parameters.Tenant, typ string, groups []*G, name func(*G) *string) bool {
+	var namespaces []parameters.LogRulesNamespace
+	byNamespace := map[parameters.LogRulesNamespace][]*G{}
+	for _, group := range groups {
+		g := *group
+		ns := o.lokiNamespace(typ, tenant, *name(&g))
+		*name(&g) = o.managedGroupName(*name(&g))
+
+		if _, ok := byNamespace[ns]; !ok {
+			namespaces = append(namespaces, ns)
+		}
+		byNamespace[ns] = append(byNamespace[ns], &g)
+	}
+
+	for _, ns := range namespaces {
+		if !o.setLogsRuleGroupsBatch(fc, tenant, ns, typ, byNamespace[ns]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// setLogsRuleGroupsBatch sends Loki rule groups of typ for tenant to namespace in a single request, returning false if
+// that failed.
+func (o *ObsctlRulesSyncer) setLogsRuleGroupsBatch(fc *client.ClientWithResponses, tenant parameters.Tenant, namespace parameters.LogRulesNamespace, typ string, groups interface{}) bool {
+	body, err := o.marshalLokiRules(lokiRuleFile{Groups: groups})
+	if err != nil {
+		level.Warn(o.logger).Log("msg", "encoding loki rule groups, sending groups one by one", "type", typ, "error", err)
+		return false
+	}
+
+	level.Debug(o.logger).Log("msg", "setting rule file", "rule", string(body))
+	resp, err := o.setLogsRules(fc, tenant, namespace, body)
+	if err != nil {
+		level.Warn(o.logger).Log("msg", "setting batched loki rule groups, sending groups one by one", "type", typ, "tenant", tenant, "error", err)
+		return false
+	}
+	if resp.StatusCode()/100 != 2 {
+		level.Warn(o.logger).Log("msg", "batched loki rule groups rejected, sending groups one by one", "type", typ, "tenant", tenant, "status", resp.StatusCode(), "body", string(resp.Body))
+		return false
+	}
+
+	o.lokiRulesSetOps.WithLabelValues(typ, o.tenantLabel(tenant)).Inc()
+	return true
+}
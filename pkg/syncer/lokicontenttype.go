@@ -0,0 +1,40 @@
+package syncer
+
+import (
+	"encoding/json"
+	"mime"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultLokiRulesContentType is the content type Loki rules are sent with, unless configured otherwise.
+const DefaultLokiRulesContentType = "application/yaml"
+
+// WithLokiRulesContentType sets the content type Loki rule groups are sent with, e.g. application/x-yaml for
+// Observatorium API versions which expect it. Groups are encoded as JSON if it is a JSON media type, and as YAML
+// otherwise.
+func WithLokiRulesContentType(contentType string) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.lokiRulesContentType = contentType
+	}
+}
+
+// isJSONContentType returns true if contentType is application/json or a +json structured syntax type.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// marshalLokiRules encodes a Loki rule group or rule file in the format of the configured content type.
+func (o *ObsctlRulesSyncer) marshalLokiRules(v interface{}) ([]byte, error) {
+	if isJSONContentType(o.lokiRulesContentType) {
+		return json.Marshal(v)
+	}
+
+	return yaml.Marshal(v)
+}
@@ -0,0 +1,32 @@
+package syncer
+
+import (
+	"github.com/observatorium/api/client/parameters"
+)
+
+// LokiNamespaceResolver returns the Loki rules namespace a tenant's rule group is pinned to, if any.
+type LokiNamespaceResolver interface {
+	// LokiNamespace returns the namespace the tenant's rule group of type typ, either "alerting" or "recording", is
+	// pinned to, or an empty string if it isn't pinned.
+	LokiNamespace(typ, tenant, group string) string
+}
+
+// WithLokiNamespaceResolver sets Loki rule groups pinned to a namespace by r in that namespace, rather than in the
+// tenant's namespace.
+func WithLokiNamespaceResolver(r LokiNamespaceResolver) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.lokiNamespaces = r
+	}
+}
+
+// lokiNamespace returns the Loki rules namespace to set the tenant's rule group of type typ in, given its name before
+// applying the managed group prefix.
+func (o *ObsctlRulesSyncer) lokiNamespace(typ string, tenant parameters.Tenant, group string) parameters.LogRulesNamespace {
+	if o.lokiNamespaces != nil {
+		if ns := o.lokiNamespaces.LokiNamespace(typ, string(tenant), group); ns != "" {
+			return parameters.LogRulesNamespace(ns)
+		}
+	}
+
+	return parameters.LogRulesNamespace(tenant)
+}
@@ -0,0 +1,182 @@
+package syncer
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/observatorium/obsctl/pkg/config"
+)
+
+// WithInMemoryConfig keeps the obsctl config in memory only, never reading it from or writing it to disk, e.g. for
+// ephemeral pods with a read-only filesystem. The config is then kept in memory across reloads, rather than on disk.
+func WithInMemoryConfig(enabled bool) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.inMemoryConfig = enabled
+	}
+}
+
+// The methods below mutate o.c like their obsctl config counterparts, which save the config to disk after each
+// mutation, except that they don't save it in in-memory mode. o.mu must be held.
+
+func (o *ObsctlRulesSyncer) addAPI(name, apiURL string) error {
+	if !o.inMemoryConfig {
+		err := o.c.AddAPI(o.logger, name, apiURL)
+		o.recordConfigDiskOp("add", err)
+		return err
+	}
+
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return errors.Wrapf(err, "parsing API URL %s", apiURL)
+	}
+	if u.Host == "" || u.Scheme == "" {
+		return errors.Newf("%s is not a valid URL (scheme: %s, host: %s)", apiURL, u.Scheme, u.Host)
+	}
+	if _, ok := o.c.APIs[name]; ok {
+		return errors.Newf("api with name %s already exists", name)
+	}
+
+	if o.c.APIs == nil {
+		o.c.APIs = map[string]config.APIConfig{}
+	}
+	o.c.APIs[name] = config.APIConfig{URL: strings.TrimSuffix(u.String(), "/") + "/"}
+	return nil
+}
+
+func (o *ObsctlRulesSyncer) addTenant(name, api, tenant string, oidcCfg *config.OIDCConfig) error {
+	if !o.inMemoryConfig {
+		err := o.c.AddTenant(o.logger, name, api, tenant, oidcCfg)
+		o.recordConfigDiskOp("add", err)
+		return err
+	}
+
+	a, ok := o.c.APIs[api]
+	if !ok {
+		return errors.Newf("api with name %s doesn't exist", api)
+	}
+	if strings.Contains(name, "/") {
+		return errors.Newf("tenant name %s cannot contain slashes", name)
+	}
+	if _, ok := a.Contexts[name]; ok {
+		return errors.Newf("tenant with name %s already exists in api %s", name, api)
+	}
+
+	if a.Contexts == nil {
+		a.Contexts = map[string]config.TenantConfig{}
+		o.c.APIs[api] = a
+	}
+	a.Contexts[name] = config.TenantConfig{Tenant: tenant, OIDC: oidcCfg}
+	if o.c.Current.API == "" && o.c.Current.Tenant == "" {
+		o.c.Current.API, o.c.Current.Tenant = api, name
+	}
+	return nil
+}
+
+func (o *ObsctlRulesSyncer) removeAPI(name string) error {
+	if !o.inMemoryConfig {
+		err := o.c.RemoveAPI(o.logger, name)
+		o.recordConfigDiskOp("remove", err)
+		return err
+	}
+
+	if _, ok := o.c.APIs[name]; !ok {
+		return errors.Newf("api with name %s doesn't exist", name)
+	}
+	if o.c.Current.API == name {
+		o.c.Current.API, o.c.Current.Tenant = "", ""
+	}
+	delete(o.c.APIs, name)
+	return nil
+}
+
+func (o *ObsctlRulesSyncer) removeTenant(name, api string) error {
+	if !o.inMemoryConfig {
+		err := o.c.RemoveTenant(o.logger, name, api)
+		o.recordConfigDiskOp("remove", err)
+		return err
+	}
+
+	if _, ok := o.c.APIs[api].Contexts[name]; !ok {
+		return errors.Newf("tenant with name %s doesn't exist in api %s", name, api)
+	}
+	delete(o.c.APIs[api].Contexts, name)
+	return nil
+}
+
+func (o *ObsctlRulesSyncer) setCurrentContext(api, tenant string) error {
+	if !o.inMemoryConfig {
+		err := o.c.SetCurrentContext(o.logger, api, tenant)
+		o.recordConfigDiskOp("set_context", err)
+		return err
+	}
+
+	if _, ok := o.c.APIs[api].Contexts[tenant]; !ok {
+		return errors.Newf("tenant with name %s doesn't exist in api %s", tenant, api)
+	}
+	o.c.Current.API, o.c.Current.Tenant = api, tenant
+	return nil
+}
+
+// currentConfig returns the obsctl config to make requests with. In in-memory mode, it's a clone of o.c, so that it
+// can be used without holding o.mu.
+func (o *ObsctlRulesSyncer) currentConfig() (*config.Config, error) {
+	if !o.inMemoryConfig {
+		return config.Read(o.logger)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.c == nil {
+		return nil, errors.New("obsctl config not loaded yet")
+	}
+	return cloneConfig(o.c), nil
+}
+
+// oidcClient returns an HTTP client authenticating as the current OIDC tenant of cfg, a config returned by
+// currentConfig. Unlike obsctl's Config.Client, which saves the acquired token to disk, it keeps the token in o.c, unless
+// the tenant was reconfigured meanwhile.
+func (o *ObsctlRulesSyncer) oidcClient(ctx context.Context, cfg *config.Config) (*http.Client, error) {
+	tenantCfg, _, err := cfg.GetCurrentContext()
+	if err != nil {
+		return nil, errors.Wrap(err, "getting current context")
+	}
+
+	// OIDC configs are shared with o.c, so acquire the token on a copy.
+	shared := tenantCfg.OIDC
+	oidcCfg := *shared
+	tenantCfg.OIDC = &oidcCfg
+	c, err := tenantCfg.Client(ctx, o.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	api, tenant := cfg.Current.API, cfg.Current.Tenant
+	if t, ok := o.c.APIs[api].Contexts[tenant]; ok && t.OIDC == shared {
+		t.OIDC = &oidcCfg
+		o.c.APIs[api].Contexts[tenant] = t
+	}
+	return c, nil
+}
+
+// cloneConfig returns a copy of c whose APIs and tenant contexts can be mutated without affecting c. OIDC configs are
+// shared, as they're replaced rather than mutated once added to the config.
+func cloneConfig(c *config.Config) *config.Config {
+	clone := *c
+	clone.APIs = make(map[string]config.APIConfig, len(c.APIs))
+	for name, a := range c.APIs {
+		contexts := make(map[string]config.TenantConfig, len(a.Contexts))
+		for tenant, t := range a.Contexts {
+			contexts[tenant] = t
+		}
+		a.Contexts = contexts
+		clone.APIs[name] = a
+	}
+	return &clone
+}
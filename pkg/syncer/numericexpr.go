@@ -0,0 +1,40 @@
+package syncer
+
+import (
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client/parameters"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// WithRejectNumericExprs rejects the metrics rules of a tenant if the expr of any rule is an integer rather than a
+// string, which only malformed PrometheusRules have. By default, such exprs are synced as the equivalent PromQL number
+// literal.
+func WithRejectNumericExprs(enabled bool) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.rejectNumericExprs = enabled
+	}
+}
+
+// normalizeExprs returns a copy of rules where integer exprs are converted to their string form, so that they're
+// encoded as PromQL rather than as YAML numbers, or an error if numeric exprs are rejected.
+func (o *ObsctlRulesSyncer) normalizeExprs(tenant parameters.Tenant, rules monitoringv1.PrometheusRuleSpec) (monitoringv1.PrometheusRuleSpec, error) {
+	return mapRules(rules, func(g monitoringv1.RuleGroup, r monitoringv1.Rule) (monitoringv1.Rule, error) {
+		if r.Expr.Type != intstr.Int {
+			return r, nil
+		}
+
+		name := r.Alert
+		if name == "" {
+			name = r.Record
+		}
+		if o.rejectNumericExprs {
+			return r, errors.Newf("rule %q of group %q has numeric expr %d, expected a PromQL expression string", name, g.Name, r.Expr.IntVal)
+		}
+
+		level.Warn(o.logger).Log("msg", "converting numeric rule expr to string", "tenant", tenant, "group", g.Name, "rule", name, "expr", r.Expr.IntVal)
+		r.Expr = intstr.FromString(r.Expr.String())
+		return r, nil
+	})
+}
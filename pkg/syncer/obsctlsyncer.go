@@ -1,11 +1,15 @@
 package syncer
 
 import (
-	"bytes"
 	"context"
+	"crypto/x509"
 	"encoding/json"
+	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/efficientgo/core/errors"
 	"github.com/go-kit/log"
@@ -13,16 +17,20 @@ import (
 	lokiv1 "github.com/grafana/loki/operator/apis/loki/v1"
 	"github.com/observatorium/api/client/parameters"
 	"github.com/observatorium/obsctl/pkg/config"
-	"github.com/observatorium/obsctl/pkg/fetcher"
 	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/pkg/rulefmt"
 	"golang.org/x/exp/slices"
+	"golang.org/x/oauth2"
 	"gopkg.in/yaml.v3"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/rhobs/obsctl-reloader/pkg/metricsprefix"
+	"github.com/rhobs/obsctl-reloader/pkg/tenantlabel"
 )
 
 const (
@@ -36,8 +44,10 @@ type ObsctlRulesSyncer struct {
 	ctx             context.Context
 	logger          log.Logger
 	skipClientCheck bool
-	k8s             client.Client
-	namespace       string
+	// configCheckConcurrency is the maximum number of tenant clients created concurrently to check tenant configs.
+	configCheckConcurrency int
+	k8s                    client.Client
+	namespace              string
 
 	apiURL         string
 	audience       string
@@ -47,15 +57,145 @@ type ObsctlRulesSyncer struct {
 	autoDetectSecretsFn func(ctx context.Context,
 		k8s client.Client,
 		namespace, audience, issuerURL, managedTenants string,
-	) (map[string]*config.OIDCConfig, error)
+	) (map[string]*TenantSecret, error)
+
+	// mu serializes mutations of the obsctl config, both of c and of the config persisted to disk, which obsctl
+	// doesn't protect against concurrent writes. It must be held while calling any mutating method of c.
+	mu             sync.Mutex
+	c              *config.Config
+	inMemoryConfig bool
+	httpClient     *http.Client
+
+	apiCAConfigMap *ConfigMapKeyRef
+	apiCA          []byte
+
+	apiMaxIdleConnsPerHost int
+	apiHTTP2Mode           HTTP2Mode
+	apiRootCAs             *x509.CertPool
+	apiTenantPathTemplate  string
+	tenantHeaderName       string
+	maxRetryAfter          time.Duration
+	lokiBatchGroups        bool
+	lokiRulesContentType   string
+	debugHTTP              bool
+	lokiNamespaces         LokiNamespaceResolver
+	maxRulesPerType        int
+	minAlertFor            time.Duration
+	rejectNumericExprs     bool
+	exprTransforms         []ExprTransform
+	maxRangeDuration       time.Duration
+	rangeLimitAction       RangeLimitAction
 
-	c *config.Config
+	sanitizeTenantLabels bool
+	metricsPrefix        string
+	promotedAnnotations  []string
+	managedGroupPrefix   string
+	audit                *auditLog
+	ruleDiffs            *ruleDiffCache
 
 	lokiRulesSetOps      *prometheus.CounterVec
 	promRulesSetOps      *prometheus.CounterVec
 	lokiRulesSetFailures *prometheus.CounterVec
 	promRulesSetFailures *prometheus.CounterVec
 	promRulesStoreOps    *prometheus.CounterVec
+	configDiskOps        *prometheus.CounterVec
+	tenantLastError      *prometheus.GaugeVec
+	lastSyncs            lastSyncs
+	syncWindows          syncWindows
+	syncSuccessRatio     *prometheus.GaugeVec
+	invalidPromotions    *prometheus.CounterVec
+	oidcTokenFailures    *prometheus.CounterVec
+	rateLimited          *prometheus.CounterVec
+	ruleLimitExceeded    *prometheus.CounterVec
+	duplicateCredentials *prometheus.CounterVec
+	inflightRequests     prometheus.Gauge
+	rangeLimitedRules    *prometheus.CounterVec
+}
+
+// Option configures optional behavior of ObsctlRulesSyncer.
+type Option func(o *ObsctlRulesSyncer)
+
+// WithAPIMaxIdleConnsPerHost sets the maximum number of idle (keep-alive) connections kept per Observatorium API host.
+func WithAPIMaxIdleConnsPerHost(n int) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.apiMaxIdleConnsPerHost = n
+	}
+}
+
+// WithAPIHTTP2Mode sets whether HTTP/2 is used for requests to Observatorium API. Defaults to HTTP2Auto.
+func WithAPIHTTP2Mode(mode HTTP2Mode) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.apiHTTP2Mode = mode
+	}
+}
+
+// WithAPITenantPathTemplate makes requests target tenant-specific paths of Observatorium API, for deployments exposing
+// per-tenant API prefixes. The template, e.g. /api/v1/{tenant}, replaces the default /api/{signal}/v1/{tenant} prefix of
+// each request path, where {signal} is either metrics or logs.
+func WithAPITenantPathTemplate(tmpl string) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.apiTenantPathTemplate = tmpl
+	}
+}
+
+// WithTenantHeaderName sets the tenant of each request to Observatorium API in the given header too, e.g. X-Scope-OrgID,
+// for deployments identifying tenants by header rather than by path.
+func WithTenantHeaderName(name string) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.tenantHeaderName = name
+	}
+}
+
+// WithSanitizedTenantLabels sanitizes the tenant label values of the syncer's metrics with tenantlabel.Sanitize.
+// Requests to Observatorium API always use the actual tenant.
+func WithSanitizedTenantLabels(enabled bool) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.sanitizeTenantLabels = enabled
+	}
+}
+
+// WithMetricsPrefix sets the prefix of the names of the syncer's metrics, in place of metricsprefix.Default.
+func WithMetricsPrefix(prefix string) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.metricsPrefix = prefix
+	}
+}
+
+// WithPromotedAnnotations copies the values of the given annotations of each metrics rule onto its labels, for
+// downstream systems routing on labels. Existing labels are kept.
+func WithPromotedAnnotations(keys ...string) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.promotedAnnotations = keys
+	}
+}
+
+// WithConfigCheckConcurrency sets how many tenant clients are created concurrently to check tenant configs when
+// initializing the obsctl config. Defaults to 1.
+func WithConfigCheckConcurrency(n int) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.configCheckConcurrency = n
+	}
+}
+
+// WithManagedGroupPrefix prefixes the name of each synced rule group with prefix, unless it already has it, to mark
+// rule groups managed by the reloader on the Observatorium side, e.g. to safely purge them.
+func WithManagedGroupPrefix(prefix string) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.managedGroupPrefix = prefix
+	}
+}
+
+// ConfigMapKeyRef references a key of a ConfigMap.
+type ConfigMapKeyRef struct {
+	Namespace, Name, Key string
+}
+
+// WithAPICAConfigMap makes the syncer trust the CA bundle stored in the given ConfigMap key for requests to
+// Observatorium API. The CA is read on every config reload.
+func WithAPICAConfigMap(ref ConfigMapKeyRef) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.apiCAConfigMap = &ref
+	}
 }
 
 func NewObsctlRulesSyncer(
@@ -64,8 +204,9 @@ func NewObsctlRulesSyncer(
 	kc client.Client,
 	namespace, apiURL, audience, issuerURL, managedTenants string,
 	reg prometheus.Registerer,
+	opts ...Option,
 ) *ObsctlRulesSyncer {
-	return &ObsctlRulesSyncer{
+	o := &ObsctlRulesSyncer{
 		ctx:            ctx,
 		logger:         logger,
 		k8s:            kc,
@@ -74,38 +215,170 @@ func NewObsctlRulesSyncer(
 		audience:       audience,
 		issuerURL:      issuerURL,
 		managedTenants: managedTenants,
+		metricsPrefix:  metricsprefix.Default,
+
+		autoDetectSecretsFn:    AutoDetectTenantSecrets,
+		apiMaxIdleConnsPerHost: DefaultAPIMaxIdleConnsPerHost,
+		configCheckConcurrency: 1,
+		lokiRulesContentType:   DefaultLokiRulesContentType,
+		syncWindows:            syncWindows{size: DefaultSyncSuccessWindow},
+	}
+
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	o.registerMetrics(reg)
+	o.httpClient = &http.Client{Transport: newAPITransport(o.apiMaxIdleConnsPerHost, o.apiHTTP2Mode, nil)}
+
+	return o
+}
+
+// RegisterMetrics registers the metrics of an ObsctlRulesSyncer configured with opts with reg, without creating one,
+// e.g. to check for duplicate metrics at startup.
+func RegisterMetrics(reg prometheus.Registerer, opts ...Option) {
+	o := &ObsctlRulesSyncer{metricsPrefix: metricsprefix.Default}
+	for _, opt := range opts {
+		opt(o)
+	}
+	o.registerMetrics(reg)
+}
+
+func (o *ObsctlRulesSyncer) registerMetrics(reg prometheus.Registerer) {
+	o.lokiRulesSetOps = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "loki_rule_sets_total",
+		Help:      "Total number of obsctl set operations for lokiv1/v1beta1 rules.",
+	}, []string{"type", "tenant"})
+	o.promRulesSetOps = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "prom_rule_sets_total",
+		Help:      "Total number of obsctl set operations for monitoringv1 rules.",
+	}, []string{"tenant"})
+	o.lokiRulesSetFailures = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "loki_rule_set_failures_total",
+		Help:      "Total number of failed obsctl set operations for lokiv1/v1beta1 rules.",
+	}, []string{"type", "tenant"})
+	o.promRulesSetFailures = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "prom_rule_set_failures_total",
+		Help:      "Total number of failed obsctl set operations for monitoringv1 rules.",
+	}, []string{"tenant", "reason"})
+	o.promRulesStoreOps = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "prom_rules_store_ops_total",
+		Help:      "Total number of downstream requests to store prometheus rules.",
+	}, []string{"tenant", "status_code"})
+	o.configDiskOps = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "config_disk_ops_total",
+		Help:      "Total number of obsctl config operations persisted to disk, by operation and outcome.",
+	}, []string{"op", "outcome"})
+	o.tenantLastError = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "tenant_last_error",
+		Help:      "Reason of the error of the last rules set operation of a tenant; 1 for the current reason, 0 for others. All 0 if it succeeded.",
+	}, []string{"tenant", "reason"})
+	o.invalidPromotions = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "prom_rule_invalid_annotation_promotions_total",
+		Help:      "Total number of rule annotations which couldn't be promoted to labels, because of an invalid label name or value, or a conflicting label.",
+	}, []string{"tenant"})
+	o.oidcTokenFailures = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "oidc_token_failures_total",
+		Help:      "Total number of failures to acquire an OIDC token for a tenant, including failed OIDC discovery.",
+	}, []string{"tenant"})
+	o.rateLimited = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "rate_limited_total",
+		Help:      "Total number of Loki rules set requests rate limited by Observatorium API.",
+	}, []string{"tenant"})
+	o.ruleLimitExceeded = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "tenant_rule_limit_exceeded_total",
+		Help:      "Total number of rules set operations rejected for exceeding the maximum number of rules of one type per tenant.",
+	}, []string{"tenant"})
+	o.duplicateCredentials = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "duplicate_tenant_credentials_total",
+		Help:      "Total number of times a tenant was found sharing its OIDC client ID with other tenants, on config reloads.",
+	}, []string{"tenant"})
+	o.inflightRequests = promauto.With(reg).NewGauge(prometheus.GaugeOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "inflight_api_requests",
+		Help:      "Number of rules set requests to Observatorium API currently in flight.",
+	})
+	o.syncSuccessRatio = promauto.With(reg).NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "sync_success_ratio",
+		Help:      "Ratio of successful rules set operations of a tenant, over its last operations as configured by the sync success window.",
+	}, []string{"tenant"})
+	o.rangeLimitedRules = promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
+		Namespace: o.metricsPrefix,
+		Name:      "prom_rule_range_limited_total",
+		Help:      "Total number of metrics rules with range vector selectors exceeding the maximum range, by whether they were capped or rejected.",
+	}, []string{"tenant", "action"})
+}
+
+// SplitList splits a comma-separated list, e.g. of tenants as passed to NewObsctlRulesSyncer, ignoring surrounding
+// whitespace and empty entries.
+func SplitList(s string) []string {
+	var res []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			res = append(res, e)
+		}
+	}
+
+	return res
+}
+
+// Data keys of tenant secrets. Each key can also be spelled with underscores instead of dashes, e.g. client_id, in
+// which case the dashed key takes precedence if both are set.
+const (
+	// SecretKeyClientID is the OIDC client ID of the tenant. Required.
+	SecretKeyClientID = "client-id"
+	// SecretKeyClientSecret is the OIDC client secret of the tenant. Required.
+	SecretKeyClientSecret = "client-secret"
+	// SecretKeyIssuerURL overrides the OIDC issuer URL for the tenant.
+	SecretKeyIssuerURL = "issuer-url"
+	// SecretKeyAudience overrides the OIDC audience for the tenant.
+	SecretKeyAudience = "audience"
+	// SecretKeyAPIURL overrides the Observatorium API URL the tenant's rules are synced to.
+	SecretKeyAPIURL = "api-url"
+	// SecretKeyTenantID is the tenant's name in Observatorium API, if it differs from the tenant label.
+	SecretKeyTenantID = "tenant-id"
+)
+
+// TenantSecret is the configuration of a tenant, read from its secret.
+type TenantSecret struct {
+	OIDC *config.OIDCConfig
+	// APIURL is the URL of the Observatorium API the tenant's rules are synced to, if it differs from the default one.
+	APIURL string
+	// TenantID is the tenant's name in Observatorium API, if it differs from the tenant label.
+	TenantID string
+}
 
-		autoDetectSecretsFn: AutoDetectTenantSecrets,
-
-		lokiRulesSetOps: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
-			Name: "obsctl_reloader_loki_rule_sets_total",
-			Help: "Total number of obsctl set operations for lokiv1/v1beta1 rules.",
-		}, []string{"type", "tenant"}),
-		promRulesSetOps: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
-			Name: "obsctl_reloader_prom_rule_sets_total",
-			Help: "Total number of obsctl set operations for monitoringv1 rules.",
-		}, []string{"tenant"}),
-		lokiRulesSetFailures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
-			Name: "obsctl_reloader_loki_rule_set_failures_total",
-			Help: "Total number of failed obsctl set operations for lokiv1/v1beta1 rules.",
-		}, []string{"type", "tenant"}),
-		promRulesSetFailures: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
-			Name: "obsctl_reloader_prom_rule_set_failures_total",
-			Help: "Total number of failed obsctl set operations for monitoringv1 rules.",
-		}, []string{"tenant", "reason"}),
-		promRulesStoreOps: promauto.With(reg).NewCounterVec(prometheus.CounterOpts{
-			Name: "obsctl_reloader_prom_rules_store_ops_total",
-			Help: "Total number of downstream requests to store prometheus rules.",
-		}, []string{"tenant", "status_code"}),
+// secretValue returns the value of key in data, or of its underscored spelling.
+func secretValue(data map[string][]byte, key string) string {
+	if v, ok := data[key]; ok {
+		return string(v)
 	}
+
+	return string(data[strings.ReplaceAll(key, "-", "_")])
 }
 
+// AutoDetectTenantSecrets reads the configuration of the managed tenants from the secrets in namespace labeled with
+// the tenant, see the SecretKey constants for the data keys. audience and issuerURL are used for tenants which don't
+// override them. Secrets without OIDC client credentials are skipped.
 func AutoDetectTenantSecrets(
 	ctx context.Context,
 	k8s client.Client,
 	namespace, audience, issuerURL, managedTenants string,
-) (map[string]*config.OIDCConfig, error) {
-	tenantSecret := map[string]*config.OIDCConfig{}
+) (map[string]*TenantSecret, error) {
+	tenantSecret := map[string]*TenantSecret{}
 
 	// List secrets by filtered with tenant label.
 	ls, err := metav1.LabelSelectorAsSelector(
@@ -124,12 +397,13 @@ func AutoDetectTenantSecrets(
 		return nil, err
 	}
 
-	// Filter secrets for configured tenants.
-	configuredTenants := strings.Split(managedTenants, ",")
+	// Filter secrets for configured tenants. The empty tenant is never configured, so that secrets labeled with an
+	// empty tenant aren't picked up, e.g. if no tenants are configured at all.
+	configuredTenants := SplitList(managedTenants)
 	for i := range secret.Items {
 		lbls := secret.Items[i].Labels
 
-		if _, ok := lbls["tenant"]; !ok {
+		if lbls["tenant"] == "" {
 			continue
 		}
 
@@ -142,25 +416,19 @@ func AutoDetectTenantSecrets(
 			continue
 		}
 
+		data := secret.Items[i].Data
 		tOIDC := &config.OIDCConfig{
 			Audience:      audience,
 			IssuerURL:     issuerURL,
 			OfflineAccess: false,
+			ClientID:      secretValue(data, SecretKeyClientID),
+			ClientSecret:  secretValue(data, SecretKeyClientSecret),
 		}
-
-		// Get tenant credentials from secret.
-		// TODO: Define spec for secrets. Currently can be both underscore and dash.
-		if cd, ok := secret.Items[i].Data["client_id"]; ok {
-			tOIDC.ClientID = string(cd)
-		}
-		if cd, ok := secret.Items[i].Data["client-id"]; ok {
-			tOIDC.ClientID = string(cd)
-		}
-		if cs, ok := secret.Items[i].Data["client_secret"]; ok {
-			tOIDC.ClientSecret = string(cs)
+		if v := secretValue(data, SecretKeyAudience); v != "" {
+			tOIDC.Audience = v
 		}
-		if cs, ok := secret.Items[i].Data["client-secret"]; ok {
-			tOIDC.ClientSecret = string(cs)
+		if v := secretValue(data, SecretKeyIssuerURL); v != "" {
+			tOIDC.IssuerURL = v
 		}
 
 		// Skip if secret is missing credentials.
@@ -168,34 +436,55 @@ func AutoDetectTenantSecrets(
 			continue
 		}
 
-		tenantSecret[lbls["tenant"]] = tOIDC
+		tenantSecret[lbls["tenant"]] = &TenantSecret{
+			OIDC:     tOIDC,
+			APIURL:   secretValue(data, SecretKeyAPIURL),
+			TenantID: secretValue(data, SecretKeyTenantID),
+		}
 	}
 
 	return tenantSecret, nil
 }
 
-// InitOrReloadObsctlConfig reads config from disk if present, or initializes one based on env vars.
+// InitOrReloadObsctlConfig reads config from disk if present, or initializes one based on env vars. The config is then
+// updated from the tenant secrets incrementally: tenants whose config is unchanged are kept as is, along with any token
+// already acquired for them, and only new or changed tenants are checked and (re-)added.
 func (o *ObsctlRulesSyncer) InitOrReloadObsctlConfig() error {
-	// Check if config is already present on disk.
-	cfg, err := config.Read(o.logger)
-	if err != nil {
-		return errors.Wrap(err, "reading obsctl config from disk")
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := o.reloadAPICA(); err != nil {
+		level.Error(o.logger).Log("msg", "loading API CA", "error", err)
+		return errors.Wrap(err, "loading API CA")
 	}
 
-	if len(cfg.APIs[obsctlContextAPIName].Contexts) != 0 && cfg.APIs[obsctlContextAPIName].URL == o.apiURL {
-		o.c = cfg
-		level.Info(o.logger).Log("msg", "loading obsctl config from disk")
-		return nil
+	prev := o.c
+	if !o.inMemoryConfig {
+		// Check if config is already present on disk.
+		cfg, err := config.Read(o.logger)
+		o.recordConfigDiskOp("read", err)
+		if err != nil {
+			return errors.Wrap(err, "reading obsctl config from disk")
+		}
+		prev = cfg
+	} else if prev != nil {
+		// Fetchers may still hold a copy of the previous config, so don't mutate its APIs in place.
+		prev = cloneConfig(prev)
 	}
 
-	level.Info(o.logger).Log("msg", "creating new obsctl config")
+	if prev != nil && sameAPIURL(prev.APIs[obsctlContextAPIName].URL, o.apiURL) {
+		o.c = prev
+		level.Info(o.logger).Log("msg", "reloading obsctl config")
+	} else {
+		level.Info(o.logger).Log("msg", "creating new obsctl config")
 
-	// No previous config present,
-	// Add API.
-	o.c = &config.Config{}
-	if err := o.c.AddAPI(o.logger, obsctlContextAPIName, o.apiURL); err != nil {
-		level.Error(o.logger).Log("msg", "add api", "error", err)
-		return errors.Wrap(err, "adding new API to obsctl config")
+		// No previous config present,
+		// Add API.
+		o.c = &config.Config{}
+		if err := o.addAPI(obsctlContextAPIName, o.apiURL); err != nil {
+			level.Error(o.logger).Log("msg", "add api", "error", err)
+			return errors.Wrap(err, "adding new API to obsctl config")
+		}
 	}
 
 	tenantSecrets, err := o.autoDetectSecretsFn(o.ctx, o.k8s, o.namespace, o.audience, o.issuerURL, o.managedTenants)
@@ -204,38 +493,337 @@ func (o *ObsctlRulesSyncer) InitOrReloadObsctlConfig() error {
 		return errors.Wrap(err, "auto detecting tenant secrets")
 	}
 
-	// Add all managed tenants under the API.
-	for tenant, oidc := range tenantSecrets {
-		tenantCfg := config.TenantConfig{OIDC: oidc}
-		tenantCfg.Tenant = tenant
+	o.reportDuplicateCredentials(tenantSecrets)
 
-		if !o.skipClientCheck {
-			// We create a client here to check if config is valid for a particular managed tenant.
-			if _, err := tenantCfg.Client(o.ctx, o.logger); err != nil {
-				level.Error(o.logger).Log("msg", "creating authenticated client", "tenant", tenant, "error", err)
-				// Don't block on this error. We can still sync rules for other tenants.
+	// Tenants are kept under the API, or under their own API if they override its URL.
+	type tenantEntry struct {
+		api, apiURL string
+		cfg         config.TenantConfig
+	}
+	var (
+		entries = make(map[string]tenantEntry, len(tenantSecrets))
+		changed = make(map[string]*TenantSecret, len(tenantSecrets))
+		keep    = map[string]map[string]bool{}
+	)
+	for tenant, secret := range tenantSecrets {
+		e := tenantEntry{api: obsctlContextAPIName, apiURL: o.apiURL, cfg: config.TenantConfig{Tenant: tenant, OIDC: secret.OIDC}}
+		if secret.TenantID != "" {
+			e.cfg.Tenant = secret.TenantID
+		}
+		if secret.APIURL != "" && !sameAPIURL(secret.APIURL, o.apiURL) {
+			e.api, e.apiURL = tenantAPIName(tenant), secret.APIURL
+		}
+		entries[tenant] = e
+
+		existingAPI, foundAPI := o.c.APIs[e.api]
+		existingTenantCfg, foundTenant := existingAPI.Contexts[tenant]
+		if foundAPI && foundTenant && sameAPIURL(existingAPI.URL, e.apiURL) && o.tenantConfigMatches(existingTenantCfg, e.cfg) {
+			if keep[e.api] == nil {
+				keep[e.api] = map[string]bool{}
+			}
+			keep[e.api][tenant] = true
+			continue
+		}
+		changed[tenant] = secret
+	}
+
+	validTenants := o.checkTenantConfigs(changed)
+
+	for tenant := range changed {
+		if !validTenants[tenant] {
+			// Don't block on invalid configs. We can still sync rules for other tenants.
+			continue
+		}
+
+		e := entries[tenant]
+		if a, ok := o.c.APIs[e.api]; ok && e.api != obsctlContextAPIName && !sameAPIURL(a.URL, e.apiURL) {
+			if err := o.removeAPI(e.api); err != nil {
+				level.Error(o.logger).Log("msg", "removing tenant API", "tenant", tenant, "url", a.URL, "error", err)
+				continue
+			}
+		}
+		if _, ok := o.c.APIs[e.api]; !ok {
+			if err := o.addAPI(e.api, e.apiURL); err != nil {
+				level.Error(o.logger).Log("msg", "adding tenant API", "tenant", tenant, "url", e.apiURL, "error", err)
 				continue
 			}
 		}
 
-		existingTenantCfg, foundTenant := o.c.APIs[obsctlContextAPIName].Contexts[tenant]
-		if foundTenant && !o.tenantConfigMatches(existingTenantCfg, tenantCfg) {
-			err := o.c.RemoveTenant(o.logger, tenantCfg.Tenant, obsctlContextAPIName)
-			if err != nil {
+		if _, foundTenant := o.c.APIs[e.api].Contexts[tenant]; foundTenant {
+			if err := o.removeTenant(tenant, e.api); err != nil {
 				// We don't really care about the error here, logging only for visibility.
 				level.Info(o.logger).Log("msg", "removing tenant", "tenant", tenant, "error", err)
 			}
 		}
 
-		if err := o.c.AddTenant(o.logger, tenantCfg.Tenant, obsctlContextAPIName, tenantCfg.Tenant, tenantCfg.OIDC); err != nil {
+		if err := o.addTenant(tenant, e.api, e.cfg.Tenant, e.cfg.OIDC); err != nil {
 			level.Error(o.logger).Log("msg", "adding tenant", "tenant", tenant, "error", err)
 			return errors.Wrap(err, "adding tenant to obsctl config")
 		}
+		if keep[e.api] == nil {
+			keep[e.api] = map[string]bool{}
+		}
+		keep[e.api][tenant] = true
 	}
 
+	o.removeStaleTenants(keep)
 	return nil
 }
 
+// removeStaleTenants removes the tenants which aren't in keep, e.g. as their secret was deleted or their config is now
+// invalid, as well as the tenant APIs left without tenants.
+func (o *ObsctlRulesSyncer) removeStaleTenants(keep map[string]map[string]bool) {
+	for api, a := range o.c.APIs {
+		for tenant := range a.Contexts {
+			if keep[api][tenant] {
+				continue
+			}
+			if err := o.removeTenant(tenant, api); err != nil {
+				level.Warn(o.logger).Log("msg", "removing stale tenant", "tenant", tenant, "api", api, "error", err)
+			}
+		}
+
+		if api != obsctlContextAPIName && len(keep[api]) == 0 {
+			if err := o.removeAPI(api); err != nil {
+				level.Warn(o.logger).Log("msg", "removing stale tenant API", "api", api, "error", err)
+			}
+		}
+	}
+}
+
+// sameAPIURL reports whether two API URLs are the same, regardless of a trailing slash.
+func sameAPIURL(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+// tenantAPIName returns the name of the obsctl API config of a tenant overriding the Observatorium API URL.
+func tenantAPIName(tenant string) string {
+	return obsctlContextAPIName + "-" + tenant
+}
+
+// reportDuplicateCredentials warns about tenants sharing the same OIDC client, which is most likely a mistake in their
+// secrets: their rules would be synced with the same token, possibly under the wrong tenant's scope.
+func (o *ObsctlRulesSyncer) reportDuplicateCredentials(tenantSecrets map[string]*TenantSecret) {
+	type oidcClient struct{ issuerURL, clientID string }
+	tenantsByClient := map[oidcClient][]string{}
+	for tenant, secret := range tenantSecrets {
+		if secret.OIDC == nil || secret.OIDC.ClientID == "" {
+			continue
+		}
+		c := oidcClient{issuerURL: secret.OIDC.IssuerURL, clientID: secret.OIDC.ClientID}
+		tenantsByClient[c] = append(tenantsByClient[c], tenant)
+	}
+
+	for c, tenants := range tenantsByClient {
+		if len(tenants) < 2 {
+			continue
+		}
+
+		sort.Strings(tenants)
+		level.Warn(o.logger).Log("msg", "tenants share the same OIDC client ID", "client_id", c.clientID, "issuer_url", c.issuerURL, "tenants", strings.Join(tenants, ","))
+		for _, tenant := range tenants {
+			o.duplicateCredentials.WithLabelValues(o.tenantLabel(parameters.Tenant(tenant))).Inc()
+		}
+	}
+}
+
+// checkTenantConfigs returns the tenants whose config is valid. We create a client for each tenant to check its config,
+// with up to configCheckConcurrency clients created at a time. Acquired tokens are kept in the tenant's OIDC config.
+// Only local state is touched here; the obsctl config is updated afterwards by the caller.
+func (o *ObsctlRulesSyncer) checkTenantConfigs(tenantSecrets map[string]*TenantSecret) map[string]bool {
+	valid := make(map[string]bool, len(tenantSecrets))
+	if o.skipClientCheck {
+		for tenant := range tenantSecrets {
+			valid[tenant] = true
+		}
+		return valid
+	}
+
+	concurrency := o.configCheckConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, concurrency)
+	)
+	for tenant, secret := range tenantSecrets {
+		tenantCfg := config.TenantConfig{Tenant: tenant, OIDC: secret.OIDC}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if _, err := tenantCfg.Client(o.ctx, o.logger); err != nil {
+				level.Error(o.logger).Log("msg", "creating authenticated client", "tenant", tenantCfg.Tenant, "error", err)
+				return
+			}
+
+			mu.Lock()
+			valid[tenantCfg.Tenant] = true
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	return valid
+}
+
+// recordConfigDiskOp counts an obsctl config operation which reads from or writes to disk.
+func (o *ObsctlRulesSyncer) recordConfigDiskOp(op string, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	o.configDiskOps.WithLabelValues(op, outcome).Inc()
+}
+
+// Reasons for failed set operations, as reported by obsctl_reloader_tenant_last_error.
+const (
+	errorReasonAuth          = "auth"
+	errorReasonNetwork       = "network"
+	errorReasonValidation    = "validation"
+	errorReasonDownstream4xx = "downstream_4xx"
+	errorReasonDownstream5xx = "downstream_5xx"
+)
+
+var errorReasons = []string{errorReasonAuth, errorReasonNetwork, errorReasonValidation, errorReasonDownstream4xx, errorReasonDownstream5xx}
+
+// promoteAnnotations returns a copy of rules where the configured annotations of each rule are copied onto its labels.
+// Annotations which aren't valid as label, or conflict with an existing label, are skipped and reported.
+func (o *ObsctlRulesSyncer) promoteAnnotations(tenant parameters.Tenant, rules monitoringv1.PrometheusRuleSpec) monitoringv1.PrometheusRuleSpec {
+	// Promoting annotations never fails.
+	rules, _ = mapRules(rules, func(g monitoringv1.RuleGroup, r monitoringv1.Rule) (monitoringv1.Rule, error) {
+		// Copy labels, as they may be shared with other tenants too.
+		labels := make(map[string]string, len(r.Labels)+len(o.promotedAnnotations))
+		for k, v := range r.Labels {
+			labels[k] = v
+		}
+
+		for _, key := range o.promotedAnnotations {
+			v, ok := r.Annotations[key]
+			if !ok {
+				continue
+			}
+
+			var reason string
+			switch existing, exists := labels[key]; {
+			case !model.LabelName(key).IsValid():
+				reason = "invalid label name"
+			case !model.LabelValue(v).IsValid():
+				reason = "invalid label value"
+			case exists && existing != v:
+				reason = "conflicting label"
+			}
+			if reason != "" {
+				level.Warn(o.logger).Log("msg", "skipping annotation promotion", "tenant", tenant, "group", g.Name, "alert", r.Alert, "annotation", key, "reason", reason)
+				o.invalidPromotions.WithLabelValues(o.tenantLabel(tenant)).Inc()
+				continue
+			}
+
+			labels[key] = v
+		}
+
+		if len(labels) > 0 {
+			r.Labels = labels
+		}
+		return r, nil
+	})
+	return rules
+}
+
+// mapRules returns a copy of rules where each rule is replaced with the one f returns for it, given its group, or rules
+// and the first error f returns. Rules are copied, as the source may be shared with other tenants.
+func mapRules(rules monitoringv1.PrometheusRuleSpec, f func(g monitoringv1.RuleGroup, r monitoringv1.Rule) (monitoringv1.Rule, error)) (monitoringv1.PrometheusRuleSpec, error) {
+	groups := make([]monitoringv1.RuleGroup, 0, len(rules.Groups))
+	for _, g := range rules.Groups {
+		rs := make([]monitoringv1.Rule, 0, len(g.Rules))
+		for _, r := range g.Rules {
+			mapped, err := f(g, r)
+			if err != nil {
+				return rules, err
+			}
+			rs = append(rs, mapped)
+		}
+
+		g.Rules = rs
+		groups = append(groups, g)
+	}
+
+	rules.Groups = groups
+	return rules, nil
+}
+
+// tenantLabel returns the tenant label value of metrics for tenant.
+func (o *ObsctlRulesSyncer) tenantLabel(tenant parameters.Tenant) string {
+	if o.sanitizeTenantLabels {
+		return tenantlabel.Sanitize(string(tenant))
+	}
+
+	return string(tenant)
+}
+
+// managedGroupName returns the name a rule group is synced with, marked with the managed group prefix.
+func (o *ObsctlRulesSyncer) managedGroupName(name string) string {
+	if strings.HasPrefix(name, o.managedGroupPrefix) {
+		return name
+	}
+
+	return o.managedGroupPrefix + name
+}
+
+// setTenantLastError records the reason of the last set operation's error for tenant, or clears it if reason is empty.
+func (o *ObsctlRulesSyncer) setTenantLastError(tenant parameters.Tenant, reason string) {
+	for _, r := range errorReasons {
+		v := 0.0
+		if r == reason {
+			v = 1
+		}
+		o.tenantLastError.WithLabelValues(o.tenantLabel(tenant), r).Set(v)
+	}
+	o.lastSyncs.record(tenant, reason)
+	o.syncSuccessRatio.WithLabelValues(o.tenantLabel(tenant)).Set(o.syncWindows.record(tenant, reason == ""))
+}
+
+// setTenantRequestError records the error of a request sent to Observatorium API as the last error of tenant, and
+// counts it as an OIDC token failure if the token couldn't be refreshed.
+func (o *ObsctlRulesSyncer) setTenantRequestError(tenant parameters.Tenant, err error) {
+	reason := requestErrorReason(err)
+	if reason == errorReasonAuth {
+		o.oidcTokenFailures.WithLabelValues(o.tenantLabel(tenant)).Inc()
+	}
+	o.setTenantLastError(tenant, reason)
+}
+
+// requestErrorReason categorizes an error returned while sending a request to Observatorium API. Failing to
+// retrieve an OIDC token surfaces here too, as tokens are fetched by the HTTP client.
+func requestErrorReason(err error) string {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		return errorReasonAuth
+	}
+
+	return errorReasonNetwork
+}
+
+// statusErrorReason categorizes a non-2xx status code returned by Observatorium API.
+func statusErrorReason(code int) string {
+	switch {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return errorReasonAuth
+	case code/100 == 4:
+		return errorReasonDownstream4xx
+	default:
+		return errorReasonDownstream5xx
+	}
+}
+
 // tenantConfigMatches checks if two tenant configs are equal. We consider them equal if they have the same tenant name
 // and OIDC config (regardless of any token that might've been already acquired and cached).
 func (o *ObsctlRulesSyncer) tenantConfigMatches(firstConfig, secondConfig config.TenantConfig) bool {
@@ -243,8 +831,9 @@ func (o *ObsctlRulesSyncer) tenantConfigMatches(firstConfig, secondConfig config
 		return false
 	}
 
-	if firstConfig.OIDC != secondConfig.OIDC {
-		return false
+	// OIDC configs are compared by value, as they are read into new structs on each reload.
+	if firstConfig.OIDC == nil || secondConfig.OIDC == nil {
+		return firstConfig.OIDC == nil && secondConfig.OIDC == nil
 	}
 
 	return firstConfig.OIDC.ClientID == secondConfig.OIDC.ClientID &&
@@ -255,7 +844,15 @@ func (o *ObsctlRulesSyncer) tenantConfigMatches(firstConfig, secondConfig config
 }
 
 func (o *ObsctlRulesSyncer) SetCurrentTenant(tenant string) error {
-	if err := o.c.SetCurrentContext(o.logger, obsctlContextAPIName, tenant); err != nil {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	api := obsctlContextAPIName
+	if _, ok := o.c.APIs[tenantAPIName(tenant)].Contexts[tenant]; ok {
+		api = tenantAPIName(tenant)
+	}
+
+	if err := o.setCurrentContext(api, tenant); err != nil {
 		level.Error(o.logger).Log("msg", "switching context", "tenant", tenant, "error", err)
 		return err
 	}
@@ -263,103 +860,233 @@ func (o *ObsctlRulesSyncer) SetCurrentTenant(tenant string) error {
 	return nil
 }
 
-func (o *ObsctlRulesSyncer) LogsAlertingSet(rules lokiv1.AlertingRuleSpec) error {
+func (o *ObsctlRulesSyncer) LogsAlertingSet(rules lokiv1.AlertingRuleSpec) (err error) {
 	level.Debug(o.logger).Log("msg", "setting logs for tenant")
-	fc, currentTenant, err := fetcher.NewCustomFetcher(o.ctx, o.logger)
+	fc, currentTenant, err := o.newFetcher()
+	defer func() {
+		groups, n := make([]string, 0, len(rules.Groups)), 0
+		for _, g := range rules.Groups {
+			groups = append(groups, g.Name)
+			n += len(g.Rules)
+		}
+		o.recordAudit(currentTenant, auditTypeLogsAlerting, groups, n, err)
+		if err == nil && o.ruleDiffs != nil {
+			o.logRuleDiff(currentTenant, auditTypeLogsAlerting, snapshotRuleGroups(rules.Groups, func(g *lokiv1.AlertingRuleGroup) string { return g.Name }))
+		}
+	}()
 	if err != nil {
 		level.Error(o.logger).Log("msg", "getting fetcher client", "error", err)
+		o.setTenantLastError(currentTenant, errorReasonAuth)
 		return errors.Wrap(err, "getting fetcher client")
 	}
 
+	n := 0
+	for _, group := range rules.Groups {
+		n += len(group.Rules)
+	}
+	if err := o.checkRuleLimit(currentTenant, "logs_alerting", n); err != nil {
+		o.lokiRulesSetFailures.WithLabelValues("alerting", o.tenantLabel(currentTenant)).Inc()
+		return err
+	}
+
+	if o.lokiBatchGroups && len(rules.Groups) > 1 {
+		if setLogsRuleGroupsBatches(o, fc, currentTenant, "alerting", rules.Groups, func(g *lokiv1.AlertingRuleGroup) *string { return &g.Name }) {
+			o.setTenantLastError(currentTenant, "")
+			return nil
+		}
+	}
+
 	for _, group := range rules.Groups {
-		body, err := yaml.Marshal(group)
+		namespace := o.lokiNamespace("alerting", currentTenant, group.Name)
+		if o.managedGroupPrefix != "" {
+			g := *group
+			g.Name = o.managedGroupName(g.Name)
+			group = &g
+		}
+
+		body, err := o.marshalLokiRules(group)
 		if err != nil {
-			level.Error(o.logger).Log("msg", "converting lokiv1 alerting rule group to yaml", "error", err)
-			o.lokiRulesSetFailures.WithLabelValues("alerting", string(currentTenant)).Inc()
-			return errors.Wrap(err, "converting lokiv1 alerting rule group to yaml")
+			level.Error(o.logger).Log("msg", "encoding lokiv1 alerting rule group", "error", err)
+			o.lokiRulesSetFailures.WithLabelValues("alerting", o.tenantLabel(currentTenant)).Inc()
+			o.setTenantLastError(currentTenant, errorReasonValidation)
+			return errors.Wrap(err, "encoding lokiv1 alerting rule group")
 		}
 
 		level.Debug(o.logger).Log("msg", "setting rule file", "rule", string(body))
-		resp, err := fc.SetLogsRulesWithBodyWithResponse(o.ctx, currentTenant, parameters.LogRulesNamespace(currentTenant), "application/yaml", bytes.NewReader(body))
+		resp, err := o.setLogsRules(fc, currentTenant, namespace, body)
 		if err != nil {
 			level.Error(o.logger).Log("msg", "getting response", "error", err)
-			o.lokiRulesSetFailures.WithLabelValues("alerting", string(currentTenant)).Inc()
+			o.lokiRulesSetFailures.WithLabelValues("alerting", o.tenantLabel(currentTenant)).Inc()
+			o.setTenantRequestError(currentTenant, err)
 			return err
 		}
 
 		if resp.StatusCode()/100 != 2 {
+			o.setTenantLastError(currentTenant, statusErrorReason(resp.StatusCode()))
 			if len(resp.Body) != 0 {
 				level.Error(o.logger).Log("msg", "setting loki alerting rules", "error", string(resp.Body))
-				o.lokiRulesSetFailures.WithLabelValues("alerting", string(currentTenant)).Inc()
+				o.lokiRulesSetFailures.WithLabelValues("alerting", o.tenantLabel(currentTenant)).Inc()
 				return errors.Newf("non-200 status code: %v with body: %v", resp.StatusCode(), string(resp.Body))
 			}
-			o.lokiRulesSetFailures.WithLabelValues("alerting", string(currentTenant)).Inc()
+			o.lokiRulesSetFailures.WithLabelValues("alerting", o.tenantLabel(currentTenant)).Inc()
 			return errors.Newf("non-200 status code: %v with empty body", resp.StatusCode())
 		}
 
 		level.Debug(o.logger).Log("msg", string(resp.Body))
-		o.lokiRulesSetOps.WithLabelValues("alerting", string(currentTenant)).Inc()
+		o.lokiRulesSetOps.WithLabelValues("alerting", o.tenantLabel(currentTenant)).Inc()
 	}
 
+	o.setTenantLastError(currentTenant, "")
 	return nil
 }
 
-func (o *ObsctlRulesSyncer) LogsRecordingSet(rules lokiv1.RecordingRuleSpec) error {
+func (o *ObsctlRulesSyncer) LogsRecordingSet(rules lokiv1.RecordingRuleSpec) (err error) {
 	level.Debug(o.logger).Log("msg", "setting logs for tenant")
-	fc, currentTenant, err := fetcher.NewCustomFetcher(o.ctx, o.logger)
+	fc, currentTenant, err := o.newFetcher()
+	defer func() {
+		groups, n := make([]string, 0, len(rules.Groups)), 0
+		for _, g := range rules.Groups {
+			groups = append(groups, g.Name)
+			n += len(g.Rules)
+		}
+		o.recordAudit(currentTenant, auditTypeLogsRecording, groups, n, err)
+		if err == nil && o.ruleDiffs != nil {
+			o.logRuleDiff(currentTenant, auditTypeLogsRecording, snapshotRuleGroups(rules.Groups, func(g *lokiv1.RecordingRuleGroup) string { return g.Name }))
+		}
+	}()
 	if err != nil {
 		level.Error(o.logger).Log("msg", "getting fetcher client", "error", err)
+		o.setTenantLastError(currentTenant, errorReasonAuth)
 		return errors.Wrap(err, "getting fetcher client")
 	}
 
+	n := 0
+	for _, group := range rules.Groups {
+		n += len(group.Rules)
+	}
+	if err := o.checkRuleLimit(currentTenant, "logs_recording", n); err != nil {
+		o.lokiRulesSetFailures.WithLabelValues("recording", o.tenantLabel(currentTenant)).Inc()
+		return err
+	}
+
+	if o.lokiBatchGroups && len(rules.Groups) > 1 {
+		if setLogsRuleGroupsBatches(o, fc, currentTenant, "recording", rules.Groups, func(g *lokiv1.RecordingRuleGroup) *string { return &g.Name }) {
+			o.setTenantLastError(currentTenant, "")
+			return nil
+		}
+	}
+
 	for _, group := range rules.Groups {
-		body, err := yaml.Marshal(group)
+		namespace := o.lokiNamespace("recording", currentTenant, group.Name)
+		if o.managedGroupPrefix != "" {
+			g := *group
+			g.Name = o.managedGroupName(g.Name)
+			group = &g
+		}
+
+		body, err := o.marshalLokiRules(group)
 		if err != nil {
-			level.Error(o.logger).Log("msg", "converting lokiv1 recording rule group to yaml", "error", err)
-			o.lokiRulesSetFailures.WithLabelValues("recording", string(currentTenant)).Inc()
-			return errors.Wrap(err, "converting lokiv1 recording rule group to yaml")
+			level.Error(o.logger).Log("msg", "encoding lokiv1 recording rule group", "error", err)
+			o.lokiRulesSetFailures.WithLabelValues("recording", o.tenantLabel(currentTenant)).Inc()
+			o.setTenantLastError(currentTenant, errorReasonValidation)
+			return errors.Wrap(err, "encoding lokiv1 recording rule group")
 		}
 
 		level.Debug(o.logger).Log("msg", "setting rule file", "rule", string(body))
-		resp, err := fc.SetLogsRulesWithBodyWithResponse(o.ctx, currentTenant, parameters.LogRulesNamespace(currentTenant), "application/yaml", bytes.NewReader(body))
+		resp, err := o.setLogsRules(fc, currentTenant, namespace, body)
 		if err != nil {
 			level.Error(o.logger).Log("msg", "getting response", "error", err)
-			o.lokiRulesSetFailures.WithLabelValues("recording", string(currentTenant)).Inc()
+			o.lokiRulesSetFailures.WithLabelValues("recording", o.tenantLabel(currentTenant)).Inc()
+			o.setTenantRequestError(currentTenant, err)
 			return err
 		}
 
 		if resp.StatusCode()/100 != 2 {
+			o.setTenantLastError(currentTenant, statusErrorReason(resp.StatusCode()))
 			if len(resp.Body) != 0 {
 				level.Error(o.logger).Log("msg", "setting loki recording rules", "error", string(resp.Body))
-				o.lokiRulesSetFailures.WithLabelValues("recording", string(currentTenant)).Inc()
+				o.lokiRulesSetFailures.WithLabelValues("recording", o.tenantLabel(currentTenant)).Inc()
 				return errors.Newf("non-200 status code: %v with body: %v", resp.StatusCode(), string(resp.Body))
 			}
-			o.lokiRulesSetFailures.WithLabelValues("recording", string(currentTenant)).Inc()
+			o.lokiRulesSetFailures.WithLabelValues("recording", o.tenantLabel(currentTenant)).Inc()
 			return errors.Newf("non-200 status code: %v with empty body", resp.StatusCode())
 		}
 
 		level.Debug(o.logger).Log("msg", string(resp.Body))
-		o.lokiRulesSetOps.WithLabelValues("recording", string(currentTenant)).Inc()
+		o.lokiRulesSetOps.WithLabelValues("recording", o.tenantLabel(currentTenant)).Inc()
 	}
 
+	o.setTenantLastError(currentTenant, "")
 	return nil
 }
 
-func (o *ObsctlRulesSyncer) MetricsSet(rules monitoringv1.PrometheusRuleSpec) error {
+func (o *ObsctlRulesSyncer) MetricsSet(rules monitoringv1.PrometheusRuleSpec) (err error) {
 	level.Debug(o.logger).Log("msg", "setting metrics for tenant")
-	fc, currentTenant, err := fetcher.NewCustomFetcher(o.ctx, o.logger)
-	o.promRulesSetOps.WithLabelValues(string(currentTenant)).Inc()
+	fc, currentTenant, err := o.newFetcher()
+	defer func() {
+		groups, n := make([]string, 0, len(rules.Groups)), 0
+		for _, g := range rules.Groups {
+			groups = append(groups, g.Name)
+			n += len(g.Rules)
+		}
+		o.recordAudit(currentTenant, auditTypeMetrics, groups, n, err)
+		if err == nil && o.ruleDiffs != nil {
+			o.logRuleDiff(currentTenant, auditTypeMetrics, snapshotRuleGroups(rules.Groups, func(g monitoringv1.RuleGroup) string { return g.Name }))
+		}
+	}()
+	o.promRulesSetOps.WithLabelValues(o.tenantLabel(currentTenant)).Inc()
 
 	if err != nil {
 		level.Error(o.logger).Log("msg", "getting fetcher client", "error", err)
-		o.promRulesSetFailures.WithLabelValues(string(currentTenant), "get_fetcher_client").Inc()
+		o.promRulesSetFailures.WithLabelValues(o.tenantLabel(currentTenant), "get_fetcher_client").Inc()
+		o.setTenantLastError(currentTenant, errorReasonAuth)
 		return errors.Wrap(err, "getting fetcher client")
 	}
 
+	n := 0
+	for _, g := range rules.Groups {
+		n += len(g.Rules)
+	}
+	if err := o.checkRuleLimit(currentTenant, "metrics", n); err != nil {
+		o.promRulesSetFailures.WithLabelValues(o.tenantLabel(currentTenant), "rule_limit_exceeded").Inc()
+		return err
+	}
+
+	rules, err = o.normalizeExprs(currentTenant, rules)
+	if err != nil {
+		level.Error(o.logger).Log("msg", "rejecting rules with numeric expr", "error", err)
+		o.promRulesSetFailures.WithLabelValues(o.tenantLabel(currentTenant), "numeric_expr").Inc()
+		o.setTenantLastError(currentTenant, errorReasonValidation)
+		return err
+	}
+	if len(o.promotedAnnotations) > 0 {
+		rules = o.promoteAnnotations(currentTenant, rules)
+	}
+	if o.minAlertFor > 0 {
+		rules = o.applyMinAlertFor(currentTenant, rules)
+	}
+	if o.managedGroupPrefix != "" {
+		groups := make([]monitoringv1.RuleGroup, 0, len(rules.Groups))
+		for _, g := range rules.Groups {
+			g.Name = o.managedGroupName(g.Name)
+			groups = append(groups, g)
+		}
+		rules.Groups = groups
+	}
+	if len(o.exprTransforms) > 0 {
+		if rules, err = o.applyExprTransforms(currentTenant, rules); err != nil {
+			level.Error(o.logger).Log("msg", "rejecting rules failing expr transform", "error", err)
+			o.promRulesSetFailures.WithLabelValues(o.tenantLabel(currentTenant), "expr_transform").Inc()
+			o.setTenantLastError(currentTenant, errorReasonValidation)
+			return err
+		}
+	}
+
 	ruleGroups, err := json.Marshal(rules)
 	if err != nil {
 		level.Error(o.logger).Log("msg", "converting monitoringv1 rules to json", "error", err)
-		o.promRulesSetFailures.WithLabelValues(string(currentTenant), "converting_to_json").Inc()
+		o.promRulesSetFailures.WithLabelValues(o.tenantLabel(currentTenant), "converting_to_json").Inc()
+		o.setTenantLastError(currentTenant, errorReasonValidation)
 		return errors.Wrap(err, "converting monitoringv1 rules to json")
 	}
 
@@ -368,37 +1095,42 @@ func (o *ObsctlRulesSyncer) MetricsSet(rules monitoringv1.PrometheusRuleSpec) er
 		for e := range errs {
 			level.Error(o.logger).Log("msg", "rulefmt parsing rules", "error", e, "groups", groups)
 		}
-		o.promRulesSetFailures.WithLabelValues(string(currentTenant), "parsing_rules").Inc()
+		o.promRulesSetFailures.WithLabelValues(o.tenantLabel(currentTenant), "parsing_rules").Inc()
+		o.setTenantLastError(currentTenant, errorReasonValidation)
 		return errors.Wrap(errs[0], "rulefmt parsing rules")
 	}
 
 	body, err := yaml.Marshal(groups)
 	if err != nil {
 		level.Error(o.logger).Log("msg", "converting rulefmt rules to yaml", "error", err)
-		o.promRulesSetFailures.WithLabelValues(string(currentTenant), "converting_to_yaml").Inc()
+		o.promRulesSetFailures.WithLabelValues(o.tenantLabel(currentTenant), "converting_to_yaml").Inc()
+		o.setTenantLastError(currentTenant, errorReasonValidation)
 		return errors.Wrap(err, "converting rulefmt rules to yaml")
 	}
 
 	level.Debug(o.logger).Log("msg", "setting rule file", "rule", string(body))
-	resp, err := fc.SetRawRulesWithBodyWithResponse(o.ctx, currentTenant, "application/yaml", bytes.NewReader(body))
+	resp, err := o.setRawRules(fc, currentTenant, body)
 	if err != nil {
 		level.Error(o.logger).Log("msg", "getting response", "error", err)
-		o.promRulesSetFailures.WithLabelValues(string(currentTenant), "getting_response").Inc()
+		o.promRulesSetFailures.WithLabelValues(o.tenantLabel(currentTenant), "getting_response").Inc()
+		o.setTenantRequestError(currentTenant, err)
 		return err
 	}
-	o.promRulesStoreOps.WithLabelValues(string(currentTenant), strconv.Itoa(resp.StatusCode())).Inc()
+	o.promRulesStoreOps.WithLabelValues(o.tenantLabel(currentTenant), strconv.Itoa(resp.StatusCode())).Inc()
 
 	if resp.StatusCode()/100 != 2 {
+		o.setTenantLastError(currentTenant, statusErrorReason(resp.StatusCode()))
 		if len(resp.Body) != 0 {
 			level.Error(o.logger).Log("msg", "setting rules", "error", string(resp.Body))
-			o.promRulesSetFailures.WithLabelValues(string(currentTenant), "rules_store_error").Inc()
+			o.promRulesSetFailures.WithLabelValues(o.tenantLabel(currentTenant), "rules_store_error").Inc()
 			return errors.Newf("non-200 status code: %v with body: %v", resp.StatusCode(), string(resp.Body))
 		}
-		o.promRulesSetFailures.WithLabelValues(string(currentTenant), "rules_store_error").Inc()
+		o.promRulesSetFailures.WithLabelValues(o.tenantLabel(currentTenant), "rules_store_error").Inc()
 		return errors.Newf("non-200 status code: %v with empty body", resp.StatusCode())
 	}
 
 	level.Debug(o.logger).Log("msg", string(resp.Body))
+	o.setTenantLastError(currentTenant, "")
 
 	return nil
 }
@@ -0,0 +1,1753 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	"github.com/go-kit/log"
+	lokiv1 "github.com/grafana/loki/operator/apis/loki/v1"
+	"github.com/observatorium/api/client/parameters"
+	"github.com/observatorium/obsctl/pkg/config"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/promql/parser"
+	"golang.org/x/oauth2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// setupTestConfig writes an obsctl config to a temporary location, with a single tenant without OIDC
+// credentials pointing at the given API URL.
+func setupTestConfig(t *testing.T, apiURL, tenant string) {
+	t.Helper()
+	t.Setenv("OBSCTL_CONFIG_PATH", filepath.Join(t.TempDir(), "config.json"))
+
+	logger := log.NewNopLogger()
+	cfg, err := config.Read(logger)
+	testutil.Ok(t, err)
+	testutil.Ok(t, cfg.AddAPI(logger, obsctlContextAPIName, apiURL))
+	testutil.Ok(t, cfg.AddTenant(logger, tenant, obsctlContextAPIName, tenant, nil))
+}
+
+func newTestSyncer(t *testing.T, opts ...Option) *ObsctlRulesSyncer {
+	t.Helper()
+
+	return NewObsctlRulesSyncer(
+		context.TODO(),
+		log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr)),
+		nil,
+		"test", "", "", "", "test",
+		prometheus.NewRegistry(),
+		opts...,
+	)
+}
+
+var testPrometheusRuleSpec = monitoringv1.PrometheusRuleSpec{
+	Groups: []monitoringv1.RuleGroup{
+		{
+			Name:     "TestGroup",
+			Interval: "30s",
+			Rules: []monitoringv1.Rule{
+				{
+					Record: "TestRecordingRule",
+					Expr:   intstr.FromString("vector(1)"),
+				},
+			},
+		},
+	},
+}
+
+func TestAPITransportConfigured(t *testing.T) {
+	o := newTestSyncer(t)
+	tr, ok := o.httpClient.Transport.(*http.Transport)
+	testutil.Assert(t, ok, "expected *http.Transport")
+	testutil.Equals(t, DefaultAPIMaxIdleConnsPerHost, tr.MaxIdleConnsPerHost)
+
+	o = newTestSyncer(t, WithAPIMaxIdleConnsPerHost(200))
+	tr, ok = o.httpClient.Transport.(*http.Transport)
+	testutil.Assert(t, ok, "expected *http.Transport")
+	testutil.Equals(t, 200, tr.MaxIdleConnsPerHost)
+	testutil.Equals(t, 200, tr.MaxIdleConns)
+}
+
+func TestMetricsSetUsesAPITransport(t *testing.T) {
+	var gotPath, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotPath, gotBody = r.URL.Path, string(b)
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+
+	var requests int
+	o := newTestSyncer(t)
+	o.httpClient.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		requests++
+		return http.DefaultTransport.RoundTrip(r)
+	})
+
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Equals(t, 1, requests)
+	testutil.Equals(t, "/api/metrics/v1/test/api/v1/rules/raw", gotPath)
+	testutil.Equals(t, `groups:
+    - name: TestGroup
+      interval: 30s
+      rules:
+        - record: "TestRecordingRule"
+          expr: "vector(1)"
+`, gotBody)
+}
+
+type roundTripperFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestInflightAPIRequests(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+
+	o := newTestSyncer(t)
+	var inflight []float64
+	fail := false
+	o.httpClient.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		inflight = append(inflight, promtestutil.ToFloat64(o.inflightRequests))
+		if fail {
+			return nil, errors.New("connection refused")
+		}
+		return http.DefaultTransport.RoundTrip(r)
+	})
+	alerting := lokiv1.AlertingRuleSpec{Groups: []*lokiv1.AlertingRuleGroup{{
+		Name:  "TestGroup",
+		Rules: []*lokiv1.AlertingRuleGroupSpec{{Alert: "TestAlert", Expr: `count_over_time({job="a"}[5m]) > 0`}},
+	}}}
+
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Ok(t, o.LogsAlertingSet(alerting))
+
+	// Failed requests are no longer counted either.
+	fail = true
+	testutil.NotOk(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.NotOk(t, o.LogsAlertingSet(alerting))
+
+	testutil.Equals(t, []float64{1, 1, 1, 1}, inflight)
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(o.inflightRequests))
+}
+
+func TestConfigDiskOps(t *testing.T) {
+	t.Setenv("OBSCTL_CONFIG_PATH", filepath.Join(t.TempDir(), "config.json"))
+
+	o := newTestSyncer(t)
+	o.apiURL = "http://localhost:8080/"
+	o.skipClientCheck = true
+	o.autoDetectSecretsFn = func(_ context.Context, _ client.Client, _, _, _, _ string) (map[string]*TenantSecret, error) {
+		return map[string]*TenantSecret{
+			"test": {OIDC: &config.OIDCConfig{ClientID: "id", ClientSecret: "secret"}},
+		}, nil
+	}
+
+	// No config on disk yet, so the API and tenant are added.
+	testutil.Ok(t, o.InitOrReloadObsctlConfig())
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.configDiskOps.WithLabelValues("read", "success")))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(o.configDiskOps.WithLabelValues("add", "success")))
+
+	// Config is now present on disk and is reused.
+	testutil.Ok(t, o.InitOrReloadObsctlConfig())
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(o.configDiskOps.WithLabelValues("read", "success")))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(o.configDiskOps.WithLabelValues("add", "success")))
+
+	testutil.Ok(t, o.SetCurrentTenant("test"))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.configDiskOps.WithLabelValues("set_context", "success")))
+	testutil.NotOk(t, o.SetCurrentTenant("unknown"))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.configDiskOps.WithLabelValues("set_context", "failure")))
+}
+
+func TestIncrementalConfigReload(t *testing.T) {
+	for _, inMemory := range []bool{false, true} {
+		inMemory := inMemory
+		t.Run(fmt.Sprintf("in-memory=%v", inMemory), func(t *testing.T) {
+			t.Setenv("OBSCTL_CONFIG_PATH", filepath.Join(t.TempDir(), "config.json"))
+
+			o := newTestSyncer(t, WithInMemoryConfig(inMemory))
+			o.apiURL = "http://localhost:8080/"
+			o.skipClientCheck = true
+			clientSecrets := map[string]string{"a": "secret", "b": "secret", "c": "secret"}
+			o.autoDetectSecretsFn = func(_ context.Context, _ client.Client, _, _, _, _ string) (map[string]*TenantSecret, error) {
+				// Secrets are read into new structs on each reload.
+				secrets := map[string]*TenantSecret{}
+				for tenant, secret := range clientSecrets {
+					secrets[tenant] = &TenantSecret{OIDC: &config.OIDCConfig{ClientID: tenant, ClientSecret: secret}}
+				}
+				return secrets, nil
+			}
+			tenantCfg := func(tenant string) config.TenantConfig {
+				cfg, err := o.currentConfig()
+				testutil.Ok(t, err)
+				return cfg.APIs[obsctlContextAPIName].Contexts[tenant]
+			}
+
+			testutil.Ok(t, o.InitOrReloadObsctlConfig())
+			if !inMemory {
+				testutil.Equals(t, 4.0, promtestutil.ToFloat64(o.configDiskOps.WithLabelValues("add", "success")))
+			}
+
+			// Cache a token for a, as a client created with its config would.
+			token := &oauth2.Token{AccessToken: "cached"}
+			if inMemory {
+				tenantCfg("a").OIDC.Token = token
+			} else {
+				cfg, err := config.Read(o.logger)
+				testutil.Ok(t, err)
+				cfg.APIs[obsctlContextAPIName].Contexts["a"].OIDC.Token = token
+				testutil.Ok(t, cfg.Save(o.logger))
+			}
+
+			// Only b, whose secret changed, is re-added, and c, whose secret was deleted, is removed.
+			clientSecrets["b"] = "rotated"
+			delete(clientSecrets, "c")
+			testutil.Ok(t, o.InitOrReloadObsctlConfig())
+			if !inMemory {
+				testutil.Equals(t, 5.0, promtestutil.ToFloat64(o.configDiskOps.WithLabelValues("add", "success")))
+				testutil.Equals(t, 2.0, promtestutil.ToFloat64(o.configDiskOps.WithLabelValues("remove", "success")))
+			}
+
+			testutil.Assert(t, tenantCfg("a").OIDC.Token != nil, "expected the cached token of the unchanged tenant to be kept")
+			testutil.Equals(t, "cached", tenantCfg("a").OIDC.Token.AccessToken)
+			testutil.Equals(t, "rotated", tenantCfg("b").OIDC.ClientSecret)
+			cfg, err := o.currentConfig()
+			testutil.Ok(t, err)
+			_, ok := cfg.APIs[obsctlContextAPIName].Contexts["c"]
+			testutil.Assert(t, !ok, "expected the deleted tenant to be removed")
+		})
+	}
+}
+
+func TestTenantConfigMatches(t *testing.T) {
+	oidc := func() *config.OIDCConfig {
+		return &config.OIDCConfig{ClientID: "id", ClientSecret: "secret", Audience: "aud", IssuerURL: "http://issuer", OfflineAccess: true}
+	}
+	withOIDC := func(mutate func(c *config.OIDCConfig)) config.TenantConfig {
+		c := oidc()
+		mutate(c)
+		return config.TenantConfig{Tenant: "test", OIDC: c}
+	}
+	shared := oidc()
+
+	o := newTestSyncer(t)
+	for _, tc := range []struct {
+		name          string
+		first, second config.TenantConfig
+		want          bool
+	}{
+		{name: "same pointer", first: config.TenantConfig{Tenant: "test", OIDC: shared}, second: config.TenantConfig{Tenant: "test", OIDC: shared}, want: true},
+		{name: "equal values, different pointers", first: config.TenantConfig{Tenant: "test", OIDC: oidc()}, second: config.TenantConfig{Tenant: "test", OIDC: oidc()}, want: true},
+		{name: "both without OIDC", first: config.TenantConfig{Tenant: "test"}, second: config.TenantConfig{Tenant: "test"}, want: true},
+		{name: "one without OIDC", first: config.TenantConfig{Tenant: "test"}, second: config.TenantConfig{Tenant: "test", OIDC: oidc()}},
+		{name: "different tenant", first: config.TenantConfig{Tenant: "test", OIDC: oidc()}, second: config.TenantConfig{Tenant: "other", OIDC: oidc()}},
+		{name: "different client ID", first: withOIDC(func(c *config.OIDCConfig) {}), second: withOIDC(func(c *config.OIDCConfig) { c.ClientID = "other" })},
+		{name: "different client secret", first: withOIDC(func(c *config.OIDCConfig) {}), second: withOIDC(func(c *config.OIDCConfig) { c.ClientSecret = "other" })},
+		{name: "different audience", first: withOIDC(func(c *config.OIDCConfig) {}), second: withOIDC(func(c *config.OIDCConfig) { c.Audience = "other" })},
+		{name: "different issuer", first: withOIDC(func(c *config.OIDCConfig) {}), second: withOIDC(func(c *config.OIDCConfig) { c.IssuerURL = "http://other" })},
+		{name: "different offline access", first: withOIDC(func(c *config.OIDCConfig) {}), second: withOIDC(func(c *config.OIDCConfig) { c.OfflineAccess = false })},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.Equals(t, tc.want, o.tenantConfigMatches(tc.first, tc.second))
+			testutil.Equals(t, tc.want, o.tenantConfigMatches(tc.second, tc.first))
+		})
+	}
+}
+
+func TestAPICAConfigMap(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "observatorium", Name: "api-ca"},
+		Data: map[string]string{
+			"ca.crt": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})),
+		},
+	}
+	kc := fake.NewClientBuilder().WithObjects(cm).Build()
+
+	// Without the CA, the API server certificate is not trusted.
+	o := newTestSyncer(t)
+	testutil.NotOk(t, o.MetricsSet(testPrometheusRuleSpec))
+
+	o = newTestSyncer(t, WithAPICAConfigMap(ConfigMapKeyRef{Namespace: "observatorium", Name: "api-ca", Key: "ca.crt"}))
+	o.k8s = kc
+	testutil.Ok(t, o.reloadAPICA())
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+
+	// A rotated CA is picked up on reload.
+	cm.Data["ca.crt"] = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: selfSignedCert(t).Certificate[0]}))
+	testutil.Ok(t, kc.Update(context.TODO(), cm))
+	testutil.Ok(t, o.reloadAPICA())
+	testutil.NotOk(t, o.MetricsSet(testPrometheusRuleSpec))
+
+	// Missing keys are reported.
+	o = newTestSyncer(t, WithAPICAConfigMap(ConfigMapKeyRef{Namespace: "observatorium", Name: "api-ca", Key: "missing"}))
+	o.k8s = kc
+	testutil.NotOk(t, o.reloadAPICA())
+}
+
+func TestAPICAConfigMapWithOIDCIssuer(t *testing.T) {
+	var gotAuth string
+	api := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+	}))
+	defer api.Close()
+
+	// The issuer is signed by another CA than the API, trusted as a system CA.
+	issuerCert := selfSignedCert(t)
+	var issuerURL string
+	issuer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer":%q,"token_endpoint":%q,"authorization_endpoint":%q,"jwks_uri":%q}`,
+				issuerURL, issuerURL+"/token", issuerURL+"/auth", issuerURL+"/keys")
+		case "/token":
+			fmt.Fprint(w, `{"access_token":"token","token_type":"bearer","expires_in":3600}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	issuer.TLS = &tls.Config{Certificates: []tls.Certificate{issuerCert}}
+	issuer.StartTLS()
+	defer issuer.Close()
+	issuerURL = issuer.URL
+
+	defer func(f func() (*x509.CertPool, error)) { systemCertPool = f }(systemCertPool)
+	systemCertPool = func() (*x509.CertPool, error) {
+		pool := x509.NewCertPool()
+		pool.AddCert(issuer.Certificate())
+		return pool, nil
+	}
+
+	t.Setenv("OBSCTL_CONFIG_PATH", filepath.Join(t.TempDir(), "config.json"))
+	logger := log.NewNopLogger()
+	cfg, err := config.Read(logger)
+	testutil.Ok(t, err)
+	testutil.Ok(t, cfg.AddAPI(logger, obsctlContextAPIName, api.URL))
+	testutil.Ok(t, cfg.AddTenant(logger, "test", obsctlContextAPIName, "test", &config.OIDCConfig{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		IssuerURL:    issuer.URL,
+	}))
+
+	kc := fake.NewClientBuilder().WithObjects(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "observatorium", Name: "api-ca"},
+		Data: map[string]string{
+			"ca.crt": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: api.Certificate().Raw})),
+		},
+	}).Build()
+	o := newTestSyncer(t, WithAPICAConfigMap(ConfigMapKeyRef{Namespace: "observatorium", Name: "api-ca", Key: "ca.crt"}))
+	o.k8s = kc
+	testutil.Ok(t, o.reloadAPICA())
+
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Equals(t, "Bearer token", gotAuth)
+}
+
+// selfSignedCert returns a self-signed CA certificate, also valid as a server certificate for 127.0.0.1.
+func selfSignedCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	testutil.Ok(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	testutil.Ok(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestAPITransportHTTP2Mode(t *testing.T) {
+	newServer := func(enableHTTP2 bool) *httptest.Server {
+		srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.Proto))
+		}))
+		srv.EnableHTTP2 = enableHTTP2
+		srv.StartTLS()
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	h2Srv, h1Srv := newServer(true), newServer(false)
+
+	for _, tc := range []struct {
+		name      string
+		mode      HTTP2Mode
+		srv       *httptest.Server
+		wantProto string
+		wantErr   bool
+	}{
+		{name: "auto with HTTP/2 server", mode: HTTP2Auto, srv: h2Srv, wantProto: "HTTP/2.0"},
+		{name: "auto with HTTP/1.1 server", mode: HTTP2Auto, srv: h1Srv, wantProto: "HTTP/1.1"},
+		{name: "force with HTTP/2 server", mode: HTTP2Force, srv: h2Srv, wantProto: "HTTP/2.0"},
+		{name: "force with HTTP/1.1 server", mode: HTTP2Force, srv: h1Srv, wantErr: true},
+		{name: "disable with HTTP/2 server", mode: HTTP2Disable, srv: h2Srv, wantProto: "HTTP/1.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pool := x509.NewCertPool()
+			pool.AddCert(tc.srv.Certificate())
+			c := &http.Client{Transport: newAPITransport(DefaultAPIMaxIdleConnsPerHost, tc.mode, pool)}
+
+			resp, err := c.Get(tc.srv.URL)
+			if tc.wantErr {
+				testutil.NotOk(t, err)
+				return
+			}
+			testutil.Ok(t, err)
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.wantProto, string(b))
+			testutil.Equals(t, tc.wantProto, resp.Proto)
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+	var buf bytes.Buffer
+	o := newTestSyncer(t, WithAuditLog(&buf))
+
+	status = http.StatusOK
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Ok(t, o.LogsRecordingSet(lokiv1.RecordingRuleSpec{Groups: []*lokiv1.RecordingRuleGroup{
+		{Name: "a", Rules: []*lokiv1.RecordingRuleGroupSpec{{Record: "a", Expr: "vector(1)"}, {Record: "b", Expr: "vector(1)"}}},
+		{Name: "b"},
+	}}))
+	status = http.StatusInternalServerError
+	testutil.NotOk(t, o.LogsAlertingSet(lokiv1.AlertingRuleSpec{Groups: []*lokiv1.AlertingRuleGroup{{Name: "c"}}}))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	testutil.Equals(t, 3, len(lines))
+
+	var entries []auditEntry
+	for _, l := range lines {
+		var e auditEntry
+		testutil.Ok(t, json.Unmarshal([]byte(l), &e))
+		testutil.Assert(t, !e.Timestamp.IsZero(), "missing timestamp")
+		e.Timestamp = time.Time{}
+		entries = append(entries, e)
+	}
+
+	testutil.Equals(t, []auditEntry{
+		{Tenant: "test", Type: auditTypeMetrics, Groups: []string{"TestGroup"}, Rules: 1, Status: "success"},
+		{Tenant: "test", Type: auditTypeLogsRecording, Groups: []string{"a", "b"}, Rules: 2, Status: "success"},
+		{Tenant: "test", Type: auditTypeLogsAlerting, Groups: []string{"c"}, Rules: 0, Status: "failure", Error: "non-200 status code: 500 with empty body"},
+	}, entries)
+}
+
+func TestDiffRuleGroups(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		prev, cur map[string]string
+		want      ruleGroupsDiff
+	}{
+		{
+			name: "unchanged",
+			prev: map[string]string{"a": "1", "b": "2"},
+			cur:  map[string]string{"a": "1", "b": "2"},
+			want: ruleGroupsDiff{},
+		},
+		{
+			name: "no previous groups",
+			prev: map[string]string{},
+			cur:  map[string]string{"b": "2", "a": "1"},
+			want: ruleGroupsDiff{Added: []string{"a", "b"}},
+		},
+		{
+			name: "added, removed and modified",
+			prev: map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"},
+			cur:  map[string]string{"a": "1", "b": "20", "d": "40", "e": "5"},
+			want: ruleGroupsDiff{Added: []string{"e"}, Removed: []string{"c"}, Modified: []string{"b", "d"}},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			testutil.Equals(t, tc.want, diffRuleGroups(tc.prev, tc.cur))
+		})
+	}
+}
+
+func TestRuleDiffLogging(t *testing.T) {
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+	o := newTestSyncer(t, WithRuleDiffLogging(true))
+	var buf bytes.Buffer
+	o.logger = log.NewLogfmtLogger(&buf)
+
+	modified := *testPrometheusRuleSpec.DeepCopy()
+	modified.Groups[0].Rules[0].Labels = map[string]string{"severity": "critical"}
+	modified.Groups = append(modified.Groups, monitoringv1.RuleGroup{Name: "Added"})
+
+	// The first set operation has nothing to compare to.
+	status = http.StatusOK
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Assert(t, !strings.Contains(buf.String(), "synced rule groups changed"), "unexpected diff log: %s", buf.String())
+
+	// Failed set operations don't replace the previously synced rules.
+	status = http.StatusInternalServerError
+	testutil.NotOk(t, o.MetricsSet(modified))
+	testutil.Assert(t, !strings.Contains(buf.String(), "synced rule groups changed"), "unexpected diff log: %s", buf.String())
+
+	status = http.StatusOK
+	testutil.Ok(t, o.MetricsSet(modified))
+	testutil.Assert(t, strings.Contains(buf.String(), `msg="synced rule groups changed" tenant=test type=metrics added=Added removed= modified=TestGroup`), "missing diff log: %s", buf.String())
+}
+
+func TestTenantLastError(t *testing.T) {
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+	o := newTestSyncer(t)
+
+	assertReason := func(t *testing.T, want string) {
+		t.Helper()
+		for _, r := range errorReasons {
+			v := 0.0
+			if r == want {
+				v = 1
+			}
+			testutil.Equals(t, v, promtestutil.ToFloat64(o.tenantLastError.WithLabelValues("test", r)), "reason %s", r)
+		}
+	}
+
+	for _, tc := range []struct {
+		status int
+		want   string
+	}{
+		{status: http.StatusBadRequest, want: errorReasonDownstream4xx},
+		{status: http.StatusServiceUnavailable, want: errorReasonDownstream5xx},
+		{status: http.StatusForbidden, want: errorReasonAuth},
+		{status: http.StatusOK, want: ""},
+	} {
+		status = tc.status
+		err := o.MetricsSet(testPrometheusRuleSpec)
+		if tc.want != "" {
+			testutil.NotOk(t, err)
+		} else {
+			testutil.Ok(t, err)
+		}
+		assertReason(t, tc.want)
+	}
+
+	// Failing to get a token surfaces as a request error.
+	o.httpClient.Transport = roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		return nil, errors.Wrap(&oauth2.RetrieveError{Response: &http.Response{StatusCode: http.StatusUnauthorized}}, "oauth2: cannot fetch token")
+	})
+	testutil.NotOk(t, o.MetricsSet(testPrometheusRuleSpec))
+	assertReason(t, errorReasonAuth)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.oidcTokenFailures.WithLabelValues("test")))
+
+	o.httpClient.Transport = http.DefaultTransport
+	srv.Close()
+	testutil.NotOk(t, o.MetricsSet(testPrometheusRuleSpec))
+	assertReason(t, errorReasonNetwork)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.oidcTokenFailures.WithLabelValues("test")))
+}
+
+func TestConcurrentConfigReloads(t *testing.T) {
+	t.Setenv("OBSCTL_CONFIG_PATH", filepath.Join(t.TempDir(), "config.json"))
+
+	o := newTestSyncer(t)
+	o.apiURL = "http://localhost:8080/"
+	o.skipClientCheck = true
+	o.autoDetectSecretsFn = func(_ context.Context, _ client.Client, _, _, _, _ string) (map[string]*TenantSecret, error) {
+		return map[string]*TenantSecret{
+			"a": {OIDC: &config.OIDCConfig{ClientID: "id", ClientSecret: "secret"}},
+			"b": {OIDC: &config.OIDCConfig{ClientID: "id", ClientSecret: "secret"}},
+		}, nil
+	}
+
+	// The config is always initialized before any tenant is selected.
+	testutil.Ok(t, o.InitOrReloadObsctlConfig())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- o.InitOrReloadObsctlConfig()
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- o.SetCurrentTenant("a")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		testutil.Ok(t, err)
+	}
+	testutil.Equals(t, 2, len(o.c.APIs[obsctlContextAPIName].Contexts))
+
+	cfg, err := config.Read(log.NewNopLogger())
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(cfg.APIs[obsctlContextAPIName].Contexts))
+}
+
+func TestConfigCheckConcurrency(t *testing.T) {
+	var inFlight, maxInFlight int32
+	var issuerURL string
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer":%q,"token_endpoint":%q,"authorization_endpoint":%q,"jwks_uri":%q}`,
+				issuerURL, issuerURL+"/token", issuerURL+"/auth", issuerURL+"/keys")
+		case "/token":
+			n := atomic.AddInt32(&inFlight, 1)
+			defer atomic.AddInt32(&inFlight, -1)
+			for {
+				m := atomic.LoadInt32(&maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+					break
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprint(w, `{"access_token":"token","token_type":"bearer","expires_in":3600}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer issuer.Close()
+	issuerURL = issuer.URL
+
+	t.Setenv("OBSCTL_CONFIG_PATH", filepath.Join(t.TempDir(), "config.json"))
+
+	o := newTestSyncer(t, WithConfigCheckConcurrency(3))
+	o.apiURL = "http://localhost:8080/"
+	o.autoDetectSecretsFn = func(_ context.Context, _ client.Client, _, _, _, _ string) (map[string]*TenantSecret, error) {
+		secrets := map[string]*TenantSecret{
+			// Invalid configs are skipped, without failing other tenants.
+			"invalid": {OIDC: &config.OIDCConfig{ClientID: "id", ClientSecret: "secret", IssuerURL: "http://127.0.0.1:0"}},
+		}
+		for i := 0; i < 8; i++ {
+			secrets[fmt.Sprintf("tenant-%d", i)] = &TenantSecret{OIDC: &config.OIDCConfig{ClientID: "id", ClientSecret: "secret", IssuerURL: issuer.URL}}
+		}
+		return secrets, nil
+	}
+
+	testutil.Ok(t, o.InitOrReloadObsctlConfig())
+
+	testutil.Assert(t, maxInFlight > 1, "expected concurrent client checks")
+	testutil.Assert(t, maxInFlight <= 3, "expected at most 3 concurrent client checks, got %d", maxInFlight)
+
+	contexts := o.c.APIs[obsctlContextAPIName].Contexts
+	testutil.Equals(t, 8, len(contexts))
+	for i := 0; i < 8; i++ {
+		tenantCfg, ok := contexts[fmt.Sprintf("tenant-%d", i)]
+		testutil.Assert(t, ok, "tenant-%d missing from config", i)
+		testutil.Equals(t, "token", tenantCfg.OIDC.Token.AccessToken)
+	}
+}
+
+func TestOIDCTokenFailures(t *testing.T) {
+	var apiCalls int
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apiCalls++
+	}))
+	defer api.Close()
+
+	// Stub issuer, serving discovery but rejecting the client credentials.
+	var issuerURL string
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"issuer":%q,"token_endpoint":%q,"authorization_endpoint":%q,"jwks_uri":%q}`,
+				issuerURL, issuerURL+"/token", issuerURL+"/auth", issuerURL+"/keys")
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer issuer.Close()
+	issuerURL = issuer.URL
+
+	t.Setenv("OBSCTL_CONFIG_PATH", filepath.Join(t.TempDir(), "config.json"))
+	logger := log.NewNopLogger()
+	cfg, err := config.Read(logger)
+	testutil.Ok(t, err)
+	testutil.Ok(t, cfg.AddAPI(logger, obsctlContextAPIName, api.URL))
+	testutil.Ok(t, cfg.AddTenant(logger, "test", obsctlContextAPIName, "test", &config.OIDCConfig{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		IssuerURL:    issuer.URL,
+	}))
+
+	o := newTestSyncer(t)
+
+	testutil.NotOk(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.oidcTokenFailures.WithLabelValues("test")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.tenantLastError.WithLabelValues("test", errorReasonAuth)))
+
+	// An unreachable issuer fails OIDC discovery.
+	issuer.Close()
+	testutil.NotOk(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(o.oidcTokenFailures.WithLabelValues("test")))
+
+	// The API is never reached without a token.
+	testutil.Equals(t, 0, apiCalls)
+}
+
+func TestAPITenantPathTemplate(t *testing.T) {
+	var gotPaths []string
+	mux := http.NewServeMux()
+	for _, p := range []string{"/tenants/test/metrics/api/v1/rules/raw", "/tenants/test/logs/loki/api/v1/rules/test"} {
+		mux.HandleFunc(p, func(w http.ResponseWriter, r *http.Request) {
+			gotPaths = append(gotPaths, r.URL.Path)
+		})
+	}
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+
+	// The stub only serves tenant-specific paths, so the default ones fail.
+	o := newTestSyncer(t)
+	testutil.NotOk(t, o.MetricsSet(testPrometheusRuleSpec))
+
+	o = newTestSyncer(t, WithAPITenantPathTemplate("/tenants/{tenant}/{signal}/"))
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Ok(t, o.LogsAlertingSet(lokiv1.AlertingRuleSpec{Groups: []*lokiv1.AlertingRuleGroup{{Name: "TestGroup"}}}))
+	testutil.Equals(t, []string{"/tenants/test/metrics/api/v1/rules/raw", "/tenants/test/logs/loki/api/v1/rules/test"}, gotPaths)
+}
+
+// staticLokiNamespaces pins Loki rule groups, keyed by type and group name, e.g. alerting/TestGroup, to namespaces.
+type staticLokiNamespaces map[string]string
+
+func (s staticLokiNamespaces) LokiNamespace(typ, _, group string) string {
+	return s[typ+"/"+group]
+}
+
+func TestLokiNamespaceResolver(t *testing.T) {
+	var gotPaths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPaths = append(gotPaths, strings.TrimPrefix(r.URL.Path, "/api/logs/v1/test/loki/api/v1/rules/"))
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+
+	pinned := staticLokiNamespaces{"alerting/Pinned": "shared", "recording/Pinned": "recordings"}
+	alerting := lokiv1.AlertingRuleSpec{Groups: []*lokiv1.AlertingRuleGroup{{Name: "Pinned"}, {Name: "Other"}}}
+	recording := lokiv1.RecordingRuleSpec{Groups: []*lokiv1.RecordingRuleGroup{{Name: "Pinned"}}}
+
+	for _, tc := range []struct {
+		name      string
+		opts      []Option
+		wantPaths []string
+	}{
+		{
+			name:      "not pinned",
+			wantPaths: []string{"test", "test", "test"},
+		},
+		{
+			name:      "pinned",
+			opts:      []Option{WithLokiNamespaceResolver(pinned), WithManagedGroupPrefix("managed-")},
+			wantPaths: []string{"shared", "test", "recordings"},
+		},
+		{
+			name:      "pinned batched",
+			opts:      []Option{WithLokiNamespaceResolver(pinned), WithLokiBatchGroups(true)},
+			wantPaths: []string{"shared", "test", "recordings"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gotPaths = nil
+			o := newTestSyncer(t, tc.opts...)
+			testutil.Ok(t, o.LogsAlertingSet(alerting))
+			testutil.Ok(t, o.LogsRecordingSet(recording))
+			testutil.Equals(t, tc.wantPaths, gotPaths)
+		})
+	}
+}
+
+func TestSyncWindow(t *testing.T) {
+	w := &syncWindow{outcomes: make([]bool, 4)}
+	testutil.Equals(t, 1.0, w.ratio())
+
+	for _, tc := range []struct {
+		success bool
+		want    float64
+	}{
+		{success: true, want: 1},
+		{success: false, want: 0.5},
+		{success: true, want: 2.0 / 3},
+		{success: true, want: 0.75},
+		// The window is full, so the oldest outcomes are dropped.
+		{success: false, want: 0.5},
+		{success: true, want: 0.75},
+		{success: true, want: 0.75},
+		{success: true, want: 0.75},
+		{success: true, want: 1},
+	} {
+		w.add(tc.success)
+		testutil.Equals(t, tc.want, w.ratio())
+	}
+}
+
+func TestSyncSuccessRatio(t *testing.T) {
+	o := newTestSyncer(t, WithSyncSuccessWindow(2))
+
+	o.setTenantLastError("a", "")
+	o.setTenantLastError("b", errorReasonAuth)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.syncSuccessRatio.WithLabelValues("a")))
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(o.syncSuccessRatio.WithLabelValues("b")))
+
+	o.setTenantLastError("a", errorReasonNetwork)
+	o.setTenantLastError("b", "")
+	testutil.Equals(t, 0.5, promtestutil.ToFloat64(o.syncSuccessRatio.WithLabelValues("a")))
+	testutil.Equals(t, 0.5, promtestutil.ToFloat64(o.syncSuccessRatio.WithLabelValues("b")))
+
+	// Only the last 2 operations count.
+	o.setTenantLastError("b", "")
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.syncSuccessRatio.WithLabelValues("b")))
+}
+
+func TestTenantStatuses(t *testing.T) {
+	var status int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+	o := NewObsctlRulesSyncer(context.TODO(), log.NewNopLogger(), nil, "test", "", "", "", "test,missing", prometheus.NewRegistry())
+
+	testutil.Equals(t, []TenantStatus{
+		{Tenant: "test", Configured: true, AuthStatus: AuthStatusUnknown},
+		{Tenant: "missing", AuthStatus: AuthStatusUnconfigured},
+	}, o.TenantStatuses())
+
+	for _, tc := range []struct {
+		status   int
+		wantAuth string
+		wantErr  string
+	}{
+		{status: http.StatusForbidden, wantAuth: AuthStatusFailed, wantErr: errorReasonAuth},
+		{status: http.StatusServiceUnavailable, wantAuth: AuthStatusOK, wantErr: errorReasonDownstream5xx},
+		{status: http.StatusOK, wantAuth: AuthStatusOK},
+	} {
+		status = tc.status
+		before := time.Now().UTC()
+		_ = o.MetricsSet(testPrometheusRuleSpec)
+
+		got := o.TenantStatuses()[0]
+		testutil.Equals(t, tc.wantAuth, got.AuthStatus)
+		testutil.Assert(t, got.LastSync != nil, "expected a last sync summary")
+		testutil.Equals(t, tc.wantErr, got.LastSync.Error)
+		testutil.Assert(t, !got.LastSync.Time.Before(before), "expected a recent last sync time, got %v", got.LastSync.Time)
+	}
+}
+
+func TestDumpRedactsCredentials(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://api/api/logs/v1/test/loki/api/v1/rules/test", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set("Cookie", "session=secret-session")
+	req.Header.Set("Content-Type", "application/yaml")
+
+	got := dumpRequest(req, []byte("name: TestGroup\n"))
+	testutil.Assert(t, !strings.Contains(got, "secret"), "expected credentials to be redacted, got %s", got)
+	testutil.Assert(t, strings.Contains(got, "Authorization: REDACTED"), "expected redacted authorization header, got %s", got)
+	testutil.Assert(t, strings.Contains(got, "Content-Type: application/yaml"), "expected content type, got %s", got)
+	testutil.Assert(t, strings.HasSuffix(got, "name: TestGroup\n"), "expected request body, got %s", got)
+	// The original request is left as is.
+	testutil.Equals(t, "Bearer secret-token", req.Header.Get("Authorization"))
+
+	resp := &http.Response{StatusCode: http.StatusBadRequest, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{"Set-Cookie": {"session=secret-session"}}}
+	got = dumpResponse(resp, []byte("invalid rules"))
+	testutil.Assert(t, !strings.Contains(got, "secret"), "expected credentials to be redacted, got %s", got)
+	testutil.Assert(t, strings.Contains(got, "400 Bad Request"), "expected status, got %s", got)
+	testutil.Assert(t, strings.HasSuffix(got, "invalid rules"), "expected response body, got %s", got)
+}
+
+func TestDebugHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret-session"})
+		http.Error(w, "invalid rules", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+
+	for _, enabled := range []bool{false, true} {
+		var logs bytes.Buffer
+		o := NewObsctlRulesSyncer(context.TODO(), log.NewLogfmtLogger(&logs), nil, "test", "", "", "", "test", prometheus.NewRegistry(), WithDebugHTTP(enabled))
+		testutil.NotOk(t, o.LogsAlertingSet(lokiv1.AlertingRuleSpec{Groups: []*lokiv1.AlertingRuleGroup{{Name: "TestGroup"}}}))
+
+		testutil.Equals(t, enabled, strings.Contains(logs.String(), "loki rules set request"))
+		testutil.Assert(t, !strings.Contains(logs.String(), "secret-session"), "expected credentials to be redacted, got %s", logs.String())
+		if enabled {
+			testutil.Assert(t, strings.Contains(logs.String(), "name: TestGroup"), "expected request body, got %s", logs.String())
+			testutil.Assert(t, strings.Contains(logs.String(), "Set-Cookie: REDACTED"), "expected redacted response header, got %s", logs.String())
+		}
+	}
+}
+
+func TestLokiRulesContentType(t *testing.T) {
+	var gotContentType, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotContentType, gotBody = r.Header.Get("Content-Type"), string(b)
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+
+	alerting := lokiv1.AlertingRuleSpec{Groups: []*lokiv1.AlertingRuleGroup{{
+		Name:  "TestGroup",
+		Rules: []*lokiv1.AlertingRuleGroupSpec{{Alert: "TestAlert", Expr: `count_over_time({job="a"}[5m]) > 0`}},
+	}}}
+	recording := lokiv1.RecordingRuleSpec{Groups: []*lokiv1.RecordingRuleGroup{{
+		Name:  "TestGroup",
+		Rules: []*lokiv1.RecordingRuleGroupSpec{{Record: "test:count", Expr: `count_over_time({job="a"}[5m])`}},
+	}}}
+	yamlAlerting := `name: TestGroup
+interval: ""
+limit: 0
+rules:
+    - alert: TestAlert
+      expr: count_over_time({job="a"}[5m]) > 0
+      for: ""
+      annotations: {}
+      labels: {}
+`
+	yamlRecording := `name: TestGroup
+interval: ""
+limit: 0
+rules:
+    - record: test:count
+      expr: count_over_time({job="a"}[5m])
+`
+
+	for _, tc := range []struct {
+		contentType     string
+		wantAlerting    string
+		wantRecording   string
+		wantContentType string
+	}{
+		{
+			wantContentType: "application/yaml",
+			wantAlerting:    yamlAlerting,
+			wantRecording:   yamlRecording,
+		},
+		{
+			contentType:     "application/x-yaml",
+			wantContentType: "application/x-yaml",
+			wantAlerting:    yamlAlerting,
+			wantRecording:   yamlRecording,
+		},
+		{
+			contentType:     "application/json",
+			wantContentType: "application/json",
+			wantAlerting:    `{"name":"TestGroup","interval":"","rules":[{"alert":"TestAlert","expr":"count_over_time({job=\"a\"}[5m]) \u003e 0"}]}`,
+			wantRecording:   `{"name":"TestGroup","interval":"","rules":[{"record":"test:count","expr":"count_over_time({job=\"a\"}[5m])"}]}`,
+		},
+	} {
+		t.Run(tc.wantContentType, func(t *testing.T) {
+			var opts []Option
+			if tc.contentType != "" {
+				opts = append(opts, WithLokiRulesContentType(tc.contentType))
+			}
+			o := newTestSyncer(t, opts...)
+
+			testutil.Ok(t, o.LogsAlertingSet(alerting))
+			testutil.Equals(t, tc.wantContentType, gotContentType)
+			testutil.Equals(t, tc.wantAlerting, gotBody)
+
+			testutil.Ok(t, o.LogsRecordingSet(recording))
+			testutil.Equals(t, tc.wantContentType, gotContentType)
+			testutil.Equals(t, tc.wantRecording, gotBody)
+		})
+	}
+}
+
+func TestTenantHeaderName(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Scope-OrgID") != "test" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+
+	// By default, the tenant is only part of the path.
+	o := newTestSyncer(t)
+	testutil.NotOk(t, o.MetricsSet(testPrometheusRuleSpec))
+
+	o = newTestSyncer(t, WithTenantHeaderName("X-Scope-OrgID"))
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Ok(t, o.LogsAlertingSet(lokiv1.AlertingRuleSpec{Groups: []*lokiv1.AlertingRuleGroup{{Name: "TestGroup"}}}))
+}
+
+func TestSanitizedTenantLabels(t *testing.T) {
+	var gotPath string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "team.a")
+
+	o := newTestSyncer(t, WithSanitizedTenantLabels(true))
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+
+	// The actual tenant is used for the request, the sanitized one for metrics.
+	testutil.Equals(t, "/api/metrics/v1/team.a/api/v1/rules/raw", gotPath)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.promRulesSetOps.WithLabelValues("team_a")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.promRulesStoreOps.WithLabelValues("team_a", "200")))
+}
+
+func TestMetricsPrefix(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+
+	reg := prometheus.NewRegistry()
+	o := NewObsctlRulesSyncer(context.TODO(), log.NewNopLogger(), nil, "test", "", "", "", "test", reg, WithMetricsPrefix("rules_sync"))
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+
+	testutil.Ok(t, promtestutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP rules_sync_prom_rule_sets_total Total number of obsctl set operations for monitoringv1 rules.
+# TYPE rules_sync_prom_rule_sets_total counter
+rules_sync_prom_rule_sets_total{tenant="test"} 1
+`), "rules_sync_prom_rule_sets_total", "obsctl_reloader_prom_rule_sets_total"))
+
+	mfs, err := reg.Gather()
+	testutil.Ok(t, err)
+	for _, mf := range mfs {
+		testutil.Assert(t, strings.HasPrefix(mf.GetName(), "rules_sync_"), "expected prefixed metric name, got %s", mf.GetName())
+	}
+}
+
+func TestPromotedAnnotations(t *testing.T) {
+	var gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotBody = string(b)
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+
+	spec := monitoringv1.PrometheusRuleSpec{
+		Groups: []monitoringv1.RuleGroup{
+			{
+				Name: "TestGroup",
+				Rules: []monitoringv1.Rule{
+					{
+						Alert:  "TestAlertingRule",
+						Expr:   intstr.FromString("vector(1)"),
+						Labels: map[string]string{"severity": "critical"},
+						Annotations: map[string]string{
+							"team":     "observability",
+							"severity": "warning",
+							"owner":    "\xff",
+							"summary":  "Not promoted.",
+						},
+					},
+				},
+			},
+		},
+	}
+
+	o := newTestSyncer(t, WithPromotedAnnotations("team", "severity", "owner", "missing"))
+	testutil.Ok(t, o.MetricsSet(spec))
+	testutil.Equals(t, `groups:
+    - name: TestGroup
+      rules:
+        - alert: "TestAlertingRule"
+          expr: "vector(1)"
+          labels:
+            severity: critical
+            team: observability
+          annotations:
+            owner: �
+            severity: warning
+            summary: Not promoted.
+            team: observability
+`, gotBody)
+
+	// Conflicting labels and invalid label values are reported.
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(o.invalidPromotions.WithLabelValues("test")))
+
+	// Source rules must not be modified.
+	testutil.Equals(t, map[string]string{"severity": "critical"}, spec.Groups[0].Rules[0].Labels)
+}
+
+func TestLogsSetRateLimited(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		retryAfter  string
+		maxWait     time.Duration
+		wantErr     bool
+		wantCalls   int
+		wantLimited float64
+	}{
+		{name: "retried", retryAfter: "0", maxWait: time.Second, wantCalls: 2, wantLimited: 1},
+		{name: "retry disabled", retryAfter: "0", maxWait: 0, wantErr: true, wantCalls: 1, wantLimited: 1},
+		{name: "retry after exceeds cap", retryAfter: "120", maxWait: time.Second, wantErr: true, wantCalls: 1, wantLimited: 1},
+		{name: "invalid retry after", retryAfter: "soon", maxWait: time.Second, wantErr: true, wantCalls: 1, wantLimited: 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if calls == 1 {
+					w.Header().Set("Retry-After", tc.retryAfter)
+					w.WriteHeader(http.StatusTooManyRequests)
+				}
+			}))
+			defer srv.Close()
+
+			setupTestConfig(t, srv.URL, "test")
+			o := newTestSyncer(t, WithMaxRetryAfter(tc.maxWait))
+
+			err := o.LogsAlertingSet(lokiv1.AlertingRuleSpec{Groups: []*lokiv1.AlertingRuleGroup{{Name: "TestGroup"}}})
+			if tc.wantErr {
+				testutil.NotOk(t, err)
+			} else {
+				testutil.Ok(t, err)
+			}
+			testutil.Equals(t, tc.wantCalls, calls)
+			testutil.Equals(t, tc.wantLimited, promtestutil.ToFloat64(o.rateLimited.WithLabelValues("test")))
+		})
+	}
+}
+
+func TestLokiBatchGroups(t *testing.T) {
+	alerting := lokiv1.AlertingRuleSpec{Groups: []*lokiv1.AlertingRuleGroup{
+		{Name: "A", Rules: []*lokiv1.AlertingRuleGroupSpec{{Alert: "A", Expr: `count_over_time({job="a"}[5m]) > 0`}}},
+		{Name: "B", Rules: []*lokiv1.AlertingRuleGroupSpec{{Alert: "B", Expr: `count_over_time({job="b"}[5m]) > 0`}}},
+		{Name: "C", Rules: []*lokiv1.AlertingRuleGroupSpec{{Alert: "C", Expr: `count_over_time({job="c"}[5m]) > 0`}}},
+	}}
+	recording := lokiv1.RecordingRuleSpec{Groups: []*lokiv1.RecordingRuleGroup{
+		{Name: "A", Rules: []*lokiv1.RecordingRuleGroupSpec{{Record: "a", Expr: `count_over_time({job="a"}[5m])`}}},
+		{Name: "B", Rules: []*lokiv1.RecordingRuleGroupSpec{{Record: "b", Expr: `count_over_time({job="b"}[5m])`}}},
+	}}
+
+	for _, tc := range []struct {
+		name          string
+		batch         bool
+		rejectBatches bool
+		wantRequests  int
+		wantBatches   int
+	}{
+		{name: "disabled", wantRequests: 5},
+		{name: "enabled", batch: true, wantRequests: 2, wantBatches: 2},
+		{name: "batch rejected", batch: true, rejectBatches: true, wantRequests: 7, wantBatches: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			requests, batches := 0, 0
+			var batchBody string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				b, _ := io.ReadAll(r.Body)
+				if strings.HasPrefix(string(b), "groups:") {
+					batches++
+					batchBody = string(b)
+					if tc.rejectBatches {
+						http.Error(w, "invalid rules config: rule group name must not be empty", http.StatusBadRequest)
+					}
+				}
+			}))
+			defer srv.Close()
+
+			setupTestConfig(t, srv.URL, "test")
+			o := newTestSyncer(t, WithLokiBatchGroups(tc.batch), WithManagedGroupPrefix("managed-"))
+
+			testutil.Ok(t, o.LogsAlertingSet(alerting))
+			testutil.Ok(t, o.LogsRecordingSet(recording))
+			testutil.Equals(t, tc.wantRequests, requests)
+			testutil.Equals(t, tc.wantBatches, batches)
+			if tc.batch {
+				testutil.Assert(t, strings.Contains(batchBody, "name: managed-A") && strings.Contains(batchBody, "name: managed-B"), "expected managed group names in batch, got %s", batchBody)
+			}
+		})
+	}
+
+	// A single group is sent as is.
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		b, _ := io.ReadAll(r.Body)
+		testutil.Assert(t, !strings.HasPrefix(string(b), "groups:"), "expected a single group body, got %s", b)
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+	o := newTestSyncer(t, WithLokiBatchGroups(true))
+	testutil.Ok(t, o.LogsAlertingSet(lokiv1.AlertingRuleSpec{Groups: alerting.Groups[:1]}))
+	testutil.Equals(t, 1, requests)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value  string
+		want   time.Duration
+		wantOK bool
+	}{
+		{value: "", wantOK: false},
+		{value: "30", want: 30 * time.Second, wantOK: true},
+		{value: "-1", wantOK: false},
+		{value: "Thu, 01 Jun 2023 12:00:10 GMT", want: 10 * time.Second, wantOK: true},
+		{value: "Thu, 01 Jun 2023 11:00:00 GMT", want: 0, wantOK: true},
+		{value: "later", wantOK: false},
+	} {
+		got, ok := parseRetryAfter(tc.value, now)
+		testutil.Equals(t, tc.wantOK, ok, "value %q", tc.value)
+		testutil.Equals(t, tc.want, got, "value %q", tc.value)
+	}
+}
+
+func TestManagedGroupPrefix(t *testing.T) {
+	var gotBodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		gotBodies = append(gotBodies, string(b))
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+	o := newTestSyncer(t, WithManagedGroupPrefix("obsctl-reloader:"))
+
+	spec := monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{
+		testPrometheusRuleSpec.Groups[0],
+		{Name: "obsctl-reloader:Marked", Rules: testPrometheusRuleSpec.Groups[0].Rules},
+	}}
+	testutil.Ok(t, o.MetricsSet(spec))
+	testutil.Ok(t, o.LogsAlertingSet(lokiv1.AlertingRuleSpec{Groups: []*lokiv1.AlertingRuleGroup{{Name: "LogsGroup"}}}))
+
+	testutil.Equals(t, 2, len(gotBodies))
+	testutil.Equals(t, `groups:
+    - name: obsctl-reloader:TestGroup
+      interval: 30s
+      rules:
+        - record: "TestRecordingRule"
+          expr: "vector(1)"
+    - name: obsctl-reloader:Marked
+      rules:
+        - record: "TestRecordingRule"
+          expr: "vector(1)"
+`, gotBodies[0])
+	testutil.Assert(t, strings.Contains(gotBodies[1], "name: obsctl-reloader:LogsGroup"), "expected marked logs group, got %s", gotBodies[1])
+
+	// Source groups must not be modified.
+	testutil.Equals(t, "TestGroup", spec.Groups[0].Name)
+}
+
+func TestMaxRulesPerType(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+	o := newTestSyncer(t, WithMaxRulesPerType(2))
+
+	rules := testPrometheusRuleSpec.Groups[0].Rules
+	atLimit := monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{
+		{Name: "A", Rules: rules},
+		{Name: "B", Rules: rules},
+	}}
+	aboveLimit := monitoringv1.PrometheusRuleSpec{Groups: append(atLimit.Groups, monitoringv1.RuleGroup{Name: "C", Rules: rules})}
+
+	testutil.Ok(t, o.MetricsSet(atLimit))
+	testutil.Equals(t, 1, requests)
+	testutil.Equals(t, 0.0, promtestutil.ToFloat64(o.ruleLimitExceeded.WithLabelValues("test")))
+
+	// Rules exceeding the limit aren't synced at all.
+	err := o.MetricsSet(aboveLimit)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, "tenant test has 3 metrics rules, exceeding the limit of 2 per rule type", err.Error())
+	testutil.Equals(t, 1, requests)
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.ruleLimitExceeded.WithLabelValues("test")))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.promRulesSetFailures.WithLabelValues("test", "rule_limit_exceeded")))
+
+	recording := []*lokiv1.RecordingRuleGroupSpec{{Record: "a", Expr: "vector(1)"}, {Record: "b", Expr: "vector(1)"}, {Record: "c", Expr: "vector(1)"}}
+	testutil.NotOk(t, o.LogsRecordingSet(lokiv1.RecordingRuleSpec{Groups: []*lokiv1.RecordingRuleGroup{{Name: "a", Rules: recording}}}))
+	testutil.Equals(t, 1, requests)
+	testutil.Equals(t, 2.0, promtestutil.ToFloat64(o.ruleLimitExceeded.WithLabelValues("test")))
+
+	// Zero means no limit.
+	o = newTestSyncer(t)
+	testutil.Ok(t, o.MetricsSet(aboveLimit))
+	testutil.Equals(t, 2, requests)
+}
+
+func TestMinAlertFor(t *testing.T) {
+	o := newTestSyncer(t, WithMinAlertFor(5*time.Minute))
+
+	spec := monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{{
+		Name: "Alerts",
+		Rules: []monitoringv1.Rule{
+			{Alert: "Unset", Expr: intstr.FromString("vector(1)")},
+			{Alert: "BelowFloor", Expr: intstr.FromString("vector(1)"), For: "1m"},
+			{Alert: "AtFloor", Expr: intstr.FromString("vector(1)"), For: "300s"},
+			{Alert: "AboveFloor", Expr: intstr.FromString("vector(1)"), For: "1h"},
+			{Alert: "Invalid", Expr: intstr.FromString("vector(1)"), For: "soon"},
+			{Record: "Recording", Expr: intstr.FromString("vector(1)")},
+		},
+	}}}
+
+	got := o.applyMinAlertFor("test", spec)
+	fors := []string{}
+	for _, r := range got.Groups[0].Rules {
+		fors = append(fors, r.For)
+	}
+	testutil.Equals(t, []string{"5m", "5m", "300s", "1h", "soon", ""}, fors)
+
+	// Source rules must not be modified.
+	testutil.Equals(t, "", spec.Groups[0].Rules[0].For)
+	testutil.Equals(t, "1m", spec.Groups[0].Rules[1].For)
+}
+
+func TestMaxRangeSelector(t *testing.T) {
+	o := newTestSyncer(t, WithExprTransforms(MaxRangeSelector(time.Hour)))
+
+	spec := monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{{
+		Name: "Rules",
+		Rules: []monitoringv1.Rule{
+			{Record: "Capped", Expr: intstr.FromString(`sum(rate(http_requests_total{job="a"}[1d]))`)},
+			{Record: "Nested", Expr: intstr.FromString("max_over_time(up[2h]) / avg_over_time(up[30m])")},
+			{Record: "Subquery", Expr: intstr.FromString("max_over_time(rate(x[5m])[1d:5m])")},
+			{Alert: "WithinMax", Expr: intstr.FromString("increase(errors_total[1h]) > 0")},
+			{Record: "Instant", Expr: intstr.FromString("up == 0")},
+			{Record: "Invalid", Expr: intstr.FromString("rate(up[")},
+		},
+	}}}
+
+	got, err := o.applyExprTransforms("test", spec)
+	testutil.Ok(t, err)
+	exprs := []string{}
+	for _, r := range got.Groups[0].Rules {
+		exprs = append(exprs, r.Expr.String())
+	}
+	testutil.Equals(t, []string{
+		`sum(rate(http_requests_total{job="a"}[1h]))`,
+		"max_over_time(up[1h]) / avg_over_time(up[30m])",
+		"max_over_time(rate(x[5m])[1h:5m])",
+		"increase(errors_total[1h]) > 0",
+		"up == 0",
+		"rate(up[",
+	}, exprs)
+
+	// Source rules must not be modified.
+	testutil.Equals(t, `sum(rate(http_requests_total{job="a"}[1d]))`, spec.Groups[0].Rules[0].Expr.String())
+}
+
+func TestMaxRangeDuration(t *testing.T) {
+	spec := func(exprs ...string) monitoringv1.PrometheusRuleSpec {
+		rules := []monitoringv1.Rule{}
+		for i, e := range exprs {
+			rules = append(rules, monitoringv1.Rule{Record: fmt.Sprintf("rule%d", i), Expr: intstr.FromString(e)})
+		}
+		return monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{{Name: "Rules", Rules: rules}}}
+	}
+	inLimit := spec("rate(x[5m])", "increase(y[1d])", "z")
+	overLimit := spec("rate(x[30d])", "increase(y[1d])", "max_over_time(rate(x[2d])[30d:5m]) / avg_over_time(up[1h])")
+
+	t.Run("cap", func(t *testing.T) {
+		o := newTestSyncer(t, WithMaxRangeDuration(24*time.Hour, RangeLimitCap))
+
+		got, err := o.applyExprTransforms("test", inLimit)
+		testutil.Ok(t, err)
+		testutil.Equals(t, inLimit, got)
+		testutil.Equals(t, 0, promtestutil.CollectAndCount(o.rangeLimitedRules))
+
+		got, err = o.applyExprTransforms("test", overLimit)
+		testutil.Ok(t, err)
+		testutil.Equals(t, "rate(x[1d])", got.Groups[0].Rules[0].Expr.String())
+		testutil.Equals(t, "increase(y[1d])", got.Groups[0].Rules[1].Expr.String())
+		testutil.Equals(t, "max_over_time(rate(x[1d])[1d:5m]) / avg_over_time(up[1h])", got.Groups[0].Rules[2].Expr.String())
+		testutil.Equals(t, 2.0, promtestutil.ToFloat64(o.rangeLimitedRules.WithLabelValues("test", "capped")))
+		// Source rules must not be modified.
+		testutil.Equals(t, "rate(x[30d])", overLimit.Groups[0].Rules[0].Expr.String())
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		o := newTestSyncer(t, WithMaxRangeDuration(24*time.Hour, RangeLimitReject))
+
+		_, err := o.applyExprTransforms("test", inLimit)
+		testutil.Ok(t, err)
+
+		_, err = o.applyExprTransforms("test", overLimit)
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "range 30d of x exceeds the maximum of 1d"), "unexpected error: %v", err)
+		testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.rangeLimitedRules.WithLabelValues("test", "rejected")))
+
+		_, err = o.applyExprTransforms("test", spec("max_over_time(rate(x[5m])[30d:5m])"))
+		testutil.NotOk(t, err)
+		testutil.Assert(t, strings.Contains(err.Error(), "range 30d of rate(x[5m]) exceeds the maximum of 1d"), "unexpected error: %v", err)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		o := newTestSyncer(t, WithMaxRangeDuration(0, RangeLimitReject))
+		testutil.Equals(t, 0, len(o.exprTransforms))
+	})
+}
+
+func TestExprTransformError(t *testing.T) {
+	o := newTestSyncer(t, WithExprTransforms(func(_ parameters.Tenant, _ parser.Expr) (parser.Expr, error) {
+		return nil, errors.New("unsupported")
+	}))
+
+	_, err := o.applyExprTransforms("test", testPrometheusRuleSpec)
+	testutil.NotOk(t, err)
+}
+
+func TestNumericExprs(t *testing.T) {
+	var bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+	}))
+	defer srv.Close()
+
+	setupTestConfig(t, srv.URL, "test")
+
+	spec := monitoringv1.PrometheusRuleSpec{Groups: []monitoringv1.RuleGroup{{
+		Name: "Numeric",
+		Rules: []monitoringv1.Rule{
+			{Record: "constant", Expr: intstr.FromInt(42)},
+			{Alert: "Always", Expr: intstr.FromString("vector(1)")},
+		},
+	}}}
+
+	// Numeric exprs are synced as PromQL strings.
+	o := newTestSyncer(t)
+	testutil.Ok(t, o.MetricsSet(spec))
+	testutil.Equals(t, 1, len(bodies))
+	testutil.Assert(t, strings.Contains(bodies[0], `expr: "42"`), "expected numeric expr as string, got %s", bodies[0])
+	// Source rules must not be modified.
+	testutil.Equals(t, intstr.Int, spec.Groups[0].Rules[0].Expr.Type)
+
+	// Or rejected, without syncing anything.
+	o = newTestSyncer(t, WithRejectNumericExprs(true))
+	err := o.MetricsSet(spec)
+	testutil.NotOk(t, err)
+	testutil.Equals(t, `rule "constant" of group "Numeric" has numeric expr 42, expected a PromQL expression string`, err.Error())
+	testutil.Equals(t, 1, len(bodies))
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.promRulesSetFailures.WithLabelValues("test", "numeric_expr")))
+}
+
+func TestAutoDetectTenantSecrets(t *testing.T) {
+	secret := func(name, tenant string) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test", Labels: map[string]string{"tenant": tenant}},
+			Data:       map[string][]byte{"client-id": []byte(name), "client-secret": []byte("secret")},
+		}
+	}
+	kc := fake.NewClientBuilder().WithObjects(
+		secret("a", "a"),
+		secret("b", "b"),
+		secret("empty", ""),
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "no-credentials", Namespace: "test", Labels: map[string]string{"tenant": "c"}},
+			Data:       map[string][]byte{"client_id": []byte("no-credentials")},
+		},
+	).Build()
+
+	for _, tc := range []struct {
+		name           string
+		managedTenants string
+		want           []string
+	}{
+		{name: "no tenants", managedTenants: "", want: []string{}},
+		{name: "only separators", managedTenants: " , ,", want: []string{}},
+		{name: "some tenants", managedTenants: "a", want: []string{"a"}},
+		{name: "tenants with whitespace", managedTenants: " a, b ,", want: []string{"a", "b"}},
+		{name: "tenant without credentials", managedTenants: "a,c", want: []string{"a"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := AutoDetectTenantSecrets(context.TODO(), kc, "test", "audience", "https://issuer.example.com", tc.managedTenants)
+			testutil.Ok(t, err)
+
+			tenants := []string{}
+			for tenant, secret := range got {
+				testutil.Equals(t, tenant, secret.OIDC.ClientID)
+				testutil.Equals(t, "audience", secret.OIDC.Audience)
+				tenants = append(tenants, tenant)
+			}
+			sort.Strings(tenants)
+			testutil.Equals(t, tc.want, tenants)
+		})
+	}
+}
+
+func TestAutoDetectTenantSecretsSchema(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data map[string]string
+		want *TenantSecret
+	}{
+		{
+			name: "dashed keys",
+			data: map[string]string{"client-id": "id", "client-secret": "secret"},
+			want: &TenantSecret{OIDC: &config.OIDCConfig{ClientID: "id", ClientSecret: "secret", Audience: "default-audience", IssuerURL: "https://default.example.com"}},
+		},
+		{
+			name: "underscored keys",
+			data: map[string]string{"client_id": "id", "client_secret": "secret"},
+			want: &TenantSecret{OIDC: &config.OIDCConfig{ClientID: "id", ClientSecret: "secret", Audience: "default-audience", IssuerURL: "https://default.example.com"}},
+		},
+		{
+			name: "dashed keys take precedence",
+			data: map[string]string{"client-id": "id", "client_id": "other", "client_secret": "secret"},
+			want: &TenantSecret{OIDC: &config.OIDCConfig{ClientID: "id", ClientSecret: "secret", Audience: "default-audience", IssuerURL: "https://default.example.com"}},
+		},
+		{
+			name: "all keys",
+			data: map[string]string{
+				"client-id":     "id",
+				"client-secret": "secret",
+				"issuer-url":    "https://sso.example.com",
+				"audience":      "observatorium",
+				"api-url":       "https://observatorium.example.com",
+				"tenant_id":     "0fc2b00e",
+			},
+			want: &TenantSecret{
+				OIDC:     &config.OIDCConfig{ClientID: "id", ClientSecret: "secret", Audience: "observatorium", IssuerURL: "https://sso.example.com"},
+				APIURL:   "https://observatorium.example.com",
+				TenantID: "0fc2b00e",
+			},
+		},
+		{
+			name: "missing client secret",
+			data: map[string]string{"client-id": "id", "api-url": "https://observatorium.example.com"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := map[string][]byte{}
+			for k, v := range tc.data {
+				data[k] = []byte(v)
+			}
+			kc := fake.NewClientBuilder().WithObjects(&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "test", Labels: map[string]string{"tenant": "test"}},
+				Data:       data,
+			}).Build()
+
+			got, err := AutoDetectTenantSecrets(context.TODO(), kc, "test", "default-audience", "https://default.example.com", "test")
+			testutil.Ok(t, err)
+			testutil.Equals(t, tc.want, got["test"])
+		})
+	}
+}
+
+func TestTenantSecretOverrides(t *testing.T) {
+	t.Setenv("OBSCTL_CONFIG_PATH", filepath.Join(t.TempDir(), "config.json"))
+
+	var gotDefault, gotOverride string
+	defaultAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { gotDefault = r.URL.Path }))
+	defer defaultAPI.Close()
+	overrideAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { gotOverride = r.URL.Path }))
+	defer overrideAPI.Close()
+
+	o := newTestSyncer(t)
+	o.apiURL = defaultAPI.URL
+	o.skipClientCheck = true
+	o.autoDetectSecretsFn = func(_ context.Context, _ client.Client, _, _, _, _ string) (map[string]*TenantSecret, error) {
+		return map[string]*TenantSecret{
+			"a": {},
+			"b": {APIURL: overrideAPI.URL, TenantID: "b-id"},
+			"c": {APIURL: defaultAPI.URL + "/", TenantID: "c-id"},
+		}, nil
+	}
+	testutil.Ok(t, o.InitOrReloadObsctlConfig())
+
+	testutil.Ok(t, o.SetCurrentTenant("a"))
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Equals(t, "/api/metrics/v1/a/api/v1/rules/raw", gotDefault)
+
+	testutil.Ok(t, o.SetCurrentTenant("b"))
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Equals(t, "/api/metrics/v1/b-id/api/v1/rules/raw", gotOverride)
+	// Metrics are labeled with the managed tenant.
+	testutil.Equals(t, 1.0, promtestutil.ToFloat64(o.promRulesSetOps.WithLabelValues("b")))
+
+	// Overriding the API URL with the default one keeps the tenant under the default API.
+	testutil.Ok(t, o.SetCurrentTenant("c"))
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Equals(t, "/api/metrics/v1/c-id/api/v1/rules/raw", gotDefault)
+	testutil.Equals(t, 2, len(o.c.APIs[obsctlContextAPIName].Contexts))
+	testutil.Equals(t, "b-id", o.c.APIs[tenantAPIName("b")].Contexts["b"].Tenant)
+}
+
+func TestInMemoryConfig(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OBSCTL_CONFIG_PATH", filepath.Join(dir, "obsctl", "config.json"))
+
+	var gotPaths, gotAuth []string
+	defaultAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPaths = append(gotPaths, r.URL.Path)
+		gotAuth = append(gotAuth, r.Header.Get("Authorization"))
+	}))
+	defer defaultAPI.Close()
+	overrideAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { gotPaths = append(gotPaths, r.URL.Path) }))
+	defer overrideAPI.Close()
+
+	var issuerURL string
+	var tokenRequests int
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			fmt.Fprintf(w, `{"issuer":%q,"token_endpoint":%q,"authorization_endpoint":%q,"jwks_uri":%q}`,
+				issuerURL, issuerURL+"/token", issuerURL+"/auth", issuerURL+"/keys")
+		case "/token":
+			tokenRequests++
+			fmt.Fprint(w, `{"access_token":"token","token_type":"bearer","expires_in":3600}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer issuer.Close()
+	issuerURL = issuer.URL
+
+	o := newTestSyncer(t, WithInMemoryConfig(true))
+	o.apiURL = defaultAPI.URL
+	o.skipClientCheck = true
+	secrets := map[string]*TenantSecret{
+		"a": {},
+		"b": {APIURL: overrideAPI.URL, TenantID: "b-id"},
+		"c": {OIDC: &config.OIDCConfig{ClientID: "id", ClientSecret: "secret", IssuerURL: issuer.URL}},
+	}
+	o.autoDetectSecretsFn = func(_ context.Context, _ client.Client, _, _, _, _ string) (map[string]*TenantSecret, error) {
+		return secrets, nil
+	}
+
+	// Syncing before the config is loaded fails, rather than reading it from disk.
+	testutil.NotOk(t, o.MetricsSet(testPrometheusRuleSpec))
+
+	testutil.Ok(t, o.InitOrReloadObsctlConfig())
+	testutil.Ok(t, o.SetCurrentTenant("a"))
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Ok(t, o.SetCurrentTenant("b"))
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Equals(t, []string{"/api/metrics/v1/a/api/v1/rules/raw", "/api/metrics/v1/b-id/api/v1/rules/raw"}, gotPaths)
+
+	// OIDC tenants get a token, which is kept in memory and reused by later syncs.
+	testutil.Ok(t, o.SetCurrentTenant("c"))
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Ok(t, o.MetricsSet(testPrometheusRuleSpec))
+	testutil.Equals(t, 1, tokenRequests)
+	testutil.Equals(t, []string{"", "Bearer token", "Bearer token"}, gotAuth)
+	testutil.Equals(t, "token", o.c.APIs[obsctlContextAPIName].Contexts["c"].OIDC.Token.AccessToken)
+
+	// Reloads remove the tenants whose secret was deleted.
+	delete(secrets, "b")
+	testutil.Ok(t, o.InitOrReloadObsctlConfig())
+	testutil.NotOk(t, o.SetCurrentTenant("b"))
+	testutil.Ok(t, o.SetCurrentTenant("a"))
+
+	// Nothing was ever written to disk.
+	entries, err := os.ReadDir(dir)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 0, len(entries))
+	testutil.Equals(t, 0, promtestutil.CollectAndCount(o.configDiskOps))
+}
+
+func TestDuplicateTenantCredentials(t *testing.T) {
+	t.Setenv("OBSCTL_CONFIG_PATH", filepath.Join(t.TempDir(), "config.json"))
+
+	oidc := func(clientID, issuerURL string) *TenantSecret {
+		return &TenantSecret{OIDC: &config.OIDCConfig{ClientID: clientID, ClientSecret: "secret", IssuerURL: issuerURL}}
+	}
+	o := newTestSyncer(t)
+	o.apiURL = "https://observatorium.example.com"
+	o.skipClientCheck = true
+	o.autoDetectSecretsFn = func(_ context.Context, _ client.Client, _, _, _, _ string) (map[string]*TenantSecret, error) {
+		return map[string]*TenantSecret{
+			"a":       oidc("shared", "https://issuer.example.com"),
+			"b":       oidc("shared", "https://issuer.example.com"),
+			"c":       oidc("c", "https://issuer.example.com"),
+			"other":   oidc("shared", "https://other-issuer.example.com"),
+			"no-oidc": {},
+		}, nil
+	}
+	testutil.Ok(t, o.InitOrReloadObsctlConfig())
+
+	// Sharing credentials is only reported, the tenants are still configured.
+	testutil.Equals(t, 5, len(o.c.APIs[obsctlContextAPIName].Contexts))
+	testutil.Ok(t, promtestutil.CollectAndCompare(o.duplicateCredentials, strings.NewReader(`
+# HELP obsctl_reloader_duplicate_tenant_credentials_total Total number of times a tenant was found sharing its OIDC client ID with other tenants, on config reloads.
+# TYPE obsctl_reloader_duplicate_tenant_credentials_total counter
+obsctl_reloader_duplicate_tenant_credentials_total{tenant="a"} 1
+obsctl_reloader_duplicate_tenant_credentials_total{tenant="b"} 1
+`)))
+}
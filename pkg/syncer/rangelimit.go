@@ -0,0 +1,105 @@
+package syncer
+
+import (
+	"time"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client/parameters"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// RangeLimitAction defines how metrics rules with range vector selectors exceeding the maximum range are handled.
+type RangeLimitAction string
+
+const (
+	// RangeLimitCap caps the range of the selectors to the maximum.
+	RangeLimitCap RangeLimitAction = "cap"
+	// RangeLimitReject rejects the metrics rules of the tenant.
+	RangeLimitReject RangeLimitAction = "reject"
+)
+
+// ParseRangeLimitAction returns the action with the given name.
+func ParseRangeLimitAction(s string) (RangeLimitAction, error) {
+	switch a := RangeLimitAction(s); a {
+	case RangeLimitCap, RangeLimitReject:
+		return a, nil
+	default:
+		return "", errors.Newf("unknown range limit action %q", s)
+	}
+}
+
+// WithMaxRangeDuration limits the range of range vector selectors and subqueries in synced metrics rules, e.g.
+// rate(x[30d]), to max.
+// Rules exceeding it are handled according to action. It's applied as an expr transform, after the ones registered
+// before it. Zero disables it.
+func WithMaxRangeDuration(max time.Duration, action RangeLimitAction) Option {
+	return func(o *ObsctlRulesSyncer) {
+		if max <= 0 {
+			return
+		}
+		o.maxRangeDuration = max
+		o.rangeLimitAction = action
+		o.exprTransforms = append(o.exprTransforms, o.limitRangeDurations)
+	}
+}
+
+// MaxRangeSelector returns a transform capping the range of range vector selectors and subqueries, e.g. rate(x[1d]),
+// to max, so that rules can't look back further than max. Unlike WithMaxRangeDuration, it records no metrics.
+func MaxRangeSelector(max time.Duration) ExprTransform {
+	return func(_ parameters.Tenant, expr parser.Expr) (parser.Expr, error) {
+		for _, r := range rangesOver(expr, max) {
+			*r.rng = max
+		}
+		return expr, nil
+	}
+}
+
+// rangeOver is a range vector selector or subquery whose range exceeds the maximum range.
+type rangeOver struct {
+	// expr is the selected expression, without its range.
+	expr parser.Expr
+	rng  *time.Duration
+}
+
+// rangesOver returns the range vector selectors, e.g. x[30d], and subqueries, e.g. rate(x[5m])[30d:5m], of expr whose
+// range exceeds max.
+func rangesOver(expr parser.Expr, max time.Duration) []rangeOver {
+	var over []rangeOver
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.MatrixSelector:
+			if n.Range > max {
+				over = append(over, rangeOver{expr: n.VectorSelector, rng: &n.Range})
+			}
+		case *parser.SubqueryExpr:
+			if n.Range > max {
+				over = append(over, rangeOver{expr: n.Expr, rng: &n.Range})
+			}
+		}
+		return nil
+	})
+	return over
+}
+
+// limitRangeDurations caps or rejects the range vector selectors and subqueries of expr exceeding the maximum range.
+func (o *ObsctlRulesSyncer) limitRangeDurations(tenant parameters.Tenant, expr parser.Expr) (parser.Expr, error) {
+	over := rangesOver(expr, o.maxRangeDuration)
+	if len(over) == 0 {
+		return expr, nil
+	}
+
+	max := model.Duration(o.maxRangeDuration).String()
+	if o.rangeLimitAction == RangeLimitReject {
+		o.rangeLimitedRules.WithLabelValues(o.tenantLabel(tenant), "rejected").Inc()
+		return nil, errors.Newf("range %s of %s exceeds the maximum of %s", model.Duration(*over[0].rng), over[0].expr, max)
+	}
+
+	for _, r := range over {
+		level.Debug(o.logger).Log("msg", "capping range", "tenant", tenant, "expr", r.expr, "range", model.Duration(*r.rng), "max", max)
+		*r.rng = o.maxRangeDuration
+	}
+	o.rangeLimitedRules.WithLabelValues(o.tenantLabel(tenant), "capped").Inc()
+	return expr, nil
+}
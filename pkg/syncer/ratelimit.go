@@ -0,0 +1,73 @@
+package syncer
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/observatorium/api/client"
+	"github.com/observatorium/api/client/parameters"
+)
+
+// maxRateLimitRetries is the maximum number of times a rate limited request is retried.
+const maxRateLimitRetries = 3
+
+// WithMaxRetryAfter makes Loki rules set requests rate limited by Observatorium API, i.e. answered with 429 Too Many
+// Requests, be retried after the delay given by the Retry-After header, if it's at most d. Zero disables retries.
+func WithMaxRetryAfter(d time.Duration) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.maxRetryAfter = d
+	}
+}
+
+// setLogsRules sends a Loki rule group for tenant to namespace, retrying while rate limited, as allowed by maxRetryAfter.
+func (o *ObsctlRulesSyncer) setLogsRules(fc *client.ClientWithResponses, tenant parameters.Tenant, namespace parameters.LogRulesNamespace, body []byte) (*client.SetLogsRulesResponse, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := o.setLogsRulesOnce(fc, tenant, namespace, body)
+		if err == nil {
+			o.logLogsRulesExchange(tenant, body, resp)
+		}
+		if err != nil || resp.StatusCode() != http.StatusTooManyRequests {
+			return resp, err
+		}
+		o.rateLimited.WithLabelValues(o.tenantLabel(tenant)).Inc()
+
+		wait, ok := parseRetryAfter(resp.HTTPResponse.Header.Get("Retry-After"), time.Now())
+		if !ok || o.maxRetryAfter <= 0 || wait > o.maxRetryAfter || attempt >= maxRateLimitRetries {
+			return resp, nil
+		}
+
+		level.Warn(o.logger).Log("msg", "rate limited by Observatorium API, retrying", "tenant", tenant, "retry_after", wait)
+		select {
+		case <-time.After(wait):
+		case <-o.ctx.Done():
+			return resp, nil
+		}
+	}
+}
+
+// parseRetryAfter returns the delay requested by a Retry-After header value, given either in seconds or as an HTTP
+// date, or false if it's invalid.
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+
+	return 0, true
+}
@@ -0,0 +1,121 @@
+package syncer
+
+import (
+	"sync"
+
+	lokiv1 "github.com/grafana/loki/operator/apis/loki/v1"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+)
+
+var _ RulesSyncer = &RecordingSyncer{}
+
+// Methods of RulesSyncer, as recorded by RecordingSyncer.
+const (
+	MethodInitOrReloadObsctlConfig = "InitOrReloadObsctlConfig"
+	MethodSetCurrentTenant         = "SetCurrentTenant"
+	MethodLogsAlertingSet          = "LogsAlertingSet"
+	MethodLogsRecordingSet         = "LogsRecordingSet"
+	MethodMetricsSet               = "MetricsSet"
+)
+
+// RecordedCall is a call to a RulesSyncer method recorded by RecordingSyncer.
+type RecordedCall struct {
+	// Method is the name of the method called, one of the Method* constants.
+	Method string
+	// Tenant is the current tenant when the method was called. For SetCurrentTenant, it's the tenant set.
+	Tenant string
+	// Rules is the rules argument of the set methods, i.e. a lokiv1.AlertingRuleSpec, lokiv1.RecordingRuleSpec or
+	// monitoringv1.PrometheusRuleSpec. It's nil for other methods.
+	Rules interface{}
+}
+
+// RecordingSyncer is a RulesSyncer which doesn't sync anything, but records all calls with their arguments, for tests
+// of code using a RulesSyncer, e.g. loop.SyncLoop. It's safe for concurrent use. The zero value succeeds every call.
+type RecordingSyncer struct {
+	// Fail, if set, is called for each call after recording it, and its result is returned by the call, e.g. to
+	// simulate Observatorium API errors for some tenants.
+	Fail func(call RecordedCall) error
+
+	mu      sync.Mutex
+	current string
+	calls   []RecordedCall
+}
+
+func (r *RecordingSyncer) record(method, tenant string, rules interface{}) error {
+	r.mu.Lock()
+	if method == MethodSetCurrentTenant {
+		r.current = tenant
+	}
+	call := RecordedCall{Method: method, Tenant: r.current, Rules: rules}
+	r.calls = append(r.calls, call)
+	fail := r.Fail
+	r.mu.Unlock()
+
+	if fail == nil {
+		return nil
+	}
+	return fail(call)
+}
+
+func (r *RecordingSyncer) InitOrReloadObsctlConfig() error {
+	return r.record(MethodInitOrReloadObsctlConfig, "", nil)
+}
+
+func (r *RecordingSyncer) SetCurrentTenant(tenant string) error {
+	return r.record(MethodSetCurrentTenant, tenant, nil)
+}
+
+func (r *RecordingSyncer) LogsAlertingSet(rules lokiv1.AlertingRuleSpec) error {
+	return r.record(MethodLogsAlertingSet, "", rules)
+}
+
+func (r *RecordingSyncer) LogsRecordingSet(rules lokiv1.RecordingRuleSpec) error {
+	return r.record(MethodLogsRecordingSet, "", rules)
+}
+
+func (r *RecordingSyncer) MetricsSet(rules monitoringv1.PrometheusRuleSpec) error {
+	return r.record(MethodMetricsSet, "", rules)
+}
+
+// Calls returns a copy of all calls recorded so far, in order.
+func (r *RecordingSyncer) Calls() []RecordedCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]RecordedCall(nil), r.calls...)
+}
+
+// CallsTo returns the calls to method recorded so far, in order.
+func (r *RecordingSyncer) CallsTo(method string) []RecordedCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var calls []RecordedCall
+	for _, c := range r.calls {
+		if c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+
+	return calls
+}
+
+// MetricsRules returns the rules of the last MetricsSet call for each tenant, i.e. the metrics rules Observatorium API
+// would have for each tenant.
+func (r *RecordingSyncer) MetricsRules() map[string]monitoringv1.PrometheusRuleSpec {
+	rules := map[string]monitoringv1.PrometheusRuleSpec{}
+	for _, c := range r.CallsTo(MethodMetricsSet) {
+		rules[c.Tenant] = c.Rules.(monitoringv1.PrometheusRuleSpec)
+	}
+
+	return rules
+}
+
+// Reset forgets all recorded calls and the current tenant.
+func (r *RecordingSyncer) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.current = ""
+	r.calls = nil
+}
@@ -0,0 +1,78 @@
+package syncer
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/efficientgo/core/errors"
+	"github.com/efficientgo/core/testutil"
+	lokiv1 "github.com/grafana/loki/operator/apis/loki/v1"
+	monitoringv1 "github.com/prometheus-operator/prometheus-operator/pkg/apis/monitoring/v1"
+)
+
+func TestRecordingSyncer(t *testing.T) {
+	r := &RecordingSyncer{}
+
+	testutil.Ok(t, r.InitOrReloadObsctlConfig())
+	testutil.Ok(t, r.SetCurrentTenant("a"))
+	testutil.Ok(t, r.MetricsSet(testPrometheusRuleSpec))
+	testutil.Ok(t, r.LogsAlertingSet(lokiv1.AlertingRuleSpec{TenantID: "a"}))
+	testutil.Ok(t, r.SetCurrentTenant("b"))
+	testutil.Ok(t, r.LogsRecordingSet(lokiv1.RecordingRuleSpec{TenantID: "b"}))
+	testutil.Ok(t, r.MetricsSet(monitoringv1.PrometheusRuleSpec{}))
+
+	testutil.Equals(t, []RecordedCall{
+		{Method: MethodInitOrReloadObsctlConfig},
+		{Method: MethodSetCurrentTenant, Tenant: "a"},
+		{Method: MethodMetricsSet, Tenant: "a", Rules: testPrometheusRuleSpec},
+		{Method: MethodLogsAlertingSet, Tenant: "a", Rules: lokiv1.AlertingRuleSpec{TenantID: "a"}},
+		{Method: MethodSetCurrentTenant, Tenant: "b"},
+		{Method: MethodLogsRecordingSet, Tenant: "b", Rules: lokiv1.RecordingRuleSpec{TenantID: "b"}},
+		{Method: MethodMetricsSet, Tenant: "b", Rules: monitoringv1.PrometheusRuleSpec{}},
+	}, r.Calls())
+	testutil.Equals(t, 2, len(r.CallsTo(MethodSetCurrentTenant)))
+	testutil.Equals(t, map[string]monitoringv1.PrometheusRuleSpec{
+		"a": testPrometheusRuleSpec,
+		"b": {},
+	}, r.MetricsRules())
+
+	r.Reset()
+	testutil.Equals(t, 0, len(r.Calls()))
+	testutil.Ok(t, r.MetricsSet(testPrometheusRuleSpec))
+	testutil.Equals(t, "", r.Calls()[0].Tenant)
+}
+
+func TestRecordingSyncerFail(t *testing.T) {
+	r := &RecordingSyncer{Fail: func(c RecordedCall) error {
+		if c.Method == MethodMetricsSet && c.Tenant == "b" {
+			return errors.New("rejected")
+		}
+		return nil
+	}}
+
+	testutil.Ok(t, r.SetCurrentTenant("a"))
+	testutil.Ok(t, r.MetricsSet(testPrometheusRuleSpec))
+	testutil.Ok(t, r.SetCurrentTenant("b"))
+	testutil.NotOk(t, r.MetricsSet(testPrometheusRuleSpec))
+	// Failed calls are recorded too.
+	testutil.Equals(t, 2, len(r.CallsTo(MethodMetricsSet)))
+}
+
+func TestRecordingSyncerConcurrent(t *testing.T) {
+	r := &RecordingSyncer{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_ = r.SetCurrentTenant(fmt.Sprintf("tenant-%d", i))
+			_ = r.MetricsSet(testPrometheusRuleSpec)
+			_ = r.Calls()
+		}(i)
+	}
+	wg.Wait()
+
+	testutil.Equals(t, 20, len(r.Calls()))
+}
@@ -0,0 +1,81 @@
+package syncer
+
+import (
+	"sync"
+
+	"github.com/observatorium/api/client/parameters"
+)
+
+// DefaultSyncSuccessWindow is the default number of rules set operations of a tenant its success ratio is computed over.
+const DefaultSyncSuccessWindow = 20
+
+// WithSyncSuccessWindow sets the number of last rules set operations of each tenant the sync_success_ratio metric is
+// computed over. Defaults to DefaultSyncSuccessWindow.
+func WithSyncSuccessWindow(n int) Option {
+	return func(o *ObsctlRulesSyncer) {
+		o.syncWindows.size = n
+	}
+}
+
+// syncWindow holds the outcomes of the last rules set operations of a tenant, in a ring buffer.
+type syncWindow struct {
+	outcomes []bool
+	next     int
+	full     bool
+}
+
+func (w *syncWindow) add(success bool) {
+	w.outcomes[w.next] = success
+	w.next = (w.next + 1) % len(w.outcomes)
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+// ratio returns the ratio of successful operations in the window, or 1 if it's empty.
+func (w *syncWindow) ratio() float64 {
+	n := w.next
+	if w.full {
+		n = len(w.outcomes)
+	}
+	if n == 0 {
+		return 1
+	}
+
+	successes := 0
+	for _, ok := range w.outcomes[:n] {
+		if ok {
+			successes++
+		}
+	}
+	return float64(successes) / float64(n)
+}
+
+// syncWindows holds the sync window of each tenant.
+type syncWindows struct {
+	mu      sync.Mutex
+	size    int
+	tenants map[string]*syncWindow
+}
+
+// record adds the outcome of a rules set operation of tenant to its window, and returns the window's success ratio.
+func (s *syncWindows) record(tenant parameters.Tenant, success bool) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tenants == nil {
+		s.tenants = map[string]*syncWindow{}
+	}
+	w, ok := s.tenants[string(tenant)]
+	if !ok {
+		size := s.size
+		if size < 1 {
+			size = 1
+		}
+		w = &syncWindow{outcomes: make([]bool, size)}
+		s.tenants[string(tenant)] = w
+	}
+
+	w.add(success)
+	return w.ratio()
+}
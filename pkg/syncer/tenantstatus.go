@@ -0,0 +1,94 @@
+package syncer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/observatorium/api/client/parameters"
+)
+
+// Auth statuses of a tenant.
+const (
+	AuthStatusUnconfigured = "unconfigured"
+	AuthStatusUnknown      = "unknown"
+	AuthStatusFailed       = "failed"
+	AuthStatusOK           = "ok"
+)
+
+// TenantStatus is the current state of a managed tenant, for debugging onboarding.
+type TenantStatus struct {
+	Tenant string `json:"tenant"`
+	// Configured is true if the tenant has a valid obsctl config, so that its rules can be synced.
+	Configured bool `json:"configured"`
+	// AuthStatus is AuthStatusUnconfigured if the tenant isn't configured, AuthStatusUnknown if no rules were set for it
+	// yet, AuthStatusFailed if its last rules set operation failed to authenticate and AuthStatusOK otherwise.
+	AuthStatus string       `json:"authStatus"`
+	LastSync   *SyncSummary `json:"lastSync,omitempty"`
+}
+
+// SyncSummary is the outcome of the last rules set operation of a tenant, of any type.
+type SyncSummary struct {
+	Time time.Time `json:"time"`
+	// Error is the reason of the failure, as exported by the tenant_last_error metric, or empty on success.
+	Error string `json:"error,omitempty"`
+}
+
+// lastSyncs records the outcome of the last rules set operation of each tenant.
+type lastSyncs struct {
+	mu      sync.Mutex
+	tenants map[string]SyncSummary
+}
+
+func (l *lastSyncs) record(tenant parameters.Tenant, reason string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.tenants == nil {
+		l.tenants = map[string]SyncSummary{}
+	}
+	l.tenants[string(tenant)] = SyncSummary{Time: time.Now().UTC(), Error: reason}
+}
+
+func (l *lastSyncs) get(tenant string) (SyncSummary, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, ok := l.tenants[tenant]
+	return s, ok
+}
+
+// TenantStatuses returns the status of each managed tenant, in the order they are managed.
+func (o *ObsctlRulesSyncer) TenantStatuses() []TenantStatus {
+	tenants := SplitList(o.managedTenants)
+
+	// Without a readable config, no tenant is configured.
+	configured := map[string]bool{}
+	if cfg, err := o.currentConfig(); err == nil {
+		for _, tenant := range tenants {
+			_, inDefault := cfg.APIs[obsctlContextAPIName].Contexts[tenant]
+			_, inOwn := cfg.APIs[tenantAPIName(tenant)].Contexts[tenant]
+			configured[tenant] = inDefault || inOwn
+		}
+	}
+
+	statuses := make([]TenantStatus, 0, len(tenants))
+	for _, tenant := range tenants {
+		s := TenantStatus{Tenant: tenant, Configured: configured[tenant], AuthStatus: AuthStatusUnconfigured}
+		if last, ok := o.lastSyncs.get(tenant); ok {
+			s.LastSync = &last
+		}
+
+		switch {
+		case !s.Configured:
+		case s.LastSync == nil:
+			s.AuthStatus = AuthStatusUnknown
+		case s.LastSync.Error == errorReasonAuth:
+			s.AuthStatus = AuthStatusFailed
+		default:
+			s.AuthStatus = AuthStatusOK
+		}
+		statuses = append(statuses, s)
+	}
+
+	return statuses
+}
@@ -0,0 +1,17 @@
+// Package tenantlabel maps tenant names to values used for the tenant label of obsctl-reloader's own metrics.
+package tenantlabel
+
+import "strings"
+
+// Sanitize returns tenant with every character other than ASCII letters, digits, '_' and '-' replaced by '_', so that
+// tenant names which are fine for Kubernetes, e.g. containing dots or slashes, produce clean metric label values.
+func Sanitize(tenant string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, tenant)
+}
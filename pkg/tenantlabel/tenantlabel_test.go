@@ -0,0 +1,26 @@
+package tenantlabel
+
+import (
+	"testing"
+
+	"github.com/efficientgo/core/testutil"
+)
+
+func TestSanitize(t *testing.T) {
+	for _, tc := range []struct {
+		tenant string
+		want   string
+	}{
+		{tenant: "", want: ""},
+		{tenant: "rhobs", want: "rhobs"},
+		{tenant: "team-a_prod", want: "team-a_prod"},
+		{tenant: "team.a", want: "team_a"},
+		{tenant: "org/team a", want: "org_team_a"},
+		{tenant: "équipe", want: "_quipe"},
+		{tenant: `a"b{c}`, want: "a_b_c_"},
+	} {
+		t.Run(tc.tenant, func(t *testing.T) {
+			testutil.Equals(t, tc.want, Sanitize(tc.tenant))
+		})
+	}
+}